@@ -0,0 +1,330 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/config"
+	"github.com/nylssoft/goaccesslog/internal/control"
+	"github.com/nylssoft/goaccesslog/internal/logexport"
+	"github.com/nylssoft/goaccesslog/internal/storage"
+	"github.com/nylssoft/goaccesslog/internal/top"
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+)
+
+const usage = `Usage:
+  goaccesslog -config <config-file>
+  goaccesslog ban [-socket <socket-file>] <ip> [-for <duration>]
+  goaccesslog unban [-socket <socket-file>] <ip>
+  goaccesslog list-bans [-socket <socket-file>] [-json]
+  goaccesslog rebuild-stats -config <config-file>
+  goaccesslog search -config <config-file> [-from <time>] [-to <time>] [-limit <count>] [-json] <query>
+  goaccesslog export -config <config-file> -format csv|ndjson|parquet -output <directory> [-from <time>] [-to <time>]
+                     [-ip <ip>] [-status <status>] [-method <method>] [-split-by-day] [-gzip]
+  goaccesslog top -config <config-file> [-socket <socket-file>] [-window <duration>] [-interval <duration>]`
+
+func printUsage() {
+	fmt.Println(usage)
+}
+
+// Runs the specified subcommand and returns the exit code of the process.
+func runCommand(name string, args []string) int {
+	var err error
+	switch name {
+	case "ban":
+		err = banCommand(args)
+	case "unban":
+		err = unbanCommand(args)
+	case "list-bans":
+		err = listBansCommand(args)
+	case "rebuild-stats":
+		err = rebuildStatsCommand(args)
+	case "search":
+		err = searchCommand(args)
+	case "export":
+		err = exportCommand(args)
+	case "top":
+		err = topCommand(args)
+	default:
+		printUsage()
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", err)
+		return 1
+	}
+	return 0
+}
+
+func banCommand(args []string) error {
+	flags := flag.NewFlagSet("ban", flag.ContinueOnError)
+	socket := flags.String("socket", config.DefaultControlSocketFilename, "control socket file")
+	duration := flags.Duration("for", 0, "ban duration, e.g. 24h")
+	ip, err := parseIpArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	err = control.NewClient(*socket).Ban(ip, *duration)
+	if err == nil {
+		fmt.Println("Banned IP", ip)
+	}
+	return err
+}
+
+func unbanCommand(args []string) error {
+	flags := flag.NewFlagSet("unban", flag.ContinueOnError)
+	socket := flags.String("socket", config.DefaultControlSocketFilename, "control socket file")
+	ip, err := parseIpArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	err = control.NewClient(*socket).Unban(ip)
+	if err == nil {
+		fmt.Println("Unbanned IP", ip)
+	}
+	return err
+}
+
+func listBansCommand(args []string) error {
+	flags := flag.NewFlagSet("list-bans", flag.ContinueOnError)
+	socket := flags.String("socket", config.DefaultControlSocketFilename, "control socket file")
+	asJson := flags.Bool("json", false, "print bans as JSON")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return fmt.Errorf("unexpected argument '%s'", positional[0])
+	}
+	bans, err := control.NewClient(*socket).ListBans()
+	if err != nil {
+		return err
+	}
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(bans)
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "IP\tFROM\tUNTIL\tOCCURRED\tHITS\tRULE\tCATEGORY\tSOURCE")
+	for _, ban := range bans {
+		until := "never"
+		if ban.Category != ufw.CATEGORY_BLOCKLIST {
+			until = ban.To.Format(time.DateTime)
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d\t%d\t%s\t%s\t%s\n", ban.IP, ban.From.Format(time.DateTime), until, ban.Occurred, ban.Hits, ban.Rule, ban.Category, ban.Source)
+	}
+	return writer.Flush()
+}
+
+func rebuildStatsCommand(args []string) error {
+	flags := flag.NewFlagSet("rebuild-stats", flag.ContinueOnError)
+	configFilename := flags.String("config", "", "config file")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return fmt.Errorf("unexpected argument '%s'", positional[0])
+	}
+	storage, err := openStorage(*configFilename)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	err = storage.RebuildStats()
+	if err == nil {
+		fmt.Println("Rebuilt statistics from stored log lines.")
+	}
+	return err
+}
+
+func searchCommand(args []string) error {
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	configFilename := flags.String("config", "", "config file")
+	from := flags.String("from", "", "start time (inclusive), e.g. 2025-06-01 or '2025-06-01 12:00:00'")
+	to := flags.String("to", "", "end time (exclusive)")
+	limit := flags.Int("limit", storage.DEFAULT_SEARCH_LIMIT, "maximum number of log lines")
+	asJson := flags.Bool("json", false, "print log lines as JSON")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) == 0 {
+		return errors.New("missing search query")
+	}
+	query := storage.SearchQuery{Text: strings.Join(positional, " "), Limit: *limit}
+	query.From, err = parseTime(*from)
+	if err == nil {
+		query.To, err = parseTime(*to)
+	}
+	if err != nil {
+		return err
+	}
+	storage, err := openStorage(*configFilename)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	logLines, err := storage.Search(query)
+	if err != nil {
+		return err
+	}
+	if *asJson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(logLines)
+	}
+	writer := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(writer, "TIME\tIP\tSTATUS\tMETHOD\tURI\tUSER AGENT")
+	for _, logLine := range logLines {
+		fmt.Fprintf(writer, "%s\t%s\t%d\t%s\t%s\t%s\n", logLine.TimeLocal.Local().Format(time.DateTime), logLine.Client(), logLine.Status,
+			logLine.RequestMethod, logLine.RequestUri, logLine.UserAgent)
+	}
+	return writer.Flush()
+}
+
+func exportCommand(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	configFilename := flags.String("config", "", "config file")
+	format := flags.String("format", logexport.FORMAT_CSV, "export format: "+strings.Join(logexport.Formats, ", "))
+	directory := flags.String("output", "", "output directory")
+	from := flags.String("from", "", "start time (inclusive), e.g. 2025-06-01 or '2025-06-01 12:00:00'")
+	to := flags.String("to", "", "end time (exclusive)")
+	ip := flags.String("ip", "", "IP address of the client")
+	status := flags.Int("status", 0, "HTTP status code")
+	method := flags.String("method", "", "HTTP request method")
+	splitByDay := flags.Bool("split-by-day", false, "write one file per UTC day")
+	compress := flags.Bool("gzip", false, "compress files with gzip")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return fmt.Errorf("unexpected argument '%s'", positional[0])
+	}
+	if len(*directory) == 0 {
+		return errors.New("missing output directory")
+	}
+	filter := storage.LogFilter{RemoteAddr: *ip, Status: *status, RequestMethod: strings.ToUpper(*method)}
+	filter.From, err = parseTime(*from)
+	if err == nil {
+		filter.To, err = parseTime(*to)
+	}
+	if err != nil {
+		return err
+	}
+	storage, err := openStorage(*configFilename)
+	if err != nil {
+		return err
+	}
+	defer storage.Close()
+	options := logexport.Options{Format: *format, Directory: *directory, SplitByDay: *splitByDay, Gzip: *compress}
+	filenames, err := logexport.NewExporter(storage, options).Export(filter)
+	if err != nil {
+		return err
+	}
+	for _, filename := range filenames {
+		fmt.Println("Exported", filename)
+	}
+	return nil
+}
+
+func topCommand(args []string) error {
+	flags := flag.NewFlagSet("top", flag.ContinueOnError)
+	configFilename := flags.String("config", "", "config file")
+	socket := flags.String("socket", "", "control socket file, default is the control socket of the config file")
+	options := top.DefaultOptions()
+	flags.DurationVar(&options.Window, "window", options.Window, "time window of the statistics")
+	flags.DurationVar(&options.Interval, "interval", options.Interval, "refresh interval")
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) > 0 {
+		return fmt.Errorf("unexpected argument '%s'", positional[0])
+	}
+	if options.Window <= 0 || options.Interval <= 0 {
+		return errors.New("window and interval must be positive")
+	}
+	cfg, err := loadConfig(*configFilename)
+	if err != nil {
+		return err
+	}
+	if len(*socket) == 0 {
+		*socket = cfg.ControlSocketFilename()
+	}
+	storage := storage.NewStorage(cfg.DatabaseDriver(), cfg.DatabaseDataSource())
+	defer storage.Close()
+	return top.NewTop(options, storage, control.NewClient(*socket), os.Stdin, os.Stdout).Run()
+}
+
+// Opens the storage of the config file without starting the process.
+func openStorage(configFilename string) (storage.Storage, error) {
+	cfg, err := loadConfig(configFilename)
+	if err != nil {
+		return nil, err
+	}
+	return storage.NewStorage(cfg.DatabaseDriver(), cfg.DatabaseDataSource()), nil
+}
+
+// Loads the database settings of the config file without starting the process.
+func loadConfig(configFilename string) (config.Config, error) {
+	if len(configFilename) == 0 {
+		return nil, errors.New("missing config file")
+	}
+	cfg := config.NewConfig()
+	err := cfg.LoadDatabase(configFilename)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Parses a local time in RFC 3339, date time or date format, returns the zero time for an empty string.
+func parseTime(str string) (time.Time, error) {
+	if len(str) == 0 {
+		return time.Time{}, nil
+	}
+	for _, layout := range []string{time.RFC3339, time.DateTime, time.DateOnly} {
+		t, err := time.ParseInLocation(layout, str, time.Local)
+		if err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid time '%s'", str)
+}
+
+func parseIpArgs(flags *flag.FlagSet, args []string) (string, error) {
+	positional, err := parseArgs(flags, args)
+	if err != nil {
+		return "", err
+	}
+	if len(positional) != 1 {
+		return "", errors.New("exactly one IP address is required")
+	}
+	return positional[0], nil
+}
+
+// Parses flags that may appear before or after positional arguments.
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		if flags.NArg() == 0 {
+			break
+		}
+		positional = append(positional, flags.Arg(0))
+		args = flags.Args()[1:]
+	}
+	return positional, nil
+}
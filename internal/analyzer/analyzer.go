@@ -4,16 +4,20 @@ import (
 	"time"
 
 	"github.com/nylssoft/goaccesslog/internal/config"
+	"github.com/nylssoft/goaccesslog/internal/storage"
 	"github.com/nylssoft/goaccesslog/internal/ufw"
 )
 
 type Analyzer interface {
+	// Inserts all log lines not older than the specified time into the storage in short transactions
+	// and rejects IP addresses of malicious requests after the log lines have been committed. Returns the time of the last processed log line.
 	Analyze(lastTimeLocal time.Time) (time.Time, error)
 }
 
-func NewAnalyzer(cfg config.Config, ufw ufw.Ufw) Analyzer {
+func NewAnalyzer(cfg config.Config, storage storage.Storage, ufw ufw.Ufw) Analyzer {
 	var analyzer analyzer_impl
 	analyzer.config = cfg
+	analyzer.storage = storage
 	analyzer.ufw = ufw
 	return &analyzer
 }
@@ -2,34 +2,60 @@ package analyzer
 
 import (
 	"crypto/md5"
-	"database/sql"
 	"encoding/hex"
+	"fmt"
 	"log"
 	"os"
 	"strings"
 	"time"
 
-	_ "github.com/mattn/go-sqlite3"
 	"github.com/nylssoft/goaccesslog/internal/config"
-	"github.com/nylssoft/goaccesslog/internal/parser"
+	"github.com/nylssoft/goaccesslog/internal/ipaddr"
+	"github.com/nylssoft/goaccesslog/internal/metrics"
+	"github.com/nylssoft/goaccesslog/internal/storage"
 	"github.com/nylssoft/goaccesslog/internal/ufw"
 )
 
+var (
+	linesParsed    = metrics.NewCounter("goaccesslog_lines_parsed_total", "Access log lines parsed, lines are parsed again on each run.")
+	linesInserted  = metrics.NewCounter("goaccesslog_lines_inserted_total", "Log lines inserted into the database.")
+	linesSkipped   = metrics.NewCounter("goaccesslog_lines_skipped_total", "Log lines skipped because they have already been stored.")
+	linesFailed    = metrics.NewCounter("goaccesslog_lines_failed_total", "Log lines that could not be inserted into the database.")
+	parseErrors    = metrics.NewCounter("goaccesslog_parse_errors_total", "Access log lines that could not be parsed.")
+	ruleHits       = metrics.NewCounter("goaccesslog_rule_hits_total", "Inserted log lines that matched a bad rule.", "rule")
+	analyzeSeconds = metrics.NewHistogram("goaccesslog_analyze_duration_seconds", "Duration of an analyze cycle.", metrics.DefaultBuckets)
+)
+
 type analyzer_impl struct {
-	db         *sql.DB
-	insertStmt *sql.Stmt
-	hashStmt   *sql.Stmt
 	// dependencies
-	config config.Config
-	ufw    ufw.Ufw
+	config  config.Config
+	storage storage.Storage
+	ufw     ufw.Ufw
+}
+
+// Maximum number of log lines inserted in one transaction.
+const maxBatchSize = 1000
+
+// IP address detected by a bad rule
+type detection struct {
+	ip       string
+	ruleName string
+	status   int
+	uri      string
 }
 
-const size_1K = 1024
-const size_1M = size_1K * size_1K
-const size_1G = size_1M * size_1M
+// Number of log lines processed in a transaction.
+type batchCounts struct {
+	inserted int
+	skipped  int
+	failed   int
+	// inserted log lines per bad rule
+	hits map[string]int
+}
 
 func (analyzer *analyzer_impl) Analyze(lastTimeLocal time.Time) (time.Time, error) {
-	defer analyzer.closeDatabase()
+	start := time.Now()
+	defer func() { analyzeSeconds.Observe(time.Since(start).Seconds()) }()
 	if analyzer.config.IsVerbose() {
 		log.Printf("Process log entries in log file '%s'. Last processed log entry: %s.\n", analyzer.config.AccessLogFilename(), lastTimeLocal)
 	}
@@ -41,120 +67,140 @@ func (analyzer *analyzer_impl) Analyze(lastTimeLocal time.Time) (time.Time, erro
 	data = strings.ReplaceAll(data, "\t", "")
 	data = strings.ReplaceAll(data, "\r", "")
 	lines := strings.Split(data, "\n")
-	insertCnt, skipCnt, errCnt := 0, 0, 0
+	// log lines are inserted in short transactions, so the write lock of the database is released regularly
+	// and bans can be saved by other goroutines in the meantime
+	var batch storage.Batch
+	defer func() {
+		if batch != nil {
+			batch.Rollback()
+		}
+	}()
+	var total, pending batchCounts
+	// time of the last committed log line and of the last log line in the open transaction
+	committedTimeLocal := lastTimeLocal
+	newLastTimeLocal := lastTimeLocal
+	// malicious IP addresses of the open transaction, rejected after the commit
+	var detections []detection
+	detected := map[string]bool{}
 	for _, line := range lines {
-		logLine, err := parser.Parse(line)
+		logLine, err := analyzer.config.LogParser().Parse(line)
 		if err != nil {
 			log.Printf("ERROR: Failed to parse log line '%s': %s\n", line, err.Error())
+			parseErrors.Inc()
 			continue
 		}
+		if len(logLine.RemoteAddr) > 0 {
+			linesParsed.Inc()
+		}
+		logLine.RemoteAddr = ipaddr.Canonical(logLine.RemoteAddr)
+		clientAddr := ipaddr.ClientAddr(logLine.RemoteAddr, logLine.XForwardedFor, logLine.ProxyProtocolAddr, analyzer.config.TrustedProxies().Contains)
+		if clientAddr != logLine.RemoteAddr {
+			logLine.ClientAddr = clientAddr
+		}
 		if len(logLine.RemoteAddr) > 0 && logLine.TimeLocal.Compare(lastTimeLocal) >= 0 {
-			skipped, err := analyzer.insertLogLine(logLine, hashLine(line))
+			if batch == nil {
+				batch, err = analyzer.storage.Begin()
+				if err != nil {
+					return committedTimeLocal, err
+				}
+				pending = batchCounts{hits: map[string]int{}}
+			}
+			hash := hashLine(line)
+			inserted, err := batch.Insert(logLine, hash)
 			if err != nil {
 				log.Printf("ERROR: Failed to insert log line '%s': %s\n", line, err.Error())
-				errCnt++
-			} else if skipped {
-				skipCnt++
+				pending.failed++
+			} else if !inserted {
+				pending.skipped++
 			} else {
-				insertCnt++
-				if !analyzer.ufw.IsRejected(logLine.RemoteAddr) &&
-					analyzer.config.IsMaliciousRequest(logLine.RemoteAddr, logLine.RequestProtocol, logLine.RequestUri, logLine.Status) {
-					analyzer.ufw.Reject(logLine.RemoteAddr)
+				pending.inserted++
+				match := analyzer.config.MatchRules(logLine)
+				err = analyzer.insertRuleHits(batch, hash, match)
+				if err != nil {
+					return committedTimeLocal, err
+				}
+				for _, badRule := range match.BadRules {
+					pending.hits[badRule]++
+				}
+				// the firewall object is not used while a transaction is open as it saves bans in the same database
+				if match.IsMalicious() && !detected[clientAddr] {
+					detected[clientAddr] = true
+					detections = append(detections, detection{ip: clientAddr, ruleName: match.BadRules[0], status: logLine.Status, uri: logLine.RequestUri})
+				}
+			}
+			newLastTimeLocal = logLine.TimeLocal
+			if pending.size() >= maxBatchSize {
+				err = analyzer.commit(batch, pending, &total)
+				batch = nil
+				if err != nil {
+					return committedTimeLocal, err
 				}
+				// committed log lines are skipped on next run, so their IP addresses are rejected now
+				analyzer.reject(detections)
+				detections = nil
+				committedTimeLocal = newLastTimeLocal
 			}
-			lastTimeLocal = logLine.TimeLocal
 		}
 	}
-	if analyzer.config.IsVerbose() && (insertCnt > 0 || skipCnt > 0 || errCnt > 0) {
-		log.Printf("Inserted %d log lines. Skipped %d log lines. Errors occurred in %d log lines.\n", insertCnt, skipCnt, errCnt)
+	if batch != nil {
+		err = analyzer.commit(batch, pending, &total)
+		batch = nil
+		if err != nil {
+			// the log lines are inserted again on next run, duplicates are ignored
+			return committedTimeLocal, err
+		}
+		analyzer.reject(detections)
+	}
+	if analyzer.config.IsVerbose() && total.size() > 0 {
+		log.Printf("Inserted %d log lines. Skipped %d log lines. Errors occurred in %d log lines.\n", total.inserted, total.skipped, total.failed)
 	}
 	analyzer.ufw.ReleaseIfExpired()
-	return lastTimeLocal, err
+	return newLastTimeLocal, nil
 }
 
-func (analyzer *analyzer_impl) insertLogLine(logLine parser.LogLine, hash string) (bool, error) {
-	analyzer.initDatabase()
-	rows, err := analyzer.hashStmt.Query(hash)
-	if err != nil {
-		return false, err
-	}
-	defer rows.Close()
-	skipped := true
-	if !rows.Next() {
-		_, err = analyzer.insertStmt.Exec(logLine.RemoteAddr, logLine.TimeLocal, logLine.RequestMethod, logLine.RequestUri, logLine.RequestProtocol, logLine.RequestLength, logLine.RequestTime, logLine.Status, logLine.BytesSent, logLine.UserAgent, hash)
-		if err != nil {
-			return false, err
+// Rejects the IP addresses detected by bad rules that have not been rejected yet.
+func (analyzer *analyzer_impl) reject(detections []detection) {
+	for _, detection := range detections {
+		if analyzer.ufw.IsRejected(detection.ip) {
+			continue
 		}
-		skipped = false
+		log.Printf("Detected malicious request for bad rule '%s'. IP %s, Status %d, URI '%s'.\n", detection.ruleName, detection.ip, detection.status, detection.uri)
+		analyzer.ufw.Reject(detection.ip, fmt.Sprintf("bad rule '%s'", detection.ruleName))
 	}
-	return skipped, nil
 }
 
-func (analyzer *analyzer_impl) initDatabase() error {
-	var err error
-	if analyzer.db == nil {
-		var fileInfo os.FileInfo
-		fileInfo, err = os.Stat(analyzer.config.DatabaseFilename())
-		if err == nil && fileInfo.Size() > size_1G {
-			log.Fatal("Database file is too large.")
-		}
-		var db *sql.DB
-		db, err = sql.Open("sqlite3", analyzer.config.DatabaseFilename())
-		if err == nil {
-			stmt := `CREATE TABLE IF NOT EXISTS accesslog (
-			remote_addr TEXT,
-			time_local TIMESTAMP,
-			request_method TEXT,
-			request_uri TEXT,
-			request_protocol TEXT,
-			request_length INTEGER,
-			request_time INTEGER,
-			status INTEGER,
-			bytes_sent INTEGER,
-			user_agent TEXT,
-			hash TEXT)`
-			_, err = db.Exec(stmt)
-			if err == nil {
-				stmt = "CREATE INDEX IF NOT EXISTS accesslog_hash_idx ON accesslog (hash)"
-				_, err = db.Exec(stmt)
-			}
-			if err != nil {
-				db.Close()
-			} else {
-				analyzer.db = db
-			}
-		}
-	}
-	if err == nil && analyzer.insertStmt == nil {
-		var stmt *sql.Stmt
-		stmt, err = analyzer.db.Prepare("INSERT INTO accesslog (remote_addr,time_local,request_method,request_uri,request_protocol,request_length,request_time,status,bytes_sent,user_agent,hash) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11)")
-		if err == nil {
-			analyzer.insertStmt = stmt
-		}
+// Commits the transaction and adds the counts of the committed log lines to the total counts and the metrics.
+// The counts are added after the commit as the log lines are inserted again on next run if the commit fails.
+func (analyzer *analyzer_impl) commit(batch storage.Batch, pending batchCounts, total *batchCounts) error {
+	err := batch.Commit()
+	if err != nil {
+		return err
 	}
-	if err == nil && analyzer.hashStmt == nil {
-		var stmt *sql.Stmt
-		stmt, err = analyzer.db.Prepare("SELECT 1 FROM accesslog WHERE hash=$1")
-		if err == nil {
-			analyzer.hashStmt = stmt
-		}
+	linesInserted.Add(float64(pending.inserted))
+	linesSkipped.Add(float64(pending.skipped))
+	linesFailed.Add(float64(pending.failed))
+	for badRule, cnt := range pending.hits {
+		ruleHits.Add(float64(cnt), badRule)
 	}
-	return err
+	total.inserted += pending.inserted
+	total.skipped += pending.skipped
+	total.failed += pending.failed
+	return nil
 }
 
-func (analyzer *analyzer_impl) closeDatabase() {
-	if analyzer.hashStmt != nil {
-		analyzer.hashStmt.Close()
-		analyzer.hashStmt = nil
-	}
-	if analyzer.insertStmt != nil {
-		analyzer.insertStmt.Close()
-		analyzer.insertStmt = nil
-	}
-	if analyzer.db != nil {
-		analyzer.db.Close()
-		analyzer.db = nil
+func (counts *batchCounts) size() int {
+	return counts.inserted + counts.skipped + counts.failed
+}
+
+// Links the log line to all matching bad rules and the overriding good rule.
+func (analyzer *analyzer_impl) insertRuleHits(batch storage.Batch, hash string, match config.RuleMatch) error {
+	for _, badRule := range match.BadRules {
+		err := batch.InsertRuleHit(storage.RuleHit{Hash: hash, BadRule: badRule, GoodRule: match.GoodRule})
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
 func hashLine(line string) string {
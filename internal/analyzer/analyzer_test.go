@@ -1,13 +1,20 @@
 package analyzer
 
 import (
+	"database/sql"
+	"errors"
+	"fmt"
 	"os"
 	"path"
+	"strconv"
+	"strings"
 	"testing"
 	"text/template"
 	"time"
 
 	"github.com/nylssoft/goaccesslog/internal/config"
+	"github.com/nylssoft/goaccesslog/internal/metrics"
+	"github.com/nylssoft/goaccesslog/internal/storage"
 	"github.com/nylssoft/goaccesslog/internal/ufw"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -22,6 +29,10 @@ func (e *mockExecutor) Exec(cmdName string, args ...string) ([]byte, error) {
 	return []byte(e.ret), e.err
 }
 
+func (e *mockExecutor) ExecInput(input []byte, cmdName string, args ...string) ([]byte, error) {
+	return []byte(e.ret), e.err
+}
+
 func TestAnalzse(t *testing.T) {
 
 	tempDir := t.TempDir()
@@ -38,9 +49,15 @@ func TestAnalzse(t *testing.T) {
 	require.Nil(t, err)
 
 	e := mockExecutor{}
-	ufw := ufw.NewUfw(&e, "unittest", time.Second, 1)
+	options := ufw.DefaultOptions()
+	options.Comment = "unittest"
+	options.Delay = time.Second
+	options.MaxFailures = 1
+	ufw := ufw.NewUfw(&e, nil, options)
 
-	analyzer := NewAnalyzer(cfg, ufw)
+	storage := storage.NewStorage(cfg.DatabaseDriver(), cfg.DatabaseDataSource())
+	defer storage.Close()
+	analyzer := NewAnalyzer(cfg, storage, ufw)
 	assert.NotNil(t, analyzer)
 
 	var lastTimeLocal time.Time
@@ -78,7 +95,269 @@ func TestAnalzse(t *testing.T) {
 	lastTimeLocal, err = analyzer.Analyze(lastTimeLocal)
 	assert.Nil(t, err)
 	assert.NotNil(t, lastTimeLocal)
+	assert.True(t, ufw.IsRejected("8.8.8.8"))
+}
 
+func TestAnalyzeBatch(t *testing.T) {
+	tempDir := t.TempDir()
+	filename := path.Join(tempDir, "config.json")
+	nginxfile := path.Join(tempDir, "test-nginx.log")
+	logfile := path.Join(tempDir, "test.log")
+	dbfile := path.Join(tempDir, "test.db")
+	require.NoError(t, os.WriteFile(nginxfile, []byte(""), 0666))
+	createConfigFile(t, filename, logfile, dbfile, nginxfile, "goodRule", "starts-with(ip,'127.')", "badrule", "eq(status,444)")
+	cfg := config.NewConfig()
+	require.NoError(t, cfg.Init(filename))
+	e := mockExecutor{}
+	ufw := ufw.NewUfw(&e, nil, ufw.DefaultOptions())
+	storage := storage.NewStorage(cfg.DatabaseDriver(), cfg.DatabaseDataSource())
+	defer storage.Close()
+	analyzer := NewAnalyzer(cfg, storage, ufw)
+
+	const lineCount = 10000
+	var sb strings.Builder
+	for i := range lineCount {
+		fmt.Fprintf(&sb, "10.0.%d.%d - - [01/Jun/2025:18:05:17 +0200] 1748793917.616 \"GET /%d HTTP/1.1\" 73 200 612 0.000 \"curl/7.81.0\"\n", i/256, i%256, i)
+	}
+	require.NoError(t, os.WriteFile(nginxfile, []byte(sb.String()), 0666))
+	_, err := analyzer.Analyze(time.Time{})
+	require.NoError(t, err)
+	// duplicate log lines are ignored by the unique hash index
+	sb.WriteString(`8.8.8.8 - - [01/Jun/2025:18:05:18 +0200] 1748793918.616 "GET / HTTP/1.1" 73 444 612 0.000 "curl/7.81.0"`)
+	require.NoError(t, os.WriteFile(nginxfile, []byte(sb.String()), 0666))
+	_, err = analyzer.Analyze(time.Time{})
+	require.NoError(t, err)
+	assert.True(t, ufw.IsRejected("8.8.8.8"))
+
+	db, err := sql.Open("sqlite3", dbfile)
+	require.NoError(t, err)
+	defer db.Close()
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM accesslog").Scan(&count))
+	assert.Equal(t, lineCount+1, count)
+	var journalMode string
+	require.NoError(t, db.QueryRow("PRAGMA journal_mode").Scan(&journalMode))
+	assert.Equal(t, "wal", journalMode)
+}
+
+func TestAnalyzeConcurrentBans(t *testing.T) {
+	tempDir := t.TempDir()
+	filename := path.Join(tempDir, "config.json")
+	nginxfile := path.Join(tempDir, "test-nginx.log")
+	logfile := path.Join(tempDir, "test.log")
+	dbfile := path.Join(tempDir, "test.db")
+	createConfigFile(t, filename, logfile, dbfile, nginxfile, "goodRule", "starts-with(ip,'127.')", "badrule", "eq(status,444)")
+	// every 100th log line is a malicious request of another IP address
+	var sb strings.Builder
+	for i := range 20000 {
+		status := 200
+		if i%100 == 0 {
+			status = 444
+		}
+		fmt.Fprintf(&sb, "10.0.%d.%d - - [01/Jun/2025:18:05:17 +0200] 1748793917.616 \"GET /%d HTTP/1.1\" 73 %d 612 0.000 \"curl/7.81.0\"\n", i/256, i%256, i, status)
+	}
+	require.NoError(t, os.WriteFile(nginxfile, []byte(sb.String()), 0666))
+	cfg := config.NewConfig()
+	require.NoError(t, cfg.Init(filename))
+	storage := storage.NewStorage(cfg.DatabaseDriver(), cfg.DatabaseDataSource())
+	defer storage.Close()
+	// bans are saved in the same database while the log lines are inserted
+	options := ufw.DefaultOptions()
+	options.Aggregation.Threshold = 0
+	firewall := ufw.NewUfw(&mockExecutor{}, storage, options)
+	firewall.Init()
+	analyzer := NewAnalyzer(cfg, storage, firewall)
+	done := make(chan bool)
+	go func() {
+		defer close(done)
+		for i := range 200 {
+			firewall.RejectFor(fmt.Sprintf("192.168.0.%d", i), time.Hour, "manual ban")
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	_, err := analyzer.Analyze(time.Time{})
+	require.NoError(t, err)
+	<-done
+	bans, err := storage.LoadBans()
+	require.NoError(t, err)
+	assert.Len(t, bans, 200+200)
+}
+
+// Storage that fails to commit the second transaction.
+type failingStorage struct {
+	storage.Storage
+	commits int
+}
+
+type failingBatch struct {
+	storage.Batch
+	storage *failingStorage
+}
+
+func (s *failingStorage) Begin() (storage.Batch, error) {
+	batch, err := s.Storage.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &failingBatch{Batch: batch, storage: s}, nil
+}
+
+func (batch *failingBatch) Commit() error {
+	batch.storage.commits++
+	if batch.storage.commits == 2 {
+		batch.Batch.Rollback()
+		return errors.New("database is locked")
+	}
+	return batch.Batch.Commit()
+}
+
+func TestAnalyzeCommitError(t *testing.T) {
+	tempDir := t.TempDir()
+	filename := path.Join(tempDir, "config.json")
+	nginxfile := path.Join(tempDir, "test-nginx.log")
+	logfile := path.Join(tempDir, "test.log")
+	dbfile := path.Join(tempDir, "test.db")
+	createConfigFile(t, filename, logfile, dbfile, nginxfile, "goodRule", "starts-with(ip,'127.')", "badrule", "eq(status,444)")
+	// one malicious request in the first and in the second transaction
+	var sb strings.Builder
+	for i := range 2 * maxBatchSize {
+		status := 200
+		if i%maxBatchSize == 0 {
+			status = 444
+		}
+		fmt.Fprintf(&sb, "10.0.%d.%d - - [01/Jun/2025:18:05:17 +0200] %d.616 \"GET /%d HTTP/1.1\" 73 %d 612 0.000 \"curl/7.81.0\"\n", i/256, i%256, 1748793917+i/maxBatchSize, i, status)
+	}
+	require.NoError(t, os.WriteFile(nginxfile, []byte(sb.String()), 0666))
+	cfg := config.NewConfig()
+	require.NoError(t, cfg.Init(filename))
+	store := &failingStorage{Storage: storage.NewStorage(cfg.DatabaseDriver(), cfg.DatabaseDataSource())}
+	defer store.Close()
+	firewall := ufw.NewUfw(&mockExecutor{}, nil, ufw.DefaultOptions())
+	analyzer := NewAnalyzer(cfg, store, firewall)
+	lastTimeLocal, err := analyzer.Analyze(time.Time{})
+	require.Error(t, err)
+	// the IP address of the committed transaction is rejected, the time of the last committed log line is returned
+	assert.True(t, firewall.IsRejected("10.0.0.0"))
+	assert.False(t, firewall.IsRejected("10.0.3.232"))
+	assert.Equal(t, int64(1748793917), lastTimeLocal.Unix())
+	lastTimeLocal, err = analyzer.Analyze(lastTimeLocal)
+	require.NoError(t, err)
+	assert.True(t, firewall.IsRejected("10.0.3.232"))
+	assert.Equal(t, int64(1748793918), lastTimeLocal.Unix())
+}
+
+func TestAnalyzeRuleHits(t *testing.T) {
+	tempDir := t.TempDir()
+	filename := path.Join(tempDir, "config.json")
+	nginxfile := path.Join(tempDir, "test-nginx.log")
+	logfile := path.Join(tempDir, "test.log")
+	dbfile := path.Join(tempDir, "test.db")
+	content := `8.8.8.8 - - [01/Jun/2025:18:05:17 +0200] 1748793917.616 "GET /a HTTP/1.1" 73 444 612 0.000 "curl/7.81.0"
+127.0.0.1 - - [01/Jun/2025:18:05:18 +0200] 1748793918.616 "GET /b HTTP/1.1" 73 444 612 0.000 "curl/7.81.0"
+8.8.4.4 - - [01/Jun/2025:18:05:19 +0200] 1748793919.616 "GET /c HTTP/1.1" 73 200 612 0.000 "curl/7.81.0"
+8.8.8.8 - - [01/Jun/2025:18:05:20 +0200] 1748793920.616 "GET /d HTTP/1.1" 73 444 612 0.000 "curl/7.81.0"`
+	require.NoError(t, os.WriteFile(nginxfile, []byte(content), 0666))
+	createConfigFile(t, filename, logfile, dbfile, nginxfile, "goodRule", "starts-with(ip,'127.')", "badrule", "eq(status,444)")
+	cfg := config.NewConfig()
+	require.NoError(t, cfg.Init(filename))
+	storage := storage.NewStorage(cfg.DatabaseDriver(), cfg.DatabaseDataSource())
+	defer storage.Close()
+	ufw := ufw.NewUfw(&mockExecutor{}, storage, ufw.DefaultOptions())
+	analyzer := NewAnalyzer(cfg, storage, ufw)
+	ruleHits := metricValue(t, `goaccesslog_rule_hits_total{rule="badrule"}`)
+	inserted := metricValue(t, "goaccesslog_lines_inserted_total")
+	cycles := metricValue(t, "goaccesslog_analyze_duration_seconds_count")
+	_, err := analyzer.Analyze(time.Time{})
+	require.NoError(t, err)
+	assert.True(t, ufw.IsRejected("8.8.8.8"))
+
+	db, err := sql.Open("sqlite3", dbfile)
+	require.NoError(t, err)
+	defer db.Close()
+	// all matching log lines are linked to the rules, also if the IP address is already rejected
+	rows, err := db.Query("SELECT a.request_uri,r.bad_rule,r.good_rule FROM rule_hits r JOIN accesslog a ON a.hash=r.hash ORDER BY r.id")
+	require.NoError(t, err)
+	defer rows.Close()
+	var hits []string
+	for rows.Next() {
+		var uri, badRule, goodRule string
+		require.NoError(t, rows.Scan(&uri, &badRule, &goodRule))
+		hits = append(hits, strings.Join([]string{uri, badRule, goodRule}, " "))
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []string{"/a badrule ", "/b badrule goodRule", "/d badrule "}, hits)
+	var ip, action, reason string
+	require.NoError(t, db.QueryRow("SELECT ip,action,reason FROM ban_events").Scan(&ip, &action, &reason))
+	assert.Equal(t, []string{"8.8.8.8", "reject", "bad rule 'badrule'"}, []string{ip, action, reason})
+	assert.Equal(t, ruleHits+3, metricValue(t, `goaccesslog_rule_hits_total{rule="badrule"}`))
+	assert.Equal(t, inserted+4, metricValue(t, "goaccesslog_lines_inserted_total"))
+	assert.Equal(t, cycles+1, metricValue(t, "goaccesslog_analyze_duration_seconds_count"))
+}
+
+// Returns the value of the sample of the metrics, 0 if the sample does not exist.
+func metricValue(t *testing.T, sample string) float64 {
+	var sb strings.Builder
+	require.NoError(t, metrics.Write(&sb))
+	for _, line := range strings.Split(sb.String(), "\n") {
+		if str, found := strings.CutPrefix(line, sample+" "); found {
+			value, err := strconv.ParseFloat(str, 64)
+			require.NoError(t, err)
+			return value
+		}
+	}
+	return 0
+}
+
+func TestAnalyzeTrustedProxies(t *testing.T) {
+	tempDir := t.TempDir()
+	filename := path.Join(tempDir, "config.json")
+	nginxfile := path.Join(tempDir, "test-nginx.log")
+	dbfile := path.Join(tempDir, "test.db")
+	content := `10.0.0.1 - - [01/Jun/2025:18:05:17 +0200] "GET /a HTTP/1.1" 444 612 "9.9.9.9, 8.8.8.8"
+10.0.0.1 - - [01/Jun/2025:18:05:18 +0200] "GET /b HTTP/1.1" 444 612 "-"
+8.8.4.4 - - [01/Jun/2025:18:05:19 +0200] "GET /c HTTP/1.1" 444 612 "7.7.7.7"`
+	require.NoError(t, os.WriteFile(nginxfile, []byte(content), 0666))
+	data := fmt.Sprintf(`{
+	"nginx": {
+		"accessLogFilename": "%s",
+		"logFormat": "$remote_addr - - [$time_local] \"$request\" $status $body_bytes_sent \"$http_x_forwarded_for\"",
+		"trustedProxies": ["10.0.0.0/8"]
+	},
+	"database": { "filename": "%s" },
+	"logger": { "filename": "%s" },
+	"rules": { "bad": [ { "name": "badrule", "condition": "eq(status,444)" } ] }
+}`, nginxfile, dbfile, path.Join(tempDir, "test.log"))
+	require.NoError(t, os.WriteFile(filename, []byte(data), 0666))
+	cfg := config.NewConfig()
+	require.NoError(t, cfg.Init(filename))
+	storage := storage.NewStorage(cfg.DatabaseDriver(), cfg.DatabaseDataSource())
+	defer storage.Close()
+	ufw := ufw.NewUfw(&mockExecutor{}, storage, ufw.DefaultOptions())
+	analyzer := NewAnalyzer(cfg, storage, ufw)
+	_, err := analyzer.Analyze(time.Time{})
+	require.NoError(t, err)
+	// the client behind the trusted proxy is rejected, not the proxy
+	assert.True(t, ufw.IsRejected("8.8.8.8"))
+	assert.False(t, ufw.IsRejected("9.9.9.9"))
+	assert.False(t, ufw.IsRejected("7.7.7.7"))
+	assert.True(t, ufw.IsRejected("8.8.4.4"))
+	// the proxy itself is the client if the request has not been forwarded
+	assert.True(t, ufw.IsRejected("10.0.0.1"))
+
+	db, err := sql.Open("sqlite3", dbfile)
+	require.NoError(t, err)
+	defer db.Close()
+	var clientAddrs []string
+	rows, err := db.Query("SELECT remote_addr,COALESCE(client_addr,'') FROM accesslog ORDER BY time_local")
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var remoteAddr, clientAddr string
+		require.NoError(t, rows.Scan(&remoteAddr, &clientAddr))
+		clientAddrs = append(clientAddrs, remoteAddr+" "+clientAddr)
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []string{"10.0.0.1 8.8.8.8", "10.0.0.1 ", "8.8.4.4 "}, clientAddrs)
 }
 
 func createConfigFile(t *testing.T, configFilename, logFilename, databaseFilename, accessLogfilename, goodRuleName, goodRuleCondition, badRuleName, badRuleCondition string) {
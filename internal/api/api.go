@@ -0,0 +1,82 @@
+package api
+
+import (
+	"net"
+	"net/netip"
+	"strings"
+
+	"github.com/nylssoft/goaccesslog/internal/fleet"
+	"github.com/nylssoft/goaccesslog/internal/storage"
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+)
+
+// Prefix of an address that is a unix socket, e.g. unix:/run/goaccesslog-api.sock.
+const UNIX_PREFIX = "unix:"
+
+// Provides the HTTP API of a running goaccesslog process.
+//
+// Endpoints:
+//
+//	GET    /api/health                         status of the process and whether manual bans are available, never requires a token
+//	GET    /api/bans?format=json|csv|txt       active bans detected by rules or added manually
+//	POST   /api/bans                           manual ban {"ip": "1.2.3.4", "duration": "1h"}, only with token
+//	DELETE /api/bans/{ip}                      manual unban, only with token
+//	GET    /api/requests?ip=&status=&method=&limit=  recent log lines, newest first
+//	GET    /api/top-ips?days=1&limit=10        IP addresses with the most requests
+//	GET    /api/top-uris?days=1&limit=10       most requested URIs
+//	GET    /api/top-user-agents?days=1&limit=10  most frequent user agents
+//	GET    /api/rule-hits?days=1               number of log lines per bad rule
+//	GET    /api/stats/hourly?days=1            requests and bytes sent per hour and status
+//	POST   /api/fleet/events                   signed ban events of peers, only if fleet is not nil
+//	GET    /metrics                            metrics in the Prometheus text exposition format
+//	GET    /dashboard/                         web dashboard, the root path redirects to the dashboard
+//
+// The txt format can be used directly as blocklist file by other hosts.
+// If a token is configured, all endpoints except health, fleet events and the static files of the dashboard require
+// the header Authorization: Bearer <token>. Manual bans require a token.
+// A token is required unless the server listens on a loopback address or a unix socket, see IsLocalAddress.
+// The log line endpoints are only available if storage is not nil.
+//
+// Use NewServer to create a new HTTP API server.
+type Server interface {
+	// Starts listening on the configured address and serves requests in the background.
+	Start() error
+	// Stops listening and closes all connections.
+	Stop()
+}
+
+// Describes the HTTP API parameters.
+type Options struct {
+	// TCP address, e.g. 127.0.0.1:8080, or unix socket with prefix UNIX_PREFIX.
+	Address string
+	// Bearer token required by the endpoints, optional for a loopback address or a unix socket.
+	Token string
+}
+
+// Returns whether the address is a unix socket or a TCP address on a loopback interface,
+// i.e. the HTTP API cannot be reached from other hosts.
+func IsLocalAddress(address string) bool {
+	if strings.HasPrefix(address, UNIX_PREFIX) {
+		return true
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip, err := netip.ParseAddr(host)
+	return err == nil && ip.IsLoopback()
+}
+
+// Creates a new HTTP API server with the specified options.
+// The storage and the fleet are optional.
+func NewServer(options Options, ufw ufw.Ufw, storage storage.Storage, fleet fleet.Fleet) Server {
+	var server server_impl
+	server.options = options
+	server.ufw = ufw
+	server.storage = storage
+	server.fleet = fleet
+	return &server
+}
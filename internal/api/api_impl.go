@@ -0,0 +1,330 @@
+package api
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/banexport"
+	"github.com/nylssoft/goaccesslog/internal/dashboard"
+	"github.com/nylssoft/goaccesslog/internal/fleet"
+	"github.com/nylssoft/goaccesslog/internal/ipaddr"
+	"github.com/nylssoft/goaccesslog/internal/metrics"
+	"github.com/nylssoft/goaccesslog/internal/storage"
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+)
+
+const timeout = 10 * time.Second
+
+const maxBodySize = 4096
+
+// Maximum number of log lines or IP addresses returned by a request.
+const maxLimit = 1000
+
+var contentTypes = map[string]string{
+	banexport.FORMAT_TXT:  "text/plain; charset=utf-8",
+	banexport.FORMAT_CSV:  "text/csv; charset=utf-8",
+	banexport.FORMAT_JSON: "application/json",
+}
+
+type server_impl struct {
+	options Options
+	server  *http.Server
+	// dependencies
+	ufw     ufw.Ufw
+	storage storage.Storage
+	fleet   fleet.Fleet
+}
+
+type banRequest struct {
+	IP       string `json:"ip"`
+	Duration string `json:"duration,omitempty"`
+}
+
+type health struct {
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	Bans        int        `json:"bans"`
+	LastLogLine *time.Time `json:"lastLogLine,omitempty"`
+	// Whether the endpoints for manual bans and unbans are available.
+	ManualBans bool `json:"manualBans"`
+}
+
+func (server *server_impl) Start() error {
+	if len(server.options.Token) == 0 && !IsLocalAddress(server.options.Address) {
+		return fmt.Errorf("HTTP API on address %s requires a token", server.options.Address)
+	}
+	listener, err := server.listen()
+	if err != nil {
+		return err
+	}
+	server.server = &http.Server{
+		Handler:      server.handler(),
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+	}
+	go server.serve(server.server, listener)
+	return nil
+}
+
+func (server *server_impl) Stop() {
+	if server.server != nil {
+		server.server.Close()
+		server.server = nil
+	}
+}
+
+func (server *server_impl) listen() (net.Listener, error) {
+	filename, isUnix := strings.CutPrefix(server.options.Address, UNIX_PREFIX)
+	if !isUnix {
+		return net.Listen("tcp", server.options.Address)
+	}
+	// remove stale socket file if the process did not terminate appropriately
+	os.Remove(filename)
+	listener, err := net.Listen("unix", filename)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(filename, 0660)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+func (server *server_impl) serve(httpServer *http.Server, listener net.Listener) {
+	err := httpServer.Serve(listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Println("ERROR: Failed to serve HTTP API.", err)
+	}
+}
+
+func (server *server_impl) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/health", server.handleHealth)
+	mux.HandleFunc("GET /api/bans", server.authorized(server.handleBans))
+	mux.Handle("GET /metrics", server.authorized(metrics.Handler().ServeHTTP))
+	if len(server.options.Token) > 0 {
+		mux.HandleFunc("POST /api/bans", server.authorized(server.handleBan))
+		mux.HandleFunc("DELETE /api/bans/{ip...}", server.authorized(server.handleUnban))
+	}
+	if server.storage != nil {
+		mux.HandleFunc("GET /api/requests", server.authorized(server.handleRequests))
+		mux.HandleFunc("GET /api/top-ips", server.authorized(topHandler(server.storage.TopIPs)))
+		mux.HandleFunc("GET /api/top-uris", server.authorized(topHandler(server.storage.TopURIs)))
+		mux.HandleFunc("GET /api/top-user-agents", server.authorized(topHandler(server.storage.TopUserAgents)))
+		mux.HandleFunc("GET /api/rule-hits", server.authorized(server.handleRuleHits))
+		mux.HandleFunc("GET /api/stats/hourly", server.authorized(server.handleHourlyStats))
+	}
+	mux.Handle("GET /dashboard/", http.StripPrefix("/dashboard", dashboard.Handler()))
+	mux.Handle("GET /{$}", http.RedirectHandler("/dashboard/", http.StatusFound))
+	if server.fleet != nil {
+		mux.Handle("POST "+fleet.EVENTS_PATH, server.fleet.Handler())
+	}
+	return mux
+}
+
+// Returns a handler that requires the configured bearer token.
+func (server *server_impl) authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(server.options.Token) > 0 {
+			token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if !found || subtle.ConstantTimeCompare([]byte(token), []byte(server.options.Token)) != 1 {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				http.Error(w, "invalid token", http.StatusUnauthorized)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
+
+func (server *server_impl) handleHealth(w http.ResponseWriter, r *http.Request) {
+	res := health{Status: "ok", Bans: len(server.ufw.Bans()), ManualBans: len(server.options.Token) > 0}
+	status := http.StatusOK
+	if server.storage != nil {
+		lastTimeLocal, err := server.storage.LastTimeLocal()
+		if err != nil {
+			res.Status = "error"
+			res.Error = err.Error()
+			status = http.StatusServiceUnavailable
+		} else if !lastTimeLocal.IsZero() {
+			res.LastLogLine = &lastTimeLocal
+		}
+	}
+	writeJson(w, status, res)
+}
+
+func (server *server_impl) handleBans(w http.ResponseWriter, r *http.Request) {
+	format := r.URL.Query().Get("format")
+	if len(format) == 0 {
+		format = banexport.FORMAT_JSON
+	}
+	if !slices.Contains(banexport.Formats, format) {
+		http.Error(w, fmt.Sprintf("unsupported format '%s'", format), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", contentTypes[format])
+	err := banexport.Write(w, format, banexport.Entries(server.ufw.Bans()))
+	if err != nil {
+		log.Println("ERROR: Failed to write bans.", err)
+	}
+}
+
+func (server *server_impl) handleBan(w http.ResponseWriter, r *http.Request) {
+	var req banRequest
+	err := json.NewDecoder(io.LimitReader(r.Body, maxBodySize)).Decode(&req)
+	if err != nil {
+		http.Error(w, "invalid ban request", http.StatusBadRequest)
+		return
+	}
+	ip, err := ipaddr.Parse(req.IP)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var duration time.Duration
+	if len(req.Duration) > 0 {
+		duration, err = time.ParseDuration(req.Duration)
+		if err != nil || duration < 0 {
+			http.Error(w, fmt.Sprintf("invalid duration '%s'", req.Duration), http.StatusBadRequest)
+			return
+		}
+	}
+	log.Printf("Manual ban for IP %s requested by HTTP API.\n", ip)
+	if !server.ufw.RejectFor(ip, duration, "manual ban") {
+		http.Error(w, fmt.Sprintf("failed to reject IP %s", ip), http.StatusConflict)
+		return
+	}
+	bans := server.ufw.Bans()
+	idx := slices.IndexFunc(bans, func(ban ufw.Ban) bool { return ban.IP == ip })
+	if idx < 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	writeJson(w, http.StatusOK, bans[idx])
+}
+
+func (server *server_impl) handleUnban(w http.ResponseWriter, r *http.Request) {
+	ip, err := ipaddr.Parse(r.PathValue("ip"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	log.Printf("Manual unban for IP %s requested by HTTP API.\n", ip)
+	if !slices.ContainsFunc(server.ufw.Bans(), func(ban ufw.Ban) bool { return ban.IP == ip }) {
+		http.Error(w, fmt.Sprintf("IP %s is not rejected", ip), http.StatusNotFound)
+		return
+	}
+	if !server.ufw.Release(ip) {
+		http.Error(w, fmt.Sprintf("failed to release IP %s", ip), http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (server *server_impl) handleRequests(w http.ResponseWriter, r *http.Request) {
+	limit, err := intParam(r, "limit", storage.DEFAULT_SEARCH_LIMIT)
+	var status int
+	if err == nil {
+		status, err = intParam(r, "status", 0)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	filter := storage.LogFilter{Status: status, RequestMethod: strings.ToUpper(query.Get("method"))}
+	if ip := query.Get("ip"); len(ip) > 0 {
+		filter.RemoteAddr = ipaddr.Canonical(ip)
+	}
+	logLines, err := server.storage.RecentLogLines(filter, min(limit, maxLimit))
+	writeResult(w, logLines, err)
+}
+
+func (server *server_impl) handleRuleHits(w http.ResponseWriter, r *http.Request) {
+	days, err := intParam(r, "days", 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	counts, err := server.storage.RuleHitCounts(since(days))
+	writeResult(w, counts, err)
+}
+
+func (server *server_impl) handleHourlyStats(w http.ResponseWriter, r *http.Request) {
+	days, err := intParam(r, "days", 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	stats, err := server.storage.HourlyStats(since(days))
+	writeResult(w, stats, err)
+}
+
+// Returns a handler for the most frequent values of the last days, see query parameters days and limit.
+func topHandler[T any](top func(from time.Time, limit int) ([]T, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		days, err := intParam(r, "days", 1)
+		var limit int
+		if err == nil {
+			limit, err = intParam(r, "limit", 10)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		counts, err := top(since(days), min(limit, maxLimit))
+		writeResult(w, counts, err)
+	}
+}
+
+// Writes the result of a storage query or an internal server error.
+func writeResult(w http.ResponseWriter, result any, err error) {
+	if err != nil {
+		log.Println("ERROR: Failed to query database for HTTP API.", err)
+		http.Error(w, "failed to query database", http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, http.StatusOK, result)
+}
+
+func writeJson(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", contentTypes[banexport.FORMAT_JSON])
+	w.WriteHeader(status)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(value)
+	if err != nil {
+		log.Println("ERROR: Failed to write HTTP API response.", err)
+	}
+}
+
+// Returns the positive integer query parameter or the default value if the parameter is missing.
+func intParam(r *http.Request, name string, defaultValue int) (int, error) {
+	str := r.URL.Query().Get(name)
+	if len(str) == 0 {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(str)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("invalid %s '%s'", name, str)
+	}
+	return value, nil
+}
+
+// Returns the start of the time range of the last days, one day is the last 24 hours.
+func since(days int) time.Time {
+	return time.Now().Add(-time.Duration(days) * 24 * time.Hour)
+}
@@ -0,0 +1,268 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/fleet"
+	"github.com/nylssoft/goaccesslog/internal/metrics"
+	"github.com/nylssoft/goaccesslog/internal/parser"
+	"github.com/nylssoft/goaccesslog/internal/storage"
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockExecutor struct{}
+
+func (e *mockExecutor) Exec(cmdName string, args ...string) ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (e *mockExecutor) ExecInput(input []byte, cmdName string, args ...string) ([]byte, error) {
+	return []byte{}, nil
+}
+
+func TestBans(t *testing.T) {
+	firewall := ufw.NewUfw(&mockExecutor{}, nil, ufw.DefaultOptions())
+	firewall.Init()
+	require.True(t, firewall.RejectFor("1.1.1.1", time.Hour, "status-444"))
+	firewall.SetBlocklist([]string{"5.6.0.0/16"})
+	server := NewServer(Options{Address: "127.0.0.1:0"}, firewall, nil, nil).(*server_impl)
+	handler := server.handler()
+
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/api/bans", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+	assert.Contains(t, res.Body.String(), `"ip": "1.1.1.1"`)
+	assert.Contains(t, res.Body.String(), `"rule": "status-444"`)
+	assert.NotContains(t, res.Body.String(), "5.6.0.0/16")
+
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/api/bans?format=txt", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), "1.1.1.1 # status-444\n")
+
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/api/bans?format=csv", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), "1.1.1.1,")
+
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/api/bans?format=xml", nil))
+	assert.Equal(t, http.StatusBadRequest, res.Code)
+
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/api/bans", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, res.Code)
+
+	// start and stop listening
+	require.NoError(t, server.Start())
+	server.Stop()
+	assert.Error(t, NewServer(Options{Address: "invalid"}, firewall, nil, nil).Start())
+
+	// fleet events are only accepted if the fleet is enabled
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodPost, fleet.EVENTS_PATH, nil))
+	assert.Equal(t, http.StatusNotFound, res.Code)
+	handler = NewServer(Options{Address: "127.0.0.1:0"}, firewall, nil, fleet.NewFleet(fleet.Options{Secret: "secret"})).(*server_impl).handler()
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodPost, fleet.EVENTS_PATH, nil))
+	assert.Equal(t, http.StatusUnauthorized, res.Code)
+}
+
+func TestToken(t *testing.T) {
+	firewall := ufw.NewUfw(&mockExecutor{}, nil, ufw.DefaultOptions())
+	firewall.Init()
+	handler := NewServer(Options{Token: "secret"}, firewall, nil, nil).(*server_impl).handler()
+	request := func(method string, target string, token string, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res
+	}
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/api/bans", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/api/bans", "invalid", "").Code)
+	assert.Equal(t, http.StatusOK, request(http.MethodGet, "/api/bans", "secret", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodGet, "/metrics", "", "").Code)
+	res := request(http.MethodGet, "/metrics", "secret", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, metrics.CONTENT_TYPE, res.Header().Get("Content-Type"))
+	assert.Contains(t, res.Body.String(), "# TYPE goaccesslog_bans_total counter")
+	// health does not require a token
+	res = request(http.MethodGet, "/api/health", "", "")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `"status": "ok"`)
+	assert.Contains(t, res.Body.String(), `"manualBans": true`)
+	assert.NotContains(t, res.Body.String(), "lastLogLine")
+
+	// manual ban and unban
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodPost, "/api/bans", "", `{"ip":"1.1.1.1"}`).Code)
+	res = request(http.MethodPost, "/api/bans", "secret", `{"ip":"1.1.1.1","duration":"2h"}`)
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), `"ip": "1.1.1.1"`)
+	assert.True(t, firewall.IsRejected("1.1.1.1"))
+	assert.Equal(t, http.StatusOK, request(http.MethodPost, "/api/bans", "secret", `{"ip":"2001:db8::/64"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/api/bans", "secret", `{"ip":"invalid"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/api/bans", "secret", `{"ip":"1.1.1.1","duration":"x"}`).Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/api/bans", "secret", `{"ip":"3.3.3.3","duration":"-1h"}`).Code)
+	assert.False(t, firewall.IsRejected("3.3.3.3"))
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodPost, "/api/bans", "secret", `invalid`).Code)
+	assert.Equal(t, http.StatusUnauthorized, request(http.MethodDelete, "/api/bans/1.1.1.1", "", "").Code)
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/api/bans/1.1.1.1", "secret", "").Code)
+	assert.False(t, firewall.IsRejected("1.1.1.1"))
+	assert.Equal(t, http.StatusNoContent, request(http.MethodDelete, "/api/bans/2001:db8::/64", "secret", "").Code)
+	assert.Equal(t, http.StatusNotFound, request(http.MethodDelete, "/api/bans/1.1.1.1", "secret", "").Code)
+	assert.Equal(t, http.StatusBadRequest, request(http.MethodDelete, "/api/bans/invalid", "secret", "").Code)
+
+	// manual bans are disabled without token
+	handler = NewServer(Options{}, firewall, nil, nil).(*server_impl).handler()
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodPost, "/api/bans", strings.NewReader(`{"ip":"1.1.1.1"}`)))
+	assert.Equal(t, http.StatusMethodNotAllowed, res.Code)
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	assert.Contains(t, res.Body.String(), `"manualBans": false`)
+	assert.False(t, firewall.IsRejected("1.1.1.1"))
+}
+
+func TestStorage(t *testing.T) {
+	store := storage.NewStorage(storage.DRIVER_SQLITE, path.Join(t.TempDir(), "test.db"))
+	defer store.Close()
+	now := time.Now()
+	batch, err := store.Begin()
+	require.NoError(t, err)
+	logLines := []parser.LogLine{
+		{RemoteAddr: "1.1.1.1", TimeLocal: now.Add(-time.Minute), RequestMethod: "GET", RequestUri: "/.env", Status: 404},
+		{RemoteAddr: "1.1.1.1", TimeLocal: now, RequestMethod: "GET", RequestUri: "/", Status: 200},
+		{RemoteAddr: "2.2.2.2", TimeLocal: now, RequestMethod: "POST", RequestUri: "/login", Status: 200},
+	}
+	for i, logLine := range logLines {
+		_, err = batch.Insert(logLine, string(rune('a'+i)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, batch.InsertRuleHit(storage.RuleHit{Hash: "a", BadRule: "status-404"}))
+	require.NoError(t, batch.Commit())
+	firewall := ufw.NewUfw(&mockExecutor{}, nil, ufw.DefaultOptions())
+	firewall.Init()
+	handler := NewServer(Options{}, firewall, store, nil).(*server_impl).handler()
+	get := func(target string, expectedStatus int, value any) {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, target, nil))
+		require.Equal(t, expectedStatus, res.Code, res.Body.String())
+		if value != nil {
+			assert.Equal(t, "application/json", res.Header().Get("Content-Type"))
+			require.NoError(t, json.Unmarshal(res.Body.Bytes(), value))
+		}
+	}
+
+	var requests []parser.LogLine
+	get("/api/requests", http.StatusOK, &requests)
+	require.Len(t, requests, 3)
+	assert.Equal(t, "/login", requests[0].RequestUri)
+	get("/api/requests?ip=1.1.1.1&status=404&method=get", http.StatusOK, &requests)
+	require.Len(t, requests, 1)
+	assert.Equal(t, "/.env", requests[0].RequestUri)
+	get("/api/requests?limit=1", http.StatusOK, &requests)
+	assert.Len(t, requests, 1)
+	get("/api/requests?limit=0", http.StatusBadRequest, nil)
+	get("/api/requests?status=x", http.StatusBadRequest, nil)
+
+	var topIPs []storage.IPCount
+	get("/api/top-ips", http.StatusOK, &topIPs)
+	assert.Equal(t, []storage.IPCount{{IP: "1.1.1.1", Requests: 2}, {IP: "2.2.2.2", Requests: 1}}, topIPs)
+	get("/api/top-ips?days=7&limit=1", http.StatusOK, &topIPs)
+	assert.Equal(t, []storage.IPCount{{IP: "1.1.1.1", Requests: 2}}, topIPs)
+	get("/api/top-ips?days=-1", http.StatusBadRequest, nil)
+
+	var ruleHits []storage.RuleHitCount
+	get("/api/rule-hits", http.StatusOK, &ruleHits)
+	assert.Equal(t, []storage.RuleHitCount{{BadRule: "status-404", Hits: 1}}, ruleHits)
+
+	var topURIs []storage.ValueCount
+	get("/api/top-uris?limit=2", http.StatusOK, &topURIs)
+	require.Len(t, topURIs, 2)
+	get("/api/top-user-agents", http.StatusOK, &topURIs)
+	assert.Empty(t, topURIs)
+
+	var hourlyStats []storage.HourlyStat
+	get("/api/stats/hourly", http.StatusOK, &hourlyStats)
+	var total int64
+	for _, stat := range hourlyStats {
+		total += stat.Requests
+	}
+	assert.Equal(t, int64(3), total)
+	get("/api/stats/hourly?days=x", http.StatusBadRequest, nil)
+
+	var status health
+	get("/api/health", http.StatusOK, &status)
+	assert.Equal(t, "ok", status.Status)
+	require.NotNil(t, status.LastLogLine)
+	assert.True(t, now.Equal(*status.LastLogLine))
+
+	// database errors
+	store.Close()
+	handler = NewServer(Options{}, firewall, storage.NewStorage(storage.DRIVER_SQLITE, t.TempDir()), nil).(*server_impl).handler()
+	get("/api/health", http.StatusServiceUnavailable, &status)
+	assert.Equal(t, "error", status.Status)
+	get("/api/requests", http.StatusInternalServerError, nil)
+}
+
+func TestUnixSocket(t *testing.T) {
+	filename := path.Join(t.TempDir(), "api.sock")
+	firewall := ufw.NewUfw(&mockExecutor{}, nil, ufw.DefaultOptions())
+	server := NewServer(Options{Address: UNIX_PREFIX + filename}, firewall, nil, nil)
+	require.NoError(t, server.Start())
+	defer server.Stop()
+	client := http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", filename)
+		}}}
+	res, err := client.Get("http://localhost/api/health")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+}
+
+func TestLocalAddress(t *testing.T) {
+	for _, address := range []string{"127.0.0.1:8080", "127.1.2.3:0", "[::1]:8080", "localhost:8080", UNIX_PREFIX + "/run/api.sock"} {
+		assert.True(t, IsLocalAddress(address), address)
+	}
+	for _, address := range []string{":8080", "0.0.0.0:8080", "[::]:8080", "192.0.2.1:8080", "example.com:8080", "invalid"} {
+		assert.False(t, IsLocalAddress(address), address)
+	}
+	// a public address requires a token
+	firewall := ufw.NewUfw(&mockExecutor{}, nil, ufw.DefaultOptions())
+	assert.Error(t, NewServer(Options{Address: ":0"}, firewall, nil, nil).Start())
+	server := NewServer(Options{Address: ":0", Token: "secret"}, firewall, nil, nil)
+	require.NoError(t, server.Start())
+	server.Stop()
+}
+
+func TestDashboard(t *testing.T) {
+	firewall := ufw.NewUfw(&mockExecutor{}, nil, ufw.DefaultOptions())
+	handler := NewServer(Options{Token: "secret"}, firewall, nil, nil).(*server_impl).handler()
+	res := httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusFound, res.Code)
+	assert.Equal(t, "/dashboard/", res.Header().Get("Location"))
+	// static files do not require the token
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/dashboard/", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), "dashboard.js")
+	res = httptest.NewRecorder()
+	handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, res.Code)
+}
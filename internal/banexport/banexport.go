@@ -0,0 +1,60 @@
+package banexport
+
+import (
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+)
+
+const (
+	// One IP address or network per line, usable as blocklist file.
+	FORMAT_TXT = "txt"
+	// Comma separated values with header line.
+	FORMAT_CSV = "csv"
+	// JSON array of bans.
+	FORMAT_JSON = "json"
+)
+
+// All supported export formats.
+var Formats = []string{FORMAT_TXT, FORMAT_CSV, FORMAT_JSON}
+
+// Writes the active bans into files so that other hosts can use them as blocklist.
+//
+// Only bans detected by rules or added manually are exported,
+// bans imported from blocklists are not shared again.
+//
+// Use NewExporter to create a new exporter.
+type Exporter interface {
+	// Writes the bans into the files bans.txt, bans.csv and bans.json of the export directory.
+	// Each file is replaced atomically.
+	Export(bans []ufw.Ban) error
+}
+
+// Describes an exported ban.
+type Entry struct {
+	IP        string    `json:"ip"`
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Rule      string    `json:"rule"`
+	Hits      int       `json:"hits"`
+	Expires   time.Time `json:"expires"`
+}
+
+// Creates a new exporter for the specified directory.
+func NewExporter(directory string) Exporter {
+	var exporter exporter_impl
+	exporter.directory = directory
+	return &exporter
+}
+
+// Returns the exported entries for the bans detected by rules or added manually.
+func Entries(bans []ufw.Ban) []Entry {
+	entries := []Entry{}
+	for _, ban := range bans {
+		if ban.Category == ufw.CATEGORY_BLOCKLIST {
+			continue
+		}
+		entries = append(entries, Entry{IP: ban.IP, FirstSeen: ban.FirstSeen, LastSeen: ban.LastSeen, Rule: ban.Rule, Hits: ban.Hits, Expires: ban.To})
+	}
+	return entries
+}
@@ -0,0 +1,93 @@
+package banexport
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+)
+
+type exporter_impl struct {
+	directory string
+}
+
+func (exporter *exporter_impl) Export(bans []ufw.Ban) error {
+	entries := Entries(bans)
+	for _, format := range Formats {
+		err := exporter.writeFile(filepath.Join(exporter.directory, "bans."+format), format, entries)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Writes a temporary file and renames it, so readers never see a partially written file.
+func (exporter *exporter_impl) writeFile(filename string, format string, entries []Entry) error {
+	file, err := os.CreateTemp(exporter.directory, ".bans-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(file.Name())
+	err = Write(file, format, entries)
+	if err == nil {
+		err = file.Chmod(0644)
+	}
+	closeErr := file.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(file.Name(), filename)
+	}
+	return err
+}
+
+// Writes the entries in the specified format.
+func Write(writer io.Writer, format string, entries []Entry) error {
+	switch format {
+	case FORMAT_TXT:
+		return writeText(writer, entries)
+	case FORMAT_CSV:
+		return writeCsv(writer, entries)
+	case FORMAT_JSON:
+		encoder := json.NewEncoder(writer)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+	return fmt.Errorf("unsupported export format '%s'", format)
+}
+
+func writeText(writer io.Writer, entries []Entry) error {
+	_, err := fmt.Fprintf(writer, "# goaccesslog bans exported at %s\n", time.Now().UTC().Format(time.RFC3339))
+	for _, entry := range entries {
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(writer, "%s # %s\n", entry.IP, entry.Rule)
+	}
+	return err
+}
+
+func writeCsv(writer io.Writer, entries []Entry) error {
+	w := csv.NewWriter(writer)
+	w.Write([]string{"ip", "first_seen", "last_seen", "rule", "hits", "expires"})
+	for _, entry := range entries {
+		w.Write([]string{entry.IP, formatTime(entry.FirstSeen), formatTime(entry.LastSeen), entry.Rule, strconv.Itoa(entry.Hits), formatTime(entry.Expires)})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
@@ -0,0 +1,68 @@
+package banexport
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWrite(t *testing.T) {
+	now := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	bans := []ufw.Ban{
+		{IP: "1.1.1.1", From: now, To: now.Add(time.Hour), FirstSeen: now.Add(-time.Hour), LastSeen: now, Rule: "status-444", Hits: 3},
+		{IP: "5.6.0.0/16", From: now, Category: ufw.CATEGORY_BLOCKLIST},
+		{IP: "2001:db8::1", From: now, To: now.Add(time.Hour), FirstSeen: now, LastSeen: now, Rule: "manual ban", Hits: 1},
+	}
+	entries := Entries(bans)
+	require.Len(t, entries, 2)
+	assert.Equal(t, "1.1.1.1", entries[0].IP)
+	assert.Equal(t, "2001:db8::1", entries[1].IP)
+	assert.Equal(t, now.Add(time.Hour), entries[0].Expires)
+	assert.NotNil(t, Entries(nil))
+
+	var buf bytes.Buffer
+	require.NoError(t, Write(&buf, FORMAT_TXT, entries))
+	assert.Contains(t, buf.String(), "# goaccesslog bans exported at ")
+	assert.Contains(t, buf.String(), "\n1.1.1.1 # status-444\n2001:db8::1 # manual ban\n")
+
+	buf.Reset()
+	require.NoError(t, Write(&buf, FORMAT_CSV, entries))
+	assert.Equal(t, `ip,first_seen,last_seen,rule,hits,expires
+1.1.1.1,2025-05-01T11:00:00Z,2025-05-01T12:00:00Z,status-444,3,2025-05-01T13:00:00Z
+2001:db8::1,2025-05-01T12:00:00Z,2025-05-01T12:00:00Z,manual ban,1,2025-05-01T13:00:00Z
+`, buf.String())
+
+	buf.Reset()
+	require.NoError(t, Write(&buf, FORMAT_JSON, entries))
+	var decoded []Entry
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &decoded))
+	assert.Equal(t, entries, decoded)
+
+	assert.Error(t, Write(&buf, "xml", entries))
+}
+
+func TestExport(t *testing.T) {
+	dir := t.TempDir()
+	exporter := NewExporter(dir)
+	now := time.Now()
+	err := exporter.Export([]ufw.Ban{{IP: "1.1.1.1", From: now, To: now.Add(time.Hour), Rule: "status-444", Hits: 1}})
+	require.NoError(t, err)
+	for _, format := range Formats {
+		data, err := os.ReadFile(path.Join(dir, "bans."+format))
+		require.NoError(t, err)
+		assert.Contains(t, string(data), "1.1.1.1")
+	}
+	files, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, files, len(Formats))
+
+	exporter = NewExporter(path.Join(dir, "doesnotexist"))
+	assert.Error(t, exporter.Export(nil))
+}
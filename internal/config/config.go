@@ -1,11 +1,54 @@
 package config
 
+import (
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/api"
+	"github.com/nylssoft/goaccesslog/internal/fleet"
+	"github.com/nylssoft/goaccesslog/internal/iplist"
+	"github.com/nylssoft/goaccesslog/internal/parser"
+	"github.com/nylssoft/goaccesslog/internal/retention"
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+)
+
 type Config interface {
 	Init(filename string) error
+	Load(filename string) error
+	LoadDatabase(filename string) error
 	IsVerbose() bool
 	AccessLogFilename() string
+	LogParser() parser.Parser
+	DatabaseDriver() string
+	DatabaseDataSource() string
 	DatabaseFilename() string
-	IsMaliciousRequest(ip string, protocol string, uri string, status int) bool
+	IsRetentionEnabled() bool
+	RetentionOptions() retention.Options
+	RetentionInterval() time.Duration
+	ControlSocketFilename() string
+	FirewallOptions() ufw.Options
+	AllowedIPs() iplist.IPList
+	TrustedProxies() iplist.IPList
+	Blocklists() []iplist.IPList
+	ApiAddress() string
+	ApiOptions() api.Options
+	IsFleetEnabled() bool
+	FleetOptions() fleet.Options
+	ExportDirectory() string
+	ExportInterval() time.Duration
+	MatchRules(logLine parser.LogLine) RuleMatch
+}
+
+// Result of the rule evaluation for a request.
+type RuleMatch struct {
+	// Names of all bad rules that match the request in configuration order.
+	BadRules []string
+	// Name of the first good rule that overrides the bad rules, only evaluated if a bad rule matches.
+	GoodRule string
+}
+
+// Returns whether the request is considered as malicious.
+func (match RuleMatch) IsMalicious() bool {
+	return len(match.BadRules) > 0 && len(match.GoodRule) == 0
 }
 
 func NewConfig() Config {
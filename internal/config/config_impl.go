@@ -5,25 +5,97 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"net/url"
 	"os"
+	"slices"
+	"strings"
+	"time"
 
+	"github.com/nylssoft/goaccesslog/internal/api"
+	"github.com/nylssoft/goaccesslog/internal/fleet"
+	"github.com/nylssoft/goaccesslog/internal/ipaddr"
+	"github.com/nylssoft/goaccesslog/internal/iplist"
+	"github.com/nylssoft/goaccesslog/internal/parser"
+	"github.com/nylssoft/goaccesslog/internal/retention"
 	"github.com/nylssoft/goaccesslog/internal/rule"
+	"github.com/nylssoft/goaccesslog/internal/storage"
+	"github.com/nylssoft/goaccesslog/internal/ufw"
 	"gopkg.in/natefinch/lumberjack.v2"
 )
 
+const DefaultControlSocketFilename = "/run/goaccesslog.sock"
+
 type configRule struct {
 	Name      string `json:"name"`
 	Condition string `json:"condition"`
 }
 
 type config_impl struct {
-	Expressions map[string][]rule.Expression
-	Nginx       struct {
-		AccessLogFilename string `json:"accessLogFilename"`
+	Expressions       map[string][]rule.Expression
+	firewall          ufw.Options
+	allowlist         iplist.IPList
+	trustedProxies    iplist.IPList
+	blocklists        []iplist.IPList
+	exportInterval    time.Duration
+	retention         retention.Options
+	retentionInterval time.Duration
+	parser            parser.Parser
+	Nginx             struct {
+		AccessLogFilename string   `json:"accessLogFilename"`
+		LogFormat         string   `json:"logFormat"`
+		TrustedProxies    []string `json:"trustedProxies"`
 	} `json:"nginx"`
 	Database struct {
-		Filename string `json:"filename"`
+		Driver     string `json:"driver"`
+		DataSource string `json:"dataSource"`
+		Filename   string `json:"filename"`
+		Retention  struct {
+			MaxAge           string `json:"maxAge"`
+			MaxRows          int64  `json:"maxRows"`
+			Interval         string `json:"interval"`
+			ArchiveDirectory string `json:"archiveDirectory"`
+		} `json:"retention"`
 	} `json:"database"`
+	Firewall struct {
+		Backend           string `json:"backend"`
+		Comment           string `json:"comment"`
+		Action            string `json:"action"`
+		Ports             []int  `json:"ports"`
+		BanDuration       string `json:"banDuration"`
+		MaxEscalations    int    `json:"maxEscalations"`
+		MaxBanDuration    string `json:"maxBanDuration"`
+		ReleaseOnShutdown bool   `json:"releaseOnShutdown"`
+		UnknownRules      string `json:"unknownRules"`
+		Aggregation       struct {
+			Threshold        int    `json:"threshold"`
+			Window           string `json:"window"`
+			IPv4PrefixLength int    `json:"ipv4PrefixLength"`
+			IPv6PrefixLength int    `json:"ipv6PrefixLength"`
+		} `json:"aggregation"`
+	} `json:"firewall"`
+	Control struct {
+		SocketFilename string `json:"socketFilename"`
+	} `json:"control"`
+	Allowlist struct {
+		IPs      []string `json:"ips"`
+		Filename string   `json:"filename"`
+	} `json:"allowlist"`
+	Blocklist struct {
+		Filenames []string `json:"filenames"`
+	} `json:"blocklist"`
+	Api struct {
+		Address string `json:"address"`
+		Token   string `json:"token"`
+	} `json:"api"`
+	Fleet struct {
+		Node   string   `json:"node"`
+		Secret string   `json:"secret"`
+		Peers  []string `json:"peers"`
+	} `json:"fleet"`
+	Export struct {
+		Directory string `json:"directory"`
+		Interval  string `json:"interval"`
+	} `json:"export"`
 	Logger struct {
 		Filename string `json:"filename"`
 		MaxSize  int    `json:"maxsize"`
@@ -37,10 +109,7 @@ type config_impl struct {
 }
 
 func (cfg *config_impl) Init(filename string) error {
-	data, err := os.ReadFile(filename)
-	if err == nil {
-		err = json.Unmarshal(data, &cfg)
-	}
+	err := cfg.read(filename)
 	if err != nil {
 		return err
 	}
@@ -48,17 +117,13 @@ func (cfg *config_impl) Init(filename string) error {
 	fmt.Println("  config file          :", filename)
 	fmt.Println("  log file             :", cfg.Logger.Filename)
 	fmt.Println("  nginx access log file:", cfg.Nginx.AccessLogFilename)
-	fmt.Println("  sqlite database file :", cfg.Database.Filename)
-	err = canWriteFile(cfg.Logger.Filename, "log")
-	if err == nil {
-		err = canWriteFile(cfg.Database.Filename, "database")
-	}
-	if err == nil {
-		err = canReadFile(cfg.Nginx.AccessLogFilename, "nginx access log")
-	}
-	if err == nil {
-		err = cfg.updateExpressions()
+	if cfg.DatabaseDriver() == storage.DRIVER_SQLITE {
+		fmt.Println("  sqlite database file :", cfg.Database.Filename)
+	} else {
+		fmt.Println("  database driver      :", cfg.Database.Driver)
 	}
+	fmt.Println("  control socket file  :", cfg.ControlSocketFilename())
+	err = cfg.validate()
 	if err != nil {
 		return err
 	}
@@ -71,7 +136,16 @@ func (cfg *config_impl) Init(filename string) error {
 	log.Println("goaccesslog version 0.2.6")
 	log.Println()
 	log.Println("Note: nginx log format is expected to be")
-	log.Println("  log_format noreferer '$remote_addr - $remote_user [$time_local] $msec \"$request\" $request_length $status $body_bytes_sent $request_time \"$http_user_agent\"';")
+	log.Printf("  log_format goaccesslog '%s';\n", cfg.logFormat())
+	if cfg.trustedProxies.Len() > 0 {
+		log.Printf("Client IP is taken from X-Forwarded-For or PROXY protocol address for %d trusted proxies.\n", cfg.trustedProxies.Len())
+	}
+	if cfg.IsRetentionEnabled() {
+		log.Printf("Delete log lines older than %s or exceeding %d rows every %s.\n", cfg.retention.MaxAge, cfg.retention.MaxRows, cfg.retentionInterval)
+		if len(cfg.retention.ArchiveDirectory) > 0 {
+			log.Printf("Archive deleted log lines into directory '%s'.\n", cfg.retention.ArchiveDirectory)
+		}
+	}
 	log.Println()
 	log.Println("Rules to detect malicious requests:")
 	for _, badrule := range cfg.Rules.Bad {
@@ -83,9 +157,105 @@ func (cfg *config_impl) Init(filename string) error {
 		log.Printf("  %s: %s\n", goodrule.Name, goodrule.Condition)
 	}
 	log.Println()
+	log.Printf("Firewall backend %s: %s rules marked with comment '%s', ban duration %s, max escalations %d, max ban duration %s, ports %v.\n",
+		cfg.firewall.Backend, cfg.firewall.Action, cfg.firewall.Comment, cfg.firewall.Delay, cfg.firewall.MaxFailures, cfg.firewall.MaxDelay, cfg.firewall.Ports)
+	log.Printf("Release on shutdown: %t. Policy for firewall rules without stored ban: %s.\n", cfg.firewall.ReleaseOnShutdown, cfg.firewall.UnknownRulePolicy)
+	aggregation := cfg.firewall.Aggregation
+	if aggregation.Threshold > 0 {
+		log.Printf("Lock IPv4 /%d or IPv6 /%d network if %d IPs are locked within %s.\n",
+			aggregation.IPv4PrefixLength, aggregation.IPv6PrefixLength, aggregation.Threshold, aggregation.Window)
+	}
+	if len(cfg.allowlist.Filename()) > 0 {
+		log.Printf("Allowlist with %d IPs and networks, reloaded from file '%s' on change.\n", cfg.allowlist.Len(), cfg.allowlist.Filename())
+	} else {
+		log.Printf("Allowlist with %d IPs and networks.\n", cfg.allowlist.Len())
+	}
+	for _, blocklist := range cfg.blocklists {
+		log.Printf("Blocklist with %d IPs and networks, reloaded from file '%s' on change.\n", blocklist.Len(), blocklist.Filename())
+	}
+	if len(cfg.Api.Address) > 0 {
+		log.Printf("HTTP API listens on %s.\n", cfg.Api.Address)
+		if len(cfg.Api.Token) == 0 {
+			log.Println("WARNING: HTTP API requires no token, manual bans are disabled.")
+		}
+	}
+	if cfg.IsFleetEnabled() {
+		log.Printf("Share bans as node '%s' with peers %v.\n", cfg.Fleet.Node, cfg.Fleet.Peers)
+	}
+	if len(cfg.Export.Directory) > 0 {
+		log.Printf("Export bans into directory '%s' every %s.\n", cfg.Export.Directory, cfg.exportInterval)
+	}
+	log.Println()
 	return nil
 }
 
+func (cfg *config_impl) Load(filename string) error {
+	err := cfg.read(filename)
+	if err == nil {
+		err = cfg.validate()
+	}
+	return err
+}
+
+// Reads the config file and validates only the database settings,
+// e.g. for commands that read the database without access to the log files.
+func (cfg *config_impl) LoadDatabase(filename string) error {
+	err := cfg.read(filename)
+	if err == nil {
+		err = cfg.updateDatabase()
+	}
+	return err
+}
+
+func (cfg *config_impl) read(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err == nil {
+		err = json.Unmarshal(data, &cfg)
+	}
+	return err
+}
+
+func (cfg *config_impl) validate() error {
+	err := canWriteFile(cfg.Logger.Filename, "log")
+	if err == nil {
+		err = cfg.updateDatabase()
+	}
+	if err == nil {
+		err = canReadFile(cfg.Nginx.AccessLogFilename, "nginx access log")
+	}
+	if err == nil {
+		err = cfg.updateParser()
+	}
+	if err == nil {
+		err = cfg.updateTrustedProxies()
+	}
+	if err == nil {
+		err = cfg.updateRetention()
+	}
+	if err == nil {
+		err = cfg.updateExpressions()
+	}
+	if err == nil {
+		err = cfg.updateFirewall()
+	}
+	if err == nil {
+		err = cfg.updateAllowlist()
+	}
+	if err == nil {
+		err = cfg.updateBlocklists()
+	}
+	if err == nil {
+		err = cfg.updateExport()
+	}
+	if err == nil {
+		err = cfg.updateApi()
+	}
+	if err == nil {
+		err = cfg.updateFleet()
+	}
+	return err
+}
+
 func (cfg *config_impl) IsVerbose() bool {
 	return cfg.Logger.Verbose
 }
@@ -94,36 +264,129 @@ func (cfg *config_impl) AccessLogFilename() string {
 	return cfg.Nginx.AccessLogFilename
 }
 
+func (cfg *config_impl) LogParser() parser.Parser {
+	return cfg.parser
+}
+
+func (cfg *config_impl) DatabaseDriver() string {
+	if len(cfg.Database.Driver) == 0 {
+		return storage.DRIVER_SQLITE
+	}
+	return cfg.Database.Driver
+}
+
+func (cfg *config_impl) DatabaseDataSource() string {
+	if cfg.DatabaseDriver() == storage.DRIVER_SQLITE {
+		return cfg.Database.Filename
+	}
+	return cfg.Database.DataSource
+}
+
 func (cfg *config_impl) DatabaseFilename() string {
 	return cfg.Database.Filename
 }
 
-func (cfg *config_impl) IsMaliciousRequest(ip string, protocol string, uri string, status int) bool {
+func (cfg *config_impl) IsRetentionEnabled() bool {
+	return cfg.retention.MaxAge > 0 || cfg.retention.MaxRows > 0
+}
+
+func (cfg *config_impl) RetentionOptions() retention.Options {
+	return cfg.retention
+}
+
+func (cfg *config_impl) RetentionInterval() time.Duration {
+	return cfg.retentionInterval
+}
+
+func (cfg *config_impl) ControlSocketFilename() string {
+	if len(cfg.Control.SocketFilename) == 0 {
+		return DefaultControlSocketFilename
+	}
+	return cfg.Control.SocketFilename
+}
+
+func (cfg *config_impl) FirewallOptions() ufw.Options {
+	return cfg.firewall
+}
+
+func (cfg *config_impl) AllowedIPs() iplist.IPList {
+	return cfg.allowlist
+}
+
+func (cfg *config_impl) TrustedProxies() iplist.IPList {
+	return cfg.trustedProxies
+}
+
+func (cfg *config_impl) Blocklists() []iplist.IPList {
+	return cfg.blocklists
+}
+
+func (cfg *config_impl) ApiAddress() string {
+	return cfg.Api.Address
+}
+
+func (cfg *config_impl) ApiOptions() api.Options {
+	return api.Options{Address: cfg.Api.Address, Token: cfg.Api.Token}
+}
+
+func (cfg *config_impl) IsFleetEnabled() bool {
+	return len(cfg.Fleet.Secret) > 0
+}
+
+func (cfg *config_impl) FleetOptions() fleet.Options {
+	return fleet.Options{Node: cfg.Fleet.Node, Secret: cfg.Fleet.Secret, Peers: cfg.Fleet.Peers}
+}
+
+func (cfg *config_impl) ExportDirectory() string {
+	return cfg.Export.Directory
+}
+
+func (cfg *config_impl) ExportInterval() time.Duration {
+	return cfg.exportInterval
+}
+
+func (cfg *config_impl) MatchRules(logLine parser.LogLine) RuleMatch {
 	data := map[rule.Property]any{}
-	data[rule.PROP_IP] = ip
-	data[rule.PROP_PROTOCOL] = protocol
-	data[rule.PROP_URI] = uri
-	data[rule.PROP_STATUS] = status
-	var isMalicious bool
-	// evaluate whether request is considered as malicious
+	data[rule.PROP_IP] = ipaddr.Canonical(logLine.Client())
+	data[rule.PROP_PROTOCOL] = logLine.RequestProtocol
+	data[rule.PROP_URI] = logLine.RequestUri
+	data[rule.PROP_STATUS] = logLine.Status
+	data[rule.PROP_REFERER] = logLine.Referer
+	data[rule.PROP_HOST] = logLine.Host
+	data[rule.PROP_X_FORWARDED_FOR] = logLine.XForwardedFor
+	data[rule.PROP_UPSTREAM_ADDR] = logLine.UpstreamAddr
+	data[rule.PROP_UPSTREAM_TIME] = logLine.UpstreamResponseTime
+	data[rule.PROP_TLS_PROTOCOL] = logLine.TlsProtocol
+	data[rule.PROP_PROXY_PROTOCOL_ADDR] = logLine.ProxyProtocolAddr
+	var match RuleMatch
 	for _, badrule := range cfg.Rules.Bad {
-		isMalicious = rule.EvaluateExpressions(cfg.Expressions[badrule.Name], data)
-		if isMalicious {
-			log.Printf("Detected malicious request for bad rule '%s'. IP %s, Status %d, URI '%s'.\n", badrule.Name, ip, status, uri)
-			break
+		if rule.EvaluateExpressions(cfg.Expressions[badrule.Name], data) {
+			match.BadRules = append(match.BadRules, badrule.Name)
 		}
 	}
 	// good rules overwrite bad rules
-	if isMalicious {
+	if len(match.BadRules) > 0 {
 		for _, goodrule := range cfg.Rules.Good {
 			if rule.EvaluateExpressions(cfg.Expressions[goodrule.Name], data) {
-				log.Printf("Overwrite request using good rule '%s'.\n", goodrule.Name)
-				isMalicious = false
+				match.GoodRule = goodrule.Name
 				break
 			}
 		}
 	}
-	return isMalicious
+	return match
+}
+
+func (cfg *config_impl) logFormat() string {
+	if len(strings.TrimSpace(cfg.Nginx.LogFormat)) == 0 {
+		return parser.DEFAULT_FORMAT
+	}
+	return cfg.Nginx.LogFormat
+}
+
+func (cfg *config_impl) updateParser() error {
+	var err error
+	cfg.parser, err = parser.NewParser(cfg.Nginx.LogFormat)
+	return err
 }
 
 func (config *config_impl) updateExpressions() error {
@@ -143,6 +406,235 @@ func (config *config_impl) updateExpressions() error {
 	return nil
 }
 
+func (config *config_impl) updateAllowlist() error {
+	allowlist, err := iplist.NewIPList(config.Allowlist.IPs, config.Allowlist.Filename)
+	if err != nil {
+		return fmt.Errorf("invalid allowlist: %s", err.Error())
+	}
+	config.allowlist = allowlist
+	config.firewall.Allowlist = allowlist
+	return nil
+}
+
+func (config *config_impl) updateTrustedProxies() error {
+	trustedProxies, err := iplist.NewIPList(config.Nginx.TrustedProxies, "")
+	if err != nil {
+		return fmt.Errorf("invalid trusted proxies: %s", err.Error())
+	}
+	config.trustedProxies = trustedProxies
+	return nil
+}
+
+func (config *config_impl) updateBlocklists() error {
+	config.blocklists = nil
+	for _, filename := range config.Blocklist.Filenames {
+		blocklist, err := iplist.NewIPList(nil, filename)
+		if err != nil {
+			return fmt.Errorf("invalid blocklist: %s", err.Error())
+		}
+		config.blocklists = append(config.blocklists, blocklist)
+	}
+	return nil
+}
+
+func (config *config_impl) updateApi() error {
+	if len(config.Api.Address) > 0 && len(config.Api.Token) == 0 && !api.IsLocalAddress(config.Api.Address) {
+		return fmt.Errorf("HTTP API on address %s requires a token, use a loopback address or a unix socket otherwise", config.Api.Address)
+	}
+	return nil
+}
+
+func (config *config_impl) updateFleet() error {
+	if !config.IsFleetEnabled() {
+		if len(config.Fleet.Peers) > 0 {
+			return errors.New("missing fleet secret")
+		}
+		return nil
+	}
+	if len(config.Api.Address) == 0 {
+		return errors.New("fleet requires an HTTP API address to receive ban events")
+	}
+	if len(config.Api.Token) == 0 {
+		return errors.New("fleet requires an HTTP API token")
+	}
+	if len(config.Fleet.Node) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return fmt.Errorf("missing fleet node name: %s", err.Error())
+		}
+		config.Fleet.Node = hostname
+	}
+	for _, peer := range config.Fleet.Peers {
+		u, err := url.Parse(peer)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+			return fmt.Errorf("invalid fleet peer '%s'", peer)
+		}
+	}
+	return nil
+}
+
+func (config *config_impl) updateExport() error {
+	config.exportInterval = 5 * time.Minute
+	if len(config.Export.Interval) > 0 {
+		interval, err := parsePositiveDuration(config.Export.Interval, "export interval")
+		if err != nil {
+			return err
+		}
+		config.exportInterval = interval
+	}
+	if len(config.Export.Directory) > 0 {
+		info, err := os.Stat(config.Export.Directory)
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("export directory '%s' does not exist", config.Export.Directory)
+		}
+	}
+	return nil
+}
+
+func (config *config_impl) updateDatabase() error {
+	driver := config.DatabaseDriver()
+	if !slices.Contains(storage.Drivers, driver) {
+		return fmt.Errorf("unsupported database driver '%s'", driver)
+	}
+	if driver == storage.DRIVER_SQLITE {
+		return canWriteFile(config.Database.Filename, "database")
+	}
+	if len(config.Database.DataSource) == 0 {
+		return fmt.Errorf("missing database data source for driver '%s'", driver)
+	}
+	return nil
+}
+
+func (config *config_impl) updateRetention() error {
+	settings := config.Database.Retention
+	config.retention = retention.Options{MaxRows: settings.MaxRows, ArchiveDirectory: settings.ArchiveDirectory}
+	config.retentionInterval = time.Hour
+	var err error
+	if len(settings.MaxAge) > 0 {
+		config.retention.MaxAge, err = parsePositiveDuration(settings.MaxAge, "retention max age")
+		if err != nil {
+			return err
+		}
+	}
+	if settings.MaxRows < 0 {
+		return fmt.Errorf("invalid retention max rows %d", settings.MaxRows)
+	}
+	if len(settings.Interval) > 0 {
+		config.retentionInterval, err = parsePositiveDuration(settings.Interval, "retention interval")
+		if err != nil {
+			return err
+		}
+	}
+	if len(settings.ArchiveDirectory) > 0 {
+		info, err := os.Stat(settings.ArchiveDirectory)
+		if err != nil || !info.IsDir() {
+			return fmt.Errorf("retention archive directory '%s' does not exist", settings.ArchiveDirectory)
+		}
+	}
+	if config.IsRetentionEnabled() && config.DatabaseDriver() != storage.DRIVER_SQLITE {
+		return errors.New("database retention is only supported for sqlite")
+	}
+	return nil
+}
+
+func (config *config_impl) updateFirewall() error {
+	firewall := config.Firewall
+	config.firewall = ufw.DefaultOptions()
+	if len(firewall.Backend) > 0 {
+		if firewall.Backend != ufw.BACKEND_UFW && firewall.Backend != ufw.BACKEND_NFT && firewall.Backend != ufw.BACKEND_IPSET {
+			return fmt.Errorf("unsupported firewall backend '%s'", firewall.Backend)
+		}
+		config.firewall.Backend = firewall.Backend
+	}
+	if len(firewall.Comment) > 0 {
+		if strings.ContainsAny(firewall.Comment, "#'\" \t\r\n") {
+			return fmt.Errorf("invalid firewall comment '%s'", firewall.Comment)
+		}
+		config.firewall.Comment = firewall.Comment
+	}
+	// ipset names are limited to 31 characters
+	if config.firewall.Backend == ufw.BACKEND_IPSET && len(config.firewall.Comment)+len("-v4") > 31 {
+		return fmt.Errorf("firewall comment '%s' too long for ipset backend", config.firewall.Comment)
+	}
+	if len(firewall.Action) > 0 {
+		if firewall.Action != ufw.ACTION_REJECT && firewall.Action != ufw.ACTION_DENY {
+			return fmt.Errorf("invalid firewall action '%s'", firewall.Action)
+		}
+		config.firewall.Action = firewall.Action
+	}
+	for _, port := range firewall.Ports {
+		if port < 1 || port > 65535 {
+			return fmt.Errorf("invalid firewall port %d", port)
+		}
+	}
+	config.firewall.Ports = firewall.Ports
+	var err error
+	if len(firewall.BanDuration) > 0 {
+		config.firewall.Delay, err = parsePositiveDuration(firewall.BanDuration, "ban duration")
+		if err != nil {
+			return err
+		}
+	}
+	if len(firewall.MaxBanDuration) > 0 {
+		config.firewall.MaxDelay, err = parsePositiveDuration(firewall.MaxBanDuration, "max ban duration")
+		if err != nil {
+			return err
+		}
+	}
+	if firewall.MaxEscalations != 0 {
+		if firewall.MaxEscalations < 1 || firewall.MaxEscalations > 30 {
+			return fmt.Errorf("invalid firewall max escalations %d", firewall.MaxEscalations)
+		}
+		config.firewall.MaxFailures = firewall.MaxEscalations
+	}
+	config.firewall.ReleaseOnShutdown = firewall.ReleaseOnShutdown
+	if len(firewall.UnknownRules) > 0 {
+		if !slices.Contains([]string{ufw.POLICY_ADOPT, ufw.POLICY_RELEASE, ufw.POLICY_ALERT}, firewall.UnknownRules) {
+			return fmt.Errorf("invalid firewall policy for unknown rules '%s'", firewall.UnknownRules)
+		}
+		config.firewall.UnknownRulePolicy = firewall.UnknownRules
+	}
+	return config.updateAggregation()
+}
+
+func (config *config_impl) updateAggregation() error {
+	aggregation := config.Firewall.Aggregation
+	config.firewall.Aggregation = ufw.Aggregation{
+		Threshold:        aggregation.Threshold,
+		Window:           time.Hour,
+		IPv4PrefixLength: 24,
+		IPv6PrefixLength: 64,
+	}
+	if len(aggregation.Window) > 0 {
+		window, err := parsePositiveDuration(aggregation.Window, "aggregation window")
+		if err != nil {
+			return err
+		}
+		config.firewall.Aggregation.Window = window
+	}
+	if aggregation.IPv4PrefixLength != 0 {
+		if aggregation.IPv4PrefixLength < 8 || aggregation.IPv4PrefixLength > 32 {
+			return fmt.Errorf("invalid aggregation IPv4 prefix length %d", aggregation.IPv4PrefixLength)
+		}
+		config.firewall.Aggregation.IPv4PrefixLength = aggregation.IPv4PrefixLength
+	}
+	if aggregation.IPv6PrefixLength != 0 {
+		if aggregation.IPv6PrefixLength < 16 || aggregation.IPv6PrefixLength > 128 {
+			return fmt.Errorf("invalid aggregation IPv6 prefix length %d", aggregation.IPv6PrefixLength)
+		}
+		config.firewall.Aggregation.IPv6PrefixLength = aggregation.IPv6PrefixLength
+	}
+	return nil
+}
+
+func parsePositiveDuration(str string, desc string) (time.Duration, error) {
+	duration, err := time.ParseDuration(str)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid %s '%s'", desc, str)
+	}
+	return duration, nil
+}
+
 func parseRule(cr configRule) ([]rule.Expression, error) {
 	if len(cr.Name) == 0 {
 		return nil, errors.New("missing 'name' in rule definition")
@@ -5,7 +5,12 @@ import (
 	"path"
 	"testing"
 	"text/template"
+	"time"
 
+	"github.com/nylssoft/goaccesslog/internal/api"
+	"github.com/nylssoft/goaccesslog/internal/parser"
+	"github.com/nylssoft/goaccesslog/internal/storage"
+	"github.com/nylssoft/goaccesslog/internal/ufw"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -95,6 +100,35 @@ func TestInit(t *testing.T) {
 	assert.True(t, config.IsVerbose())
 	assert.Equal(t, nginxfile, config.AccessLogFilename())
 	assert.Equal(t, dbfile, config.DatabaseFilename())
+	assert.Equal(t, DefaultControlSocketFilename, config.ControlSocketFilename())
+	assert.Equal(t, ufw.DefaultOptions().Comment, config.FirewallOptions().Comment)
+	assert.Equal(t, ufw.DefaultOptions().Delay, config.FirewallOptions().Delay)
+	assert.Equal(t, 0, config.FirewallOptions().Aggregation.Threshold)
+	assert.Equal(t, 24, config.FirewallOptions().Aggregation.IPv4PrefixLength)
+	assert.Equal(t, 64, config.FirewallOptions().Aggregation.IPv6PrefixLength)
+	assert.Equal(t, 0, config.AllowedIPs().Len())
+	assert.Empty(t, config.Blocklists())
+	assert.Equal(t, "", config.ApiAddress())
+	assert.Equal(t, api.Options{}, config.ApiOptions())
+	assert.False(t, config.IsFleetEnabled())
+	assert.Equal(t, "", config.ExportDirectory())
+	assert.Equal(t, 5*time.Minute, config.ExportInterval())
+	assert.False(t, config.IsRetentionEnabled())
+	assert.Equal(t, time.Hour, config.RetentionInterval())
+	assert.NotNil(t, config.FirewallOptions().Allowlist)
+	// load without log output
+	loaded := NewConfig()
+	assert.NoError(t, loaded.Load(filename))
+	assert.Equal(t, dbfile, loaded.DatabaseFilename())
+	assert.Error(t, loaded.Load("fiiledoesnotexist.json"))
+	// offline commands only require the database settings
+	createConfigFile(t, filename, logfile, dbfile, path.Join(tempDir, "missing-nginx.log"), goodRuleName, goodRuleCondition, badRuleName, badRuleCondition)
+	assert.Error(t, loaded.Load(filename))
+	loaded = NewConfig()
+	assert.NoError(t, loaded.LoadDatabase(filename))
+	assert.Equal(t, dbfile, loaded.DatabaseFilename())
+	createConfigFile(t, filename, logfile, "", nginxfile, goodRuleName, goodRuleCondition, badRuleName, badRuleCondition)
+	assert.Error(t, NewConfig().LoadDatabase(filename))
 
 	// rule with same name is reused
 	badRuleName = goodRuleName
@@ -103,7 +137,116 @@ func TestInit(t *testing.T) {
 	assert.Error(t, err)
 }
 
-func TestIsMaliciousRequest(t *testing.T) {
+func TestUpdateDatabase(t *testing.T) {
+	var cfg config_impl
+	cfg.Database.Filename = path.Join(t.TempDir(), "test.db")
+	assert.NoError(t, cfg.updateDatabase())
+	assert.Equal(t, storage.DRIVER_SQLITE, cfg.DatabaseDriver())
+	assert.Equal(t, cfg.Database.Filename, cfg.DatabaseDataSource())
+
+	cfg.Database.Driver = storage.DRIVER_POSTGRES
+	assert.Error(t, cfg.updateDatabase())
+	cfg.Database.DataSource = "postgres://goaccesslog@localhost/goaccesslog"
+	assert.NoError(t, cfg.updateDatabase())
+	assert.Equal(t, cfg.Database.DataSource, cfg.DatabaseDataSource())
+	// retention requires sqlite
+	cfg.Database.Retention.MaxRows = 1000
+	assert.Error(t, cfg.updateRetention())
+
+	cfg.Database.Driver = "mysql"
+	assert.Error(t, cfg.updateDatabase())
+}
+
+func TestUpdateRetention(t *testing.T) {
+	var cfg config_impl
+	cfg.Database.Retention.MaxAge = "2160h"
+	cfg.Database.Retention.MaxRows = 1000000
+	cfg.Database.Retention.Interval = "30m"
+	cfg.Database.Retention.ArchiveDirectory = t.TempDir()
+	assert.NoError(t, cfg.updateRetention())
+	assert.True(t, cfg.IsRetentionEnabled())
+	assert.Equal(t, 2160*time.Hour, cfg.RetentionOptions().MaxAge)
+	assert.Equal(t, int64(1000000), cfg.RetentionOptions().MaxRows)
+	assert.Equal(t, cfg.Database.Retention.ArchiveDirectory, cfg.RetentionOptions().ArchiveDirectory)
+	assert.Equal(t, 30*time.Minute, cfg.RetentionInterval())
+
+	cfg.Database.Retention.ArchiveDirectory = path.Join(t.TempDir(), "missing")
+	assert.Error(t, cfg.updateRetention())
+	cfg.Database.Retention.ArchiveDirectory = ""
+	cfg.Database.Retention.Interval = "0s"
+	assert.Error(t, cfg.updateRetention())
+	cfg.Database.Retention.Interval = ""
+	cfg.Database.Retention.MaxRows = -1
+	assert.Error(t, cfg.updateRetention())
+	cfg.Database.Retention.MaxRows = 0
+	cfg.Database.Retention.MaxAge = "invalid"
+	assert.Error(t, cfg.updateRetention())
+}
+
+func TestUpdateApi(t *testing.T) {
+	var cfg config_impl
+	assert.NoError(t, cfg.updateApi())
+	for _, address := range []string{"127.0.0.1:8080", "[::1]:8080", "localhost:8080", "unix:/run/goaccesslog-api.sock"} {
+		cfg.Api.Address = address
+		assert.NoError(t, cfg.updateApi(), address)
+	}
+	for _, address := range []string{":8080", "0.0.0.0:8080", "10.0.0.1:8080", "example.com:8080"} {
+		cfg.Api.Address = address
+		assert.Error(t, cfg.updateApi(), address)
+	}
+	cfg.Api.Token = "secret"
+	assert.NoError(t, cfg.updateApi())
+}
+
+func TestUpdateFleet(t *testing.T) {
+	var cfg config_impl
+	assert.NoError(t, cfg.updateFleet())
+	cfg.Fleet.Peers = []string{"http://10.0.0.2:8080"}
+	assert.Error(t, cfg.updateFleet())
+	cfg.Fleet.Secret = "shared"
+	assert.Error(t, cfg.updateFleet())
+	cfg.Api.Address = "10.0.0.1:8080"
+	// the fleet requires a token
+	assert.Error(t, cfg.updateFleet())
+	cfg.Api.Token = "secret"
+	cfg.Fleet.Node = "web1"
+	assert.NoError(t, cfg.updateFleet())
+	cfg.Fleet.Peers = []string{"10.0.0.2:8080"}
+	assert.Error(t, cfg.updateFleet())
+}
+
+func TestUpdateParser(t *testing.T) {
+	var cfg config_impl
+	assert.NoError(t, cfg.updateParser())
+	assert.Equal(t, parser.DEFAULT_FORMAT, cfg.logFormat())
+	cfg.Nginx.LogFormat = `$remote_addr [$time_local] "$request" $status "$http_referer" $host`
+	assert.NoError(t, cfg.updateParser())
+	logLine, err := cfg.LogParser().Parse(`1.1.1.1 [01/Jun/2025:18:24:22 +0200] "GET / HTTP/1.1" 200 "https://example.com/" example.com`)
+	assert.NoError(t, err)
+	assert.Equal(t, "https://example.com/", logLine.Referer)
+	assert.Equal(t, "example.com", logLine.Host)
+	cfg.Nginx.LogFormat = `$remote_addr "$request" $status`
+	assert.Error(t, cfg.updateParser())
+}
+
+func TestUpdateTrustedProxies(t *testing.T) {
+	var cfg config_impl
+	assert.NoError(t, cfg.updateTrustedProxies())
+	assert.Equal(t, 0, cfg.TrustedProxies().Len())
+	cfg.Nginx.TrustedProxies = []string{"10.0.0.0/8", "2001:db8::1"}
+	assert.NoError(t, cfg.updateTrustedProxies())
+	assert.True(t, cfg.TrustedProxies().Contains("10.1.2.3"))
+	assert.False(t, cfg.TrustedProxies().Contains("1.1.1.1"))
+	// rules evaluate the client IP address
+	cfg.Rules.Bad = []configRule{{Name: "bad", Condition: "eq(ip,'1.1.1.1')"}}
+	require.NoError(t, cfg.updateExpressions())
+	assert.True(t, cfg.MatchRules(parser.LogLine{RemoteAddr: "10.0.0.1", ClientAddr: "1.1.1.1"}).IsMalicious())
+	assert.False(t, cfg.MatchRules(parser.LogLine{RemoteAddr: "1.1.1.1", ClientAddr: "2.2.2.2"}).IsMalicious())
+	cfg.Nginx.TrustedProxies = []string{"invalid"}
+	assert.Error(t, cfg.updateTrustedProxies())
+}
+
+func TestMatchRules(t *testing.T) {
 	// prepare valid config
 	tempDir := t.TempDir()
 	filename := path.Join(tempDir, "config.json")
@@ -121,12 +264,26 @@ func TestIsMaliciousRequest(t *testing.T) {
 	err = config.Init(filename)
 	require.NoError(t, err)
 
-	ret := config.IsMaliciousRequest("127.0.0.1", "GET", "index.html", 200)
-	assert.False(t, ret)
-	ret = config.IsMaliciousRequest("127.0.0.1", "GET", "\\x00", 400)
-	assert.False(t, ret)
-	ret = config.IsMaliciousRequest("8.8.8.8", "GET", "\\x00", 400)
-	assert.True(t, ret)
+	match := config.MatchRules(parser.LogLine{RemoteAddr: "127.0.0.1", RequestProtocol: "GET", RequestUri: "index.html", Status: 200})
+	assert.Empty(t, match.BadRules)
+	assert.False(t, match.IsMalicious())
+	match = config.MatchRules(parser.LogLine{RemoteAddr: "127.0.0.1", RequestProtocol: "GET", RequestUri: "\\x00", Status: 400})
+	assert.Equal(t, RuleMatch{BadRules: []string{badRuleName}, GoodRule: goodRuleName}, match)
+	assert.False(t, match.IsMalicious())
+	match = config.MatchRules(parser.LogLine{RemoteAddr: "8.8.8.8", RequestProtocol: "GET", RequestUri: "\\x00", Status: 400})
+	assert.Equal(t, RuleMatch{BadRules: []string{badRuleName}}, match)
+	assert.True(t, match.IsMalicious())
+	// IPv4-mapped IPv6 addresses are evaluated as IPv4 addresses
+	match = config.MatchRules(parser.LogLine{RemoteAddr: "::ffff:127.0.0.1", RequestProtocol: "GET", RequestUri: "\\x00", Status: 400})
+	assert.Equal(t, goodRuleName, match.GoodRule)
+	assert.False(t, match.IsMalicious())
+
+	// extended properties
+	cfg := config.(*config_impl)
+	cfg.Rules.Bad = append(cfg.Rules.Bad, configRule{Name: "slow-upstream", Condition: "ge(upstream_time,5000) and eq(host,'example.com')"})
+	require.NoError(t, cfg.updateExpressions())
+	match = config.MatchRules(parser.LogLine{RemoteAddr: "8.8.8.8", RequestUri: "\\x00", Host: "example.com", UpstreamResponseTime: 5000})
+	assert.Equal(t, []string{badRuleName, "slow-upstream"}, match.BadRules)
 }
 
 func createConfigFile(t *testing.T, configFilename, logFilename, databaseFilename, accessLogfilename, goodRuleName, goodRuleCondition, badRuleName, badRuleCondition string) {
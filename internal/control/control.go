@@ -0,0 +1,49 @@
+package control
+
+import (
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+)
+
+// Provides a local control socket for a running goaccesslog process.
+//
+// The server accepts one JSON request per connection and answers with one JSON response.
+// All requests are applied using the firewall object of the running process,
+// therefore manual bans are known to the process and expire like detected bans.
+//
+// Use NewServer to create a new control server.
+type Server interface {
+	// Starts listening on the unix socket and serves requests in the background.
+	Start() error
+	// Stops listening and removes the unix socket file.
+	Stop()
+}
+
+// Provides access to the control socket of a running goaccesslog process.
+//
+// Use NewClient to create a new control client.
+type Client interface {
+	// Rejects the specified IP address for the specified duration.
+	// If the duration is zero the default expiration of the firewall object is used, a negative duration is rejected.
+	Ban(ip string, duration time.Duration) error
+	// Releases the specified IP address.
+	Unban(ip string) error
+	// Returns all rejected IP addresses.
+	ListBans() ([]ufw.Ban, error)
+}
+
+// Creates a new control server listening on the specified unix socket.
+func NewServer(filename string, ufw ufw.Ufw) Server {
+	var server server_impl
+	server.filename = filename
+	server.ufw = ufw
+	return &server
+}
+
+// Creates a new control client connecting to the specified unix socket.
+func NewClient(filename string) Client {
+	var client client_impl
+	client.filename = filename
+	return &client
+}
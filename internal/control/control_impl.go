@@ -0,0 +1,176 @@
+package control
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/ipaddr"
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+)
+
+const (
+	CMD_BAN       = "ban"
+	CMD_UNBAN     = "unban"
+	CMD_LIST_BANS = "list-bans"
+)
+
+const timeout = 10 * time.Second
+
+type request struct {
+	Command  string `json:"command"`
+	IP       string `json:"ip,omitempty"`
+	Duration string `json:"duration,omitempty"`
+}
+
+type response struct {
+	Error string    `json:"error,omitempty"`
+	Bans  []ufw.Ban `json:"bans,omitempty"`
+}
+
+type server_impl struct {
+	filename string
+	listener net.Listener
+	// dependencies
+	ufw ufw.Ufw
+}
+
+type client_impl struct {
+	filename string
+}
+
+func (server *server_impl) Start() error {
+	// remove stale socket file if the process did not terminate appropriately
+	os.Remove(server.filename)
+	listener, err := net.Listen("unix", server.filename)
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(server.filename, 0660)
+	if err != nil {
+		listener.Close()
+		return err
+	}
+	server.listener = listener
+	go server.serve(listener)
+	return nil
+}
+
+func (server *server_impl) Stop() {
+	if server.listener != nil {
+		server.listener.Close()
+		server.listener = nil
+	}
+}
+
+func (server *server_impl) serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				log.Println("ERROR: Failed to accept control connection.", err)
+			}
+			return
+		}
+		go server.handle(conn)
+	}
+}
+
+func (server *server_impl) handle(conn net.Conn) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	var req request
+	var res response
+	err := json.NewDecoder(conn).Decode(&req)
+	if err == nil {
+		res, err = server.execute(req)
+	}
+	if err != nil {
+		res.Error = err.Error()
+	}
+	err = json.NewEncoder(conn).Encode(res)
+	if err != nil {
+		log.Println("ERROR: Failed to write control response.", err)
+	}
+}
+
+func (server *server_impl) execute(req request) (response, error) {
+	var res response
+	switch req.Command {
+	case CMD_BAN:
+		ip, err := ipaddr.Parse(req.IP)
+		if err != nil {
+			return res, err
+		}
+		var duration time.Duration
+		if len(req.Duration) > 0 {
+			duration, err = time.ParseDuration(req.Duration)
+			if err != nil || duration < 0 {
+				return res, fmt.Errorf("invalid duration '%s'", req.Duration)
+			}
+		}
+		log.Printf("Manual ban for IP %s requested.\n", ip)
+		if !server.ufw.RejectFor(ip, duration, "manual ban") {
+			return res, fmt.Errorf("failed to reject IP %s", ip)
+		}
+	case CMD_UNBAN:
+		ip, err := ipaddr.Parse(req.IP)
+		if err != nil {
+			return res, err
+		}
+		log.Printf("Manual unban for IP %s requested.\n", ip)
+		if !slices.ContainsFunc(server.ufw.Bans(), func(ban ufw.Ban) bool { return ban.IP == ip }) {
+			return res, fmt.Errorf("IP %s is not rejected", ip)
+		}
+		if !server.ufw.Release(ip) {
+			return res, fmt.Errorf("failed to release IP %s", ip)
+		}
+	case CMD_LIST_BANS:
+		res.Bans = server.ufw.Bans()
+	default:
+		return res, fmt.Errorf("unknown command '%s'", req.Command)
+	}
+	return res, nil
+}
+
+func (client *client_impl) Ban(ip string, duration time.Duration) error {
+	req := request{Command: CMD_BAN, IP: ip}
+	if duration != 0 {
+		req.Duration = duration.String()
+	}
+	_, err := client.send(req)
+	return err
+}
+
+func (client *client_impl) Unban(ip string) error {
+	_, err := client.send(request{Command: CMD_UNBAN, IP: ip})
+	return err
+}
+
+func (client *client_impl) ListBans() ([]ufw.Ban, error) {
+	res, err := client.send(request{Command: CMD_LIST_BANS})
+	return res.Bans, err
+}
+
+func (client *client_impl) send(req request) (response, error) {
+	var res response
+	conn, err := net.DialTimeout("unix", client.filename, timeout)
+	if err != nil {
+		return res, fmt.Errorf("cannot connect to goaccesslog control socket '%s': %s", client.filename, err.Error())
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	err = json.NewEncoder(conn).Encode(req)
+	if err == nil {
+		err = json.NewDecoder(conn).Decode(&res)
+	}
+	if err == nil && len(res.Error) > 0 {
+		err = errors.New(res.Error)
+	}
+	return res, err
+}
@@ -0,0 +1,84 @@
+package control
+
+import (
+	"path"
+	"testing"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockExecutor struct {
+	ret string
+	err error
+}
+
+func (e *mockExecutor) Exec(cmdName string, args ...string) ([]byte, error) {
+	return []byte(e.ret), e.err
+}
+
+func (e *mockExecutor) ExecInput(input []byte, cmdName string, args ...string) ([]byte, error) {
+	return []byte(e.ret), e.err
+}
+
+func TestControl(t *testing.T) {
+	filename := path.Join(t.TempDir(), "test.sock")
+	e := mockExecutor{}
+	options := ufw.DefaultOptions()
+	options.Comment = "unittest"
+	options.Delay = time.Hour
+	options.MaxFailures = 10
+	ufw := ufw.NewUfw(&e, nil, options)
+
+	// process is not running
+	client := NewClient(filename)
+	assert.NotNil(t, client)
+	_, err := client.ListBans()
+	assert.Error(t, err)
+
+	server := NewServer(filename, ufw)
+	assert.NotNil(t, server)
+	err = server.Start()
+	require.NoError(t, err)
+	defer server.Stop()
+
+	bans, err := client.ListBans()
+	assert.NoError(t, err)
+	assert.Empty(t, bans)
+
+	// ban with default and with explicit duration
+	err = client.Ban("1.1.1.1", 0)
+	assert.NoError(t, err)
+	err = client.Ban("2.2.2.2", 24*time.Hour)
+	assert.NoError(t, err)
+	assert.True(t, ufw.IsRejected("1.1.1.1"))
+	assert.True(t, ufw.IsRejected("2.2.2.2"))
+
+	bans, err = client.ListBans()
+	assert.NoError(t, err)
+	require.Len(t, bans, 2)
+	assert.Equal(t, "1.1.1.1", bans[0].IP)
+	assert.Equal(t, "2.2.2.2", bans[1].IP)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), bans[1].To, time.Minute)
+
+	// invalid requests
+	assert.Error(t, client.Ban("invalid", 0))
+	assert.ErrorContains(t, client.Ban("4.4.4.4", -time.Hour), "invalid duration '-1h0m0s'")
+	assert.False(t, ufw.IsRejected("4.4.4.4"))
+	assert.Error(t, client.Unban("3.3.3.3"))
+
+	err = client.Unban("1.1.1.1")
+	assert.NoError(t, err)
+	assert.False(t, ufw.IsRejected("1.1.1.1"))
+	bans, err = client.ListBans()
+	assert.NoError(t, err)
+	assert.Len(t, bans, 1)
+
+	// networks are banned and released as a unit
+	assert.NoError(t, client.Ban("3.3.3.0/24", time.Hour))
+	assert.True(t, ufw.IsRejected("3.3.3.3"))
+	assert.NoError(t, client.Unban("3.3.3.0/24"))
+	assert.False(t, ufw.IsRejected("3.3.3.3"))
+}
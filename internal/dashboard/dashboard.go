@@ -0,0 +1,22 @@
+package dashboard
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+)
+
+// Static files of the dashboard, embedded into the program.
+//
+//go:embed static
+var static embed.FS
+
+// Returns a handler that serves the static files of the web dashboard, e.g. /index.html.
+//
+// The dashboard is a single page that reads the statistics, top lists and bans from the HTTP API
+// of the running process and releases bans on request. It does not load any external resources.
+// The token of the HTTP API is entered on the page and kept in the local storage of the browser.
+func Handler() http.Handler {
+	files, _ := fs.Sub(static, "static")
+	return http.FileServerFS(files)
+}
@@ -0,0 +1,30 @@
+package dashboard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler(t *testing.T) {
+	handler := Handler()
+	get := func(target string) *httptest.ResponseRecorder {
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, httptest.NewRequest(http.MethodGet, target, nil))
+		return res
+	}
+	res := get("/")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Header().Get("Content-Type"), "text/html")
+	assert.Contains(t, res.Body.String(), `<script src="dashboard.js"`)
+	res = get("/dashboard.js")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Body.String(), "/api/stats/hourly")
+	assert.Contains(t, res.Body.String(), "health.manualBans")
+	res = get("/dashboard.css")
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Contains(t, res.Header().Get("Content-Type"), "text/css")
+	assert.Equal(t, http.StatusNotFound, get("/missing.js").Code)
+}
@@ -0,0 +1,268 @@
+"use strict";
+
+const REFRESH_INTERVAL = 60 * 1000;
+const TOKEN_KEY = "goaccesslog-token";
+const DAYS_KEY = "goaccesslog-days";
+const SVG_NS = "http://www.w3.org/2000/svg";
+const STATUS_CLASSES = ["2xx", "3xx", "4xx", "5xx"];
+const COLORS = { "2xx": "#3fa34d", "3xx": "#3b82c4", "4xx": "#e0a526", "5xx": "#d64545" };
+
+let timer;
+// Whether the endpoints for manual bans and unbans are available.
+let manualBans = false;
+
+function token() {
+    return document.getElementById("token").value.trim();
+}
+
+function days() {
+    return document.getElementById("days").value;
+}
+
+async function request(method, path) {
+    const headers = {};
+    if (token().length > 0) {
+        headers["Authorization"] = "Bearer " + token();
+    }
+    const res = await fetch(path, { method: method, headers: headers });
+    if (!res.ok) {
+        throw new Error(method + " " + path + ": " + res.status + " " + (await res.text()).trim());
+    }
+    return res.status === 204 ? null : res.json();
+}
+
+// Returns the list of the endpoint, empty lists may be encoded as null.
+async function get(path) {
+    return (await request("GET", path)) || [];
+}
+
+function setStatus(message) {
+    document.getElementById("status").textContent = message;
+}
+
+function setText(id, text) {
+    document.getElementById(id).textContent = text;
+}
+
+function formatNumber(value) {
+    return Number(value).toLocaleString();
+}
+
+function formatBytes(value) {
+    const units = ["B", "KB", "MB", "GB", "TB"];
+    let idx = 0;
+    while (value >= 1024 && idx < units.length - 1) {
+        value /= 1024;
+        idx++;
+    }
+    return value.toFixed(idx === 0 ? 0 : 1) + " " + units[idx];
+}
+
+function formatPercent(value, total) {
+    return total > 0 ? (100 * value / total).toFixed(1) + " %" : "-";
+}
+
+function formatTime(str) {
+    return new Date(str).toLocaleString();
+}
+
+function statusClass(status) {
+    return Math.floor(status / 100) + "xx";
+}
+
+// Replaces the rows of the table body, each row is an array of cell values.
+// A cell value can be a DOM node, other values are displayed as text.
+function fillTable(id, rows, numericColumns) {
+    const tbody = document.querySelector("#" + id + " tbody");
+    tbody.replaceChildren();
+    for (const row of rows) {
+        const tr = document.createElement("tr");
+        row.forEach((value, idx) => {
+            const td = document.createElement("td");
+            if (value instanceof Node) {
+                td.appendChild(value);
+            } else {
+                td.textContent = value;
+                td.title = value;
+            }
+            if (numericColumns.includes(idx)) {
+                td.className = "num";
+            }
+            tr.appendChild(td);
+        });
+        tbody.appendChild(tr);
+    }
+}
+
+function svgElement(name, attributes) {
+    const elem = document.createElementNS(SVG_NS, name);
+    for (const [key, value] of Object.entries(attributes)) {
+        elem.setAttribute(key, value);
+    }
+    return elem;
+}
+
+// Groups the hourly statistics by hour, returns a sorted array of {hour, requests, bytesSent, 2xx, 3xx, 4xx, 5xx}.
+function groupByHour(stats) {
+    const hours = new Map();
+    for (const stat of stats) {
+        let entry = hours.get(stat.hour);
+        if (!entry) {
+            entry = { hour: new Date(stat.hour), requests: 0, bytesSent: 0, "2xx": 0, "3xx": 0, "4xx": 0, "5xx": 0 };
+            hours.set(stat.hour, entry);
+        }
+        entry.requests += stat.requests;
+        entry.bytesSent += stat.bytesSent;
+        const cls = statusClass(stat.status);
+        if (cls in entry) {
+            entry[cls] += stat.requests;
+        }
+    }
+    return Array.from(hours.values()).sort((a, b) => a.hour - b.hour);
+}
+
+// Creates an empty chart with a vertical axis from 0 to max and labels for the first and last hour.
+function createChart(id, hours, max, formatMax) {
+    const width = 1000;
+    const height = 220;
+    const svg = svgElement("svg", { viewBox: "0 0 " + width + " " + height, preserveAspectRatio: "none" });
+    const chart = { svg: svg, left: 50, top: 10, width: width - 60, height: height - 40 };
+    svg.appendChild(svgElement("line", { class: "axis", x1: chart.left, y1: chart.top + chart.height, x2: chart.left + chart.width, y2: chart.top + chart.height }));
+    svg.appendChild(svgElement("line", { class: "axis", x1: chart.left, y1: chart.top, x2: chart.left + chart.width, y2: chart.top }));
+    const maxLabel = svgElement("text", { x: chart.left - 6, y: chart.top + 4, "text-anchor": "end" });
+    maxLabel.textContent = formatMax(max);
+    svg.appendChild(maxLabel);
+    if (hours.length > 0) {
+        const first = svgElement("text", { x: chart.left, y: height - 10 });
+        first.textContent = hours[0].hour.toLocaleString();
+        const last = svgElement("text", { x: chart.left + chart.width, y: height - 10, "text-anchor": "end" });
+        last.textContent = hours[hours.length - 1].hour.toLocaleString();
+        svg.append(first, last);
+    }
+    document.getElementById(id).replaceChildren(svg);
+    return chart;
+}
+
+function renderRequestsChart(hours) {
+    const max = Math.max(1, ...hours.map(entry => entry.requests));
+    const chart = createChart("requestsChart", hours, max, formatNumber);
+    const barWidth = chart.width / Math.max(1, hours.length);
+    hours.forEach((entry, idx) => {
+        let y = chart.top + chart.height;
+        for (const cls of STATUS_CLASSES) {
+            if (entry[cls] === 0) {
+                continue;
+            }
+            const barHeight = chart.height * entry[cls] / max;
+            y -= barHeight;
+            const rect = svgElement("rect", {
+                x: chart.left + idx * barWidth, y: y, width: Math.max(1, barWidth - 1), height: barHeight, fill: COLORS[cls]
+            });
+            const title = svgElement("title", {});
+            title.textContent = entry.hour.toLocaleString() + ": " + formatNumber(entry[cls]) + " " + cls;
+            rect.appendChild(title);
+            chart.svg.appendChild(rect);
+        }
+    });
+}
+
+function renderRatesChart(hours) {
+    const rate = (entry, cls) => entry.requests > 0 ? 100 * entry[cls] / entry.requests : 0;
+    const max = Math.max(1, ...hours.map(entry => Math.max(rate(entry, "4xx"), rate(entry, "5xx"))));
+    const chart = createChart("ratesChart", hours, max, value => value.toFixed(0) + " %");
+    const step = chart.width / Math.max(1, hours.length - 1);
+    for (const cls of ["4xx", "5xx"]) {
+        const points = hours.map((entry, idx) =>
+            (chart.left + idx * step).toFixed(1) + "," + (chart.top + chart.height * (1 - rate(entry, cls) / max)).toFixed(1));
+        chart.svg.appendChild(svgElement("polyline", {
+            points: points.join(" "), fill: "none", stroke: COLORS[cls], "stroke-width": 2, "vector-effect": "non-scaling-stroke"
+        }));
+    }
+}
+
+function renderSummary(hours) {
+    const total = key => hours.reduce((sum, entry) => sum + entry[key], 0);
+    const requests = total("requests");
+    setText("requests", formatNumber(requests));
+    setText("bytes", formatBytes(total("bytesSent")));
+    setText("rate4xx", formatPercent(total("4xx"), requests));
+    setText("rate5xx", formatPercent(total("5xx"), requests));
+}
+
+function renderBans(bans) {
+    setText("activeBans", formatNumber(bans.length));
+    fillTable("bans", bans.map(ban => {
+        let action = "";
+        if (manualBans) {
+            action = document.createElement("button");
+            action.textContent = "Unban";
+            action.addEventListener("click", () => unban(ban.ip));
+        }
+        return [ban.ip, ban.rule, formatNumber(ban.hits), formatTime(ban.lastSeen), formatTime(ban.expires), action];
+    }), [2]);
+}
+
+async function unban(ip) {
+    if (!confirm("Release the ban of IP " + ip + "?")) {
+        return;
+    }
+    try {
+        await request("DELETE", "/api/bans/" + encodeURIComponent(ip));
+        renderBans(await get("/api/bans"));
+        setStatus("");
+    } catch (err) {
+        setStatus(err.message);
+    }
+}
+
+async function refresh() {
+    const range = "?days=" + encodeURIComponent(days());
+    try {
+        const [health, hourly, uris, ips, userAgents, ruleHits, bans] = await Promise.all([
+            request("GET", "/api/health"),
+            get("/api/stats/hourly" + range),
+            get("/api/top-uris" + range),
+            get("/api/top-ips" + range),
+            get("/api/top-user-agents" + range),
+            get("/api/rule-hits" + range),
+            get("/api/bans"),
+        ]);
+        manualBans = health.manualBans;
+        const hours = groupByHour(hourly);
+        renderSummary(hours);
+        renderRequestsChart(hours);
+        renderRatesChart(hours);
+        fillTable("topUris", uris.map(entry => [entry.value, formatNumber(entry.requests)]), [1]);
+        fillTable("topIps", ips.map(entry => [entry.ip, formatNumber(entry.requests)]), [1]);
+        fillTable("topUserAgents", userAgents.map(entry => [entry.value, formatNumber(entry.requests)]), [1]);
+        fillTable("ruleHits", ruleHits.map(entry => [entry.badRule, formatNumber(entry.hits), formatNumber(entry.overridden)]), [1, 2]);
+        renderBans(bans);
+        setStatus("");
+    } catch (err) {
+        setStatus(err.message);
+    }
+}
+
+function schedule() {
+    clearInterval(timer);
+    timer = setInterval(refresh, REFRESH_INTERVAL);
+    refresh();
+}
+
+function init() {
+    const tokenInput = document.getElementById("token");
+    const daysSelect = document.getElementById("days");
+    tokenInput.value = localStorage.getItem(TOKEN_KEY) || "";
+    daysSelect.value = localStorage.getItem(DAYS_KEY) || "1";
+    tokenInput.addEventListener("change", () => {
+        localStorage.setItem(TOKEN_KEY, token());
+        schedule();
+    });
+    daysSelect.addEventListener("change", () => {
+        localStorage.setItem(DAYS_KEY, days());
+        schedule();
+    });
+    schedule();
+}
+
+document.addEventListener("DOMContentLoaded", init);
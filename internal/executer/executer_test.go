@@ -12,3 +12,10 @@ func TestExec(t *testing.T) {
 	assert.NotNil(t, ret)
 	assert.Nil(t, err)
 }
+
+func TestExecInput(t *testing.T) {
+	executer := NewExecuter()
+	ret, err := executer.ExecInput([]byte("hello"), "cat")
+	assert.Equal(t, "hello", string(ret))
+	assert.Nil(t, err)
+}
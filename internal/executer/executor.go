@@ -2,6 +2,8 @@ package executer
 
 type Executer interface {
 	Exec(cmdName string, args ...string) ([]byte, error)
+	// Executes the command and writes the input to its standard input.
+	ExecInput(input []byte, cmdName string, args ...string) ([]byte, error)
 }
 
 func NewExecuter() Executer {
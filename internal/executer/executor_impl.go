@@ -1,6 +1,7 @@
 package executer
 
 import (
+	"bytes"
 	"os/exec"
 )
 
@@ -9,3 +10,9 @@ type executor_impl struct{}
 func (e *executor_impl) Exec(cmdName string, args ...string) ([]byte, error) {
 	return exec.Command(cmdName, args...).CombinedOutput()
 }
+
+func (e *executor_impl) ExecInput(input []byte, cmdName string, args ...string) ([]byte, error) {
+	cmd := exec.Command(cmdName, args...)
+	cmd.Stdin = bytes.NewReader(input)
+	return cmd.CombinedOutput()
+}
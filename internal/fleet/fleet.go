@@ -0,0 +1,48 @@
+package fleet
+
+import (
+	"net/http"
+
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+)
+
+// Shares bans between several goaccesslog instances.
+//
+// New bans of this process are sent as signed ban events to all peers using
+// HTTP POST requests to <peer>/api/fleet/events. Ban events received from peers are applied
+// using the firewall object of this process with the sending node recorded as source.
+// Received bans are not sent again, so ban events do not loop between peers.
+//
+// Each event is signed with HMAC-SHA256 using the shared secret. The signature is sent in the
+// X-Goaccesslog-Signature header. Events with an invalid signature or an outdated timestamp are rejected.
+// Each event has a random ID, events that are received more than once are ignored.
+// A received ban only extends an active ban of this process, it does not escalate the ban duration.
+//
+// Use NewFleet to create a new fleet object.
+type Fleet interface {
+	ufw.Notifier
+	// Starts sending ban events in the background, received bans are applied using the firewall object.
+	Start(ufw ufw.Ufw)
+	// Stops sending ban events. Pending ban events are discarded.
+	Stop()
+	// Returns the HTTP handler that receives ban events from peers.
+	Handler() http.Handler
+}
+
+// Describes the fleet parameters.
+type Options struct {
+	// Name of this node, sent as source of the ban events.
+	Node string
+	// Shared secret used to sign and verify ban events.
+	Secret string
+	// Base URLs of the HTTP API of the peers, e.g. http://10.0.0.2:8080.
+	Peers []string
+}
+
+// Creates a new fleet object with the specified options.
+func NewFleet(options Options) Fleet {
+	var fleet fleet_impl
+	fleet.options = options
+	fleet.client = &http.Client{Timeout: timeout}
+	return &fleet
+}
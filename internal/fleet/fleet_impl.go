@@ -0,0 +1,228 @@
+package fleet
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+)
+
+const SIGNATURE_HEADER = "X-Goaccesslog-Signature"
+
+const EVENTS_PATH = "/api/fleet/events"
+
+const timeout = 5 * time.Second
+
+// maximum age of a received ban event, also the tolerated clock skew between nodes
+const maxEventAge = 5 * time.Minute
+
+// maximum number of pending ban events, further events are discarded
+const maxPending = 1000
+
+const maxBodySize = 64 * 1024
+
+// Ban event sent to the peers.
+type event struct {
+	// Random identifier of the event, events received more than once are ignored.
+	ID       string    `json:"id"`
+	Node     string    `json:"node"`
+	IP       string    `json:"ip"`
+	Duration string    `json:"duration"`
+	Rule     string    `json:"rule"`
+	Time     time.Time `json:"time"`
+}
+
+type fleet_impl struct {
+	mutex   sync.Mutex
+	options Options
+	client  *http.Client
+	events  chan event
+	stop    chan bool
+	done    chan bool
+	// receive time of the event IDs within the maximum event age, used to detect replayed events
+	received map[string]time.Time
+	// dependencies
+	ufw ufw.Ufw
+}
+
+func (fleet *fleet_impl) Banned(ban ufw.Ban) {
+	fleet.mutex.Lock()
+	defer fleet.mutex.Unlock()
+	if fleet.events == nil || len(fleet.options.Peers) == 0 {
+		return
+	}
+	e := event{ID: rand.Text(), Node: fleet.options.Node, IP: ban.IP, Duration: ban.To.Sub(ban.From).String(), Rule: ban.Rule, Time: time.Now().UTC()}
+	select {
+	case fleet.events <- e:
+	default:
+		log.Println("ERROR: Too many pending ban events. Ban event for IP", ban.IP, "discarded.")
+	}
+}
+
+func (fleet *fleet_impl) Start(ufw ufw.Ufw) {
+	fleet.mutex.Lock()
+	defer fleet.mutex.Unlock()
+	if fleet.events != nil {
+		return
+	}
+	fleet.ufw = ufw
+	fleet.events = make(chan event, maxPending)
+	fleet.stop = make(chan bool)
+	fleet.done = make(chan bool)
+	go fleet.sender(fleet.events)
+}
+
+func (fleet *fleet_impl) Stop() {
+	fleet.mutex.Lock()
+	if fleet.events == nil {
+		fleet.mutex.Unlock()
+		return
+	}
+	fleet.events = nil
+	close(fleet.stop)
+	fleet.mutex.Unlock()
+	<-fleet.done
+}
+
+func (fleet *fleet_impl) Handler() http.Handler {
+	return http.HandlerFunc(fleet.handleEvent)
+}
+
+// Sends the ban events to all peers until the fleet is stopped.
+func (fleet *fleet_impl) sender(events chan event) {
+	defer close(fleet.done)
+	for {
+		select {
+		case <-fleet.stop:
+			return
+		case e := <-events:
+			body, err := json.Marshal(e)
+			if err != nil {
+				log.Println("ERROR: Failed to encode ban event.", err)
+				continue
+			}
+			for _, peer := range fleet.options.Peers {
+				err = fleet.send(peer, body)
+				if err != nil {
+					log.Println("ERROR: Failed to send ban event for IP", e.IP, "to peer", peer, ".", err)
+				}
+			}
+		}
+	}
+}
+
+func (fleet *fleet_impl) send(peer string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(peer, "/")+EVENTS_PATH, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(SIGNATURE_HEADER, sign(fleet.options.Secret, body))
+	res, err := fleet.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return fmt.Errorf("status %d %s", res.StatusCode, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (fleet *fleet_impl) handleEvent(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxBodySize))
+	if err != nil {
+		http.Error(w, "cannot read ban event", http.StatusBadRequest)
+		return
+	}
+	if !hmac.Equal([]byte(sign(fleet.options.Secret, body)), []byte(r.Header.Get(SIGNATURE_HEADER))) {
+		log.Println("WARNING: Received ban event with invalid signature from", r.RemoteAddr, ".")
+		http.Error(w, "invalid signature", http.StatusUnauthorized)
+		return
+	}
+	e, err := parseEvent(body, time.Now())
+	if err != nil {
+		log.Println("WARNING: Received invalid ban event from", r.RemoteAddr, ".", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if e.Node == fleet.options.Node {
+		// the event has been sent by this node
+		return
+	}
+	duration, _ := time.ParseDuration(e.Duration)
+	fleet.mutex.Lock()
+	firewall := fleet.ufw
+	replayed := firewall != nil && fleet.isReplayed(e.ID, time.Now())
+	fleet.mutex.Unlock()
+	if firewall == nil {
+		http.Error(w, "fleet not started", http.StatusServiceUnavailable)
+		return
+	}
+	if replayed {
+		log.Printf("WARNING: Ignore ban event %s for IP %s from node %s received more than once.\n", e.ID, e.IP, e.Node)
+		return
+	}
+	log.Printf("Received ban event for IP %s from node %s.\n", e.IP, e.Node)
+	if !firewall.RejectFrom(e.IP, duration, e.Rule, e.Node) && !firewall.IsRejected(e.IP) {
+		http.Error(w, fmt.Sprintf("failed to reject IP %s", e.IP), http.StatusConflict)
+	}
+}
+
+// Returns whether the event ID has already been received and remembers the event ID otherwise.
+// Event IDs are kept as long as the events are accepted, older events are rejected by their timestamp.
+// The caller must hold the mutex.
+func (fleet *fleet_impl) isReplayed(id string, now time.Time) bool {
+	if fleet.received == nil {
+		fleet.received = map[string]time.Time{}
+	}
+	for other, received := range fleet.received {
+		if now.Sub(received) > 2*maxEventAge {
+			delete(fleet.received, other)
+		}
+	}
+	if _, found := fleet.received[id]; found {
+		return true
+	}
+	fleet.received[id] = now
+	return false
+}
+
+// Parses and validates a ban event received at the specified time.
+func parseEvent(body []byte, now time.Time) (event, error) {
+	var e event
+	err := json.Unmarshal(body, &e)
+	if err != nil {
+		return e, fmt.Errorf("cannot parse ban event: %s", err.Error())
+	}
+	if len(e.ID) == 0 || len(e.Node) == 0 || len(e.IP) == 0 {
+		return e, fmt.Errorf("missing ID, node or IP in ban event")
+	}
+	duration, err := time.ParseDuration(e.Duration)
+	if err != nil || duration <= 0 {
+		return e, fmt.Errorf("invalid duration '%s' in ban event", e.Duration)
+	}
+	if e.Time.Before(now.Add(-maxEventAge)) || e.Time.After(now.Add(maxEventAge)) {
+		return e, fmt.Errorf("outdated ban event from %s", e.Time)
+	}
+	return e, nil
+}
+
+// Returns the hex encoded HMAC-SHA256 signature of the body.
+func sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
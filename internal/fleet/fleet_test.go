@@ -0,0 +1,126 @@
+package fleet
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockExecutor struct{}
+
+func (e *mockExecutor) Exec(cmdName string, args ...string) ([]byte, error) {
+	return []byte{}, nil
+}
+
+func (e *mockExecutor) ExecInput(input []byte, cmdName string, args ...string) ([]byte, error) {
+	return []byte{}, nil
+}
+
+type node struct {
+	fleet  Fleet
+	ufw    ufw.Ufw
+	server *httptest.Server
+}
+
+func newNode(name string) *node {
+	var n node
+	n.fleet = NewFleet(Options{Node: name, Secret: "secret"})
+	options := ufw.DefaultOptions()
+	options.Notifier = n.fleet
+	n.ufw = ufw.NewUfw(&mockExecutor{}, nil, options)
+	n.ufw.Init()
+	n.server = httptest.NewServer(n.fleet.Handler())
+	return &n
+}
+
+func TestFleet(t *testing.T) {
+	// three nodes on localhost, each node knows all other nodes
+	nodes := []*node{newNode("web1"), newNode("web2"), newNode("web3")}
+	for _, n := range nodes {
+		defer n.server.Close()
+		for _, other := range nodes {
+			if other != n {
+				n.fleet.(*fleet_impl).options.Peers = append(n.fleet.(*fleet_impl).options.Peers, other.server.URL)
+			}
+		}
+		n.fleet.Start(n.ufw)
+		defer n.fleet.Stop()
+	}
+
+	require.True(t, nodes[0].ufw.RejectFor("1.1.1.1", 2*time.Hour, "status-444"))
+	for _, n := range nodes[1:] {
+		assert.Eventually(t, func() bool { return n.ufw.IsRejected("1.1.1.1") }, 5*time.Second, 10*time.Millisecond)
+		bans := n.ufw.Bans()
+		require.Len(t, bans, 1)
+		assert.Equal(t, "web1", bans[0].Source)
+		assert.Equal(t, "status-444", bans[0].Rule)
+		assert.Equal(t, 2*time.Hour, bans[0].To.Sub(bans[0].From).Round(time.Second))
+	}
+	// received bans are not sent again
+	time.Sleep(100 * time.Millisecond)
+	bans := nodes[0].ufw.Bans()
+	require.Len(t, bans, 1)
+	assert.Equal(t, "", bans[0].Source)
+	assert.Equal(t, 1, bans[0].Hits)
+}
+
+func TestHandleEvent(t *testing.T) {
+	fleet := NewFleet(Options{Node: "web1", Secret: "secret"})
+	firewall := ufw.NewUfw(&mockExecutor{}, nil, ufw.DefaultOptions())
+	firewall.Init()
+	handler := fleet.Handler()
+	post := func(body string, signature string) int {
+		req := httptest.NewRequest(http.MethodPost, EVENTS_PATH, bytes.NewBufferString(body))
+		req.Header.Set(SIGNATURE_HEADER, signature)
+		res := httptest.NewRecorder()
+		handler.ServeHTTP(res, req)
+		return res.Code
+	}
+	body := `{"id":"e1","node":"web2","ip":"2.2.2.2","duration":"1h","rule":"manual ban","time":"` + time.Now().UTC().Format(time.RFC3339) + `"}`
+	// fleet not started
+	assert.Equal(t, http.StatusServiceUnavailable, post(body, sign("secret", []byte(body))))
+	fleet.Start(firewall)
+	defer fleet.Stop()
+	assert.Equal(t, http.StatusUnauthorized, post(body, sign("other", []byte(body))))
+	assert.Equal(t, http.StatusUnauthorized, post(body, ""))
+	assert.False(t, firewall.IsRejected("2.2.2.2"))
+	assert.Equal(t, http.StatusOK, post(body, sign("secret", []byte(body))))
+	assert.True(t, firewall.IsRejected("2.2.2.2"))
+	// replayed events are ignored
+	bans := firewall.Bans()
+	require.Len(t, bans, 1)
+	assert.Equal(t, http.StatusOK, post(body, sign("secret", []byte(body))))
+	assert.Equal(t, bans, firewall.Bans())
+	// own events are ignored
+	body = `{"id":"e2","node":"web1","ip":"3.3.3.3","duration":"1h","rule":"manual ban","time":"` + time.Now().UTC().Format(time.RFC3339) + `"}`
+	assert.Equal(t, http.StatusOK, post(body, sign("secret", []byte(body))))
+	assert.False(t, firewall.IsRejected("3.3.3.3"))
+	// outdated event
+	body = `{"id":"e3","node":"web2","ip":"3.3.3.3","duration":"1h","rule":"manual ban","time":"2020-01-01T00:00:00Z"}`
+	assert.Equal(t, http.StatusBadRequest, post(body, sign("secret", []byte(body))))
+	// invalid IP
+	body = `{"id":"e4","node":"web2","ip":"invalid","duration":"1h","rule":"manual ban","time":"` + time.Now().UTC().Format(time.RFC3339) + `"}`
+	assert.Equal(t, http.StatusConflict, post(body, sign("secret", []byte(body))))
+}
+
+func TestParseEvent(t *testing.T) {
+	now := time.Now()
+	_, err := parseEvent([]byte(`invalid`), now)
+	assert.Error(t, err)
+	_, err = parseEvent([]byte(`{"id":"e1","node":"web2","duration":"1h"}`), now)
+	assert.Error(t, err)
+	_, err = parseEvent([]byte(`{"id":"e1","node":"web2","ip":"1.1.1.1","duration":"-1h","time":"`+now.Format(time.RFC3339)+`"}`), now)
+	assert.Error(t, err)
+	_, err = parseEvent([]byte(`{"id":"e1","node":"web2","ip":"1.1.1.1","duration":"1h","time":"`+now.Add(time.Hour).Format(time.RFC3339)+`"}`), now)
+	assert.Error(t, err)
+	e, err := parseEvent([]byte(`{"id":"e1","node":"web2","ip":"1.1.1.1","duration":"1h","rule":"status-444","time":"`+now.Format(time.RFC3339)+`"}`), now)
+	assert.NoError(t, err)
+	assert.Equal(t, "web2", e.Node)
+	assert.Equal(t, "status-444", e.Rule)
+}
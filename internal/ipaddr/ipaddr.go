@@ -0,0 +1,128 @@
+package ipaddr
+
+import (
+	"fmt"
+	"net/netip"
+	"strings"
+)
+
+// Returns the canonical representation of the specified IP address or network in CIDR notation.
+//
+// IPv6 addresses are compressed and lower case, IPv4-mapped IPv6 addresses are converted
+// into IPv4 addresses, zones are removed and networks are masked, e.g.
+// 2001:0DB8::0001 becomes 2001:db8::1 and 1.2.3.4/24 becomes 1.2.3.0/24.
+// Networks with a single IP address are converted into the IP address, e.g. 1.2.3.4/32 becomes 1.2.3.4.
+// If the string is neither an IP address nor a network it is returned unchanged.
+func Canonical(ip string) string {
+	ret, err := Parse(ip)
+	if err != nil {
+		return ip
+	}
+	return ret
+}
+
+// Parses an IP address or a network in CIDR notation and returns its canonical representation.
+func Parse(ip string) (string, error) {
+	if strings.Contains(ip, "/") {
+		prefix, err := ParsePrefix(ip)
+		if err != nil {
+			return ip, err
+		}
+		if prefix.IsSingleIP() {
+			return prefix.Addr().String(), nil
+		}
+		return prefix.String(), nil
+	}
+	addr, err := ParseAddr(ip)
+	if err != nil {
+		return ip, err
+	}
+	return addr.String(), nil
+}
+
+// Parses an IP address and returns its canonical form.
+func ParseAddr(ip string) (netip.Addr, error) {
+	addr, err := netip.ParseAddr(strings.TrimSpace(ip))
+	if err != nil {
+		return addr, fmt.Errorf("invalid IP address '%s'", ip)
+	}
+	return addr.Unmap().WithZone(""), nil
+}
+
+// Parses a network in CIDR notation and returns its canonical form.
+func ParsePrefix(ip string) (netip.Prefix, error) {
+	prefix, err := netip.ParsePrefix(strings.TrimSpace(ip))
+	if err != nil {
+		return prefix, fmt.Errorf("invalid network '%s'", ip)
+	}
+	addr := prefix.Addr()
+	bits := prefix.Bits()
+	if addr.Is4In6() {
+		if bits < 96 {
+			return prefix.Masked(), nil
+		}
+		addr = addr.Unmap()
+		bits -= 96
+	}
+	return netip.PrefixFrom(addr, bits).Masked(), nil
+}
+
+// Returns whether the specified string is a network in CIDR notation.
+func IsPrefix(ip string) bool {
+	_, err := ParsePrefix(ip)
+	return err == nil
+}
+
+// Returns whether the specified IP address or network is contained in the specified network.
+func Contains(prefix netip.Prefix, ip string) bool {
+	if IsPrefix(ip) {
+		other, _ := ParsePrefix(ip)
+		return other.Bits() >= prefix.Bits() && prefix.Contains(other.Addr())
+	}
+	addr, err := ParseAddr(ip)
+	return err == nil && prefix.Contains(addr)
+}
+
+// Returns the IP address of the client of a request received from the specified remote address.
+//
+// If the remote address is trusted, the hops of the X-Forwarded-For header followed by the
+// PROXY protocol address are examined from right to left and the first untrusted hop is the client.
+// A hop that is not a valid IP address may be forged, in this case the last trusted hop is the client.
+// If all hops are trusted the leftmost hop is the client.
+// Returns the canonical remote address if it is not trusted.
+func ClientAddr(remoteAddr string, forwardedFor string, proxyProtocolAddr string, isTrusted func(ip string) bool) string {
+	client := Canonical(remoteAddr)
+	if !isTrusted(client) {
+		return client
+	}
+	var hops []string
+	for _, hop := range strings.Split(forwardedFor, ",") {
+		hop = strings.TrimSpace(hop)
+		if len(hop) > 0 {
+			hops = append(hops, hop)
+		}
+	}
+	if len(proxyProtocolAddr) > 0 {
+		hops = append(hops, proxyProtocolAddr)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, err := parseHop(hops[i])
+		if err != nil {
+			break
+		}
+		client = addr.String()
+		if !isTrusted(client) {
+			break
+		}
+	}
+	return client
+}
+
+// Parses an IP address with an optional port, e.g. 1.2.3.4:8080 or [2001:db8::1]:8080.
+func parseHop(hop string) (netip.Addr, error) {
+	addrPort, err := netip.ParseAddrPort(hop)
+	if err == nil {
+		return addrPort.Addr().Unmap().WithZone(""), nil
+	}
+	return ParseAddr(hop)
+}
@@ -0,0 +1,77 @@
+package ipaddr
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCanonical(t *testing.T) {
+	assert.Equal(t, "1.2.3.4", Canonical("1.2.3.4"))
+	assert.Equal(t, "1.2.3.4", Canonical(" 1.2.3.4 "))
+	assert.Equal(t, "1.2.3.4", Canonical("::ffff:1.2.3.4"))
+	assert.Equal(t, "2001:db8::1", Canonical("2001:0db8::1"))
+	assert.Equal(t, "2001:db8::1", Canonical("2001:DB8:0:0:0:0:0:1"))
+	assert.Equal(t, "fe80::1", Canonical("fe80::1%eth0"))
+	assert.Equal(t, "1.2.3.0/24", Canonical("1.2.3.4/24"))
+	assert.Equal(t, "1.2.3.0/24", Canonical("::ffff:1.2.3.4/120"))
+	assert.Equal(t, "2001:db8::/64", Canonical("2001:0db8:0:0:1234::1/64"))
+	assert.Equal(t, "1.2.3.4", Canonical("1.2.3.4/32"))
+	assert.Equal(t, "1.2.3.4", Canonical("::ffff:1.2.3.4/128"))
+	assert.Equal(t, "2001:db8::1", Canonical("2001:0DB8::1/128"))
+	assert.Equal(t, "invalid", Canonical("invalid"))
+	assert.Equal(t, "", Canonical(""))
+}
+
+func TestParse(t *testing.T) {
+	ip, err := Parse("2001:0db8::0001")
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", ip)
+	ip, err = Parse("1.2.3.4/32")
+	assert.NoError(t, err)
+	assert.Equal(t, "1.2.3.4", ip)
+	ip, err = Parse("2001:db8::1/128")
+	assert.NoError(t, err)
+	assert.Equal(t, "2001:db8::1", ip)
+	_, err = Parse("1.2.3")
+	assert.Error(t, err)
+	_, err = Parse("1.2.3.4/33")
+	assert.Error(t, err)
+	assert.True(t, IsPrefix("1.2.3.0/24"))
+	assert.False(t, IsPrefix("1.2.3.0"))
+}
+
+func TestContains(t *testing.T) {
+	prefix := netip.MustParsePrefix("2001:db8::/64")
+	assert.True(t, Contains(prefix, "2001:0db8::1"))
+	assert.True(t, Contains(prefix, "2001:db8::/96"))
+	assert.False(t, Contains(prefix, "2001:db8::/48"))
+	assert.False(t, Contains(prefix, "2001:db8:1::1"))
+	assert.False(t, Contains(prefix, "invalid"))
+	prefix = netip.MustParsePrefix("1.2.3.0/24")
+	assert.True(t, Contains(prefix, "::ffff:1.2.3.4"))
+}
+
+func TestClientAddr(t *testing.T) {
+	trusted := func(ip string) bool {
+		return Contains(netip.MustParsePrefix("10.0.0.0/8"), ip) || ip == "192.168.1.1"
+	}
+	// remote address is not trusted, forwarded addresses are ignored
+	assert.Equal(t, "1.1.1.1", ClientAddr("1.1.1.1", "2.2.2.2", "3.3.3.3", trusted))
+	assert.Equal(t, "2001:db8::1", ClientAddr("2001:0db8::1", "", "", trusted))
+	// rightmost untrusted hop
+	assert.Equal(t, "2.2.2.2", ClientAddr("10.0.0.1", "3.3.3.3, 2.2.2.2", "", trusted))
+	assert.Equal(t, "2.2.2.2", ClientAddr("10.0.0.1", "3.3.3.3, 2.2.2.2, 10.0.0.2", "", trusted))
+	assert.Equal(t, "2.2.2.2", ClientAddr("10.0.0.1", "3.3.3.3", "2.2.2.2", trusted))
+	assert.Equal(t, "3.3.3.3", ClientAddr("10.0.0.1", "3.3.3.3", "192.168.1.1", trusted))
+	assert.Equal(t, "2.2.2.2", ClientAddr("10.0.0.1", "2.2.2.2:1234", "", trusted))
+	assert.Equal(t, "2001:db8::1", ClientAddr("10.0.0.1", "[2001:DB8::1]:1234", "", trusted))
+	assert.Equal(t, "2.2.2.2", ClientAddr("10.0.0.1", "::ffff:2.2.2.2", "", trusted))
+	// last trusted hop if a hop is invalid
+	assert.Equal(t, "10.0.0.2", ClientAddr("10.0.0.1", "unknown, 10.0.0.2", "", trusted))
+	assert.Equal(t, "10.0.0.1", ClientAddr("10.0.0.1", "2.2.2.2, invalid", "", trusted))
+	// leftmost hop if all hops are trusted
+	assert.Equal(t, "10.0.0.3", ClientAddr("10.0.0.1", "10.0.0.3, 10.0.0.2", "", trusted))
+	assert.Equal(t, "10.0.0.1", ClientAddr("10.0.0.1", "", "", trusted))
+}
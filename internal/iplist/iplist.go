@@ -0,0 +1,47 @@
+package iplist
+
+// Provides a list of IP addresses and networks.
+//
+// The list contains the entries of the configuration and optionally the entries of a file.
+// The file contains one IP address or network in CIDR notation per line.
+// Empty lines and text after # or ; are ignored, so FireHOL and Spamhaus DROP lists can be used.
+// Lines of the Spamhaus DROP JSON format are supported, the network is read from the cidr field.
+// The file is read again if Reload is called, e.g. if the file has been modified.
+//
+// The list can be used concurrently.
+//
+// Use NewIPList to create a new list.
+type IPList interface {
+	// Returns whether the specified IP address is in the list.
+	// A network is in the list if it overlaps with an entry of the list.
+	Contains(ip string) bool
+	// Returns the file name of the list or an empty string if the list has no file.
+	Filename() string
+	// Reads the file again. The previous entries of the file are kept if the file cannot be read.
+	Reload() error
+	// Returns the number of entries.
+	Len() int
+	// Returns the canonical IP addresses and networks of all entries.
+	Entries() []string
+}
+
+// Creates a new list with the specified IP addresses and networks and the entries of the specified file.
+// The file name is optional. Returns an error if an entry is invalid or the file cannot be read.
+func NewIPList(entries []string, filename string) (IPList, error) {
+	var list iplist_impl
+	list.filename = filename
+	for _, entry := range entries {
+		prefix, err := parseEntry(entry)
+		if err != nil {
+			return nil, err
+		}
+		list.prefixes = append(list.prefixes, prefix)
+	}
+	if len(filename) > 0 {
+		err := list.Reload()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &list, nil
+}
@@ -0,0 +1,129 @@
+package iplist
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/nylssoft/goaccesslog/internal/ipaddr"
+)
+
+// Line of the Spamhaus DROP JSON format.
+type dropEntry struct {
+	Cidr string `json:"cidr"`
+}
+
+type iplist_impl struct {
+	mutex    sync.Mutex
+	filename string
+	// entries of the configuration
+	prefixes []netip.Prefix
+	// entries of the file
+	filePrefixes []netip.Prefix
+}
+
+func (list *iplist_impl) Contains(ip string) bool {
+	other, err := parseEntry(ip)
+	if err != nil {
+		return false
+	}
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	for _, prefixes := range [][]netip.Prefix{list.prefixes, list.filePrefixes} {
+		for _, prefix := range prefixes {
+			if prefix.Overlaps(other) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (list *iplist_impl) Filename() string {
+	return list.filename
+}
+
+func (list *iplist_impl) Reload() error {
+	if len(list.filename) == 0 {
+		return nil
+	}
+	data, err := os.ReadFile(list.filename)
+	if err != nil {
+		return err
+	}
+	prefixes, err := parseFile(string(data))
+	if err != nil {
+		return fmt.Errorf("%s: %s", list.filename, err.Error())
+	}
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	list.filePrefixes = prefixes
+	return nil
+}
+
+func (list *iplist_impl) Len() int {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	return len(list.prefixes) + len(list.filePrefixes)
+}
+
+func (list *iplist_impl) Entries() []string {
+	list.mutex.Lock()
+	defer list.mutex.Unlock()
+	entries := make([]string, 0, len(list.prefixes)+len(list.filePrefixes))
+	for _, prefixes := range [][]netip.Prefix{list.prefixes, list.filePrefixes} {
+		for _, prefix := range prefixes {
+			if prefix.IsSingleIP() {
+				entries = append(entries, prefix.Addr().String())
+			} else {
+				entries = append(entries, prefix.String())
+			}
+		}
+	}
+	return entries
+}
+
+// Parses one IP address or network in CIDR notation per line.
+func parseFile(data string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for idx, line := range strings.Split(data, "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "{") {
+			var drop dropEntry
+			err := json.Unmarshal([]byte(line), &drop)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", idx+1, err.Error())
+			}
+			// the last line contains metadata only
+			line = drop.Cidr
+		}
+		line, _, _ = strings.Cut(line, "#")
+		line, _, _ = strings.Cut(line, ";")
+		line = strings.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		prefix, err := parseEntry(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", idx+1, err.Error())
+		}
+		prefixes = append(prefixes, prefix)
+	}
+	return prefixes, nil
+}
+
+// Returns the network of an IP address or a network in CIDR notation.
+// An IP address is returned as network with a single address.
+func parseEntry(entry string) (netip.Prefix, error) {
+	if strings.Contains(entry, "/") {
+		return ipaddr.ParsePrefix(entry)
+	}
+	addr, err := ipaddr.ParseAddr(entry)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
@@ -0,0 +1,90 @@
+package iplist
+
+import (
+	"os"
+	"path"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPList(t *testing.T) {
+	list, err := NewIPList([]string{"127.0.0.1", "10.0.0.0/8", "2001:db8::/64"}, "")
+	require.NoError(t, err)
+	assert.Equal(t, 3, list.Len())
+	assert.Equal(t, "", list.Filename())
+	assert.NoError(t, list.Reload())
+	assert.True(t, list.Contains("127.0.0.1"))
+	assert.True(t, list.Contains("::ffff:127.0.0.1"))
+	assert.True(t, list.Contains("10.1.2.3"))
+	assert.True(t, list.Contains("2001:0db8::1"))
+	assert.False(t, list.Contains("127.0.0.2"))
+	assert.False(t, list.Contains("2001:db8:1::1"))
+	assert.False(t, list.Contains("invalid"))
+	// networks overlapping with an entry
+	assert.True(t, list.Contains("127.0.0.0/24"))
+	assert.True(t, list.Contains("10.1.0.0/16"))
+	assert.False(t, list.Contains("11.0.0.0/8"))
+
+	assert.Equal(t, []string{"127.0.0.1", "10.0.0.0/8", "2001:db8::/64"}, list.Entries())
+
+	_, err = NewIPList([]string{"invalid"}, "")
+	assert.Error(t, err)
+	_, err = NewIPList(nil, "filedoesnotexist.txt")
+	assert.Error(t, err)
+}
+
+func TestReload(t *testing.T) {
+	filename := path.Join(t.TempDir(), "allowlist.txt")
+	err := os.WriteFile(filename, []byte("# office\n1.2.3.4 # gateway\n\n  5.6.7.0/24\r\n"), 0666)
+	require.NoError(t, err)
+	list, err := NewIPList([]string{"127.0.0.1"}, filename)
+	require.NoError(t, err)
+	assert.Equal(t, filename, list.Filename())
+	assert.Equal(t, 3, list.Len())
+	assert.True(t, list.Contains("1.2.3.4"))
+	assert.True(t, list.Contains("5.6.7.8"))
+
+	err = os.WriteFile(filename, []byte("2001:db8::1\n"), 0666)
+	require.NoError(t, err)
+	assert.NoError(t, list.Reload())
+	assert.False(t, list.Contains("1.2.3.4"))
+	assert.True(t, list.Contains("2001:db8::1"))
+	assert.True(t, list.Contains("127.0.0.1"))
+
+	// previous entries are kept if the file is invalid
+	err = os.WriteFile(filename, []byte("1.2.3.4\ninvalid\n"), 0666)
+	require.NoError(t, err)
+	assert.Error(t, list.Reload())
+	assert.False(t, list.Contains("1.2.3.4"))
+	assert.True(t, list.Contains("2001:db8::1"))
+}
+
+func TestFormats(t *testing.T) {
+	tempDir := t.TempDir()
+	// FireHOL netset
+	filename := path.Join(tempDir, "firehol_level1.netset")
+	err := os.WriteFile(filename, []byte("#\n# firehol_level1\n#\n0.0.0.0/8\n1.10.16.0/20\n223.254.0.0/16\n"), 0666)
+	require.NoError(t, err)
+	list, err := NewIPList(nil, filename)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0.0.0.0/8", "1.10.16.0/20", "223.254.0.0/16"}, list.Entries())
+	// Spamhaus DROP
+	filename = path.Join(tempDir, "drop.txt")
+	err = os.WriteFile(filename, []byte("; Spamhaus DROP List 2024/01/01\n; Last-Modified: Mon, 01 Jan 2024\n1.10.16.0/20 ; SBL256894\n2001:db8::/32 ; SBL123\n"), 0666)
+	require.NoError(t, err)
+	list, err = NewIPList(nil, filename)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.10.16.0/20", "2001:db8::/32"}, list.Entries())
+	// Spamhaus DROP JSON
+	filename = path.Join(tempDir, "drop_v4.json")
+	err = os.WriteFile(filename, []byte(`{"cidr":"1.10.16.0/20","sblid":"SBL256894","rir":"apnic"}
+{"cidr":"1.19.0.0/16","sblid":"SBL434604","rir":"apnic"}
+{"type":"metadata","timestamp":1704067200,"size":2,"records":2,"copyright":"(c) 2024 The Spamhaus Project SLU"}
+`), 0666)
+	require.NoError(t, err)
+	list, err = NewIPList(nil, filename)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1.10.16.0/20", "1.19.0.0/16"}, list.Entries())
+}
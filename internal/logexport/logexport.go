@@ -0,0 +1,51 @@
+package logexport
+
+import (
+	"github.com/nylssoft/goaccesslog/internal/storage"
+)
+
+const (
+	// Comma separated values with header line, times in RFC 3339 UTC format.
+	FORMAT_CSV = "csv"
+	// One JSON object per line (JSON Lines).
+	FORMAT_NDJSON = "ndjson"
+	// Apache Parquet with one row group per 100000 log lines.
+	FORMAT_PARQUET = "parquet"
+)
+
+// All supported export formats.
+var Formats = []string{FORMAT_CSV, FORMAT_NDJSON, FORMAT_PARQUET}
+
+// Writes stored log lines into files, e.g. for data analysis without access to the database.
+//
+// The log lines are streamed from the storage, so large time ranges can be exported.
+// Each file is written into a temporary file first and renamed if the export succeeds.
+//
+// Use NewExporter to create a new exporter.
+type Exporter interface {
+	// Writes the log lines matching the filter into the output directory.
+	// Returns the names of the written files. If the export fails, no file is written.
+	Export(filter storage.LogFilter) ([]string, error)
+}
+
+// Describes the exported files.
+type Options struct {
+	// Format of the files, see FORMAT constants.
+	Format string
+	// Output directory.
+	Directory string
+	// Whether one file is written per UTC day, named accesslog-YYYY-MM-DD.<format>.
+	// Otherwise all log lines are written into the file accesslog.<format>.
+	SplitByDay bool
+	// Whether the files are compressed with gzip. CSV and JSON Lines files get the suffix .gz,
+	// Parquet files use the gzip codec of the format instead of snappy.
+	Gzip bool
+}
+
+// Creates a new exporter for the log lines of the specified storage.
+func NewExporter(storage storage.Storage, options Options) Exporter {
+	var exporter exporter_impl
+	exporter.storage = storage
+	exporter.options = options
+	return &exporter
+}
@@ -0,0 +1,288 @@
+package logexport
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/parser"
+	"github.com/nylssoft/goaccesslog/internal/storage"
+	"github.com/parquet-go/parquet-go"
+)
+
+const parquet_row_group_size = 100000
+
+var csvHeader = []string{"remote_addr", "time_local", "request_method", "request_uri", "request_protocol", "request_length", "request_time", "status", "bytes_sent", "user_agent",
+	"referer", "host", "x_forwarded_for", "upstream_addr", "upstream_response_time", "tls_protocol", "proxy_protocol_addr", "client_addr"}
+
+type exporter_impl struct {
+	storage storage.Storage
+	options Options
+}
+
+// Writes log lines in an export format.
+type rowWriter interface {
+	write(logLine parser.LogLine) error
+	// Flushes the written log lines, does not close the underlying writer.
+	close() error
+}
+
+// Exported file, written into a temporary file that is renamed on success.
+type output struct {
+	name     string
+	filename string
+	file     *os.File
+	buffer   *bufio.Writer
+	gz       *gzip.Writer
+	writer   rowWriter
+}
+
+type parquetRow struct {
+	RemoteAddr      string    `parquet:"remote_addr"`
+	TimeLocal       time.Time `parquet:"time_local,timestamp(millisecond)"`
+	RequestMethod   string    `parquet:"request_method"`
+	RequestUri      string    `parquet:"request_uri"`
+	RequestProtocol string    `parquet:"request_protocol"`
+	RequestLength   int64     `parquet:"request_length"`
+	RequestTime     int64     `parquet:"request_time"`
+	Status          int32     `parquet:"status"`
+	BytesSent       int64     `parquet:"bytes_sent"`
+	UserAgent       string    `parquet:"user_agent"`
+	// extended fields are optional
+	Referer              string `parquet:"referer,optional"`
+	Host                 string `parquet:"host,optional"`
+	XForwardedFor        string `parquet:"x_forwarded_for,optional"`
+	UpstreamAddr         string `parquet:"upstream_addr,optional"`
+	UpstreamResponseTime int64  `parquet:"upstream_response_time,optional"`
+	TlsProtocol          string `parquet:"tls_protocol,optional"`
+	ProxyProtocolAddr    string `parquet:"proxy_protocol_addr,optional"`
+	ClientAddr           string `parquet:"client_addr,optional"`
+}
+
+type csvRowWriter struct {
+	writer *csv.Writer
+}
+
+type ndjsonRowWriter struct {
+	encoder *json.Encoder
+}
+
+type parquetRowWriter struct {
+	writer *parquet.GenericWriter[parquetRow]
+	rows   int
+}
+
+func (exporter *exporter_impl) Export(filter storage.LogFilter) ([]string, error) {
+	if !slices.Contains(Formats, exporter.options.Format) {
+		return nil, fmt.Errorf("unsupported export format '%s'", exporter.options.Format)
+	}
+	// log lines are read in time order, so only the output of the current day is open
+	var current *output
+	var filenames []string
+	finish := func() error {
+		out := current
+		current = nil
+		err := out.close()
+		if err == nil {
+			err = os.Rename(out.file.Name(), out.filename)
+		}
+		if err != nil {
+			os.Remove(out.file.Name())
+			return err
+		}
+		filenames = append(filenames, out.filename)
+		return nil
+	}
+	getOutput := func(name string) (*output, error) {
+		if current != nil && current.name == name {
+			return current, nil
+		}
+		if current != nil {
+			if err := finish(); err != nil {
+				return nil, err
+			}
+		}
+		filename := exporter.filename(name)
+		if slices.Contains(filenames, filename) {
+			return nil, fmt.Errorf("log lines of '%s' are not in time order", filename)
+		}
+		out, err := exporter.create(name)
+		if err != nil {
+			return nil, err
+		}
+		current = out
+		return out, nil
+	}
+	var err error
+	if !exporter.options.SplitByDay {
+		// the file is written even if no log line matches
+		_, err = getOutput("accesslog")
+	}
+	if err == nil {
+		err = exporter.storage.ReadLogLines(filter, func(logLine parser.LogLine) error {
+			name := "accesslog"
+			if exporter.options.SplitByDay {
+				name += "-" + logLine.TimeLocal.UTC().Format(time.DateOnly)
+			}
+			out, err := getOutput(name)
+			if err == nil {
+				err = out.writer.write(logLine)
+			}
+			return err
+		})
+	}
+	if current != nil {
+		if err == nil {
+			err = finish()
+		} else {
+			current.close()
+			os.Remove(current.file.Name())
+		}
+	}
+	if err != nil {
+		// the export is complete or not written at all
+		for _, filename := range filenames {
+			os.Remove(filename)
+		}
+		return nil, err
+	}
+	slices.Sort(filenames)
+	return filenames, nil
+}
+
+// Creates the temporary file for the export file with the specified name without extension.
+func (exporter *exporter_impl) create(name string) (*output, error) {
+	filename := exporter.filename(name)
+	compress := exporter.options.Gzip && exporter.options.Format != FORMAT_PARQUET
+	file, err := os.CreateTemp(exporter.options.Directory, "."+name+"-*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	var out output
+	out.name = name
+	out.filename = filename
+	out.file = file
+	out.buffer = bufio.NewWriter(file)
+	var writer io.Writer = out.buffer
+	if compress {
+		out.gz = gzip.NewWriter(out.buffer)
+		writer = out.gz
+	}
+	switch exporter.options.Format {
+	case FORMAT_CSV:
+		out.writer, err = newCsvRowWriter(writer)
+	case FORMAT_NDJSON:
+		out.writer = &ndjsonRowWriter{encoder: json.NewEncoder(writer)}
+	case FORMAT_PARQUET:
+		codec := parquet.Compression(&parquet.Snappy)
+		if exporter.options.Gzip {
+			codec = parquet.Compression(&parquet.Gzip)
+		}
+		out.writer = &parquetRowWriter{writer: parquet.NewGenericWriter[parquetRow](writer, codec)}
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(file.Name())
+		return nil, err
+	}
+	return &out, nil
+}
+
+// Returns the export file name for the specified name without extension.
+func (exporter *exporter_impl) filename(name string) string {
+	filename := filepath.Join(exporter.options.Directory, name+"."+exporter.options.Format)
+	if exporter.options.Gzip && exporter.options.Format != FORMAT_PARQUET {
+		filename += ".gz"
+	}
+	return filename
+}
+
+// Flushes all writers and closes the temporary file.
+func (out *output) close() error {
+	err := out.writer.close()
+	if out.gz != nil {
+		gzErr := out.gz.Close()
+		if err == nil {
+			err = gzErr
+		}
+	}
+	bufferErr := out.buffer.Flush()
+	if err == nil {
+		err = bufferErr
+	}
+	fileErr := out.file.Close()
+	if err == nil {
+		err = fileErr
+	}
+	return err
+}
+
+func newCsvRowWriter(w io.Writer) (*csvRowWriter, error) {
+	writer := csv.NewWriter(w)
+	err := writer.Write(csvHeader)
+	return &csvRowWriter{writer: writer}, err
+}
+
+func (w *csvRowWriter) write(logLine parser.LogLine) error {
+	return w.writer.Write([]string{logLine.RemoteAddr, logLine.TimeLocal.UTC().Format(time.RFC3339), logLine.RequestMethod, logLine.RequestUri,
+		logLine.RequestProtocol, strconv.Itoa(logLine.RequestLength), strconv.Itoa(logLine.RequestTime), strconv.Itoa(logLine.Status),
+		strconv.Itoa(logLine.BytesSent), logLine.UserAgent, logLine.Referer, logLine.Host, logLine.XForwardedFor, logLine.UpstreamAddr,
+		strconv.Itoa(logLine.UpstreamResponseTime), logLine.TlsProtocol, logLine.ProxyProtocolAddr, logLine.ClientAddr})
+}
+
+func (w *csvRowWriter) close() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+func (w *ndjsonRowWriter) write(logLine parser.LogLine) error {
+	return w.encoder.Encode(logLine)
+}
+
+func (w *ndjsonRowWriter) close() error {
+	return nil
+}
+
+func (w *parquetRowWriter) write(logLine parser.LogLine) error {
+	_, err := w.writer.Write([]parquetRow{{
+		RemoteAddr:           logLine.RemoteAddr,
+		TimeLocal:            logLine.TimeLocal,
+		RequestMethod:        logLine.RequestMethod,
+		RequestUri:           logLine.RequestUri,
+		RequestProtocol:      logLine.RequestProtocol,
+		RequestLength:        int64(logLine.RequestLength),
+		RequestTime:          int64(logLine.RequestTime),
+		Status:               int32(logLine.Status),
+		BytesSent:            int64(logLine.BytesSent),
+		UserAgent:            logLine.UserAgent,
+		Referer:              logLine.Referer,
+		Host:                 logLine.Host,
+		XForwardedFor:        logLine.XForwardedFor,
+		UpstreamAddr:         logLine.UpstreamAddr,
+		UpstreamResponseTime: int64(logLine.UpstreamResponseTime),
+		TlsProtocol:          logLine.TlsProtocol,
+		ProxyProtocolAddr:    logLine.ProxyProtocolAddr,
+		ClientAddr:           logLine.ClientAddr,
+	}})
+	if err != nil {
+		return err
+	}
+	// row groups are kept in memory until they are flushed
+	w.rows++
+	if w.rows%parquet_row_group_size == 0 {
+		err = w.writer.Flush()
+	}
+	return err
+}
+
+func (w *parquetRowWriter) close() error {
+	return w.writer.Close()
+}
@@ -0,0 +1,157 @@
+package logexport
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/parser"
+	"github.com/nylssoft/goaccesslog/internal/storage"
+	"github.com/parquet-go/parquet-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var start = time.Date(2025, 6, 1, 23, 30, 0, 0, time.UTC)
+
+func createStorage(t *testing.T) storage.Storage {
+	store := storage.NewStorage(storage.DRIVER_SQLITE, path.Join(t.TempDir(), "test.db"))
+	t.Cleanup(store.Close)
+	logLines := []parser.LogLine{
+		{RemoteAddr: "1.1.1.1", TimeLocal: start, RequestMethod: "GET", RequestUri: "/", RequestProtocol: "HTTP/1.1", RequestLength: 73, Status: 200, BytesSent: 612, UserAgent: "curl/7.81.0"},
+		{RemoteAddr: "2.2.2.2", TimeLocal: start.Add(time.Hour), RequestMethod: "POST", RequestUri: "/login", Status: 404, UserAgent: "Mozilla/5.0 (X11; Linux x86_64)",
+			Host: "example.com", UpstreamAddr: "127.0.0.1:8080", UpstreamResponseTime: 15, XForwardedFor: "3.3.3.3", ClientAddr: "3.3.3.3"},
+		{RemoteAddr: "1.1.1.1", TimeLocal: start.Add(2 * time.Hour), RequestMethod: "GET", RequestUri: "/admin", Status: 404},
+	}
+	batch, err := store.Begin()
+	require.NoError(t, err)
+	for i, logLine := range logLines {
+		_, err = batch.Insert(logLine, string(rune('a'+i)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, batch.Commit())
+	return store
+}
+
+func TestExportCsv(t *testing.T) {
+	dir := t.TempDir()
+	exporter := NewExporter(createStorage(t), Options{Format: FORMAT_CSV, Directory: dir})
+	filenames, err := exporter.Export(storage.LogFilter{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{path.Join(dir, "accesslog.csv")}, filenames)
+	file, err := os.Open(filenames[0])
+	require.NoError(t, err)
+	defer file.Close()
+	records, err := csv.NewReader(file).ReadAll()
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	assert.Equal(t, csvHeader, records[0])
+	assert.Equal(t, []string{"1.1.1.1", "2025-06-01T23:30:00Z", "GET", "/", "HTTP/1.1", "73", "0", "200", "612", "curl/7.81.0", "", "", "", "", "0", "", "", ""}, records[1])
+	assert.Equal(t, "Mozilla/5.0 (X11; Linux x86_64)", records[2][9])
+	assert.Equal(t, []string{"example.com", "3.3.3.3", "127.0.0.1:8080", "15"}, records[2][11:15])
+	assert.Equal(t, "3.3.3.3", records[2][17])
+
+	// file with header is written if no log line matches
+	filenames, err = exporter.Export(storage.LogFilter{RemoteAddr: "4.4.4.4"})
+	require.NoError(t, err)
+	require.Len(t, filenames, 1)
+	data, err := os.ReadFile(filenames[0])
+	require.NoError(t, err)
+	assert.Equal(t, "remote_addr,time_local,request_method,request_uri,request_protocol,request_length,request_time,status,bytes_sent,user_agent,"+
+		"referer,host,x_forwarded_for,upstream_addr,upstream_response_time,tls_protocol,proxy_protocol_addr,client_addr\n", string(data))
+}
+
+func TestExportNdjsonSplitByDay(t *testing.T) {
+	dir := t.TempDir()
+	exporter := NewExporter(createStorage(t), Options{Format: FORMAT_NDJSON, Directory: dir, SplitByDay: true, Gzip: true})
+	filenames, err := exporter.Export(storage.LogFilter{RemoteAddr: "1.1.1.1"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{path.Join(dir, "accesslog-2025-06-01.ndjson.gz"), path.Join(dir, "accesslog-2025-06-02.ndjson.gz")}, filenames)
+	readLines := func(filename string) []parser.LogLine {
+		file, err := os.Open(filename)
+		require.NoError(t, err)
+		defer file.Close()
+		gz, err := gzip.NewReader(file)
+		require.NoError(t, err)
+		var logLines []parser.LogLine
+		scanner := bufio.NewScanner(gz)
+		for scanner.Scan() {
+			var logLine parser.LogLine
+			require.NoError(t, json.Unmarshal(scanner.Bytes(), &logLine))
+			logLines = append(logLines, logLine)
+		}
+		require.NoError(t, scanner.Err())
+		return logLines
+	}
+	logLines := readLines(filenames[0])
+	require.Len(t, logLines, 1)
+	assert.Equal(t, "/", logLines[0].RequestUri)
+	assert.True(t, start.Equal(logLines[0].TimeLocal))
+	logLines = readLines(filenames[1])
+	require.Len(t, logLines, 1)
+	assert.Equal(t, "/admin", logLines[0].RequestUri)
+
+	// no file is written if no log line matches
+	filenames, err = exporter.Export(storage.LogFilter{From: start.Add(24 * time.Hour)})
+	require.NoError(t, err)
+	assert.Empty(t, filenames)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
+
+func TestExportParquet(t *testing.T) {
+	for _, compress := range []bool{false, true} {
+		dir := t.TempDir()
+		exporter := NewExporter(createStorage(t), Options{Format: FORMAT_PARQUET, Directory: dir, Gzip: compress})
+		filenames, err := exporter.Export(storage.LogFilter{Status: 404})
+		require.NoError(t, err)
+		assert.Equal(t, []string{path.Join(dir, "accesslog.parquet")}, filenames)
+		rows, err := parquet.ReadFile[parquetRow](filenames[0])
+		require.NoError(t, err)
+		require.Len(t, rows, 2)
+		assert.Equal(t, "2.2.2.2", rows[0].RemoteAddr)
+		assert.Equal(t, "/login", rows[0].RequestUri)
+		assert.Equal(t, "example.com", rows[0].Host)
+		assert.Equal(t, int64(15), rows[0].UpstreamResponseTime)
+		assert.Equal(t, "3.3.3.3", rows[0].ClientAddr)
+		assert.Equal(t, int32(404), rows[0].Status)
+		assert.True(t, start.Add(time.Hour).Equal(rows[0].TimeLocal))
+		assert.Equal(t, "/admin", rows[1].RequestUri)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	store := createStorage(t)
+	_, err := NewExporter(store, Options{Format: "xml", Directory: t.TempDir()}).Export(storage.LogFilter{})
+	assert.Error(t, err)
+	_, err = NewExporter(store, Options{Format: FORMAT_CSV, Directory: path.Join(t.TempDir(), "missing")}).Export(storage.LogFilter{})
+	assert.Error(t, err)
+	_, err = NewExporter(store, Options{Format: FORMAT_CSV, Directory: path.Join(t.TempDir(), "missing"), SplitByDay: true}).Export(storage.LogFilter{})
+	assert.Error(t, err)
+	// temporary files are removed if the storage fails
+	dir := t.TempDir()
+	invalid := storage.NewStorage(storage.DRIVER_SQLITE, t.TempDir())
+	_, err = NewExporter(invalid, Options{Format: FORMAT_NDJSON, Directory: dir}).Export(storage.LogFilter{})
+	assert.Error(t, err)
+	entries, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// finished days are removed if a later log line belongs to a finished day
+	batch, err := store.Begin()
+	require.NoError(t, err)
+	_, err = batch.Insert(parser.LogLine{RemoteAddr: "1.1.1.1", TimeLocal: start, RequestUri: "/late"}, "d")
+	require.NoError(t, err)
+	require.NoError(t, batch.Commit())
+	_, err = NewExporter(store, Options{Format: FORMAT_CSV, Directory: dir, SplitByDay: true}).Export(storage.LogFilter{})
+	assert.ErrorContains(t, err, "not in time order")
+	entries, err = os.ReadDir(dir)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,69 @@
+package metrics
+
+import (
+	"io"
+	"net/http"
+)
+
+// Content type of the Prometheus text exposition format.
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Default histogram buckets for durations in seconds.
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Counts events, e.g. the number of inserted log lines.
+//
+// A counter may be partitioned by labels, the label values are passed in the order of the label names.
+// Counters without labels are written as 0 before the first event.
+// The counter can be used concurrently.
+type Counter interface {
+	// Increments the counter for the label values by one.
+	Inc(labelValues ...string)
+	// Increments the counter for the label values by the specified non-negative value.
+	Add(value float64, labelValues ...string)
+}
+
+// Counts observed values in buckets, e.g. the duration of firewall commands in seconds.
+//
+// The histogram can be used concurrently.
+type Histogram interface {
+	// Adds the value for the label values.
+	Observe(value float64, labelValues ...string)
+}
+
+// Creates a new counter and registers it in the default registry.
+// The name should end with _total. A metric with the same name is replaced.
+func NewCounter(name string, help string, labelNames ...string) Counter {
+	counter := &counter_impl{desc: newDesc(name, help, "counter", labelNames)}
+	counter.series = map[string]*counterSeries{}
+	if len(labelNames) == 0 {
+		counter.series[""] = &counterSeries{}
+	}
+	defaultRegistry.register(counter)
+	return counter
+}
+
+// Creates a new histogram with the specified upper bounds of the buckets in ascending order
+// and registers it in the default registry. A metric with the same name is replaced.
+func NewHistogram(name string, help string, buckets []float64, labelNames ...string) Histogram {
+	histogram := &histogram_impl{desc: newDesc(name, help, "histogram", labelNames), buckets: buckets}
+	histogram.series = map[string]*histogramSeries{}
+	defaultRegistry.register(histogram)
+	return histogram
+}
+
+// Registers a gauge in the default registry whose value is returned by the function on each scrape.
+// The function is called concurrently. A metric with the same name is replaced.
+func NewGaugeFunc(name string, help string, fn func() float64) {
+	defaultRegistry.register(&gaugeFunc{desc: newDesc(name, help, "gauge", nil), fn: fn})
+}
+
+// Writes all metrics of the default registry ordered by name in the Prometheus text exposition format.
+func Write(w io.Writer) error {
+	return defaultRegistry.write(w)
+}
+
+// Returns a handler that serves all metrics of the default registry.
+func Handler() http.Handler {
+	return http.HandlerFunc(handle)
+}
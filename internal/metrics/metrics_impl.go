@@ -0,0 +1,231 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var defaultRegistry = &registry{metrics: map[string]metric{}}
+
+// Escapes label values, see the Prometheus text exposition format.
+var labelReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metric interface {
+	name() string
+	// Writes the samples without the HELP and TYPE lines.
+	write(w *bufio.Writer)
+	// Returns the description written in the HELP and TYPE lines.
+	description() *desc
+}
+
+type registry struct {
+	mutex   sync.Mutex
+	metrics map[string]metric
+}
+
+type desc struct {
+	metricName string
+	help       string
+	typeName   string
+	labelNames []string
+}
+
+type counter_impl struct {
+	*desc
+	mutex  sync.Mutex
+	series map[string]*counterSeries
+}
+
+type counterSeries struct {
+	labelValues []string
+	value       float64
+}
+
+type histogram_impl struct {
+	*desc
+	buckets []float64
+	mutex   sync.Mutex
+	series  map[string]*histogramSeries
+}
+
+type histogramSeries struct {
+	labelValues []string
+	// number of observations per bucket, not cumulative
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+type gaugeFunc struct {
+	*desc
+	fn func() float64
+}
+
+func newDesc(name string, help string, typeName string, labelNames []string) *desc {
+	return &desc{metricName: name, help: help, typeName: typeName, labelNames: labelNames}
+}
+
+func (d *desc) name() string {
+	return d.metricName
+}
+
+func (d *desc) description() *desc {
+	return d
+}
+
+// Returns the key of the series for the label values, false if the number of label values is wrong.
+func (d *desc) key(labelValues []string) (string, bool) {
+	if len(labelValues) != len(d.labelNames) {
+		log.Printf("ERROR: Metric %s expects %d label values but got %d.\n", d.metricName, len(d.labelNames), len(labelValues))
+		return "", false
+	}
+	return strings.Join(labelValues, "\xff"), true
+}
+
+// Writes a sample line with the label values and an optional extra label, e.g. le for buckets.
+func (d *desc) writeSample(w *bufio.Writer, suffix string, labelValues []string, extraName string, extraValue string, value float64) {
+	w.WriteString(d.metricName + suffix)
+	if len(labelValues) > 0 || len(extraName) > 0 {
+		w.WriteString("{")
+		for i, labelValue := range labelValues {
+			if i > 0 {
+				w.WriteString(",")
+			}
+			w.WriteString(d.labelNames[i] + `="` + labelReplacer.Replace(labelValue) + `"`)
+		}
+		if len(extraName) > 0 {
+			if len(labelValues) > 0 {
+				w.WriteString(",")
+			}
+			w.WriteString(extraName + `="` + extraValue + `"`)
+		}
+		w.WriteString("}")
+	}
+	w.WriteString(" " + formatFloat(value) + "\n")
+}
+
+func (registry *registry) register(m metric) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	registry.metrics[m.name()] = m
+}
+
+func (registry *registry) write(w io.Writer) error {
+	registry.mutex.Lock()
+	metrics := make([]metric, 0, len(registry.metrics))
+	for _, m := range registry.metrics {
+		metrics = append(metrics, m)
+	}
+	registry.mutex.Unlock()
+	slices.SortFunc(metrics, func(a, b metric) int { return strings.Compare(a.name(), b.name()) })
+	buffer := bufio.NewWriter(w)
+	for _, m := range metrics {
+		d := m.description()
+		buffer.WriteString("# HELP " + d.metricName + " " + strings.ReplaceAll(d.help, "\n", `\n`) + "\n")
+		buffer.WriteString("# TYPE " + d.metricName + " " + d.typeName + "\n")
+		m.write(buffer)
+	}
+	return buffer.Flush()
+}
+
+func (counter *counter_impl) Inc(labelValues ...string) {
+	counter.Add(1, labelValues...)
+}
+
+func (counter *counter_impl) Add(value float64, labelValues ...string) {
+	key, ok := counter.key(labelValues)
+	if !ok || value < 0 {
+		return
+	}
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	series := counter.series[key]
+	if series == nil {
+		series = &counterSeries{labelValues: slices.Clone(labelValues)}
+		counter.series[key] = series
+	}
+	series.value += value
+}
+
+func (counter *counter_impl) write(w *bufio.Writer) {
+	counter.mutex.Lock()
+	defer counter.mutex.Unlock()
+	for _, key := range sortedKeys(counter.series) {
+		series := counter.series[key]
+		counter.writeSample(w, "", series.labelValues, "", "", series.value)
+	}
+}
+
+func (histogram *histogram_impl) Observe(value float64, labelValues ...string) {
+	key, ok := histogram.key(labelValues)
+	if !ok {
+		return
+	}
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	series := histogram.series[key]
+	if series == nil {
+		series = &histogramSeries{labelValues: slices.Clone(labelValues), counts: make([]uint64, len(histogram.buckets))}
+		histogram.series[key] = series
+	}
+	idx, _ := slices.BinarySearch(histogram.buckets, value)
+	if idx < len(series.counts) {
+		series.counts[idx]++
+	}
+	series.count++
+	series.sum += value
+}
+
+func (histogram *histogram_impl) write(w *bufio.Writer) {
+	histogram.mutex.Lock()
+	defer histogram.mutex.Unlock()
+	for _, key := range sortedKeys(histogram.series) {
+		series := histogram.series[key]
+		var cumulative uint64
+		for i, bucket := range histogram.buckets {
+			cumulative += series.counts[i]
+			histogram.writeSample(w, "_bucket", series.labelValues, "le", formatFloat(bucket), float64(cumulative))
+		}
+		histogram.writeSample(w, "_bucket", series.labelValues, "le", "+Inf", float64(series.count))
+		histogram.writeSample(w, "_sum", series.labelValues, "", "", series.sum)
+		histogram.writeSample(w, "_count", series.labelValues, "", "", float64(series.count))
+	}
+}
+
+func (gauge *gaugeFunc) write(w *bufio.Writer) {
+	gauge.writeSample(w, "", nil, "", "", gauge.fn())
+}
+
+func handle(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", CONTENT_TYPE)
+	err := Write(w)
+	if err != nil {
+		log.Println("ERROR: Failed to write metrics.", err)
+	}
+}
+
+func sortedKeys[T any](series map[string]T) []string {
+	keys := make([]string, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	return keys
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
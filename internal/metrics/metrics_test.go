@@ -0,0 +1,82 @@
+package metrics
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCounter(t *testing.T) {
+	counter := NewCounter("test_lines_total", "Lines read.")
+	labeled := NewCounter("test_hits_total", "Hits per rule.", "rule")
+	assert.Contains(t, write(t), "# HELP test_lines_total Lines read.\n# TYPE test_lines_total counter\ntest_lines_total 0\n")
+	assert.NotContains(t, write(t), "test_hits_total{")
+	counter.Inc()
+	counter.Add(2.5)
+	counter.Add(-1)
+	labeled.Inc("status-444")
+	labeled.Inc(`quote"back\slash`)
+	labeled.Inc("status-444")
+	// wrong number of label values is ignored
+	labeled.Inc()
+	labeled.Inc("a", "b")
+	text := write(t)
+	assert.Contains(t, text, "test_lines_total 3.5\n")
+	assert.Contains(t, text, "# TYPE test_hits_total counter\ntest_hits_total{rule=\"quote\\\"back\\\\slash\"} 1\ntest_hits_total{rule=\"status-444\"} 2\n")
+}
+
+func TestHistogram(t *testing.T) {
+	histogram := NewHistogram("test_duration_seconds", "Duration.", []float64{0.1, 1}, "backend", "operation")
+	histogram.Observe(0.05, "nft", "apply")
+	histogram.Observe(0.1, "nft", "apply")
+	histogram.Observe(0.5, "nft", "apply")
+	histogram.Observe(2, "nft", "apply")
+	histogram.Observe(1)
+	text := write(t)
+	assert.Contains(t, text, `# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{backend="nft",operation="apply",le="0.1"} 2
+test_duration_seconds_bucket{backend="nft",operation="apply",le="1"} 3
+test_duration_seconds_bucket{backend="nft",operation="apply",le="+Inf"} 4
+test_duration_seconds_sum{backend="nft",operation="apply"} 2.65
+test_duration_seconds_count{backend="nft",operation="apply"} 4
+`)
+	NewHistogram("test_cycle_seconds", "Cycle.", []float64{1}).Observe(3)
+	assert.Contains(t, write(t), "test_cycle_seconds_bucket{le=\"1\"} 0\ntest_cycle_seconds_bucket{le=\"+Inf\"} 1\ntest_cycle_seconds_sum 3\n")
+}
+
+func TestGaugeFunc(t *testing.T) {
+	value := 1.0
+	NewGaugeFunc("test_bans", "Active bans.", func() float64 { return value })
+	assert.Contains(t, write(t), "# TYPE test_bans gauge\ntest_bans 1\n")
+	value = 5
+	assert.Contains(t, write(t), "test_bans 5\n")
+	// metric with the same name is replaced
+	NewGaugeFunc("test_bans", "Active bans.", func() float64 { return 7 })
+	text := write(t)
+	assert.Contains(t, text, "test_bans 7\n")
+	assert.Equal(t, 1, strings.Count(text, "# TYPE test_bans "))
+}
+
+func TestHandler(t *testing.T) {
+	NewCounter("test_requests_total", "Requests.").Inc()
+	NewCounter("test_errors_total", "Errors.")
+	res := httptest.NewRecorder()
+	Handler().ServeHTTP(res, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, res.Code)
+	assert.Equal(t, CONTENT_TYPE, res.Header().Get("Content-Type"))
+	assert.Contains(t, res.Body.String(), "test_requests_total 1\n")
+	// metrics are ordered by name
+	text := res.Body.String()
+	require.Contains(t, text, "# HELP test_errors_total")
+	assert.Less(t, strings.Index(text, "# HELP test_errors_total"), strings.Index(text, "# HELP test_requests_total"))
+}
+
+func write(t *testing.T) string {
+	var sb strings.Builder
+	require.NoError(t, Write(&sb))
+	return sb.String()
+}
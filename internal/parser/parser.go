@@ -5,19 +5,67 @@ import (
 	"time"
 )
 
+// nginx log format supported by Parse.
+const DEFAULT_FORMAT = `$remote_addr - $remote_user [$time_local] $msec "$request" $request_length $status $body_bytes_sent $request_time "$http_user_agent"`
+
 type LogLine struct {
-	RemoteAddr      string
-	TimeLocal       time.Time
-	RequestMethod   string
-	RequestUri      string
-	RequestProtocol string
-	RequestLength   int
-	RequestTime     int
-	Status          int
-	BytesSent       int
-	UserAgent       string
+	RemoteAddr      string    `json:"remoteAddr"`
+	TimeLocal       time.Time `json:"timeLocal"`
+	RequestMethod   string    `json:"requestMethod"`
+	RequestUri      string    `json:"requestUri"`
+	RequestProtocol string    `json:"requestProtocol"`
+	RequestLength   int       `json:"requestLength"`
+	RequestTime     int       `json:"requestTime"`
+	Status          int       `json:"status"`
+	BytesSent       int       `json:"bytesSent"`
+	UserAgent       string    `json:"userAgent"`
+	// Extended fields, only filled in if the log format contains them.
+	Referer       string `json:"referer,omitempty"`
+	Host          string `json:"host,omitempty"`
+	XForwardedFor string `json:"xForwardedFor,omitempty"`
+	UpstreamAddr  string `json:"upstreamAddr,omitempty"`
+	// Sum of the response times of all upstream servers in milliseconds.
+	UpstreamResponseTime int    `json:"upstreamResponseTime,omitempty"`
+	TlsProtocol          string `json:"tlsProtocol,omitempty"`
+	ProxyProtocolAddr    string `json:"proxyProtocolAddr,omitempty"`
+	// IP address of the client if the request has been forwarded by a trusted proxy
+	// and the client differs from the remote address. Not filled in by the parser.
+	ClientAddr string `json:"clientAddr,omitempty"`
+}
+
+// Returns the IP address of the client, which is the remote address if the request has not been forwarded.
+func (logLine LogLine) Client() string {
+	if len(logLine.ClientAddr) > 0 {
+		return logLine.ClientAddr
+	}
+	return logLine.RemoteAddr
+}
+
+// Parses access log lines of an nginx log format.
+//
+// Use NewParser to create a new parser.
+type Parser interface {
+	// Parses the log line. Returns an empty log line for an empty line.
+	Parse(line string) (LogLine, error)
 }
 
+// Creates a new parser for the specified nginx log_format string.
+//
+// The following variables are stored, all other variables are skipped:
+// $remote_addr, $time_local, $time_iso8601, $msec, $request, $request_method, $request_uri, $server_protocol,
+// $request_length, $status, $body_bytes_sent, $bytes_sent, $request_time, $http_user_agent, $http_referer,
+// $host, $http_host, $http_x_forwarded_for, $upstream_addr, $upstream_response_time, $ssl_protocol
+// and $proxy_protocol_addr.
+// The format must contain $remote_addr and one of the time variables, the value '-' is an empty value.
+// DEFAULT_FORMAT is used for an empty format.
+func NewParser(format string) (Parser, error) {
+	if len(strings.TrimSpace(format)) == 0 || normalizeSpace(format) == DEFAULT_FORMAT {
+		return &defaultParser{}, nil
+	}
+	return newFormatParser(format)
+}
+
+// Parses a log line of the format DEFAULT_FORMAT.
 func Parse(line string) (LogLine, error) {
 	var err error
 	logLine := LogLine{}
@@ -29,17 +77,9 @@ func Parse(line string) (LogLine, error) {
 		}
 		msec, line := parseMsec(line)
 		logLine.TimeLocal = time.UnixMilli(msec)
-		logLine.RequestUri, line = parseRequest(line)
-		idx := strings.Index(logLine.RequestUri, " ")
-		if idx > 0 && idx < 32 {
-			logLine.RequestMethod = logLine.RequestUri[0:idx]
-			logLine.RequestUri = logLine.RequestUri[idx+1:]
-			idx = strings.LastIndex(logLine.RequestUri, " ")
-			if idx > 0 && len(logLine.RequestUri)-idx < 32 {
-				logLine.RequestProtocol = logLine.RequestUri[idx+1:]
-				logLine.RequestUri = logLine.RequestUri[0:idx]
-			}
-		}
+		var request string
+		request, line = parseRequest(line)
+		splitRequest(&logLine, request)
 		logLine.RequestLength, line = parseInt(line)
 		logLine.Status, line = parseInt(line)
 		logLine.BytesSent, line = parseInt(line)
@@ -1,12 +1,212 @@
 package parser
 
 import (
+	"errors"
+	"fmt"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
 	"unicode"
 )
 
+type defaultParser struct{}
+
+// Parser for a configured log format using a regular expression with one group per variable.
+type formatParser struct {
+	regexp    *regexp.Regexp
+	variables []string
+}
+
+var timeVariables = []string{"time_local", "time_iso8601", "msec"}
+
+// Upstream variables contain one value per upstream server separated by ", " or " : ", even if they are not quoted.
+var listVariables = []string{"upstream_addr", "upstream_response_time", "upstream_status", "upstream_connect_time", "upstream_header_time"}
+
+var variableRegexp = regexp.MustCompile(`\$([a-z0-9_]+)`)
+
+var spaceRegexp = regexp.MustCompile(`\s+`)
+
+func (parser *defaultParser) Parse(line string) (LogLine, error) {
+	return Parse(line)
+}
+
+func newFormatParser(format string) (*formatParser, error) {
+	format = normalizeSpace(format)
+	var parser formatParser
+	var sb strings.Builder
+	sb.WriteString("^")
+	last := 0
+	for _, match := range variableRegexp.FindAllStringSubmatchIndex(format, -1) {
+		sb.WriteString(literalPattern(format[last:match[0]]))
+		variable := format[match[2]:match[3]]
+		if containsAny(listVariables, variable) {
+			sb.WriteString(`([^ ,]*(?:(?:, | : )[^ ,]*)*)`)
+		} else {
+			// values end at the following literal, e.g. a quote or a space
+			sb.WriteString("(.*?)")
+		}
+		parser.variables = append(parser.variables, variable)
+		last = match[1]
+	}
+	sb.WriteString(literalPattern(format[last:]))
+	sb.WriteString("$")
+	if !containsAny(parser.variables, "remote_addr") {
+		return nil, fmt.Errorf("log format '%s' does not contain $remote_addr", format)
+	}
+	if !containsAny(parser.variables, timeVariables...) {
+		return nil, fmt.Errorf("log format '%s' does not contain $time_local, $time_iso8601 or $msec", format)
+	}
+	var err error
+	parser.regexp, err = regexp.Compile(sb.String())
+	if err != nil {
+		return nil, err
+	}
+	return &parser, nil
+}
+
+func (parser *formatParser) Parse(line string) (LogLine, error) {
+	var logLine LogLine
+	line = strings.TrimSpace(line)
+	if len(line) == 0 {
+		return logLine, nil
+	}
+	values := parser.regexp.FindStringSubmatch(line)
+	if values == nil {
+		return logLine, errors.New("log line does not match log format")
+	}
+	var msec string
+	for i, variable := range parser.variables {
+		value := values[i+1]
+		if value == "-" {
+			continue
+		}
+		// $msec has the highest precision and is applied last
+		if variable == "msec" {
+			msec = value
+			continue
+		}
+		err := setField(&logLine, variable, value)
+		if err != nil {
+			return logLine, fmt.Errorf("invalid value '%s' for $%s: %s", value, variable, err.Error())
+		}
+	}
+	if len(msec) > 0 {
+		err := setField(&logLine, "msec", msec)
+		if err != nil {
+			return logLine, fmt.Errorf("invalid value '%s' for $msec: %s", msec, err.Error())
+		}
+	}
+	return logLine, nil
+}
+
+// Sets the field of the log line for the value of the variable, unknown variables are skipped.
+func setField(logLine *LogLine, variable string, value string) error {
+	var err error
+	switch variable {
+	case "remote_addr":
+		logLine.RemoteAddr = value
+	case "time_local":
+		logLine.TimeLocal, err = time.Parse("02/Jan/2006:15:04:05 -0700", value)
+	case "time_iso8601":
+		logLine.TimeLocal, err = time.Parse(time.RFC3339, value)
+	case "msec":
+		var sec float64
+		sec, err = strconv.ParseFloat(value, 64)
+		logLine.TimeLocal = time.UnixMilli(int64(sec*1000 + 0.5))
+	case "request":
+		splitRequest(logLine, value)
+	case "request_method":
+		logLine.RequestMethod = value
+	case "request_uri":
+		logLine.RequestUri = value
+	case "server_protocol":
+		logLine.RequestProtocol = value
+	case "request_length":
+		logLine.RequestLength = atoi(value)
+	case "status":
+		logLine.Status = atoi(value)
+	case "body_bytes_sent", "bytes_sent":
+		logLine.BytesSent = atoi(value)
+	case "request_time":
+		logLine.RequestTime = sumDurations(value)
+	case "http_user_agent":
+		logLine.UserAgent = value
+	case "http_referer":
+		logLine.Referer = value
+	case "host", "http_host":
+		logLine.Host = value
+	case "http_x_forwarded_for":
+		logLine.XForwardedFor = value
+	case "upstream_addr":
+		logLine.UpstreamAddr = value
+	case "upstream_response_time":
+		logLine.UpstreamResponseTime = sumDurations(value)
+	case "ssl_protocol":
+		logLine.TlsProtocol = value
+	case "proxy_protocol_addr":
+		logLine.ProxyProtocolAddr = value
+	}
+	return err
+}
+
+// Returns the regular expression for a literal of the log format, whitespace matches any whitespace.
+func literalPattern(literal string) string {
+	parts := strings.Split(literal, " ")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return strings.Join(parts, `\s+`)
+}
+
+func normalizeSpace(format string) string {
+	return spaceRegexp.ReplaceAllString(strings.TrimSpace(format), " ")
+}
+
+func containsAny(variables []string, names ...string) bool {
+	for _, variable := range variables {
+		for _, name := range names {
+			if variable == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Splits the request line into method, URI and protocol.
+func splitRequest(logLine *LogLine, request string) {
+	logLine.RequestUri = request
+	idx := strings.Index(logLine.RequestUri, " ")
+	if idx > 0 && idx < 32 {
+		logLine.RequestMethod = logLine.RequestUri[0:idx]
+		logLine.RequestUri = logLine.RequestUri[idx+1:]
+		idx = strings.LastIndex(logLine.RequestUri, " ")
+		if idx > 0 && len(logLine.RequestUri)-idx < 32 {
+			logLine.RequestProtocol = logLine.RequestUri[idx+1:]
+			logLine.RequestUri = logLine.RequestUri[0:idx]
+		}
+	}
+}
+
+func atoi(value string) int {
+	num, _ := strconv.Atoi(value)
+	return num
+}
+
+// Returns the sum of durations in seconds in milliseconds,
+// e.g. "0.012, 0.004 : 0.100" for several upstream servers.
+func sumDurations(value string) int {
+	var sum float64
+	for _, field := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ':' || unicode.IsSpace(r) }) {
+		f, err := strconv.ParseFloat(field, 64)
+		if err == nil {
+			sum += f
+		}
+	}
+	return int(sum*1000 + 0.5)
+}
+
 func parseIpAddress(line string) (string, string) {
 	var ipaddress strings.Builder
 	for idx, c := range line {
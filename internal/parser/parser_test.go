@@ -5,6 +5,7 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestParse(t *testing.T) {
@@ -32,3 +33,85 @@ func TestParseFail(t *testing.T) {
 	_, err = Parse(``)
 	assert.Nil(t, err)
 }
+
+func TestNewParser(t *testing.T) {
+	line := `127.0.0.1 - - [01/Jun/2025:18:24:22 +0200] 1748795062.703 "GET /hello HTTP/1.1" 78 404 162 0.000 "curl/7.81.0"`
+	expected, err := Parse(line)
+	require.NoError(t, err)
+	// default format uses Parse
+	for _, format := range []string{"", DEFAULT_FORMAT, `$remote_addr - $remote_user [$time_local] $msec "$request" $request_length $status  $body_bytes_sent $request_time "$http_user_agent"`} {
+		parser, err := NewParser(format)
+		require.NoError(t, err)
+		logLine, err := parser.Parse(line)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, logLine)
+	}
+	// invalid formats
+	_, err = NewParser(`$remote_addr "$request"`)
+	assert.Error(t, err)
+	_, err = NewParser(`[$time_local] "$request"`)
+	assert.Error(t, err)
+}
+
+func TestParseFormat(t *testing.T) {
+	parser, err := NewParser(`$remote_addr - $remote_user [$time_local] "$request" $status $body_bytes_sent "$http_referer" "$http_user_agent" ` +
+		`$host "$http_x_forwarded_for" $upstream_addr $upstream_response_time $request_time $ssl_protocol $proxy_protocol_addr`)
+	require.NoError(t, err)
+
+	logLine, err := parser.Parse(`10.0.0.1 - alice [01/Jun/2025:18:24:22 +0200] "POST /login?next=/ HTTP/2.0" 302 0 "https://example.com/" "Mozilla/5.0 (X11; Linux x86_64)" ` +
+		`example.com "203.0.113.7, 10.0.0.1" 127.0.0.1:8080, 127.0.0.1:8081 0.012, 0.004 0.020 TLSv1.3 198.51.100.1`)
+	require.NoError(t, err)
+	assert.Equal(t, LogLine{
+		RemoteAddr:           "10.0.0.1",
+		TimeLocal:            time.Date(2025, 6, 1, 18, 24, 22, 0, time.FixedZone("", 2*60*60)),
+		RequestMethod:        "POST",
+		RequestUri:           "/login?next=/",
+		RequestProtocol:      "HTTP/2.0",
+		Status:               302,
+		RequestTime:          20,
+		Referer:              "https://example.com/",
+		UserAgent:            "Mozilla/5.0 (X11; Linux x86_64)",
+		Host:                 "example.com",
+		XForwardedFor:        "203.0.113.7, 10.0.0.1",
+		UpstreamAddr:         "127.0.0.1:8080, 127.0.0.1:8081",
+		UpstreamResponseTime: 16,
+		TlsProtocol:          "TLSv1.3",
+		ProxyProtocolAddr:    "198.51.100.1",
+	}, logLine)
+
+	// '-' is an empty value
+	logLine, err = parser.Parse(`10.0.0.1 - - [01/Jun/2025:18:24:22 +0200] "GET / HTTP/1.1" 200 612 "-" "-" example.com "-" - - 0.000 - -`)
+	require.NoError(t, err)
+	assert.Equal(t, "", logLine.Referer)
+	assert.Equal(t, "", logLine.XForwardedFor)
+	assert.Equal(t, "", logLine.UpstreamAddr)
+	assert.Equal(t, 0, logLine.UpstreamResponseTime)
+	assert.Equal(t, 612, logLine.BytesSent)
+
+	// empty line
+	logLine, err = parser.Parse("  ")
+	assert.NoError(t, err)
+	assert.Equal(t, "", logLine.RemoteAddr)
+	// line of another format
+	_, err = parser.Parse(`127.0.0.1 - - [01/Jun/2025:18:24:22 +0200] 1748795062.703 "GET /hello HTTP/1.1" 78 404 162 0.000 "curl/7.81.0"`)
+	assert.Error(t, err)
+	// invalid time
+	_, err = parser.Parse(`10.0.0.1 - - [01/Jun/2025 18:24:22] "GET / HTTP/1.1" 200 612 "-" "-" example.com "-" - - 0.000 - -`)
+	assert.Error(t, err)
+}
+
+func TestParseFormatTime(t *testing.T) {
+	parser, err := NewParser(`$remote_addr $time_iso8601 $msec $request_method $request_uri $server_protocol $bytes_sent`)
+	require.NoError(t, err)
+	// $msec is more precise than the other time variables
+	logLine, err := parser.Parse(`::1 2025-06-01T18:24:22+02:00 1748795062.703 GET / HTTP/1.1 700`)
+	require.NoError(t, err)
+	assert.Equal(t, time.UnixMilli(1748795062703), logLine.TimeLocal)
+	assert.Equal(t, "GET", logLine.RequestMethod)
+	assert.Equal(t, "/", logLine.RequestUri)
+	assert.Equal(t, "HTTP/1.1", logLine.RequestProtocol)
+	assert.Equal(t, 700, logLine.BytesSent)
+	logLine, err = parser.Parse(`::1 2025-06-01T18:24:22+02:00 - GET / HTTP/1.1 700`)
+	require.NoError(t, err)
+	assert.True(t, time.Date(2025, 6, 1, 16, 24, 22, 0, time.UTC).Equal(logLine.TimeLocal))
+}
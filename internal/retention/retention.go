@@ -0,0 +1,48 @@
+package retention
+
+import (
+	"time"
+)
+
+// Limits the size of the table accesslog of the sqlite database.
+//
+// Log lines older than the maximum age are deleted, and if the table contains more than
+// the maximum number of rows the oldest log lines are deleted.
+// Free pages are returned to the file system using incremental vacuum.
+// If an archive directory is set, deleted log lines are appended to compressed monthly files
+// accesslog-YYYY-MM.csv.gz before they are deleted.
+// Rule hits of deleted log lines are deleted as well.
+//
+// The database is opened on first use and kept open until Close is called.
+// Free pages are only returned if the database has been converted for incremental vacuum by Init.
+//
+// Use NewRetention to create a new retention object.
+type Retention interface {
+	// Opens the database and converts it once for incremental vacuum using a full VACUUM.
+	// The conversion may take a while for large databases and locks the database,
+	// so it should be called at startup before the database is used by other goroutines.
+	Init() error
+	// Deletes all log lines that exceed the retention limits at the specified time.
+	// Returns the number of deleted log lines.
+	Prune(now time.Time) (int64, error)
+	// Closes the database.
+	Close()
+}
+
+// Describes the retention limits, a limit is disabled if it is not positive.
+type Options struct {
+	// Maximum age of log lines.
+	MaxAge time.Duration
+	// Maximum number of log lines.
+	MaxRows int64
+	// Directory for the compressed monthly archive files, optional.
+	ArchiveDirectory string
+}
+
+// Creates a new retention object for the specified sqlite database file.
+func NewRetention(filename string, options Options) Retention {
+	var retention retention_impl
+	retention.filename = filename
+	retention.options = options
+	return &retention
+}
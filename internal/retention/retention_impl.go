@@ -0,0 +1,281 @@
+package retention
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nylssoft/goaccesslog/internal/parser"
+	"github.com/nylssoft/goaccesslog/internal/schema"
+	"github.com/nylssoft/goaccesslog/internal/storage"
+)
+
+// columns of the archive files, the hash identifies the log line
+const archiveColumns = storage.LOG_LINE_COLUMNS + ",hash"
+
+// sqlite value for PRAGMA auto_vacuum=INCREMENTAL
+const auto_vacuum_incremental = 2
+
+type retention_impl struct {
+	filename string
+	options  Options
+	db       *sql.DB
+}
+
+// Compressed CSV file of one month.
+type archiveFile struct {
+	file   *os.File
+	gz     *gzip.Writer
+	writer *csv.Writer
+}
+
+func (retention *retention_impl) Init() error {
+	err := retention.initDatabase()
+	if err == nil {
+		err = enableIncrementalVacuum(retention.db)
+	}
+	return err
+}
+
+func (retention *retention_impl) Prune(now time.Time) (int64, error) {
+	var conditions []string
+	var args []any
+	if retention.options.MaxAge > 0 {
+		conditions = append(conditions, "time_local < ?")
+		args = append(args, now.Add(-retention.options.MaxAge).UTC())
+	}
+	if retention.options.MaxRows > 0 {
+		conditions = append(conditions, fmt.Sprintf("rowid <= (SELECT rowid FROM accesslog ORDER BY rowid DESC LIMIT 1 OFFSET %d)", retention.options.MaxRows))
+	}
+	if len(conditions) == 0 {
+		return 0, nil
+	}
+	where := strings.Join(conditions, " OR ")
+	err := retention.initDatabase()
+	if err != nil {
+		return 0, err
+	}
+	tx, err := retention.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if len(retention.options.ArchiveDirectory) > 0 {
+		// if the transaction fails the log lines are archived again on next run
+		err = retention.archive(tx, where, args)
+		if err != nil {
+			return 0, err
+		}
+	}
+	// rule hits reference the log lines by hash
+	_, err = tx.Exec("DELETE FROM rule_hits WHERE hash IN (SELECT hash FROM accesslog WHERE "+where+")", args...)
+	if err != nil {
+		return 0, err
+	}
+	res, err := tx.Exec("DELETE FROM accesslog WHERE "+where, args...)
+	if err != nil {
+		return 0, err
+	}
+	cnt, err := res.RowsAffected()
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		return 0, err
+	}
+	if cnt > 0 {
+		// return free pages to the file system and truncate the write ahead log,
+		// incremental vacuum does nothing if the database has not been converted by Init
+		_, err = retention.db.Exec("PRAGMA incremental_vacuum")
+		if err == nil {
+			_, err = retention.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+		}
+		if err != nil {
+			log.Println("ERROR: Failed to vacuum database.", err)
+		}
+	}
+	return cnt, nil
+}
+
+func (retention *retention_impl) Close() {
+	if retention.db != nil {
+		retention.db.Close()
+		retention.db = nil
+	}
+}
+
+// Appends the log lines matching the condition to the monthly archive files.
+func (retention *retention_impl) archive(tx *sql.Tx, where string, args []any) error {
+	rows, err := tx.Query("SELECT "+archiveColumns+" FROM accesslog WHERE "+where+" ORDER BY rowid", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	files := map[string]*archiveFile{}
+	for rows.Next() && err == nil {
+		var hash sql.NullString
+		var logLine parser.LogLine
+		logLine, err = storage.ScanLogLine(rows, &hash)
+		if err != nil {
+			break
+		}
+		month := logLine.TimeLocal.UTC().Format("2006-01")
+		file, ok := files[month]
+		if !ok {
+			file, err = openArchiveFile(filepath.Join(retention.options.ArchiveDirectory, "accesslog-"+month+".csv.gz"))
+			if err != nil {
+				break
+			}
+			files[month] = file
+		}
+		err = file.writer.Write(archiveRecord(logLine, hash.String))
+	}
+	if err == nil {
+		err = rows.Err()
+	}
+	for _, file := range files {
+		closeErr := file.close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// Opens the archive file for appending, a new gzip member is started for each run.
+func openArchiveFile(filename string) (*archiveFile, error) {
+	err := rotateArchiveFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return nil, err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	var archive archiveFile
+	archive.file = file
+	archive.gz = gzip.NewWriter(file)
+	archive.writer = csv.NewWriter(archive.gz)
+	if info.Size() == 0 {
+		err = archive.writer.Write(strings.Split(archiveColumns, ","))
+		if err != nil {
+			archive.close()
+			return nil, err
+		}
+	}
+	return &archive, nil
+}
+
+// Renames an existing archive file with other columns, e.g. written by a previous version,
+// to accesslog-YYYY-MM.<n>.csv.gz, so that all records of an archive file have the same columns.
+func rotateArchiveFile(filename string) error {
+	file, err := os.Open(filename)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var header []string
+	gz, err := gzip.NewReader(file)
+	if err == nil {
+		header, err = csv.NewReader(gz).Read()
+	}
+	file.Close()
+	if err == io.EOF || strings.Join(header, ",") == archiveColumns {
+		// empty file or same columns
+		return nil
+	}
+	for n := 1; ; n++ {
+		rotated := fmt.Sprintf("%s.%d.csv.gz", strings.TrimSuffix(filename, ".csv.gz"), n)
+		_, err = os.Stat(rotated)
+		if errors.Is(err, fs.ErrNotExist) {
+			log.Printf("Archive file '%s' has other columns, renamed to '%s'.\n", filename, rotated)
+			return os.Rename(filename, rotated)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (archive *archiveFile) close() error {
+	archive.writer.Flush()
+	err := archive.writer.Error()
+	gzErr := archive.gz.Close()
+	if err == nil {
+		err = gzErr
+	}
+	fileErr := archive.file.Close()
+	if err == nil {
+		err = fileErr
+	}
+	return err
+}
+
+// Returns the values of the archive columns.
+func archiveRecord(logLine parser.LogLine, hash string) []string {
+	return []string{logLine.RemoteAddr, logLine.TimeLocal.UTC().Format(time.RFC3339), logLine.RequestMethod, logLine.RequestUri,
+		logLine.RequestProtocol, strconv.Itoa(logLine.RequestLength), strconv.Itoa(logLine.RequestTime), strconv.Itoa(logLine.Status),
+		strconv.Itoa(logLine.BytesSent), logLine.UserAgent, logLine.Referer, logLine.Host, logLine.XForwardedFor, logLine.UpstreamAddr,
+		strconv.Itoa(logLine.UpstreamResponseTime), logLine.TlsProtocol, logLine.ProxyProtocolAddr, logLine.ClientAddr, hash}
+}
+
+func (retention *retention_impl) initDatabase() error {
+	if retention.db != nil {
+		return nil
+	}
+	db, err := sql.Open("sqlite3", retention.filename+"?_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL")
+	if err != nil {
+		return err
+	}
+	// PRAGMA auto_vacuum and VACUUM have to use the same connection
+	db.SetMaxOpenConns(1)
+	err = schema.Migrate(db)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	retention.db = db
+	return nil
+}
+
+// Converts the database once so that free pages can be released using PRAGMA incremental_vacuum.
+func enableIncrementalVacuum(db *sql.DB) error {
+	var autoVacuum int
+	err := db.QueryRow("PRAGMA auto_vacuum").Scan(&autoVacuum)
+	if err != nil || autoVacuum == auto_vacuum_incremental {
+		return err
+	}
+	log.Println("Enable incremental vacuum for database. This may take a while.")
+	_, err = db.Exec("PRAGMA auto_vacuum=INCREMENTAL")
+	if err == nil {
+		_, err = db.Exec("VACUUM")
+	}
+	if err != nil {
+		return err
+	}
+	// VACUUM may change the rowids referenced by the full-text index
+	var triggers int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='trigger' AND name LIKE 'accesslog_fts_%'").Scan(&triggers)
+	if err == nil && triggers > 0 {
+		_, err = db.Exec("INSERT INTO accesslog_fts (accesslog_fts) VALUES ('rebuild')")
+	}
+	return err
+}
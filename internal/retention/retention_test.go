@@ -0,0 +1,178 @@
+package retention
+
+import (
+	"compress/gzip"
+	"database/sql"
+	"encoding/csv"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nylssoft/goaccesslog/internal/schema"
+	"github.com/nylssoft/goaccesslog/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var now = time.Date(2025, 7, 15, 12, 0, 0, 0, time.UTC)
+
+func createDatabase(t *testing.T, times ...time.Time) string {
+	filename := path.Join(t.TempDir(), "test.db")
+	db, err := sql.Open("sqlite3", filename)
+	require.NoError(t, err)
+	defer db.Close()
+	require.NoError(t, schema.Migrate(db))
+	// log lines are stored in UTC like by the storage
+	for i, timeLocal := range times {
+		_, err = db.Exec("INSERT INTO accesslog (remote_addr,time_local,request_uri,status,hash) VALUES ($1,$2,$3,$4,$5)",
+			"1.1.1.1", timeLocal.UTC(), "/", 200, string(rune('a'+i)))
+		require.NoError(t, err)
+	}
+	return filename
+}
+
+func countRows(t *testing.T, filename string) int {
+	db, err := sql.Open("sqlite3", filename)
+	require.NoError(t, err)
+	defer db.Close()
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM accesslog").Scan(&count))
+	return count
+}
+
+func readArchive(t *testing.T, filename string) [][]string {
+	file, err := os.Open(filename)
+	require.NoError(t, err)
+	defer file.Close()
+	gz, err := gzip.NewReader(file)
+	require.NoError(t, err)
+	records, err := csv.NewReader(gz).ReadAll()
+	require.NoError(t, err)
+	return records
+}
+
+func writeArchive(t *testing.T, filename string, data string) {
+	file, err := os.Create(filename)
+	require.NoError(t, err)
+	defer file.Close()
+	gz := gzip.NewWriter(file)
+	_, err = gz.Write([]byte(data))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+}
+
+func TestPruneMaxAge(t *testing.T) {
+	// time zone of the log line is respected
+	cest := time.FixedZone("CEST", 2*60*60)
+	filename := createDatabase(t,
+		now.Add(-72*time.Hour),
+		time.Date(2025, 7, 14, 13, 0, 0, 0, cest),
+		time.Date(2025, 7, 14, 14, 0, 0, 1000, cest),
+		now)
+	retention := NewRetention(filename, Options{MaxAge: 24 * time.Hour})
+	defer retention.Close()
+	cnt, err := retention.Prune(now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), cnt)
+	assert.Equal(t, 2, countRows(t, filename))
+	cnt, err = retention.Prune(now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), cnt)
+	// the database is not converted without Init
+	db, err := sql.Open("sqlite3", filename)
+	require.NoError(t, err)
+	defer db.Close()
+	var autoVacuum int
+	require.NoError(t, db.QueryRow("PRAGMA auto_vacuum").Scan(&autoVacuum))
+	assert.NotEqual(t, auto_vacuum_incremental, autoVacuum)
+}
+
+func TestPruneMaxRows(t *testing.T) {
+	filename := createDatabase(t, now, now, now, now, now)
+	db, err := sql.Open("sqlite3", filename)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO rule_hits (hash,bad_rule) VALUES ('a','test'),('e','test')")
+	require.NoError(t, err)
+	db.Close()
+	retention := NewRetention(filename, Options{MaxRows: 3})
+	defer retention.Close()
+	require.NoError(t, retention.Init())
+	// the database is converted only once
+	require.NoError(t, retention.Init())
+	cnt, err := retention.Prune(now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), cnt)
+	db, err = sql.Open("sqlite3", filename)
+	require.NoError(t, err)
+	defer db.Close()
+	// the oldest log lines are deleted together with their rule hits
+	var hash string
+	require.NoError(t, db.QueryRow("SELECT MIN(hash) FROM accesslog").Scan(&hash))
+	assert.Equal(t, "c", hash)
+	require.NoError(t, db.QueryRow("SELECT GROUP_CONCAT(hash) FROM rule_hits").Scan(&hash))
+	assert.Equal(t, "e", hash)
+	var autoVacuum int
+	require.NoError(t, db.QueryRow("PRAGMA auto_vacuum").Scan(&autoVacuum))
+	assert.Equal(t, auto_vacuum_incremental, autoVacuum)
+}
+
+func TestPruneDisabled(t *testing.T) {
+	filename := createDatabase(t, now.Add(-10000*time.Hour))
+	retention := NewRetention(filename, Options{})
+	defer retention.Close()
+	cnt, err := retention.Prune(now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), cnt)
+	assert.Equal(t, 1, countRows(t, filename))
+}
+
+func TestPruneArchive(t *testing.T) {
+	filename := createDatabase(t,
+		time.Date(2025, 5, 31, 23, 0, 0, 0, time.UTC),
+		time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2025, 6, 2, 0, 0, 0, 0, time.UTC),
+		now)
+	db, err := sql.Open("sqlite3", filename)
+	require.NoError(t, err)
+	_, err = db.Exec("UPDATE accesslog SET referer='https://example.com/',host='example.com',upstream_response_time=12,client_addr='2.2.2.2' WHERE hash='b'")
+	require.NoError(t, err)
+	db.Close()
+	archiveDir := t.TempDir()
+	// archive file of a previous version with other columns
+	writeArchive(t, path.Join(archiveDir, "accesslog-2025-06.csv.gz"), "remote_addr,time_local,hash\n1.1.1.1,2025-06-01T00:00:00Z,x\n")
+	retention := NewRetention(filename, Options{MaxAge: 44 * 24 * time.Hour, ArchiveDirectory: archiveDir})
+	defer retention.Close()
+	cnt, err := retention.Prune(now)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), cnt)
+	records := readArchive(t, path.Join(archiveDir, "accesslog-2025-05.csv.gz"))
+	require.Len(t, records, 2)
+	assert.Equal(t, strings.Split(storage.LOG_LINE_COLUMNS+",hash", ","), records[0])
+	assert.Equal(t, []string{"1.1.1.1", "2025-05-31T23:00:00Z", "", "/", "", "0", "0", "200", "0", "", "", "", "", "", "0", "", "", "", "a"}, records[1])
+	records = readArchive(t, path.Join(archiveDir, "accesslog-2025-06.csv.gz"))
+	require.Len(t, records, 2)
+	assert.Equal(t, []string{"1.1.1.1", "2025-06-01T00:00:00Z", "", "/", "", "0", "0", "200", "0", "", "https://example.com/", "example.com", "", "", "12", "", "", "2.2.2.2", "b"}, records[1])
+	assert.Equal(t, [][]string{{"remote_addr", "time_local", "hash"}, {"1.1.1.1", "2025-06-01T00:00:00Z", "x"}},
+		readArchive(t, path.Join(archiveDir, "accesslog-2025-06.1.csv.gz")))
+	// next run appends to the archive file
+	cnt, err = retention.Prune(now.Add(24 * time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), cnt)
+	records = readArchive(t, path.Join(archiveDir, "accesslog-2025-06.csv.gz"))
+	require.Len(t, records, 3)
+	assert.Equal(t, "c", records[2][18])
+	assert.Equal(t, 1, countRows(t, filename))
+}
+
+func TestPruneArchiveError(t *testing.T) {
+	filename := createDatabase(t, now.Add(-48*time.Hour))
+	retention := NewRetention(filename, Options{MaxAge: time.Hour, ArchiveDirectory: path.Join(t.TempDir(), "missing")})
+	defer retention.Close()
+	_, err := retention.Prune(now)
+	assert.Error(t, err)
+	// log lines are kept if they cannot be archived
+	assert.Equal(t, 1, countRows(t, filename))
+}
@@ -5,7 +5,7 @@ package rule
 // STRING := "'" CHAR "'"
 // DIGIT := 0 | 1 | 2 | 3 | 4 | 5 | 6 | 7 | 8 | 9
 // OPERATOR := eq | ne | gt | ge | lt | le | contains | starts-with | ends-with
-// PROPERTY := status | protocol | uri | ip
+// PROPERTY := status | protocol | uri | ip | referer | host | x_forwarded_for | upstream_addr | upstream_time | tls_protocol | proxy_protocol_addr
 
 type Operator int
 
@@ -34,6 +34,15 @@ const (
 	PROP_URI
 	PROP_IP
 	PROP_PROTOCOL
+	// extended properties, empty if the log format does not contain them
+	PROP_REFERER
+	PROP_HOST
+	PROP_X_FORWARDED_FOR
+	PROP_UPSTREAM_ADDR
+	// upstream response time in milliseconds
+	PROP_UPSTREAM_TIME
+	PROP_TLS_PROTOCOL
+	PROP_PROXY_PROTOCOL_ADDR
 )
 
 func ParseCondition(str string) ([]Expression, error) {
@@ -22,10 +22,17 @@ var operatorMap map[string]Operator = map[string]Operator{
 }
 
 var propertyMap map[string]Property = map[string]Property{
-	"status":   PROP_STATUS,
-	"uri":      PROP_URI,
-	"ip":       PROP_IP,
-	"protocol": PROP_PROTOCOL,
+	"status":              PROP_STATUS,
+	"uri":                 PROP_URI,
+	"ip":                  PROP_IP,
+	"protocol":            PROP_PROTOCOL,
+	"referer":             PROP_REFERER,
+	"host":                PROP_HOST,
+	"x_forwarded_for":     PROP_X_FORWARDED_FOR,
+	"upstream_addr":       PROP_UPSTREAM_ADDR,
+	"upstream_time":       PROP_UPSTREAM_TIME,
+	"tls_protocol":        PROP_TLS_PROTOCOL,
+	"proxy_protocol_addr": PROP_PROXY_PROTOCOL_ADDR,
 }
 
 var invalidNumberOperators []Operator = []Operator{OPR_IN, OPR_STARTS, OPR_ENDS}
@@ -142,7 +149,7 @@ func parseExpr(str string, idx int) ([]Expression, error) {
 }
 
 func isIntType(prop Property) bool {
-	return prop == PROP_STATUS
+	return prop == PROP_STATUS || prop == PROP_UPSTREAM_TIME
 }
 
 func parseFunction(str string, idx int) (Operator, int, error) {
@@ -193,3 +193,29 @@ func TestEvaluateExpression(t *testing.T) {
 	assert.False(t, ret)
 
 }
+
+func TestExtendedProperties(t *testing.T) {
+	expr, err := ParseCondition("eq(host,'example.com') and contains(referer,'spam') and ge(upstream_time,1000) and starts-with(tls_protocol,'TLSv1.0')" +
+		" and ne(x_forwarded_for,'') and eq(upstream_addr,'127.0.0.1:8080') and eq(proxy_protocol_addr,'1.1.1.1')")
+	require.NoError(t, err)
+	require.Len(t, expr, 7)
+	assert.Equal(t, 1000, expr[2].Values[0])
+	data := map[Property]any{
+		PROP_HOST:                "example.com",
+		PROP_REFERER:             "https://spam.example/",
+		PROP_UPSTREAM_TIME:       1500,
+		PROP_TLS_PROTOCOL:        "TLSv1.0",
+		PROP_X_FORWARDED_FOR:     "2.2.2.2",
+		PROP_UPSTREAM_ADDR:       "127.0.0.1:8080",
+		PROP_PROXY_PROTOCOL_ADDR: "1.1.1.1",
+	}
+	assert.True(t, EvaluateExpressions(expr, data))
+	data[PROP_UPSTREAM_TIME] = 999
+	assert.False(t, EvaluateExpressions(expr, data))
+
+	// upstream time is a number
+	_, err = ParseCondition("contains(upstream_time,'1')")
+	assert.Error(t, err)
+	_, err = ParseCondition("eq(upstream_time,'1')")
+	assert.Error(t, err)
+}
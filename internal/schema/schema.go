@@ -0,0 +1,42 @@
+package schema
+
+import (
+	"database/sql"
+)
+
+// Describes a change of the database schema.
+//
+// Migrations are applied in the order of their versions. Each migration must be idempotent,
+// e.g. use CREATE TABLE IF NOT EXISTS or check for existing columns, because databases
+// created before the schema_version table existed already contain some of the changes.
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(tx *sql.Tx) error
+}
+
+// Applies all migrations that have not been applied to the sqlite database yet.
+//
+// The applied versions are stored in the table schema_version.
+// Each migration runs in its own transaction together with the update of the schema version.
+// Returns an error if the database has been migrated by a newer program version.
+func Migrate(db *sql.DB) error {
+	return migrate(db, migrations)
+}
+
+// Applies all migrations that have not been applied to the PostgreSQL database yet.
+//
+// PostgreSQL databases have their own migrations and versions, see Migrate.
+func MigratePostgres(db *sql.DB) error {
+	return migrate(db, postgresMigrations)
+}
+
+// Returns the current schema version of the database, 0 if no migration has been applied.
+func Version(db *sql.DB) (int, error) {
+	return version(db)
+}
+
+// Returns the latest sqlite schema version known by this program version.
+func LatestVersion() int {
+	return migrations[len(migrations)-1].Version
+}
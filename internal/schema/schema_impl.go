@@ -0,0 +1,311 @@
+package schema
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+)
+
+// All migrations ordered by version. Append new migrations, never modify applied ones.
+var migrations = []Migration{
+	{1, "create table accesslog", createAccessLog},
+	{2, "create table bans", createBans},
+	{3, "add ban category, statistics and source", addBanColumns},
+	{4, "replace accesslog hash index with unique index", uniqueHashIndex},
+	{5, "create statistics tables", createStats},
+	{6, "create tables rule_hits and ban_events", createAudit},
+	{7, "add extended accesslog columns", addAccessLogColumns},
+	{8, "add accesslog column client_addr", addClientAddr},
+	{9, "convert accesslog time_local to UTC and create index", timeLocalIndex},
+}
+
+// All PostgreSQL migrations ordered by version. Append new migrations, never modify applied ones.
+var postgresMigrations = []Migration{
+	{1, "create table accesslog", createPostgresAccessLog},
+	{2, "create table bans", createPostgresBans},
+	{3, "create statistics tables", createStats},
+	{4, "create tables rule_hits and ban_events", createPostgresAudit},
+	{5, "add extended accesslog columns", addPostgresAccessLogColumns},
+	{6, "add accesslog column client_addr", addPostgresClientAddr},
+	{7, "create accesslog time_local index", createTimeLocalIndex},
+}
+
+func migrate(db *sql.DB, migrations []Migration) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY,
+		description TEXT,
+		applied TIMESTAMP)`)
+	if err != nil {
+		return err
+	}
+	current, err := version(db)
+	if err != nil {
+		return err
+	}
+	latest := migrations[len(migrations)-1].Version
+	if current > latest {
+		return fmt.Errorf("database schema version %d is newer than the supported version %d", current, latest)
+	}
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+		err = apply(db, migration)
+		if err != nil {
+			return fmt.Errorf("database migration %d '%s' failed: %s", migration.Version, migration.Description, err.Error())
+		}
+	}
+	return nil
+}
+
+// Applies the migration in a transaction.
+// The migration is skipped if another process applied it in the meantime.
+func apply(db *sql.DB, migration Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	var applied int
+	err = tx.QueryRow("SELECT COUNT(*) FROM schema_version WHERE version=$1", migration.Version).Scan(&applied)
+	if err != nil || applied > 0 {
+		return err
+	}
+	err = migration.Apply(tx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO schema_version (version,description,applied) VALUES ($1,$2,$3)",
+		migration.Version, migration.Description, time.Now())
+	if err != nil {
+		return err
+	}
+	err = tx.Commit()
+	if err == nil {
+		log.Printf("Applied database migration %d: %s.\n", migration.Version, migration.Description)
+	}
+	return err
+}
+
+func version(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRow("SELECT MAX(version) FROM schema_version").Scan(&version)
+	return int(version.Int64), err
+}
+
+// Adds the column to the table if it does not exist.
+func addColumn(tx *sql.Tx, table string, name string, definition string) error {
+	var found int
+	err := tx.QueryRow("SELECT COUNT(*) FROM pragma_table_info($1) WHERE name=$2", table, name).Scan(&found)
+	if err == nil && found == 0 {
+		_, err = tx.Exec("ALTER TABLE " + table + " ADD COLUMN " + name + " " + definition)
+	}
+	return err
+}
+
+func createAccessLog(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS accesslog (
+		remote_addr TEXT,
+		time_local TIMESTAMP,
+		request_method TEXT,
+		request_uri TEXT,
+		request_protocol TEXT,
+		request_length INTEGER,
+		request_time INTEGER,
+		status INTEGER,
+		bytes_sent INTEGER,
+		user_agent TEXT,
+		hash TEXT)`)
+	if err == nil {
+		_, err = tx.Exec("CREATE INDEX IF NOT EXISTS accesslog_hash_idx ON accesslog (hash)")
+	}
+	return err
+}
+
+func createBans(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS bans (
+		ip TEXT PRIMARY KEY,
+		from_time TIMESTAMP,
+		to_time TIMESTAMP,
+		occurred INTEGER)`)
+	return err
+}
+
+func addBanColumns(tx *sql.Tx) error {
+	columns := []struct {
+		name       string
+		definition string
+	}{
+		{"category", "TEXT NOT NULL DEFAULT ''"},
+		{"first_seen", "TIMESTAMP"},
+		{"last_seen", "TIMESTAMP"},
+		{"rule", "TEXT NOT NULL DEFAULT ''"},
+		{"hits", "INTEGER NOT NULL DEFAULT 0"},
+		{"source", "TEXT NOT NULL DEFAULT ''"},
+	}
+	for _, column := range columns {
+		err := addColumn(tx, "bans", column.name, column.definition)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func uniqueHashIndex(tx *sql.Tx) error {
+	// duplicates may exist if several processes inserted the same log line
+	_, err := tx.Exec("DELETE FROM accesslog WHERE hash IS NOT NULL AND rowid NOT IN (SELECT MIN(rowid) FROM accesslog GROUP BY hash)")
+	if err == nil {
+		_, err = tx.Exec("DROP INDEX IF EXISTS accesslog_hash_idx")
+	}
+	if err == nil {
+		_, err = tx.Exec("CREATE UNIQUE INDEX IF NOT EXISTS accesslog_hash_uidx ON accesslog (hash)")
+	}
+	return err
+}
+
+// Statistics tables are used by sqlite and PostgreSQL. Hours and days are stored as UTC text.
+func createStats(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS stats_hourly (
+		hour TEXT NOT NULL,
+		status INTEGER NOT NULL,
+		requests BIGINT NOT NULL,
+		bytes_sent BIGINT NOT NULL,
+		PRIMARY KEY (hour, status))`)
+	if err == nil {
+		_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS stats_daily_ips (
+			day TEXT NOT NULL,
+			remote_addr TEXT NOT NULL,
+			requests BIGINT NOT NULL,
+			PRIMARY KEY (day, remote_addr))`)
+	}
+	return err
+}
+
+func createAudit(tx *sql.Tx) error {
+	return createAuditTables(tx, "INTEGER PRIMARY KEY AUTOINCREMENT", "TIMESTAMP")
+}
+
+// Rule hits reference the log lines by hash, because the rowid of accesslog may change on VACUUM.
+func createAuditTables(tx *sql.Tx, idDefinition string, timeType string) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS rule_hits (
+		id ` + idDefinition + `,
+		hash TEXT NOT NULL,
+		bad_rule TEXT NOT NULL,
+		good_rule TEXT NOT NULL DEFAULT '')`)
+	if err == nil {
+		_, err = tx.Exec("CREATE INDEX IF NOT EXISTS rule_hits_hash_idx ON rule_hits (hash)")
+	}
+	if err == nil {
+		_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS ban_events (
+			id ` + idDefinition + `,
+			event_time ` + timeType + ` NOT NULL,
+			ip TEXT NOT NULL,
+			action TEXT NOT NULL,
+			reason TEXT NOT NULL DEFAULT '',
+			to_time ` + timeType + `,
+			category TEXT NOT NULL DEFAULT '',
+			source TEXT NOT NULL DEFAULT '')`)
+	}
+	if err == nil {
+		_, err = tx.Exec("CREATE INDEX IF NOT EXISTS ban_events_ip_idx ON ban_events (ip)")
+	}
+	return err
+}
+
+// Optional fields of the log lines, NULL if the log format does not contain them.
+var accessLogColumns = []struct {
+	name       string
+	definition string
+}{
+	{"referer", "TEXT"},
+	{"host", "TEXT"},
+	{"x_forwarded_for", "TEXT"},
+	{"upstream_addr", "TEXT"},
+	{"upstream_response_time", "INTEGER"},
+	{"tls_protocol", "TEXT"},
+	{"proxy_protocol_addr", "TEXT"},
+}
+
+func addAccessLogColumns(tx *sql.Tx) error {
+	for _, column := range accessLogColumns {
+		err := addColumn(tx, "accesslog", column.name, column.definition)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Client IP address of requests forwarded by trusted proxies, NULL if the request has not been forwarded.
+func addClientAddr(tx *sql.Tx) error {
+	return addColumn(tx, "accesslog", "client_addr", "TEXT")
+}
+
+// Time ranges compare time_local as text, therefore all log lines are stored in UTC.
+// The format matches the sqlite driver: fractional seconds without trailing zeros and the offset +00:00.
+func timeLocalIndex(tx *sql.Tx) error {
+	_, err := tx.Exec(`UPDATE accesslog SET time_local=rtrim(rtrim(strftime('%Y-%m-%d %H:%M:%f', time_local), '0'), '.') || '+00:00'
+		WHERE time_local NOT LIKE '%+00:00' AND strftime('%Y-%m-%d %H:%M:%f', time_local) IS NOT NULL`)
+	if err == nil {
+		err = createTimeLocalIndex(tx)
+	}
+	return err
+}
+
+func createTimeLocalIndex(tx *sql.Tx) error {
+	_, err := tx.Exec("CREATE INDEX IF NOT EXISTS accesslog_time_local_idx ON accesslog (time_local)")
+	return err
+}
+
+func createPostgresAccessLog(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS accesslog (
+		id BIGSERIAL PRIMARY KEY,
+		remote_addr TEXT,
+		time_local TIMESTAMPTZ,
+		request_method TEXT,
+		request_uri TEXT,
+		request_protocol TEXT,
+		request_length INTEGER,
+		request_time INTEGER,
+		status INTEGER,
+		bytes_sent BIGINT,
+		user_agent TEXT,
+		hash TEXT UNIQUE)`)
+	return err
+}
+
+func createPostgresBans(tx *sql.Tx) error {
+	_, err := tx.Exec(`CREATE TABLE IF NOT EXISTS bans (
+		ip TEXT PRIMARY KEY,
+		from_time TIMESTAMPTZ,
+		to_time TIMESTAMPTZ,
+		occurred INTEGER,
+		category TEXT NOT NULL DEFAULT '',
+		first_seen TIMESTAMPTZ,
+		last_seen TIMESTAMPTZ,
+		rule TEXT NOT NULL DEFAULT '',
+		hits INTEGER NOT NULL DEFAULT 0,
+		source TEXT NOT NULL DEFAULT '')`)
+	return err
+}
+
+func createPostgresAudit(tx *sql.Tx) error {
+	return createAuditTables(tx, "BIGSERIAL PRIMARY KEY", "TIMESTAMPTZ")
+}
+
+func addPostgresAccessLogColumns(tx *sql.Tx) error {
+	for _, column := range accessLogColumns {
+		_, err := tx.Exec("ALTER TABLE accesslog ADD COLUMN IF NOT EXISTS " + column.name + " " + column.definition)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func addPostgresClientAddr(tx *sql.Tx) error {
+	_, err := tx.Exec("ALTER TABLE accesslog ADD COLUMN IF NOT EXISTS client_addr TEXT")
+	return err
+}
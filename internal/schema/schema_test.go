@@ -0,0 +1,131 @@
+package schema
+
+import (
+	"database/sql"
+	"errors"
+	"path"
+	"testing"
+
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func openDatabase(t *testing.T) *sql.DB {
+	db, err := sql.Open("sqlite3", path.Join(t.TempDir(), "test.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMigrate(t *testing.T) {
+	db := openDatabase(t)
+	require.NoError(t, Migrate(db))
+	version, err := Version(db)
+	assert.NoError(t, err)
+	assert.Equal(t, LatestVersion(), version)
+	_, err = db.Exec("INSERT INTO bans (ip,from_time,to_time,occurred,category,hits,source) VALUES ('1.1.1.1','2025-01-01','2025-01-02',1,'',1,'')")
+	assert.NoError(t, err)
+	_, err = db.Exec("INSERT INTO accesslog (remote_addr,hash) VALUES ('1.1.1.1','hash')")
+	assert.NoError(t, err)
+	// migrations are applied only once
+	require.NoError(t, Migrate(db))
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM schema_version").Scan(&count))
+	assert.Equal(t, len(migrations), count)
+}
+
+func TestMigrateExistingDatabase(t *testing.T) {
+	// database created by a version without schema_version table
+	db := openDatabase(t)
+	_, err := db.Exec("CREATE TABLE accesslog (remote_addr TEXT, time_local TIMESTAMP, request_method TEXT, request_uri TEXT, request_protocol TEXT, request_length INTEGER, request_time INTEGER, status INTEGER, bytes_sent INTEGER, user_agent TEXT, hash TEXT)")
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE bans (ip TEXT PRIMARY KEY, from_time TIMESTAMP, to_time TIMESTAMP, occurred INTEGER, category TEXT NOT NULL DEFAULT '')")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO bans (ip,from_time,to_time,occurred) VALUES ('1.1.1.1','2025-01-01','2025-01-02',1)")
+	require.NoError(t, err)
+	require.NoError(t, Migrate(db))
+	var ip, source string
+	var hits int
+	require.NoError(t, db.QueryRow("SELECT ip,hits,source FROM bans").Scan(&ip, &hits, &source))
+	assert.Equal(t, "1.1.1.1", ip)
+	assert.Equal(t, 0, hits)
+	assert.Equal(t, "", source)
+}
+
+func TestMigrateDuplicateHashes(t *testing.T) {
+	// database created by a version with a non unique hash index
+	db := openDatabase(t)
+	_, err := db.Exec("CREATE TABLE accesslog (remote_addr TEXT, time_local TIMESTAMP, request_method TEXT, request_uri TEXT, request_protocol TEXT, request_length INTEGER, request_time INTEGER, status INTEGER, bytes_sent INTEGER, user_agent TEXT, hash TEXT)")
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE INDEX accesslog_hash_idx ON accesslog (hash)")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO accesslog (remote_addr,hash) VALUES ('1.1.1.1','a'),('1.1.1.2','a'),('1.1.1.3','b')")
+	require.NoError(t, err)
+	require.NoError(t, Migrate(db))
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM accesslog").Scan(&count))
+	assert.Equal(t, 2, count)
+	var addr string
+	require.NoError(t, db.QueryRow("SELECT remote_addr FROM accesslog WHERE hash='a'").Scan(&addr))
+	assert.Equal(t, "1.1.1.1", addr)
+	_, err = db.Exec("INSERT INTO accesslog (remote_addr,hash) VALUES ('1.1.1.4','b')")
+	assert.Error(t, err)
+	res, err := db.Exec("INSERT OR IGNORE INTO accesslog (remote_addr,hash) VALUES ('1.1.1.4','b')")
+	require.NoError(t, err)
+	cnt, err := res.RowsAffected()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(0), cnt)
+}
+
+func TestMigrateTimeLocal(t *testing.T) {
+	// log lines stored with the time zone offset of the log line are converted to UTC
+	db := openDatabase(t)
+	require.NoError(t, migrate(db, migrations[:8]))
+	_, err := db.Exec(`INSERT INTO accesslog (remote_addr,time_local,hash) VALUES
+		('1.1.1.1','2025-06-02 01:30:00.5+02:00','a'),('1.1.1.2','2025-06-01 23:00:00+00:00','b'),('1.1.1.3','2025-06-01 22:15:00-01:00','c'),('1.1.1.4',NULL,'d')`)
+	require.NoError(t, err)
+	require.NoError(t, Migrate(db))
+	var timeLocals []string
+	rows, err := db.Query("SELECT COALESCE(CAST(time_local AS TEXT),'') FROM accesslog ORDER BY time_local")
+	require.NoError(t, err)
+	defer rows.Close()
+	for rows.Next() {
+		var timeLocal string
+		require.NoError(t, rows.Scan(&timeLocal))
+		timeLocals = append(timeLocals, timeLocal)
+	}
+	require.NoError(t, rows.Err())
+	assert.Equal(t, []string{"", "2025-06-01 23:00:00+00:00", "2025-06-01 23:15:00+00:00", "2025-06-01 23:30:00.5+00:00"}, timeLocals)
+	var plan string
+	require.NoError(t, db.QueryRow("EXPLAIN QUERY PLAN SELECT * FROM accesslog WHERE time_local >= ?", "2025-06-01").Scan(new(int), new(int), new(int), &plan))
+	assert.Contains(t, plan, "accesslog_time_local_idx")
+}
+
+func TestMigrateErrors(t *testing.T) {
+	db := openDatabase(t)
+	test := []Migration{
+		{1, "first", func(tx *sql.Tx) error {
+			_, err := tx.Exec("CREATE TABLE test (id INTEGER)")
+			return err
+		}},
+		{2, "failing", func(tx *sql.Tx) error {
+			_, err := tx.Exec("INSERT INTO test VALUES (1)")
+			if err == nil {
+				err = errors.New("simulate error")
+			}
+			return err
+		}},
+	}
+	err := migrate(db, test)
+	assert.ErrorContains(t, err, "database migration 2 'failing' failed")
+	// failed migration is rolled back
+	version, err := Version(db)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, version)
+	var count int
+	require.NoError(t, db.QueryRow("SELECT COUNT(*) FROM test").Scan(&count))
+	assert.Equal(t, 0, count)
+	// database of a newer program version
+	assert.ErrorContains(t, migrate(db, []Migration{{0, "none", nil}}), "newer than the supported version")
+}
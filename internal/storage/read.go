@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/parser"
+)
+
+// Columns of a log line in the table accesslog, see ScanLogLine.
+const LOG_LINE_COLUMNS = "remote_addr,time_local,request_method,request_uri,request_protocol,request_length,request_time,status,bytes_sent,user_agent," +
+	"referer,host,x_forwarded_for,upstream_addr,upstream_response_time,tls_protocol,proxy_protocol_addr,client_addr"
+
+func (storage *storage_impl) ReadLogLines(filter LogFilter, fn func(logLine parser.LogLine) error) error {
+	err := storage.initDatabase()
+	if err != nil {
+		return err
+	}
+	where, args := storage.whereClause(filter)
+	rows, err := storage.db.Query("SELECT "+LOG_LINE_COLUMNS+" FROM accesslog"+where+" ORDER BY "+storage.dialect.idColumn, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		logLine, err := ScanLogLine(rows)
+		if err == nil {
+			err = fn(logLine)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (storage *storage_impl) RecentLogLines(filter LogFilter, limit int) ([]parser.LogLine, error) {
+	err := storage.initDatabase()
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = DEFAULT_SEARCH_LIMIT
+	}
+	where, args := storage.whereClause(filter)
+	args = append(args, limit)
+	rows, err := storage.db.Query(fmt.Sprintf("SELECT %s FROM accesslog%s ORDER BY %s DESC LIMIT $%d",
+		LOG_LINE_COLUMNS, where, storage.dialect.idColumn, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	logLines := []parser.LogLine{}
+	for rows.Next() {
+		logLine, err := ScanLogLine(rows)
+		if err != nil {
+			return nil, err
+		}
+		logLines = append(logLines, logLine)
+	}
+	return logLines, rows.Err()
+}
+
+func (storage *storage_impl) RuleHitCounts(from time.Time) ([]RuleHitCount, error) {
+	err := storage.initDatabase()
+	if err != nil {
+		return nil, err
+	}
+	where, args := storage.whereClause(LogFilter{From: from})
+	rows, err := storage.db.Query("SELECT r.bad_rule,COUNT(*),SUM(CASE WHEN r.good_rule='' THEN 0 ELSE 1 END)"+
+		" FROM rule_hits r JOIN accesslog ON accesslog.hash=r.hash"+where+" GROUP BY r.bad_rule ORDER BY 2 DESC,1", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []RuleHitCount{}
+	for rows.Next() {
+		var count RuleHitCount
+		err = rows.Scan(&count.BadRule, &count.Hits, &count.Overridden)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+func (storage *storage_impl) TopURIs(from time.Time, limit int) ([]ValueCount, error) {
+	return storage.topValues("request_uri", from, limit)
+}
+
+func (storage *storage_impl) TopUserAgents(from time.Time, limit int) ([]ValueCount, error) {
+	return storage.topValues("user_agent", from, limit)
+}
+
+// Returns the most frequent values of the column of the log lines since the specified time, empty values are skipped.
+func (storage *storage_impl) topValues(column string, from time.Time, limit int) ([]ValueCount, error) {
+	err := storage.initDatabase()
+	if err != nil {
+		return nil, err
+	}
+	where, args := storage.whereClause(LogFilter{From: from})
+	if len(where) == 0 {
+		where = " WHERE "
+	} else {
+		where += " AND "
+	}
+	args = append(args, limit)
+	rows, err := storage.db.Query(fmt.Sprintf("SELECT %[1]s,COUNT(*) FROM accesslog%[2]s%[1]s <> '' GROUP BY %[1]s ORDER BY 2 DESC,1 LIMIT $%[3]d",
+		column, where, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []ValueCount{}
+	for rows.Next() {
+		var count ValueCount
+		err = rows.Scan(&count.Value, &count.Requests)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+// Returns the WHERE clause for the filter, an empty string if the filter matches all log lines.
+func (storage *storage_impl) whereClause(filter LogFilter) (string, []any) {
+	var conditions []string
+	var args []any
+	// adds a condition with the next numbered parameter, supported by sqlite and PostgreSQL
+	addCondition := func(format string, arg any) {
+		args = append(args, arg)
+		conditions = append(conditions, fmt.Sprintf(format, fmt.Sprintf("$%d", len(args))))
+	}
+	// time_local is stored in UTC, so sqlite can compare the text with the index
+	if !filter.From.IsZero() {
+		addCondition("time_local >= %s", filter.From.UTC())
+	}
+	if !filter.To.IsZero() {
+		addCondition("time_local < %s", filter.To.UTC())
+	}
+	if len(filter.RemoteAddr) > 0 {
+		addCondition("(remote_addr = %[1]s OR client_addr = %[1]s)", filter.RemoteAddr)
+	}
+	if filter.Status > 0 {
+		addCondition("status = %s", filter.Status)
+	}
+	if len(filter.RequestMethod) > 0 {
+		addCondition("request_method = %s", filter.RequestMethod)
+	}
+	if len(conditions) == 0 {
+		return "", nil
+	}
+	return " WHERE " + strings.Join(conditions, " AND "), args
+}
+
+// Scans the columns of LOG_LINE_COLUMNS, missing values are returned as zero values.
+// Further selected columns are scanned into the extra destinations.
+func ScanLogLine(rows *sql.Rows, extra ...any) (parser.LogLine, error) {
+	var logLine parser.LogLine
+	var timeLocal sql.NullTime
+	var remoteAddr, method, uri, protocol, userAgent, referer, host, forwardedFor, upstreamAddr, tlsProtocol, proxyProtocolAddr, clientAddr sql.NullString
+	var length, requestTime, status, bytesSent, upstreamResponseTime sql.NullInt64
+	dest := []any{&remoteAddr, &timeLocal, &method, &uri, &protocol, &length, &requestTime, &status, &bytesSent, &userAgent,
+		&referer, &host, &forwardedFor, &upstreamAddr, &upstreamResponseTime, &tlsProtocol, &proxyProtocolAddr, &clientAddr}
+	err := rows.Scan(append(dest, extra...)...)
+	if err != nil {
+		return logLine, err
+	}
+	logLine.RemoteAddr = remoteAddr.String
+	logLine.TimeLocal = timeLocal.Time
+	logLine.RequestMethod = method.String
+	logLine.RequestUri = uri.String
+	logLine.RequestProtocol = protocol.String
+	logLine.RequestLength = int(length.Int64)
+	logLine.RequestTime = int(requestTime.Int64)
+	logLine.Status = int(status.Int64)
+	logLine.BytesSent = int(bytesSent.Int64)
+	logLine.UserAgent = userAgent.String
+	logLine.Referer = referer.String
+	logLine.Host = host.String
+	logLine.XForwardedFor = forwardedFor.String
+	logLine.UpstreamAddr = upstreamAddr.String
+	logLine.UpstreamResponseTime = int(upstreamResponseTime.Int64)
+	logLine.TlsProtocol = tlsProtocol.String
+	logLine.ProxyProtocolAddr = proxyProtocolAddr.String
+	logLine.ClientAddr = clientAddr.String
+	return logLine, nil
+}
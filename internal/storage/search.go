@@ -0,0 +1,112 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"strings"
+
+	"github.com/nylssoft/goaccesslog/internal/parser"
+)
+
+// The full-text index is kept in sync with the table accesslog by triggers.
+// It is not created by a schema migration because FTS5 is only available if sqlite
+// has been built with the tag sqlite_fts5. The triggers are dropped if a program version
+// without FTS5 opens the database, and the index is rebuilt once FTS5 is available again.
+var searchStmts = []string{
+	`CREATE VIRTUAL TABLE IF NOT EXISTS accesslog_fts USING fts5(request_uri, user_agent, content='accesslog', content_rowid='rowid')`,
+	`CREATE TRIGGER IF NOT EXISTS accesslog_fts_insert AFTER INSERT ON accesslog BEGIN
+		INSERT INTO accesslog_fts (rowid,request_uri,user_agent) VALUES (new.rowid,new.request_uri,new.user_agent);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS accesslog_fts_delete AFTER DELETE ON accesslog BEGIN
+		INSERT INTO accesslog_fts (accesslog_fts,rowid,request_uri,user_agent) VALUES ('delete',old.rowid,old.request_uri,old.user_agent);
+	END`,
+	`CREATE TRIGGER IF NOT EXISTS accesslog_fts_update AFTER UPDATE ON accesslog BEGIN
+		INSERT INTO accesslog_fts (accesslog_fts,rowid,request_uri,user_agent) VALUES ('delete',old.rowid,old.request_uri,old.user_agent);
+		INSERT INTO accesslog_fts (rowid,request_uri,user_agent) VALUES (new.rowid,new.request_uri,new.user_agent);
+	END`,
+	`INSERT INTO accesslog_fts (accesslog_fts) VALUES ('rebuild')`,
+}
+
+var searchTriggers = []string{"accesslog_fts_insert", "accesslog_fts_delete", "accesslog_fts_update"}
+
+// Columns of LOG_LINE_COLUMNS qualified with the alias of the table accesslog
+var searchColumns = "a." + strings.ReplaceAll(LOG_LINE_COLUMNS, ",", ",a.")
+
+// Creates or drops the full-text index depending on the availability of FTS5.
+// Returns whether full-text search is available.
+func initSearch(db *sql.DB) (bool, error) {
+	var available bool
+	err := db.QueryRow("SELECT sqlite_compileoption_used('ENABLE_FTS5')").Scan(&available)
+	if err != nil {
+		return false, err
+	}
+	var triggers int
+	err = db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type='trigger' AND name LIKE 'accesslog_fts_%'").Scan(&triggers)
+	if err != nil || available == (triggers == len(searchTriggers)) {
+		return available, err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if available {
+		log.Println("Create full-text index for log lines. This may take a while.")
+		for _, stmt := range searchStmts {
+			_, err = tx.Exec(stmt)
+			if err != nil {
+				return false, err
+			}
+		}
+	} else {
+		log.Println("Full-text search is not available. Build with tag sqlite_fts5 to enable it.")
+		for _, trigger := range searchTriggers {
+			_, err = tx.Exec("DROP TRIGGER IF EXISTS " + trigger)
+			if err != nil {
+				return false, err
+			}
+		}
+	}
+	return available, tx.Commit()
+}
+
+func (storage *storage_impl) Search(query SearchQuery) ([]parser.LogLine, error) {
+	err := storage.initDatabase()
+	if err != nil {
+		return nil, err
+	}
+	if !storage.searchAvailable {
+		return nil, errors.New("full-text search requires a sqlite database and a program built with tag sqlite_fts5")
+	}
+	conditions := []string{"accesslog_fts MATCH ?"}
+	args := []any{query.Text}
+	if !query.From.IsZero() {
+		conditions = append(conditions, "a.time_local >= ?")
+		args = append(args, query.From.UTC())
+	}
+	if !query.To.IsZero() {
+		conditions = append(conditions, "a.time_local < ?")
+		args = append(args, query.To.UTC())
+	}
+	limit := query.Limit
+	if limit <= 0 {
+		limit = DEFAULT_SEARCH_LIMIT
+	}
+	args = append(args, limit)
+	rows, err := storage.db.Query("SELECT "+searchColumns+" FROM accesslog_fts JOIN accesslog a ON a.rowid=accesslog_fts.rowid WHERE "+
+		strings.Join(conditions, " AND ")+" ORDER BY a.rowid DESC LIMIT ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	logLines := []parser.LogLine{}
+	for rows.Next() {
+		logLine, err := ScanLogLine(rows)
+		if err != nil {
+			return nil, err
+		}
+		logLines = append(logLines, logLine)
+	}
+	return logLines, rows.Err()
+}
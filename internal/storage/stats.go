@@ -0,0 +1,152 @@
+package storage
+
+import (
+	"database/sql"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/parser"
+)
+
+const upsertHourlyStmt = `INSERT INTO stats_hourly (hour,status,requests,bytes_sent) VALUES ($1,$2,$3,$4)
+	ON CONFLICT(hour,status) DO UPDATE SET requests=stats_hourly.requests+excluded.requests,bytes_sent=stats_hourly.bytes_sent+excluded.bytes_sent`
+
+const upsertDailyIpsStmt = `INSERT INTO stats_daily_ips (day,remote_addr,requests) VALUES ($1,$2,$3)
+	ON CONFLICT(day,remote_addr) DO UPDATE SET requests=stats_daily_ips.requests+excluded.requests`
+
+type hourlyKey struct {
+	hour   string
+	status int
+}
+
+type hourlyStat struct {
+	requests  int64
+	bytesSent int64
+}
+
+type dailyIpKey struct {
+	day        string
+	remoteAddr string
+}
+
+// Statistics of the log lines inserted in a batch, saved when the batch is committed.
+type stats struct {
+	hourly   map[hourlyKey]hourlyStat
+	dailyIps map[dailyIpKey]int64
+}
+
+func newStats() *stats {
+	return &stats{hourly: map[hourlyKey]hourlyStat{}, dailyIps: map[dailyIpKey]int64{}}
+}
+
+func (stats *stats) add(logLine parser.LogLine) {
+	key := hourlyKey{hour: formatHour(logLine.TimeLocal), status: logLine.Status}
+	stat := stats.hourly[key]
+	stat.requests++
+	stat.bytesSent += int64(logLine.BytesSent)
+	stats.hourly[key] = stat
+	stats.dailyIps[dailyIpKey{day: formatDay(logLine.TimeLocal), remoteAddr: logLine.Client()}]++
+}
+
+// Adds the statistics to the statistics tables.
+func (stats *stats) save(tx *sql.Tx) error {
+	hourlyStmt, err := tx.Prepare(upsertHourlyStmt)
+	if err != nil {
+		return err
+	}
+	defer hourlyStmt.Close()
+	for key, stat := range stats.hourly {
+		_, err = hourlyStmt.Exec(key.hour, key.status, stat.requests, stat.bytesSent)
+		if err != nil {
+			return err
+		}
+	}
+	dailyIpsStmt, err := tx.Prepare(upsertDailyIpsStmt)
+	if err != nil {
+		return err
+	}
+	defer dailyIpsStmt.Close()
+	for key, requests := range stats.dailyIps {
+		_, err = dailyIpsStmt.Exec(key.day, key.remoteAddr, requests)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replaces the statistics tables with the statistics of all stored log lines.
+// The SQL expressions have to return the same text as formatHour and formatDay.
+func rebuildStats(tx *sql.Tx, hourExpr string, dayExpr string) error {
+	_, err := tx.Exec("DELETE FROM stats_hourly")
+	if err == nil {
+		_, err = tx.Exec("DELETE FROM stats_daily_ips")
+	}
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO stats_hourly (hour,status,requests,bytes_sent) SELECT " + hourExpr + ",status,COUNT(*),COALESCE(SUM(bytes_sent),0)" +
+			" FROM accesslog WHERE time_local IS NOT NULL AND status IS NOT NULL GROUP BY 1,2")
+	}
+	if err == nil {
+		_, err = tx.Exec("INSERT INTO stats_daily_ips (day,remote_addr,requests) SELECT " + dayExpr + ",COALESCE(client_addr,remote_addr),COUNT(*)" +
+			" FROM accesslog WHERE time_local IS NOT NULL AND remote_addr IS NOT NULL GROUP BY 1,2")
+	}
+	return err
+}
+
+func (storage *storage_impl) TopIPs(from time.Time, limit int) ([]IPCount, error) {
+	err := storage.initDatabase()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := storage.db.Query("SELECT remote_addr,SUM(requests) FROM stats_daily_ips WHERE day >= $1"+
+		" GROUP BY remote_addr ORDER BY 2 DESC,1 LIMIT $2", formatDay(from), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	counts := []IPCount{}
+	for rows.Next() {
+		var count IPCount
+		err = rows.Scan(&count.IP, &count.Requests)
+		if err != nil {
+			return nil, err
+		}
+		counts = append(counts, count)
+	}
+	return counts, rows.Err()
+}
+
+func (storage *storage_impl) HourlyStats(from time.Time) ([]HourlyStat, error) {
+	err := storage.initDatabase()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := storage.db.Query("SELECT hour,status,requests,bytes_sent FROM stats_hourly WHERE hour >= $1 ORDER BY hour,status", formatHour(from))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	stats := []HourlyStat{}
+	for rows.Next() {
+		var stat HourlyStat
+		var hour string
+		err = rows.Scan(&hour, &stat.Status, &stat.Requests, &stat.BytesSent)
+		if err == nil {
+			stat.Hour, err = time.Parse(time.RFC3339, hour)
+		}
+		if err != nil {
+			return nil, err
+		}
+		stats = append(stats, stat)
+	}
+	return stats, rows.Err()
+}
+
+// Returns the UTC hour of the time, e.g. 2025-06-01T16:00:00Z.
+func formatHour(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:00:00Z")
+}
+
+// Returns the UTC day of the time, e.g. 2025-06-01.
+func formatDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
@@ -0,0 +1,308 @@
+package storage
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+	"time"
+
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+	"github.com/nylssoft/goaccesslog/internal/parser"
+	"github.com/nylssoft/goaccesslog/internal/schema"
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+)
+
+const upsertStmt = `INSERT INTO bans (ip,from_time,to_time,occurred,category,first_seen,last_seen,rule,hits,source) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10)
+	ON CONFLICT(ip) DO UPDATE SET from_time=excluded.from_time,to_time=excluded.to_time,occurred=excluded.occurred,category=excluded.category,
+	first_seen=excluded.first_seen,last_seen=excluded.last_seen,rule=excluded.rule,hits=excluded.hits,source=excluded.source`
+
+const insertBanEventStmt = "INSERT INTO ban_events (event_time,ip,action,reason,to_time,category,source) VALUES ($1,$2,$3,$4,$5,$6,$7)"
+
+const insertRuleHitStmt = "INSERT INTO rule_hits (hash,bad_rule,good_rule) VALUES ($1,$2,$3)"
+
+const insertColumns = "remote_addr,time_local,request_method,request_uri,request_protocol,request_length,request_time,status,bytes_sent,user_agent,hash," +
+	"referer,host,x_forwarded_for,upstream_addr,upstream_response_time,tls_protocol,proxy_protocol_addr,client_addr"
+
+const insertValues = "$1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$19"
+
+// SQL statements that differ between the database drivers.
+type dialect struct {
+	dataSource    func(string) string
+	migrate       func(*sql.DB) error
+	insertStmt    string
+	lastTimeQuery string
+	// SQL expressions for the UTC hour and day of time_local, see formatHour and formatDay
+	hourExpr string
+	dayExpr  string
+	// Column with the insertion order of the log lines
+	idColumn string
+}
+
+var dialects = map[string]dialect{
+	DRIVER_SQLITE: {
+		dataSource: func(filename string) string {
+			return filename + "?_busy_timeout=5000&_txlock=immediate&_journal_mode=WAL"
+		},
+		migrate:       schema.Migrate,
+		insertStmt:    "INSERT OR IGNORE INTO accesslog (" + insertColumns + ") VALUES (" + insertValues + ")",
+		lastTimeQuery: "SELECT time_local FROM accesslog ORDER BY rowid DESC LIMIT 1",
+		hourExpr:      "strftime('%Y-%m-%dT%H:00:00Z', time_local)",
+		dayExpr:       "strftime('%Y-%m-%d', time_local)",
+		idColumn:      "rowid",
+	},
+	DRIVER_POSTGRES: {
+		dataSource:    func(dataSource string) string { return dataSource },
+		migrate:       schema.MigratePostgres,
+		insertStmt:    "INSERT INTO accesslog (" + insertColumns + ") VALUES (" + insertValues + ") ON CONFLICT (hash) DO NOTHING",
+		lastTimeQuery: "SELECT time_local FROM accesslog ORDER BY id DESC LIMIT 1",
+		hourExpr:      `to_char(time_local AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:00:00"Z"')`,
+		dayExpr:       `to_char(time_local AT TIME ZONE 'UTC', 'YYYY-MM-DD')`,
+		idColumn:      "id",
+	},
+}
+
+type storage_impl struct {
+	driver     string
+	dataSource string
+	// guards opening and closing the database, the storage is used by several goroutines
+	mutex           sync.Mutex
+	dialect         dialect
+	db              *sql.DB
+	searchAvailable bool
+}
+
+type batch_impl struct {
+	tx          *sql.Tx
+	insertStmt  *sql.Stmt
+	ruleHitStmt *sql.Stmt
+	stats       *stats
+}
+
+func (storage *storage_impl) Begin() (Batch, error) {
+	err := storage.initDatabase()
+	if err != nil {
+		return nil, err
+	}
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	batch := &batch_impl{tx: tx, stats: newStats()}
+	batch.insertStmt, err = tx.Prepare(storage.dialect.insertStmt)
+	if err == nil {
+		batch.ruleHitStmt, err = tx.Prepare(insertRuleHitStmt)
+	}
+	if err != nil {
+		batch.Rollback()
+		return nil, err
+	}
+	return batch, nil
+}
+
+func (storage *storage_impl) LastTimeLocal() (time.Time, error) {
+	err := storage.initDatabase()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var timeLocal sql.NullTime
+	err = storage.db.QueryRow(storage.dialect.lastTimeQuery).Scan(&timeLocal)
+	if err == sql.ErrNoRows {
+		err = nil
+	}
+	return timeLocal.Time, err
+}
+
+func (storage *storage_impl) RebuildStats() error {
+	err := storage.initDatabase()
+	if err != nil {
+		return err
+	}
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = rebuildStats(tx, storage.dialect.hourExpr, storage.dialect.dayExpr)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (storage *storage_impl) LoadBans() ([]ufw.Ban, error) {
+	err := storage.initDatabase()
+	if err != nil {
+		return nil, err
+	}
+	rows, err := storage.db.Query("SELECT ip,from_time,to_time,occurred,category,first_seen,last_seen,rule,hits,source FROM bans")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var bans []ufw.Ban
+	for rows.Next() {
+		var ban ufw.Ban
+		var firstSeen, lastSeen sql.NullTime
+		err = rows.Scan(&ban.IP, &ban.From, &ban.To, &ban.Occurred, &ban.Category, &firstSeen, &lastSeen, &ban.Rule, &ban.Hits, &ban.Source)
+		if err != nil {
+			return nil, err
+		}
+		ban.FirstSeen = firstSeen.Time
+		ban.LastSeen = lastSeen.Time
+		bans = append(bans, ban)
+	}
+	return bans, rows.Err()
+}
+
+func (storage *storage_impl) SaveBan(ban ufw.Ban) error {
+	err := storage.initDatabase()
+	if err == nil {
+		_, err = storage.db.Exec(upsertStmt, banArgs(ban)...)
+	}
+	return err
+}
+
+func (storage *storage_impl) SaveBans(bans []ufw.Ban) error {
+	err := storage.initDatabase()
+	if err != nil {
+		return err
+	}
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(upsertStmt)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, ban := range bans {
+		_, err = stmt.Exec(banArgs(ban)...)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (storage *storage_impl) SaveBanEvents(events []ufw.BanEvent) error {
+	err := storage.initDatabase()
+	if err != nil {
+		return err
+	}
+	tx, err := storage.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.Prepare(insertBanEventStmt)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+	for _, event := range events {
+		var to sql.NullTime
+		if !event.To.IsZero() {
+			to = sql.NullTime{Time: event.To, Valid: true}
+		}
+		_, err = stmt.Exec(event.Time, event.IP, event.Action, event.Reason, to, event.Category, event.Source)
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (storage *storage_impl) Close() {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if storage.db != nil {
+		storage.db.Close()
+		storage.db = nil
+	}
+}
+
+// Opens and migrates the database on first use.
+func (storage *storage_impl) initDatabase() error {
+	storage.mutex.Lock()
+	defer storage.mutex.Unlock()
+	if storage.db != nil {
+		return nil
+	}
+	dialect, ok := dialects[storage.driver]
+	if !ok {
+		return fmt.Errorf("unsupported database driver '%s'", storage.driver)
+	}
+	db, err := sql.Open(storage.driver, dialect.dataSource(storage.dataSource))
+	if err != nil {
+		return err
+	}
+	err = dialect.migrate(db)
+	if err == nil && storage.driver == DRIVER_SQLITE {
+		storage.searchAvailable, err = initSearch(db)
+	}
+	if err != nil {
+		db.Close()
+		return err
+	}
+	storage.db = db
+	storage.dialect = dialect
+	return nil
+}
+
+func (batch *batch_impl) Insert(logLine parser.LogLine, hash string) (bool, error) {
+	// extended fields are stored as NULL if the log format does not contain them
+	var upstreamResponseTime sql.NullInt64
+	if len(logLine.UpstreamAddr) > 0 || logLine.UpstreamResponseTime > 0 {
+		upstreamResponseTime = sql.NullInt64{Int64: int64(logLine.UpstreamResponseTime), Valid: true}
+	}
+	res, err := batch.insertStmt.Exec(logLine.RemoteAddr, logLine.TimeLocal.UTC(), logLine.RequestMethod, logLine.RequestUri, logLine.RequestProtocol,
+		logLine.RequestLength, logLine.RequestTime, logLine.Status, logLine.BytesSent, logLine.UserAgent, hash,
+		nullString(logLine.Referer), nullString(logLine.Host), nullString(logLine.XForwardedFor), nullString(logLine.UpstreamAddr),
+		upstreamResponseTime, nullString(logLine.TlsProtocol), nullString(logLine.ProxyProtocolAddr), nullString(logLine.ClientAddr))
+	if err != nil {
+		return false, err
+	}
+	cnt, err := res.RowsAffected()
+	if err == nil && cnt > 0 {
+		batch.stats.add(logLine)
+	}
+	return cnt > 0, err
+}
+
+func (batch *batch_impl) InsertRuleHit(hit RuleHit) error {
+	_, err := batch.ruleHitStmt.Exec(hit.Hash, hit.BadRule, hit.GoodRule)
+	return err
+}
+
+func (batch *batch_impl) Commit() error {
+	batch.closeStmts()
+	err := batch.stats.save(batch.tx)
+	if err != nil {
+		return err
+	}
+	return batch.tx.Commit()
+}
+
+func (batch *batch_impl) Rollback() {
+	batch.closeStmts()
+	batch.tx.Rollback()
+}
+
+func (batch *batch_impl) closeStmts() {
+	for _, stmt := range []*sql.Stmt{batch.insertStmt, batch.ruleHitStmt} {
+		if stmt != nil {
+			stmt.Close()
+		}
+	}
+}
+
+func banArgs(ban ufw.Ban) []any {
+	return []any{ban.IP, ban.From, ban.To, ban.Occurred, ban.Category, ban.FirstSeen, ban.LastSeen, ban.Rule, ban.Hits, ban.Source}
+}
+
+func nullString(str string) sql.NullString {
+	return sql.NullString{String: str, Valid: len(str) > 0}
+}
@@ -0,0 +1,532 @@
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/parser"
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Environment variable with the connection string of a PostgreSQL test database.
+// All log lines and bans of the database are deleted by the tests.
+const postgresEnv = "GOACCESSLOG_TEST_POSTGRES"
+
+// Returns the storages to test, the PostgreSQL storage only if the test database is configured.
+func testStorages(t *testing.T) map[string]Storage {
+	storages := map[string]Storage{DRIVER_SQLITE: NewStorage(DRIVER_SQLITE, path.Join(t.TempDir(), "test.db"))}
+	dataSource := os.Getenv(postgresEnv)
+	if len(dataSource) > 0 {
+		db, err := sql.Open(DRIVER_POSTGRES, dataSource)
+		require.NoError(t, err)
+		_, err = db.Exec("DROP TABLE IF EXISTS accesslog, bans, stats_hourly, stats_daily_ips, rule_hits, ban_events, schema_version")
+		require.NoError(t, err)
+		db.Close()
+		storages[DRIVER_POSTGRES] = NewStorage(DRIVER_POSTGRES, dataSource)
+	} else {
+		t.Logf("Skip PostgreSQL storage, set %s to test it.", postgresEnv)
+	}
+	return storages
+}
+
+func TestBanStore(t *testing.T) {
+	for driver, store := range testStorages(t) {
+		t.Run(driver, func(t *testing.T) {
+			defer store.Close()
+			testBanStore(t, store)
+		})
+	}
+}
+
+func testBanStore(t *testing.T, store Storage) {
+	assert.NotNil(t, store)
+
+	bans, err := store.LoadBans()
+	assert.NoError(t, err)
+	assert.Empty(t, bans)
+
+	from := time.Now().Truncate(time.Second)
+	err = store.SaveBan(ufw.Ban{IP: "1.1.1.1", From: from, To: from.Add(time.Hour), Occurred: 1})
+	assert.NoError(t, err)
+	err = store.SaveBan(ufw.Ban{IP: "2001:db8::/64", From: from, To: from.Add(time.Hour), Occurred: 1})
+	assert.NoError(t, err)
+	// update existing ban
+	err = store.SaveBan(ufw.Ban{IP: "1.1.1.1", From: from, To: from.Add(2 * time.Hour), Occurred: 2,
+		FirstSeen: from.Add(-time.Hour), LastSeen: from, Rule: "status-444", Hits: 5, Source: "web2"})
+	assert.NoError(t, err)
+
+	// bans are kept after the database is closed
+	store.Close()
+	bans, err = store.LoadBans()
+	assert.NoError(t, err)
+	require.Len(t, bans, 2)
+	for _, ban := range bans {
+		if ban.IP == "1.1.1.1" {
+			assert.Equal(t, 2, ban.Occurred)
+			assert.True(t, from.Add(2*time.Hour).Equal(ban.To))
+			assert.True(t, from.Add(-time.Hour).Equal(ban.FirstSeen))
+			assert.True(t, from.Equal(ban.LastSeen))
+			assert.Equal(t, "status-444", ban.Rule)
+			assert.Equal(t, 5, ban.Hits)
+			assert.Equal(t, "web2", ban.Source)
+		} else {
+			assert.Equal(t, "2001:db8::/64", ban.IP)
+			assert.True(t, from.Equal(ban.From))
+		}
+	}
+
+	// bans are saved in a transaction
+	err = store.SaveBans([]ufw.Ban{
+		{IP: "1.10.16.0/20", From: from, Category: ufw.CATEGORY_BLOCKLIST},
+		{IP: "1.1.1.1", From: from, To: from.Add(3 * time.Hour), Occurred: 3, Category: ufw.CATEGORY_BLOCKLIST}})
+	assert.NoError(t, err)
+	bans, err = store.LoadBans()
+	assert.NoError(t, err)
+	require.Len(t, bans, 3)
+	for _, ban := range bans {
+		if ban.IP == "1.1.1.1" || ban.IP == "1.10.16.0/20" {
+			assert.Equal(t, ufw.CATEGORY_BLOCKLIST, ban.Category)
+		} else {
+			assert.Equal(t, "", ban.Category)
+		}
+	}
+
+}
+
+func TestConcurrentInit(t *testing.T) {
+	for driver, store := range testStorages(t) {
+		t.Run(driver, func(t *testing.T) {
+			defer store.Close()
+			// the database is opened by the first of several goroutines, e.g. the analyzer and the HTTP API
+			var wg sync.WaitGroup
+			for i := range 10 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if i%2 == 0 {
+						_, err := store.LastTimeLocal()
+						assert.NoError(t, err)
+					} else {
+						_, err := store.LoadBans()
+						assert.NoError(t, err)
+					}
+				}()
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestBanStoreMigration(t *testing.T) {
+	from := time.Now().Truncate(time.Second)
+	// category column is added to a table of a previous version
+	filename := path.Join(t.TempDir(), "old.db")
+	db, err := sql.Open("sqlite3", filename)
+	require.NoError(t, err)
+	_, err = db.Exec("CREATE TABLE bans (ip TEXT PRIMARY KEY, from_time TIMESTAMP, to_time TIMESTAMP, occurred INTEGER)")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO bans VALUES ('1.1.1.1', $1, $2, 1)", from, from.Add(time.Hour))
+	require.NoError(t, err)
+	db.Close()
+	store := NewStorage(DRIVER_SQLITE, filename)
+	bans, err := store.LoadBans()
+	assert.NoError(t, err)
+	require.Len(t, bans, 1)
+	assert.Equal(t, "", bans[0].Category)
+	assert.True(t, bans[0].FirstSeen.IsZero())
+	assert.Equal(t, 0, bans[0].Hits)
+	store.Close()
+
+	// invalid database
+	store = NewStorage(DRIVER_SQLITE, t.TempDir())
+	_, err = store.LoadBans()
+	assert.Error(t, err)
+	assert.Error(t, store.SaveBan(ufw.Ban{IP: "1.1.1.1"}))
+	assert.Error(t, store.SaveBans([]ufw.Ban{{IP: "1.1.1.1"}}))
+	assert.Error(t, store.SaveBanEvents([]ufw.BanEvent{{IP: "1.1.1.1"}}))
+	_, err = store.Begin()
+	assert.Error(t, err)
+	_, err = store.LastTimeLocal()
+	assert.Error(t, err)
+
+	// unsupported driver
+	store = NewStorage("mysql", "test")
+	_, err = store.LoadBans()
+	assert.Error(t, err)
+}
+
+func TestBatch(t *testing.T) {
+	for driver, store := range testStorages(t) {
+		t.Run(driver, func(t *testing.T) {
+			defer store.Close()
+			testBatch(t, store)
+		})
+	}
+}
+
+func testBatch(t *testing.T, store Storage) {
+	timeLocal, err := store.LastTimeLocal()
+	assert.NoError(t, err)
+	assert.True(t, timeLocal.IsZero())
+
+	cest := time.FixedZone("CEST", 2*60*60)
+	first := parser.LogLine{RemoteAddr: "1.1.1.1", TimeLocal: time.Date(2025, 6, 1, 18, 5, 17, 0, cest), RequestMethod: "GET", RequestUri: "/", Status: 200}
+	second := first
+	second.TimeLocal = first.TimeLocal.Add(time.Second)
+
+	batch, err := store.Begin()
+	require.NoError(t, err)
+	inserted, err := batch.Insert(first, "hash1")
+	assert.NoError(t, err)
+	assert.True(t, inserted)
+	// duplicate hash is ignored
+	inserted, err = batch.Insert(second, "hash1")
+	assert.NoError(t, err)
+	assert.False(t, inserted)
+	inserted, err = batch.Insert(second, "hash2")
+	assert.NoError(t, err)
+	assert.True(t, inserted)
+	assert.NoError(t, batch.Commit())
+	batch.Rollback()
+
+	timeLocal, err = store.LastTimeLocal()
+	assert.NoError(t, err)
+	assert.True(t, second.TimeLocal.Equal(timeLocal))
+
+	// rolled back log lines are not stored
+	batch, err = store.Begin()
+	require.NoError(t, err)
+	inserted, err = batch.Insert(second, "hash3")
+	assert.NoError(t, err)
+	assert.True(t, inserted)
+	batch.Rollback()
+	batch, err = store.Begin()
+	require.NoError(t, err)
+	inserted, err = batch.Insert(first, "hash3")
+	assert.NoError(t, err)
+	assert.True(t, inserted)
+	inserted, err = batch.Insert(first, "hash2")
+	assert.NoError(t, err)
+	assert.False(t, inserted)
+	assert.NoError(t, batch.Commit())
+	timeLocal, err = store.LastTimeLocal()
+	assert.NoError(t, err)
+	assert.True(t, first.TimeLocal.Equal(timeLocal))
+}
+
+func TestAudit(t *testing.T) {
+	for driver, store := range testStorages(t) {
+		t.Run(driver, func(t *testing.T) {
+			defer store.Close()
+			testAudit(t, store)
+		})
+	}
+}
+
+func testAudit(t *testing.T, store Storage) {
+	logLine := parser.LogLine{RemoteAddr: "1.1.1.1", TimeLocal: time.Date(2025, 6, 1, 18, 5, 17, 0, time.UTC), RequestUri: "/.env", Status: 404}
+	batch, err := store.Begin()
+	require.NoError(t, err)
+	_, err = batch.Insert(logLine, "hash1")
+	require.NoError(t, err)
+	assert.NoError(t, batch.InsertRuleHit(RuleHit{Hash: "hash1", BadRule: "status-404"}))
+	assert.NoError(t, batch.InsertRuleHit(RuleHit{Hash: "hash1", BadRule: "dot-files", GoodRule: "local-ips"}))
+	require.NoError(t, batch.Commit())
+	// rule hits are rolled back together with the log lines
+	batch, err = store.Begin()
+	require.NoError(t, err)
+	_, err = batch.Insert(logLine, "hash2")
+	require.NoError(t, err)
+	assert.NoError(t, batch.InsertRuleHit(RuleHit{Hash: "hash2", BadRule: "status-404"}))
+	batch.Rollback()
+
+	now := time.Now()
+	err = store.SaveBanEvents([]ufw.BanEvent{
+		{Time: now, IP: "1.1.1.1", Action: ufw.EVENT_REJECT, Reason: "bad rule 'status-404'", To: now.Add(time.Hour), Source: "web2"},
+		{Time: now, IP: "1.10.16.0/20", Action: ufw.EVENT_REJECT, Reason: "blocklist", Category: ufw.CATEGORY_BLOCKLIST},
+		{Time: now.Add(time.Hour), IP: "1.1.1.1", Action: ufw.EVENT_RELEASE, Reason: "expired"}})
+	assert.NoError(t, err)
+
+	storage := store.(*storage_impl)
+	assert.Equal(t, []string{"1.1.1.1 /.env status-404 ", "1.1.1.1 /.env dot-files local-ips"}, queryStrings(t, storage.db,
+		"SELECT a.remote_addr,a.request_uri,r.bad_rule,r.good_rule FROM rule_hits r JOIN accesslog a ON a.hash=r.hash ORDER BY r.id"))
+	assert.Equal(t, []string{
+		"1.1.1.1 reject bad rule 'status-404'  web2",
+		"1.10.16.0/20 reject blocklist blocklist ",
+		"1.1.1.1 release expired  "}, queryStrings(t, storage.db, "SELECT ip,action,reason,category,source FROM ban_events ORDER BY id"))
+	assert.Equal(t, []string{"2"}, queryStrings(t, storage.db, "SELECT COUNT(*) FROM ban_events WHERE to_time IS NULL"))
+
+	counts, err := store.RuleHitCounts(time.Time{})
+	require.NoError(t, err)
+	assert.Equal(t, []RuleHitCount{{BadRule: "dot-files", Hits: 1, Overridden: 1}, {BadRule: "status-404", Hits: 1}}, counts)
+	counts, err = store.RuleHitCounts(logLine.TimeLocal.Add(time.Second))
+	require.NoError(t, err)
+	assert.Empty(t, counts)
+}
+
+func TestStats(t *testing.T) {
+	for driver, store := range testStorages(t) {
+		t.Run(driver, func(t *testing.T) {
+			defer store.Close()
+			testStats(t, store, driver)
+		})
+	}
+}
+
+func testStats(t *testing.T, store Storage, driver string) {
+	cest := time.FixedZone("CEST", 2*60*60)
+	start := time.Date(2025, 6, 1, 1, 30, 0, 0, cest)
+	logLines := []parser.LogLine{
+		{RemoteAddr: "1.1.1.1", TimeLocal: start, Status: 200, BytesSent: 100},
+		{RemoteAddr: "1.1.1.1", TimeLocal: start.Add(time.Minute), Status: 200, BytesSent: 50},
+		{RemoteAddr: "2.2.2.2", TimeLocal: start.Add(2 * time.Minute), Status: 404, BytesSent: 10},
+		{RemoteAddr: "1.1.1.1", TimeLocal: start.Add(time.Hour), Status: 200, BytesSent: 1},
+		// forwarded request is counted for the client
+		{RemoteAddr: "10.0.0.1", ClientAddr: "4.4.4.4", TimeLocal: start.Add(time.Hour), Status: 200, BytesSent: 2},
+	}
+	batch, err := store.Begin()
+	require.NoError(t, err)
+	for i, logLine := range logLines {
+		_, err = batch.Insert(logLine, string(rune('a'+i)))
+		require.NoError(t, err)
+	}
+	// duplicate log line is not counted
+	_, err = batch.Insert(logLines[0], "a")
+	require.NoError(t, err)
+	require.NoError(t, batch.Commit())
+	// statistics are added to existing statistics
+	batch, err = store.Begin()
+	require.NoError(t, err)
+	_, err = batch.Insert(logLines[0], "x")
+	require.NoError(t, err)
+	require.NoError(t, batch.Commit())
+
+	expectedHourly := []string{"2025-05-31T23:00:00Z 200 3 250", "2025-05-31T23:00:00Z 404 1 10", "2025-06-01T00:00:00Z 200 2 3"}
+	expectedDailyIps := []string{"2025-05-31 1.1.1.1 3", "2025-05-31 2.2.2.2 1", "2025-06-01 1.1.1.1 1", "2025-06-01 4.4.4.4 1"}
+	storage := store.(*storage_impl)
+	assert.Equal(t, expectedHourly, queryStrings(t, storage.db, "SELECT hour,status,requests,bytes_sent FROM stats_hourly ORDER BY hour,status"))
+	assert.Equal(t, expectedDailyIps, queryStrings(t, storage.db, "SELECT day,remote_addr,requests FROM stats_daily_ips ORDER BY day,remote_addr"))
+	topIPs, err := store.TopIPs(start, 2)
+	require.NoError(t, err)
+	assert.Equal(t, []IPCount{{IP: "1.1.1.1", Requests: 4}, {IP: "2.2.2.2", Requests: 1}}, topIPs)
+	topIPs, err = store.TopIPs(start.Add(24*time.Hour), 10)
+	require.NoError(t, err)
+	assert.Equal(t, []IPCount{{IP: "1.1.1.1", Requests: 1}, {IP: "4.4.4.4", Requests: 1}}, topIPs)
+	hourly, err := store.HourlyStats(start.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, []HourlyStat{{Hour: time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC), Status: 200, Requests: 2, BytesSent: 3}}, hourly)
+	hourly, err = store.HourlyStats(time.Time{})
+	require.NoError(t, err)
+	assert.Len(t, hourly, 3)
+
+	// rolled back log lines are not counted
+	batch, err = store.Begin()
+	require.NoError(t, err)
+	_, err = batch.Insert(logLines[0], "y")
+	require.NoError(t, err)
+	batch.Rollback()
+
+	// rebuild statistics from imported log lines
+	_, err = storage.db.Exec("INSERT INTO accesslog (remote_addr,time_local,status,bytes_sent,hash) VALUES ($1,$2,$3,$4,$5)",
+		"3.3.3.3", time.Date(2025, 6, 1, 0, 59, 59, 0, time.UTC), 200, 1000, "z")
+	require.NoError(t, err)
+	require.NoError(t, store.RebuildStats())
+	expectedHourly = []string{"2025-05-31T23:00:00Z 200 3 250", "2025-05-31T23:00:00Z 404 1 10", "2025-06-01T00:00:00Z 200 3 1003"}
+	expectedDailyIps = []string{"2025-05-31 1.1.1.1 3", "2025-05-31 2.2.2.2 1", "2025-06-01 1.1.1.1 1", "2025-06-01 3.3.3.3 1", "2025-06-01 4.4.4.4 1"}
+	assert.Equal(t, expectedHourly, queryStrings(t, storage.db, "SELECT hour,status,requests,bytes_sent FROM stats_hourly ORDER BY hour,status"))
+	assert.Equal(t, expectedDailyIps, queryStrings(t, storage.db, "SELECT day,remote_addr,requests FROM stats_daily_ips ORDER BY day,remote_addr"))
+}
+
+// Returns the rows of the query with space separated columns.
+func queryStrings(t *testing.T, db *sql.DB, query string) []string {
+	rows, err := db.Query(query)
+	require.NoError(t, err)
+	defer rows.Close()
+	columns, err := rows.Columns()
+	require.NoError(t, err)
+	var result []string
+	for rows.Next() {
+		values := make([]any, len(columns))
+		for i := range values {
+			values[i] = new(string)
+		}
+		require.NoError(t, rows.Scan(values...))
+		var line []string
+		for _, value := range values {
+			line = append(line, *value.(*string))
+		}
+		result = append(result, strings.Join(line, " "))
+	}
+	require.NoError(t, rows.Err())
+	return result
+}
+
+func TestSearch(t *testing.T) {
+	store := NewStorage(DRIVER_SQLITE, path.Join(t.TempDir(), "test.db"))
+	defer store.Close()
+	_, err := store.LastTimeLocal()
+	require.NoError(t, err)
+	if !store.(*storage_impl).searchAvailable {
+		_, err = store.Search(SearchQuery{Text: "test"})
+		assert.Error(t, err)
+		t.Skip("Full-text search requires tag sqlite_fts5.")
+	}
+	start := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	logLines := []parser.LogLine{
+		{RemoteAddr: "1.1.1.1", TimeLocal: start, RequestMethod: "GET", RequestUri: "/wp-login.php", Status: 404, UserAgent: "curl/7.81.0"},
+		{RemoteAddr: "2.2.2.2", TimeLocal: start.Add(time.Hour), RequestMethod: "GET", RequestUri: "/admin/login", Status: 404, UserAgent: "Mozilla/5.0"},
+		{RemoteAddr: "3.3.3.3", TimeLocal: start.Add(2 * time.Hour), RequestMethod: "POST", RequestUri: "/administrator/index.php", Status: 200, UserAgent: "python-requests/2.31"},
+	}
+	batch, err := store.Begin()
+	require.NoError(t, err)
+	for i, logLine := range logLines {
+		_, err = batch.Insert(logLine, string(rune('a'+i)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, batch.Commit())
+
+	search := func(query SearchQuery) []string {
+		result, err := store.Search(query)
+		require.NoError(t, err)
+		var ips []string
+		for _, logLine := range result {
+			ips = append(ips, logLine.RemoteAddr)
+		}
+		return ips
+	}
+	// phrase query
+	assert.Equal(t, []string{"1.1.1.1"}, search(SearchQuery{Text: `"wp-login.php"`}))
+	// prefix query, newest first
+	assert.Equal(t, []string{"3.3.3.3", "2.2.2.2"}, search(SearchQuery{Text: "admin*"}))
+	assert.Equal(t, []string{"3.3.3.3"}, search(SearchQuery{Text: "admin*", Limit: 1}))
+	// column filter
+	assert.Equal(t, []string{"3.3.3.3", "1.1.1.1"}, search(SearchQuery{Text: "user_agent:curl OR user_agent:python"}))
+	assert.Empty(t, search(SearchQuery{Text: "request_uri:curl"}))
+	// time range
+	assert.Equal(t, []string{"2.2.2.2"}, search(SearchQuery{Text: "admin*", From: start.Add(time.Hour), To: start.Add(2 * time.Hour)}))
+	// deleted log lines are removed from the index
+	_, err = store.(*storage_impl).db.Exec("DELETE FROM accesslog WHERE remote_addr='1.1.1.1'")
+	require.NoError(t, err)
+	assert.Empty(t, search(SearchQuery{Text: "php login"}))
+	result, err := store.Search(SearchQuery{Text: "php"})
+	require.NoError(t, err)
+	require.Len(t, result, 1)
+	assert.Equal(t, logLines[2].RequestUri, result[0].RequestUri)
+	assert.Equal(t, logLines[2].UserAgent, result[0].UserAgent)
+	assert.True(t, logLines[2].TimeLocal.Equal(result[0].TimeLocal))
+	// invalid query
+	_, err = store.Search(SearchQuery{Text: `"unterminated`})
+	assert.Error(t, err)
+
+	// index is rebuilt after the triggers have been dropped by a program without FTS5
+	store.Close()
+	db, err := sql.Open(DRIVER_SQLITE, store.(*storage_impl).dataSource)
+	require.NoError(t, err)
+	_, err = db.Exec("DROP TRIGGER accesslog_fts_insert")
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO accesslog (remote_addr,request_uri,hash) VALUES ('4.4.4.4','/phpmyadmin','d')")
+	require.NoError(t, err)
+	db.Close()
+	assert.Equal(t, []string{"4.4.4.4", "3.3.3.3"}, search(SearchQuery{Text: "php*"}))
+}
+
+func TestReadLogLines(t *testing.T) {
+	for driver, store := range testStorages(t) {
+		t.Run(driver, func(t *testing.T) {
+			defer store.Close()
+			testReadLogLines(t, store)
+		})
+	}
+}
+
+func testReadLogLines(t *testing.T, store Storage) {
+	cest := time.FixedZone("CEST", 2*60*60)
+	start := time.Date(2025, 6, 1, 12, 0, 0, 0, cest)
+	logLines := []parser.LogLine{
+		{RemoteAddr: "1.1.1.1", TimeLocal: start, RequestMethod: "GET", RequestUri: "/", RequestProtocol: "HTTP/1.1", RequestLength: 73, RequestTime: 2, Status: 200, BytesSent: 612, UserAgent: "curl/7.81.0"},
+		{RemoteAddr: "2.2.2.2", TimeLocal: start.Add(time.Hour), RequestMethod: "POST", RequestUri: "/login", Status: 404,
+			Referer: "https://example.com/", Host: "example.com", XForwardedFor: "3.3.3.3", UpstreamAddr: "127.0.0.1:8080", UpstreamResponseTime: 15,
+			TlsProtocol: "TLSv1.3", ProxyProtocolAddr: "4.4.4.4", ClientAddr: "3.3.3.3"},
+		{RemoteAddr: "1.1.1.1", TimeLocal: start.Add(2 * time.Hour), RequestMethod: "GET", RequestUri: "/admin", Status: 404},
+	}
+	batch, err := store.Begin()
+	require.NoError(t, err)
+	for i, logLine := range logLines {
+		_, err = batch.Insert(logLine, string(rune('a'+i)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, batch.Commit())
+
+	read := func(filter LogFilter) []parser.LogLine {
+		var result []parser.LogLine
+		err := store.ReadLogLines(filter, func(logLine parser.LogLine) error {
+			result = append(result, logLine)
+			return nil
+		})
+		require.NoError(t, err)
+		return result
+	}
+	result := read(LogFilter{})
+	require.Len(t, result, 3)
+	assert.True(t, start.Equal(result[0].TimeLocal))
+	result[0].TimeLocal = start
+	assert.Equal(t, logLines[0], result[0])
+	// extended fields
+	result[1].TimeLocal = logLines[1].TimeLocal
+	assert.Equal(t, logLines[1], result[1])
+	assert.Equal(t, "/admin", result[2].RequestUri)
+	// time range in another time zone
+	result = read(LogFilter{From: time.Date(2025, 6, 1, 11, 0, 0, 0, time.UTC), To: time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)})
+	require.Len(t, result, 1)
+	assert.Equal(t, "/login", result[0].RequestUri)
+	assert.Len(t, read(LogFilter{From: start.Add(time.Hour)}), 2)
+	assert.Len(t, read(LogFilter{To: start.Add(time.Hour)}), 1)
+	// filters
+	assert.Len(t, read(LogFilter{RemoteAddr: "1.1.1.1"}), 2)
+	assert.Len(t, read(LogFilter{RemoteAddr: "1.1.1.1", Status: 404}), 1)
+	// remote address or client address of a forwarded request
+	assert.Len(t, read(LogFilter{RemoteAddr: "2.2.2.2"}), 1)
+	assert.Len(t, read(LogFilter{RemoteAddr: "3.3.3.3"}), 1)
+	assert.Empty(t, read(LogFilter{RemoteAddr: "4.4.4.4"}))
+	assert.Len(t, read(LogFilter{RequestMethod: "POST"}), 1)
+	assert.Empty(t, read(LogFilter{RequestMethod: "POST", Status: 200}))
+	// most frequent values
+	topURIs, err := store.TopURIs(time.Time{}, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []ValueCount{{Value: "/", Requests: 1}, {Value: "/admin", Requests: 1}, {Value: "/login", Requests: 1}}, topURIs)
+	topURIs, err = store.TopURIs(start.Add(time.Hour), 1)
+	require.NoError(t, err)
+	assert.Equal(t, []ValueCount{{Value: "/admin", Requests: 1}}, topURIs)
+	// empty user agents are not counted
+	topUserAgents, err := store.TopUserAgents(time.Time{}, 10)
+	require.NoError(t, err)
+	assert.Equal(t, []ValueCount{{Value: "curl/7.81.0", Requests: 1}}, topUserAgents)
+	// newest log lines first
+	recent, err := store.RecentLogLines(LogFilter{Status: 404}, 1)
+	require.NoError(t, err)
+	require.Len(t, recent, 1)
+	assert.Equal(t, "/admin", recent[0].RequestUri)
+	recent, err = store.RecentLogLines(LogFilter{}, 0)
+	require.NoError(t, err)
+	require.Len(t, recent, 3)
+	assert.Equal(t, "/", recent[2].RequestUri)
+	recent, err = store.RecentLogLines(LogFilter{RemoteAddr: "5.5.5.5"}, 10)
+	require.NoError(t, err)
+	assert.Empty(t, recent)
+	// error of the function stops reading
+	calls := 0
+	err = store.ReadLogLines(LogFilter{}, func(logLine parser.LogLine) error {
+		calls++
+		return errors.New("stop")
+	})
+	assert.Error(t, err)
+	assert.Equal(t, 1, calls)
+}
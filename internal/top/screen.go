@@ -0,0 +1,219 @@
+package top
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+)
+
+const help = "q quit  tab switch  up/down select  s sort  / filter  esc clear filter  b ban  u unban  r refresh"
+
+// Width of the number columns.
+const numberWidth = 8
+
+// Width of the expiration date column of the bans.
+const untilWidth = 12
+
+// Renders the screen lines for a terminal with the specified number of columns and rows.
+func (top *top_impl) render(width int, height int) []string {
+	s := &top.snapshot
+	filter := top.filter
+	if len(filter) == 0 {
+		filter = "-"
+	}
+	lines := []string{
+		fmt.Sprintf("goaccesslog top - %s - window %s - sort by %s - filter %s",
+			s.time.Format(time.TimeOnly), s.window, sortOrderNames[top.order], filter),
+		top.renderRequests(),
+		top.renderClasses(),
+		top.renderStatuses(width),
+		"",
+	}
+	footer := []string{top.message, help}
+	if top.editing {
+		footer[0] = "Filter: " + top.edit + "_"
+	} else if len(top.message) == 0 && top.err != nil {
+		footer[0] = "ERROR: " + top.err.Error()
+	}
+	rows := max(0, height-len(lines)-len(footer))
+	upper := (rows + 1) / 2
+	left := (width - 2) / 2
+	right := width - 2 - left
+	lines = append(lines, join(top.renderIPs(left, upper), top.renderURIs(right, upper), left, upper)...)
+	lines = append(lines, join(top.renderBans(left, rows-upper), top.renderRuleHits(right, rows-upper), left, rows-upper)...)
+	lines = append(lines, footer...)
+	for i, line := range lines {
+		lines[i] = fit(line, width)
+	}
+	if len(lines) > height {
+		lines = lines[:height]
+	}
+	// highlight of the selected row is added after the lines are fitted to the width
+	line, column, columns := top.highlighted(width, upper, rows)
+	return highlight(lines, line, column, columns)
+}
+
+func (top *top_impl) renderRequests() string {
+	s := &top.snapshot
+	text := fmt.Sprintf("Requests: %d in window, %.2f/s window, %.2f/s last minute", s.requests, s.rate(), s.lastMinuteRate())
+	if s.truncated {
+		text += fmt.Sprintf(" (limited to %d log lines)", top.options.Limit)
+	}
+	return text
+}
+
+func (top *top_impl) renderClasses() string {
+	s := &top.snapshot
+	parts := []string{"Status:"}
+	for class := 1; class < len(s.classes); class++ {
+		percent := 0.0
+		if s.requests > 0 {
+			percent = 100 * float64(s.classes[class]) / float64(s.requests)
+		}
+		parts = append(parts, fmt.Sprintf("%dxx %d (%.1f%%)", class, s.classes[class], percent))
+	}
+	return strings.Join(parts, "  ")
+}
+
+// Returns the most frequent status codes that fit into the width.
+func (top *top_impl) renderStatuses(width int) string {
+	text := "Codes:"
+	for _, e := range top.snapshot.statuses {
+		part := fmt.Sprintf("  %s %d", e.value, e.requests)
+		if utf8.RuneCountInString(text+part) > width {
+			break
+		}
+		text += part
+	}
+	return text
+}
+
+func (top *top_impl) renderIPs(width int, rows int) []string {
+	lines := []string{row("HOTTEST IPS", "REQUESTS", "ERRORS", width)}
+	for _, e := range visibleRows(top, top.snapshot.ips, panelIPs, rows) {
+		ip := e.value
+		if top.snapshot.banned[ip] {
+			ip += " (banned)"
+		}
+		lines = append(lines, row(ip, strconv.Itoa(e.requests), strconv.Itoa(e.errors), width))
+	}
+	return lines
+}
+
+func (top *top_impl) renderURIs(width int, rows int) []string {
+	lines := []string{row("HOTTEST URIS", "REQUESTS", "ERRORS", width)}
+	for _, e := range top.snapshot.uris[:min(len(top.snapshot.uris), max(0, rows-1))] {
+		lines = append(lines, row(e.value, strconv.Itoa(e.requests), strconv.Itoa(e.errors), width))
+	}
+	return lines
+}
+
+func (top *top_impl) renderBans(width int, rows int) []string {
+	ruleWidth := max(0, (width-untilWidth)/3)
+	ipWidth := max(0, width-untilWidth-ruleWidth-2)
+	banRow := func(ip string, until string, rule string) string {
+		return fit(ip, ipWidth) + " " + fit(until, untilWidth) + " " + fit(rule, ruleWidth)
+	}
+	lines := []string{banRow("RECENT BANS", "UNTIL", "RULE")}
+	for _, ban := range visibleRows(top, top.snapshot.bans, panelBans, rows) {
+		until := "never"
+		if ban.Category != ufw.CATEGORY_BLOCKLIST {
+			until = ban.To.Local().Format("01-02 15:04")
+		}
+		rule := ban.Rule
+		if len(ban.Category) > 0 {
+			rule = ban.Category
+		}
+		lines = append(lines, banRow(ban.IP, until, rule))
+	}
+	return lines
+}
+
+func (top *top_impl) renderRuleHits(width int, rows int) []string {
+	lines := []string{row("RULE HITS", "HITS", "OVERRIDE", width)}
+	for _, ruleHit := range top.snapshot.ruleHits[:min(len(top.snapshot.ruleHits), max(0, rows-1))] {
+		lines = append(lines, row(ruleHit.BadRule, strconv.FormatInt(ruleHit.Hits, 10), strconv.FormatInt(ruleHit.Overridden, 10), width))
+	}
+	return lines
+}
+
+// Returns the rows of a selectable panel that fit below the header, scrolled to the selected row.
+func visibleRows[T any](top *top_impl, values []T, p panel, rows int) []T {
+	rows = max(0, rows-1)
+	offset := 0
+	if top.focus == p && top.selected >= rows {
+		offset = top.selected - rows + 1
+	}
+	return values[min(offset, len(values)):min(offset+rows, len(values))]
+}
+
+// Returns the screen line, column and width of the selected row, line -1 if no row is selected.
+func (top *top_impl) highlighted(width int, upper int, rows int) (int, int, int) {
+	// five lines above the panels and one header line per panel
+	line, column, panelWidth, panelRows := 6, 0, (width-2)/2, upper
+	count := len(top.snapshot.ips)
+	if top.focus == panelBans {
+		line, panelRows = 6+upper, rows-upper
+		count = len(top.snapshot.bans)
+	}
+	if top.selected >= count || panelRows < 2 {
+		return -1, 0, 0
+	}
+	return line + min(top.selected, panelRows-2), column, panelWidth
+}
+
+// Shows the selected row in reverse video.
+func highlight(lines []string, line int, column int, width int) []string {
+	if line < 0 || line >= len(lines) {
+		return lines
+	}
+	runes := []rune(lines[line])
+	end := min(column+width, len(runes))
+	lines[line] = string(runes[:column]) + "\x1b[7m" + string(runes[column:end]) + "\x1b[0m" + string(runes[end:])
+	return lines
+}
+
+// Formats a row with a name column and two number columns.
+func row(name string, first string, second string, width int) string {
+	nameWidth := max(0, width-2*numberWidth-2)
+	return fit(name, nameWidth) + " " + pad(first, numberWidth) + " " + pad(second, numberWidth)
+}
+
+// Places the right lines next to the left lines and returns the specified number of lines.
+// The left lines have the specified width.
+func join(left []string, right []string, width int, rows int) []string {
+	lines := make([]string, rows)
+	for i := range lines {
+		var l, r string
+		if i < len(left) {
+			l = left[i]
+		}
+		if i < len(right) {
+			r = right[i]
+		}
+		lines[i] = fit(l, width) + "  " + r
+	}
+	return lines
+}
+
+// Truncates or pads the text to the specified number of characters.
+func fit(text string, width int) string {
+	runes := []rune(text)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return text + strings.Repeat(" ", width-len(runes))
+}
+
+// Aligns the text to the right.
+func pad(text string, width int) string {
+	n := utf8.RuneCountInString(text)
+	if n >= width {
+		return text
+	}
+	return strings.Repeat(" ", width-n) + text
+}
@@ -0,0 +1,146 @@
+package top
+
+import (
+	"cmp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/parser"
+	"github.com/nylssoft/goaccesslog/internal/storage"
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+)
+
+type sortOrder int
+
+const (
+	sortByRequests sortOrder = iota
+	sortByErrors
+	sortByName
+)
+
+var sortOrderNames = []string{"requests", "errors", "name"}
+
+// Counts the requests of an IP address, URI or status code in the time window.
+type entry struct {
+	value    string
+	requests int
+	// requests with status 4xx or 5xx
+	errors int
+}
+
+// Describes the traffic of the time window that matches the filter.
+type snapshot struct {
+	time   time.Time
+	window time.Duration
+	// number of log lines in the time window and in the last minute
+	requests   int
+	lastMinute int
+	// true if the time window contains more log lines than read
+	truncated bool
+	// requests per status class, index is status / 100
+	classes  [6]int
+	statuses []entry
+	ips      []entry
+	uris     []entry
+	// bans ordered by start time, newest first
+	bans     []ufw.Ban
+	banned   map[string]bool
+	ruleHits []storage.RuleHitCount
+}
+
+// Counts the log lines and bans that match the filter.
+// The log lines are read from the storage for the time window before now.
+func newSnapshot(now time.Time, window time.Duration, logLines []parser.LogLine, truncated bool, bans []ufw.Ban,
+	ruleHits []storage.RuleHitCount, filter string, order sortOrder) snapshot {
+	s := snapshot{time: now, window: window, truncated: truncated, banned: map[string]bool{}, ruleHits: ruleHits}
+	filter = strings.ToLower(filter)
+	statuses := map[string]*entry{}
+	ips := map[string]*entry{}
+	uris := map[string]*entry{}
+	lastMinute := now.Add(-time.Minute)
+	for _, logLine := range logLines {
+		if !matches(logLine, filter) {
+			continue
+		}
+		s.requests++
+		if !logLine.TimeLocal.Before(lastMinute) {
+			s.lastMinute++
+		}
+		class := logLine.Status / 100
+		if class >= 0 && class < len(s.classes) {
+			s.classes[class]++
+		}
+		isError := logLine.Status >= 400
+		count(statuses, strconv.Itoa(logLine.Status), isError)
+		count(ips, logLine.Client(), isError)
+		count(uris, logLine.RequestUri, isError)
+	}
+	s.statuses = sortEntries(statuses, sortByRequests)
+	s.ips = sortEntries(ips, order)
+	s.uris = sortEntries(uris, order)
+	for _, ban := range bans {
+		s.banned[ban.IP] = true
+		if len(filter) == 0 || strings.Contains(ban.IP, filter) || strings.Contains(strings.ToLower(ban.Rule), filter) {
+			s.bans = append(s.bans, ban)
+		}
+	}
+	slices.SortStableFunc(s.bans, func(a, b ufw.Ban) int { return b.From.Compare(a.From) })
+	return s
+}
+
+// Returns the requests per second in the time window.
+func (s *snapshot) rate() float64 {
+	if s.window <= 0 {
+		return 0
+	}
+	return float64(s.requests) / s.window.Seconds()
+}
+
+// Returns the requests per second in the last minute.
+func (s *snapshot) lastMinuteRate() float64 {
+	return float64(s.lastMinute) / time.Minute.Seconds()
+}
+
+// Returns whether the client address, URI, status or user agent contains the lower case filter.
+func matches(logLine parser.LogLine, filter string) bool {
+	if len(filter) == 0 {
+		return true
+	}
+	return strings.Contains(logLine.Client(), filter) ||
+		strings.Contains(strings.ToLower(logLine.RequestUri), filter) ||
+		strconv.Itoa(logLine.Status) == filter ||
+		strings.Contains(strings.ToLower(logLine.UserAgent), filter)
+}
+
+func count(entries map[string]*entry, value string, isError bool) {
+	e := entries[value]
+	if e == nil {
+		e = &entry{value: value}
+		entries[value] = e
+	}
+	e.requests++
+	if isError {
+		e.errors++
+	}
+}
+
+// Returns the entries in the specified order, ties are ordered by value.
+func sortEntries(entries map[string]*entry, order sortOrder) []entry {
+	sorted := make([]entry, 0, len(entries))
+	for _, e := range entries {
+		sorted = append(sorted, *e)
+	}
+	slices.SortFunc(sorted, func(a, b entry) int {
+		var c int
+		switch order {
+		case sortByRequests:
+			c = cmp.Compare(b.requests, a.requests)
+		case sortByErrors:
+			c = cmp.Or(cmp.Compare(b.errors, a.errors), cmp.Compare(b.requests, a.requests))
+		}
+		return cmp.Or(c, strings.Compare(a.value, b.value))
+	})
+	return sorted
+}
@@ -0,0 +1,124 @@
+package top
+
+import (
+	"errors"
+	"io"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Names of keys that are not printable.
+const (
+	keyUp        = "up"
+	keyDown      = "down"
+	keyTab       = "tab"
+	keyEnter     = "enter"
+	keyEscape    = "escape"
+	keyBackspace = "backspace"
+	keyCtrlC     = "ctrl+c"
+)
+
+// Size of the screen if the size of the terminal is unknown.
+const (
+	defaultWidth  = 80
+	defaultHeight = 24
+)
+
+// Runs stty for the terminal of the input and returns the trimmed output, e.g. to switch into raw mode.
+func stty(input io.Reader, args ...string) (string, error) {
+	file, ok := input.(*os.File)
+	if !ok {
+		return "", errors.New("input is not a file")
+	}
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = file
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// Returns the number of columns and rows of the terminal.
+func terminalSize(input io.Reader) (int, int) {
+	out, err := stty(input, "size")
+	if err == nil {
+		rows, cols, found := strings.Cut(out, " ")
+		height, errRows := strconv.Atoi(rows)
+		width, errCols := strconv.Atoi(cols)
+		if found && errRows == nil && errCols == nil && width > 0 && height > 0 {
+			return width, height
+		}
+	}
+	return defaultWidth, defaultHeight
+}
+
+// Reads keys from the terminal in raw mode until the input is closed.
+func readKeys(input io.Reader, keys chan<- string) {
+	defer close(keys)
+	buffer := make([]byte, 256)
+	for {
+		n, err := input.Read(buffer)
+		for _, key := range parseKeys(buffer[:n]) {
+			keys <- key
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Splits the bytes read from the terminal into keys.
+// Escape sequences of unsupported keys are skipped.
+func parseKeys(data []byte) []string {
+	var keys []string
+	for len(data) > 0 {
+		switch data[0] {
+		case 0x03:
+			keys = append(keys, keyCtrlC)
+		case '\t':
+			keys = append(keys, keyTab)
+		case '\r', '\n':
+			keys = append(keys, keyEnter)
+		case 0x7f, 0x08:
+			keys = append(keys, keyBackspace)
+		case 0x1b:
+			key, size := parseEscape(data)
+			if len(key) > 0 {
+				keys = append(keys, key)
+			}
+			data = data[size:]
+			continue
+		default:
+			r, size := utf8.DecodeRune(data)
+			if r != utf8.RuneError && r >= ' ' {
+				keys = append(keys, string(r))
+			}
+			data = data[size:]
+			continue
+		}
+		data = data[1:]
+	}
+	return keys
+}
+
+// Parses an escape sequence, e.g. ESC [ A for the up key, and returns the key and the length of the sequence.
+func parseEscape(data []byte) (string, int) {
+	if len(data) < 2 || (data[1] != '[' && data[1] != 'O') {
+		return keyEscape, 1
+	}
+	// the sequence ends with a letter or a tilde, e.g. ESC [ 5 ~ for page up
+	for i := 2; i < len(data); i++ {
+		c := data[i]
+		if c == '~' || (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') {
+			switch string(data[1 : i+1]) {
+			case "[A", "OA":
+				return keyUp, i + 1
+			case "[B", "OB":
+				return keyDown, i + 1
+			}
+			return "", i + 1
+		}
+	}
+	return "", len(data)
+}
@@ -0,0 +1,64 @@
+package top
+
+import (
+	"io"
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/control"
+	"github.com/nylssoft/goaccesslog/internal/storage"
+)
+
+// Provides a top-like terminal UI for the traffic of a running goaccesslog process.
+//
+// The UI follows the log lines stored in the database and shows the requests per second,
+// the status breakdown, the hottest IP addresses and URIs of the time window, the recent bans
+// of the control socket and the rule hits. The lists can be sorted and filtered.
+// The selected IP address can be banned or unbanned through the control socket.
+//
+// Keys:
+//
+//	up, down, k, j   select an IP address
+//	tab              switch between the hottest IP addresses and the recent bans
+//	s                sort by requests, errors or name
+//	/                filter by IP address, URI, status or user agent, escape clears the filter
+//	b                ban the selected IP address
+//	u                unban the selected IP address
+//	r                refresh now
+//	q                quit
+//
+// Use NewTop to create a new terminal UI.
+type Top interface {
+	// Switches the terminal into raw mode and runs the UI until the user quits.
+	Run() error
+}
+
+// Describes the terminal UI parameters.
+type Options struct {
+	// Time window of the statistics, e.g. the last 5 minutes.
+	Window time.Duration
+	// Refresh interval.
+	Interval time.Duration
+	// Maximum number of log lines read for the time window.
+	Limit int
+}
+
+// Returns the default options of the terminal UI.
+func DefaultOptions() Options {
+	return Options{
+		Window:   5 * time.Minute,
+		Interval: 2 * time.Second,
+		Limit:    50000,
+	}
+}
+
+// Creates a new terminal UI reading keys from the input terminal and drawing on the output terminal.
+// The log lines and rule hits are read from the storage, the bans are managed by the control client.
+func NewTop(options Options, storage storage.Storage, client control.Client, input io.Reader, output io.Writer) Top {
+	var top top_impl
+	top.options = options
+	top.storage = storage
+	top.client = client
+	top.input = input
+	top.output = output
+	return &top
+}
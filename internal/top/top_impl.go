@@ -0,0 +1,242 @@
+package top
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"slices"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/nylssoft/goaccesslog/internal/control"
+	"github.com/nylssoft/goaccesslog/internal/parser"
+	"github.com/nylssoft/goaccesslog/internal/storage"
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+)
+
+type panel int
+
+const (
+	panelIPs panel = iota
+	panelBans
+)
+
+type top_impl struct {
+	options Options
+	input   io.Reader
+	output  io.Writer
+	// data of the last refresh
+	logLines []parser.LogLine
+	bans     []ufw.Ban
+	ruleHits []storage.RuleHitCount
+	err      error
+	snapshot snapshot
+	// state of the UI
+	order    sortOrder
+	filter   string
+	editing  bool
+	edit     string
+	focus    panel
+	selected int
+	message  string
+	// dependencies
+	storage storage.Storage
+	client  control.Client
+}
+
+func (top *top_impl) Run() error {
+	saved, err := stty(top.input, "-g")
+	if err != nil {
+		return fmt.Errorf("input is not a terminal: %w", err)
+	}
+	_, err = stty(top.input, "raw", "-echo")
+	if err != nil {
+		return err
+	}
+	defer stty(top.input, saved)
+	// log messages would overwrite the screen, errors are shown in the status line instead
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(io.Discard)
+	// alternate screen without cursor
+	fmt.Fprint(top.output, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(top.output, "\x1b[?25h\x1b[?1049l")
+	keys := make(chan string)
+	go readKeys(top.input, keys)
+	ticker := time.NewTicker(top.options.Interval)
+	defer ticker.Stop()
+	top.refresh()
+	for {
+		width, height := terminalSize(top.input)
+		top.draw(width, height)
+		select {
+		case key, ok := <-keys:
+			if !ok || !top.handleKey(key) {
+				return nil
+			}
+		case <-ticker.C:
+			top.refresh()
+		}
+	}
+}
+
+// Reads the log lines, rule hits and bans of the time window.
+func (top *top_impl) refresh() {
+	now := time.Now()
+	from := now.Add(-top.options.Window)
+	var errs []error
+	logLines, err := top.storage.RecentLogLines(storage.LogFilter{From: from}, top.options.Limit)
+	errs = append(errs, err)
+	ruleHits, err := top.storage.RuleHitCounts(from)
+	errs = append(errs, err)
+	bans, err := top.client.ListBans()
+	errs = append(errs, err)
+	top.logLines = logLines
+	top.ruleHits = ruleHits
+	top.bans = bans
+	top.err = nil
+	if idx := slices.IndexFunc(errs, func(err error) bool { return err != nil }); idx >= 0 {
+		top.err = errs[idx]
+	}
+	top.update(now)
+}
+
+// Counts the data of the last refresh again, e.g. if the filter or the sort order has changed.
+// The selected IP address is kept if it is still shown.
+func (top *top_impl) update(now time.Time) {
+	selectedIP := top.selectedIP()
+	truncated := top.options.Limit > 0 && len(top.logLines) >= top.options.Limit
+	top.snapshot = newSnapshot(now, top.options.Window, top.logLines, truncated, top.bans, top.ruleHits, top.filter, top.order)
+	ips := top.selectableIPs()
+	if idx := slices.Index(ips, selectedIP); idx >= 0 {
+		top.selected = idx
+	}
+	top.selected = max(0, min(top.selected, len(ips)-1))
+}
+
+// Returns the IP addresses of the focused panel.
+func (top *top_impl) selectableIPs() []string {
+	var ips []string
+	if top.focus == panelBans {
+		for _, ban := range top.snapshot.bans {
+			ips = append(ips, ban.IP)
+		}
+	} else {
+		for _, e := range top.snapshot.ips {
+			ips = append(ips, e.value)
+		}
+	}
+	return ips
+}
+
+// Returns the selected IP address of the focused panel or an empty string.
+func (top *top_impl) selectedIP() string {
+	ips := top.selectableIPs()
+	if top.selected >= 0 && top.selected < len(ips) {
+		return ips[top.selected]
+	}
+	return ""
+}
+
+// Handles a key, returns false if the UI should quit.
+func (top *top_impl) handleKey(key string) bool {
+	if key == keyCtrlC {
+		return false
+	}
+	if top.editing {
+		top.handleFilterKey(key)
+		return true
+	}
+	top.message = ""
+	switch key {
+	case "q":
+		return false
+	case keyUp, "k":
+		top.selected = max(0, top.selected-1)
+	case keyDown, "j":
+		top.selected = max(0, min(top.selected+1, len(top.selectableIPs())-1))
+	case keyTab:
+		top.focus = (top.focus + 1) % 2
+		top.selected = 0
+	case "s":
+		top.order = (top.order + 1) % sortOrder(len(sortOrderNames))
+		top.update(top.snapshot.time)
+	case "/":
+		top.editing = true
+		top.edit = top.filter
+	case keyEscape:
+		top.filter = ""
+		top.update(top.snapshot.time)
+	case "b":
+		top.ban()
+	case "u":
+		top.unban()
+	case "r":
+		top.refresh()
+	}
+	return true
+}
+
+func (top *top_impl) handleFilterKey(key string) {
+	switch key {
+	case keyEnter:
+		top.editing = false
+		top.filter = top.edit
+		top.update(top.snapshot.time)
+	case keyEscape:
+		top.editing = false
+	case keyBackspace:
+		_, size := utf8.DecodeLastRuneInString(top.edit)
+		top.edit = top.edit[:len(top.edit)-size]
+	default:
+		r, size := utf8.DecodeRuneInString(key)
+		if size == len(key) && unicode.IsPrint(r) {
+			top.edit += key
+		}
+	}
+}
+
+func (top *top_impl) ban() {
+	ip := top.selectedIP()
+	if len(ip) == 0 {
+		return
+	}
+	err := top.client.Ban(ip, 0)
+	top.afterAction(err, "Banned IP "+ip+".")
+}
+
+func (top *top_impl) unban() {
+	ip := top.selectedIP()
+	if len(ip) == 0 {
+		return
+	}
+	err := top.client.Unban(ip)
+	top.afterAction(err, "Unbanned IP "+ip+".")
+}
+
+// Shows the result of a ban or unban and reads the modified bans.
+func (top *top_impl) afterAction(err error, message string) {
+	if err != nil {
+		top.message = "ERROR: " + err.Error()
+		return
+	}
+	top.message = message
+	bans, err := top.client.ListBans()
+	if err == nil {
+		top.bans = bans
+		top.update(top.snapshot.time)
+	}
+}
+
+// Draws the screen, the cursor is moved home instead of clearing the screen to avoid flickering.
+func (top *top_impl) draw(width int, height int) {
+	lines := top.render(width, height)
+	screen := "\x1b[H"
+	for i, line := range lines {
+		if i > 0 {
+			screen += "\r\n"
+		}
+		screen += line + "\x1b[K"
+	}
+	fmt.Fprint(top.output, screen+"\x1b[J")
+}
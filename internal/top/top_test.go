@@ -0,0 +1,205 @@
+package top
+
+import (
+	"errors"
+	"path"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nylssoft/goaccesslog/internal/parser"
+	"github.com/nylssoft/goaccesslog/internal/storage"
+	"github.com/nylssoft/goaccesslog/internal/ufw"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockClient struct {
+	bans     []ufw.Ban
+	err      error
+	banned   []string
+	unbanned []string
+}
+
+func (client *mockClient) Ban(ip string, duration time.Duration) error {
+	if client.err != nil {
+		return client.err
+	}
+	client.banned = append(client.banned, ip)
+	client.bans = append(client.bans, ufw.Ban{IP: ip, From: time.Now(), To: time.Now().Add(time.Hour), Rule: "manual ban"})
+	return nil
+}
+
+func (client *mockClient) Unban(ip string) error {
+	if client.err != nil {
+		return client.err
+	}
+	client.unbanned = append(client.unbanned, ip)
+	for i, ban := range client.bans {
+		if ban.IP == ip {
+			client.bans = append(client.bans[:i], client.bans[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (client *mockClient) ListBans() ([]ufw.Ban, error) {
+	return client.bans, client.err
+}
+
+func TestParseKeys(t *testing.T) {
+	assert.Equal(t, []string{"q"}, parseKeys([]byte("q")))
+	assert.Equal(t, []string{keyUp, keyDown, keyUp, keyDown}, parseKeys([]byte("\x1b[A\x1b[B\x1bOA\x1bOB")))
+	assert.Equal(t, []string{keyTab, keyEnter, keyEnter, keyBackspace, keyCtrlC, keyEscape}, parseKeys([]byte("\t\r\n\x7f\x03\x1b")))
+	// unsupported escape sequences are skipped
+	assert.Equal(t, []string{"a", "ä"}, parseKeys([]byte("\x1b[5~a\x1b[1;5Cä\x01")))
+	assert.Empty(t, parseKeys([]byte("\x1b[1;")))
+}
+
+func TestSnapshot(t *testing.T) {
+	now := time.Now()
+	logLines := []parser.LogLine{
+		{RemoteAddr: "1.1.1.1", TimeLocal: now.Add(-2 * time.Minute), RequestUri: "/.env", Status: 404},
+		{RemoteAddr: "1.1.1.1", TimeLocal: now.Add(-2 * time.Minute), RequestUri: "/.git", Status: 404},
+		{RemoteAddr: "2.2.2.2", TimeLocal: now, RequestUri: "/", Status: 200},
+		{RemoteAddr: "3.3.3.3", TimeLocal: now, RequestUri: "/", Status: 200},
+		{RemoteAddr: "10.0.0.1", ClientAddr: "3.3.3.3", TimeLocal: now, RequestUri: "/login", Status: 500, UserAgent: "curl/8.0"},
+	}
+	bans := []ufw.Ban{
+		{IP: "1.1.1.1", From: now.Add(-time.Hour), Rule: "status-404"},
+		{IP: "4.4.4.4", From: now, Category: ufw.CATEGORY_BLOCKLIST},
+	}
+	s := newSnapshot(now, 5*time.Minute, logLines, false, bans, nil, "", sortByRequests)
+	assert.Equal(t, 5, s.requests)
+	assert.Equal(t, 3, s.lastMinute)
+	assert.InDelta(t, 5.0/300, s.rate(), 1e-9)
+	assert.InDelta(t, 3.0/60, s.lastMinuteRate(), 1e-9)
+	assert.Equal(t, [6]int{0, 0, 2, 0, 2, 1}, s.classes)
+	assert.Equal(t, []entry{{"200", 2, 0}, {"404", 2, 2}, {"500", 1, 1}}, s.statuses)
+	assert.Equal(t, []entry{{"1.1.1.1", 2, 2}, {"3.3.3.3", 2, 1}, {"2.2.2.2", 1, 0}}, s.ips)
+	assert.Equal(t, []entry{{"/", 2, 0}, {"/.env", 1, 1}, {"/.git", 1, 1}, {"/login", 1, 1}}, s.uris)
+	assert.Equal(t, "4.4.4.4", s.bans[0].IP)
+	assert.True(t, s.banned["1.1.1.1"])
+
+	s = newSnapshot(now, 5*time.Minute, logLines, false, bans, nil, "", sortByErrors)
+	assert.Equal(t, []string{"/.env", "/.git", "/login", "/"}, values(s.uris))
+	s = newSnapshot(now, 5*time.Minute, logLines, false, bans, nil, "", sortByName)
+	assert.Equal(t, []string{"1.1.1.1", "2.2.2.2", "3.3.3.3"}, values(s.ips))
+
+	// filter by IP address, URI, status and user agent
+	s = newSnapshot(now, 5*time.Minute, logLines, false, bans, nil, "1.1.1", sortByRequests)
+	assert.Equal(t, 2, s.requests)
+	assert.Len(t, s.bans, 1)
+	s = newSnapshot(now, 5*time.Minute, logLines, false, bans, nil, "/.GIT", sortByRequests)
+	assert.Equal(t, []string{"/.git"}, values(s.uris))
+	s = newSnapshot(now, 5*time.Minute, logLines, false, bans, nil, "500", sortByRequests)
+	assert.Equal(t, []string{"3.3.3.3"}, values(s.ips))
+	s = newSnapshot(now, 5*time.Minute, logLines, false, bans, nil, "Curl", sortByRequests)
+	assert.Equal(t, 1, s.requests)
+	s = newSnapshot(now, 5*time.Minute, logLines, false, bans, nil, "status-404", sortByRequests)
+	assert.Zero(t, s.requests)
+	assert.Len(t, s.bans, 1)
+}
+
+func TestTop(t *testing.T) {
+	store := storage.NewStorage(storage.DRIVER_SQLITE, path.Join(t.TempDir(), "test.db"))
+	defer store.Close()
+	now := time.Now()
+	batch, err := store.Begin()
+	require.NoError(t, err)
+	logLines := []parser.LogLine{
+		{RemoteAddr: "1.1.1.1", TimeLocal: now.Add(-time.Minute), RequestMethod: "GET", RequestUri: "/.env", Status: 404},
+		{RemoteAddr: "1.1.1.1", TimeLocal: now, RequestMethod: "GET", RequestUri: "/.git/config", Status: 404},
+		{RemoteAddr: "2.2.2.2", TimeLocal: now, RequestMethod: "GET", RequestUri: "/", Status: 200},
+		{RemoteAddr: "3.3.3.3", TimeLocal: now.Add(-time.Hour), RequestMethod: "GET", RequestUri: "/old", Status: 200},
+	}
+	for i, logLine := range logLines {
+		_, err = batch.Insert(logLine, string(rune('a'+i)))
+		require.NoError(t, err)
+	}
+	require.NoError(t, batch.InsertRuleHit(storage.RuleHit{Hash: "a", BadRule: "status-404"}))
+	require.NoError(t, batch.Commit())
+	client := &mockClient{}
+	top := NewTop(DefaultOptions(), store, client, strings.NewReader(""), &strings.Builder{}).(*top_impl)
+	top.refresh()
+	require.NoError(t, top.err)
+	assert.Equal(t, 3, top.snapshot.requests)
+	assert.Equal(t, []storage.RuleHitCount{{BadRule: "status-404", Hits: 1}}, top.snapshot.ruleHits)
+
+	screen := top.render(100, 20)
+	require.Len(t, screen, 20)
+	for _, line := range screen {
+		assert.LessOrEqual(t, utf8.RuneCountInString(strings.ReplaceAll(strings.ReplaceAll(line, "\x1b[7m", ""), "\x1b[0m", "")), 100)
+	}
+	text := strings.Join(screen, "\n")
+	assert.Contains(t, text, "Requests: 3 in window")
+	assert.Contains(t, text, "2xx 1 (33.3%)")
+	assert.Contains(t, text, "404 2")
+	assert.Contains(t, text, "\x1b[7m1.1.1.1 ")
+	assert.Contains(t, text, "/.git/config")
+	assert.Contains(t, text, "status-404")
+
+	// select and ban the second IP address
+	assert.True(t, top.handleKey(keyDown))
+	assert.True(t, top.handleKey(keyDown))
+	assert.Equal(t, "2.2.2.2", top.selectedIP())
+	assert.True(t, top.handleKey("b"))
+	assert.Equal(t, []string{"2.2.2.2"}, client.banned)
+	assert.Equal(t, "Banned IP 2.2.2.2.", top.message)
+	assert.Contains(t, strings.Join(top.render(100, 20), "\n"), "2.2.2.2 (banned)")
+
+	// the selection is kept if the sort order changes
+	assert.True(t, top.handleKey("s"))
+	assert.Equal(t, sortByErrors, top.order)
+	assert.Equal(t, "2.2.2.2", top.selectedIP())
+
+	// unban in the panel of the recent bans
+	assert.True(t, top.handleKey(keyTab))
+	assert.Equal(t, "2.2.2.2", top.selectedIP())
+	assert.True(t, top.handleKey("u"))
+	assert.Equal(t, []string{"2.2.2.2"}, client.unbanned)
+	assert.Empty(t, top.snapshot.bans)
+	assert.Empty(t, top.selectedIP())
+
+	// filter
+	assert.True(t, top.handleKey(keyTab))
+	for _, key := range []string{"/", "g", "i", "x", keyBackspace, "t", keyEnter} {
+		assert.True(t, top.handleKey(key))
+	}
+	assert.Equal(t, "git", top.filter)
+	assert.Equal(t, 1, top.snapshot.requests)
+	assert.True(t, top.handleKey("/"))
+	assert.Contains(t, strings.Join(top.render(100, 20), "\n"), "Filter: git_")
+	assert.True(t, top.handleKey("q"))
+	assert.True(t, top.handleKey(keyEscape))
+	assert.Equal(t, "git", top.filter)
+	assert.True(t, top.handleKey(keyEscape))
+	assert.Empty(t, top.filter)
+
+	// errors of the control socket are shown
+	client.err = errors.New("cannot connect")
+	assert.True(t, top.handleKey("b"))
+	assert.Equal(t, "ERROR: cannot connect", top.message)
+	top.refresh()
+	assert.Equal(t, client.err, top.err)
+	assert.True(t, top.handleKey("r"))
+	assert.Contains(t, strings.Join(top.render(100, 20), "\n"), "ERROR: cannot connect")
+
+	// small terminal
+	assert.Len(t, top.render(20, 3), 3)
+	assert.False(t, top.handleKey("q"))
+	assert.False(t, top.handleKey(keyCtrlC))
+
+	// input must be a terminal
+	assert.Error(t, top.Run())
+}
+
+func values(entries []entry) []string {
+	var values []string
+	for _, e := range entries {
+		values = append(values, e.value)
+	}
+	return values
+}
@@ -0,0 +1,197 @@
+package ufw
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nylssoft/goaccesslog/internal/executer"
+	"github.com/nylssoft/goaccesslog/internal/ipaddr"
+)
+
+const (
+	BACKEND_UFW   = "ufw"
+	BACKEND_NFT   = "nft"
+	BACKEND_IPSET = "ipset"
+)
+
+const (
+	ACTION_REJECT = "reject"
+	ACTION_DENY   = "deny"
+)
+
+const (
+	// Firewall rules without a stored ban are adopted and expire after the initial delay.
+	POLICY_ADOPT = "adopt"
+	// Firewall rules without a stored ban are deleted.
+	POLICY_RELEASE = "release"
+	// Firewall rules without a stored ban are logged and left untouched.
+	POLICY_ALERT = "alert"
+)
+
+const (
+	// Ban imported from a blocklist file, the ban does not expire.
+	CATEGORY_BLOCKLIST = "blocklist"
+)
+
+const (
+	// The IP address or network has been rejected.
+	EVENT_REJECT = "reject"
+	// The IP address or network has been released.
+	EVENT_RELEASE = "release"
+)
+
+// Adds or deletes the firewall rule for an IP address or network.
+type operation struct {
+	ip     string
+	reject bool
+}
+
+// Adds and deletes the firewall rules for rejected IP addresses and networks.
+type backend interface {
+	// Returns the IP addresses and networks of all firewall rules marked with the used comment.
+	// Creates the firewall objects required by the backend if they do not exist.
+	status() ([]string, error)
+	// Applies the operations as a batch if supported by the backend.
+	// Returns the error for each operation, the error is nil if the operation succeeded.
+	apply(ops []operation) []error
+}
+
+type ufwBackend struct {
+	comment  string
+	action   string
+	ports    []int
+	executer executer.Executer
+}
+
+func newBackend(executer executer.Executer, options Options) backend {
+	switch options.Backend {
+	case BACKEND_NFT:
+		return newNftBackend(executer, options)
+	case BACKEND_IPSET:
+		return newIpsetBackend(executer, options)
+	}
+	var backend ufwBackend
+	backend.executer = executer
+	backend.comment = options.Comment
+	backend.action = options.Action
+	backend.ports = options.Ports
+	return &backend
+}
+
+func (backend *ufwBackend) status() ([]string, error) {
+	res, err := backend.executer.Exec("ufw", "status")
+	if err != nil {
+		return nil, commandError("ufw", []string{"status"}, err, res)
+	}
+	return parseStatus(string(res), strings.ToUpper(backend.action), backend.comment), nil
+}
+
+// Applies the operations one by one as ufw does not support batches.
+func (backend *ufwBackend) apply(ops []operation) []error {
+	errs := make([]error, len(ops))
+	for idx, op := range ops {
+		if op.reject {
+			errs[idx] = backend.reject(op.ip)
+		} else {
+			errs[idx] = backend.release(op.ip)
+		}
+	}
+	return errs
+}
+
+func (backend *ufwBackend) reject(ip string) error {
+	// IPv6 rules cannot be inserted before IPv4 rules, prepend inserts at the first position of the matching list
+	args := []string{"insert", "1"}
+	if !isIPv4(ip) {
+		args = []string{"prepend"}
+	}
+	args = append(args, backend.ruleArgs(ip)...)
+	args = append(args, "comment", backend.comment)
+	res, err := backend.executer.Exec("ufw", args...)
+	return commandError("ufw", args, err, res)
+}
+
+func (backend *ufwBackend) release(ip string) error {
+	args := append([]string{"delete"}, backend.ruleArgs(ip)...)
+	res, err := backend.executer.Exec("ufw", args...)
+	return commandError("ufw", args, err, res)
+}
+
+func (backend *ufwBackend) ruleArgs(ip string) []string {
+	args := []string{backend.action, "from", ip, "to", "any"}
+	if len(backend.ports) > 0 {
+		ports := make([]string, 0, len(backend.ports))
+		for _, port := range backend.ports {
+			ports = append(ports, strconv.Itoa(port))
+		}
+		args = append(args, "port", strings.Join(ports, ","), "proto", "tcp")
+	}
+	return args
+}
+
+// Returns the canonical source addresses of all firewall rules with the specified action and comment.
+//
+// The output of ufw status contains one rule per line, e.g.
+//
+//	Anywhere                   REJECT      178.128.20.144             # goaccesslog
+//	Anywhere (v6)              REJECT      2001:db8::1                # goaccesslog
+//	80,443/tcp on eth0         DENY IN     2001:db8::/64              # goaccesslog
+func parseStatus(status string, action string, comment string) []string {
+	var ips []string
+	for line := range strings.SplitSeq(status, "\n") {
+		idx := strings.Index(line, "#")
+		if idx < 0 || strings.TrimSpace(line[idx+1:]) != comment {
+			continue
+		}
+		fields := strings.Fields(line[:idx])
+		for i := 0; i < len(fields)-1; i++ {
+			if fields[i] != action {
+				continue
+			}
+			from := fields[i+1]
+			if (from == "IN" || from == "OUT" || from == "FWD") && i+2 < len(fields) {
+				from = fields[i+2]
+			}
+			ip, err := ipaddr.Parse(from)
+			if err == nil {
+				ips = append(ips, ip)
+			}
+			break
+		}
+	}
+	return ips
+}
+
+func isIPv4(ip string) bool {
+	if ipaddr.IsPrefix(ip) {
+		prefix, _ := ipaddr.ParsePrefix(ip)
+		return prefix.Addr().Is4()
+	}
+	addr, err := ipaddr.ParseAddr(ip)
+	return err == nil && addr.Is4()
+}
+
+// Applies the operations as one batch.
+// If the batch fails, the operations are applied one by one to find the failed operations.
+func applyBatch(ops []operation, run func(batch []operation) error) []error {
+	errs := make([]error, len(ops))
+	err := run(ops)
+	if err != nil && len(ops) > 1 {
+		for idx, op := range ops {
+			errs[idx] = run([]operation{op})
+		}
+		return errs
+	}
+	for idx := range errs {
+		errs[idx] = err
+	}
+	return errs
+}
+
+func commandError(cmd string, args []string, err error, res []byte) error {
+	if err != nil {
+		return fmt.Errorf("%s %s: %s %s", cmd, strings.Join(args, " "), err.Error(), strings.TrimSpace(string(res)))
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package ufw
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nylssoft/goaccesslog/internal/executer"
+	"github.com/nylssoft/goaccesslog/internal/ipaddr"
+)
+
+// Uses one ipset for IPv4 and one ipset for IPv6 named after the comment.
+// An iptables and an ip6tables rule in the INPUT chain reject all packets with a source address in the sets.
+// Operations are applied as a batch using ipset restore.
+type ipsetBackend struct {
+	set4     string
+	set6     string
+	target   string
+	ports    []int
+	executer executer.Executer
+}
+
+func newIpsetBackend(executer executer.Executer, options Options) backend {
+	var backend ipsetBackend
+	backend.executer = executer
+	backend.set4 = options.Comment + "-v4"
+	backend.set6 = options.Comment + "-v6"
+	backend.target = "REJECT"
+	if options.Action == ACTION_DENY {
+		backend.target = "DROP"
+	}
+	backend.ports = options.Ports
+	return &backend
+}
+
+func (backend *ipsetBackend) status() ([]string, error) {
+	err := backend.setup()
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, set := range []string{backend.set4, backend.set6} {
+		args := []string{"save", set}
+		res, err := backend.executer.Exec("ipset", args...)
+		if err != nil {
+			return nil, commandError("ipset", args, err, res)
+		}
+		ips = append(ips, parseIpsetSave(string(res), set)...)
+	}
+	return ips, nil
+}
+
+func (backend *ipsetBackend) apply(ops []operation) []error {
+	return applyBatch(ops, func(batch []operation) error {
+		var sb strings.Builder
+		for _, op := range batch {
+			cmd := "del"
+			if op.reject {
+				cmd = "add"
+			}
+			fmt.Fprintf(&sb, "%s %s %s\n", cmd, backend.setName(op.ip), op.ip)
+		}
+		args := []string{"restore", "-exist"}
+		res, err := backend.executer.ExecInput([]byte(sb.String()), "ipset", args...)
+		return commandError("ipset", args, err, res)
+	})
+}
+
+// Creates the sets if they do not exist and inserts the iptables rules if they do not exist.
+func (backend *ipsetBackend) setup() error {
+	for _, family := range []struct{ set, inet, iptables string }{
+		{backend.set4, "inet", "iptables"},
+		{backend.set6, "inet6", "ip6tables"},
+	} {
+		args := []string{"create", "-exist", family.set, "hash:net", "family", family.inet}
+		res, err := backend.executer.Exec("ipset", args...)
+		if err != nil {
+			return commandError("ipset", args, err, res)
+		}
+		rule := backend.ruleArgs(family.set)
+		_, err = backend.executer.Exec(family.iptables, append([]string{"-C", "INPUT"}, rule...)...)
+		if err != nil {
+			args = append([]string{"-I", "INPUT", "1"}, rule...)
+			res, err = backend.executer.Exec(family.iptables, args...)
+			if err != nil {
+				return commandError(family.iptables, args, err, res)
+			}
+		}
+	}
+	return nil
+}
+
+func (backend *ipsetBackend) ruleArgs(set string) []string {
+	var args []string
+	if len(backend.ports) > 0 {
+		ports := make([]string, 0, len(backend.ports))
+		for _, port := range backend.ports {
+			ports = append(ports, strconv.Itoa(port))
+		}
+		args = append(args, "-p", "tcp", "-m", "multiport", "--dports", strings.Join(ports, ","))
+	}
+	return append(args, "-m", "set", "--match-set", set, "src", "-j", backend.target)
+}
+
+func (backend *ipsetBackend) setName(ip string) string {
+	if isIPv4(ip) {
+		return backend.set4
+	}
+	return backend.set6
+}
+
+// Returns the canonical IP addresses and networks of the output of ipset save, e.g.
+//
+//	create goaccesslog-v4 hash:net family inet hashsize 1024 maxelem 65536
+//	add goaccesslog-v4 1.2.3.4
+//	add goaccesslog-v4 5.6.7.0/24
+func parseIpsetSave(output string, set string) []string {
+	var ips []string
+	for line := range strings.SplitSeq(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 3 && fields[0] == "add" && fields[1] == set {
+			ip, err := ipaddr.Parse(fields[2])
+			if err == nil {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips
+}
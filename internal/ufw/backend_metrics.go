@@ -0,0 +1,58 @@
+package ufw
+
+import (
+	"time"
+
+	"github.com/nylssoft/goaccesslog/internal/metrics"
+)
+
+var (
+	commandSeconds = metrics.NewHistogram("goaccesslog_firewall_command_duration_seconds", "Duration of firewall commands.",
+		metrics.DefaultBuckets, "backend", "operation")
+	commandFailures = metrics.NewCounter("goaccesslog_firewall_command_failures_total", "Failed firewall operations.", "backend", "operation")
+	bansTotal       = metrics.NewCounter("goaccesslog_bans_total", "IP addresses and networks rejected.", "category")
+	releasesTotal   = metrics.NewCounter("goaccesslog_releases_total", "IP addresses and networks released.")
+)
+
+// Measures the duration and counts the failures of the firewall commands of a backend.
+type metricsBackend struct {
+	backend backend
+	name    string
+}
+
+func newMetricsBackend(backend backend, name string) backend {
+	return &metricsBackend{backend: backend, name: name}
+}
+
+func (backend *metricsBackend) status() ([]string, error) {
+	start := time.Now()
+	ips, err := backend.backend.status()
+	commandSeconds.Observe(time.Since(start).Seconds(), backend.name, "status")
+	if err != nil {
+		commandFailures.Inc(backend.name, "status")
+	}
+	return ips, err
+}
+
+func (backend *metricsBackend) apply(ops []operation) []error {
+	start := time.Now()
+	errs := backend.backend.apply(ops)
+	commandSeconds.Observe(time.Since(start).Seconds(), backend.name, "apply")
+	for _, err := range errs {
+		if err != nil {
+			commandFailures.Inc(backend.name, "apply")
+		}
+	}
+	return errs
+}
+
+// Counts the rejected and released IP addresses and networks of the events.
+func countEvents(events []BanEvent) {
+	for _, event := range events {
+		if event.Action == EVENT_REJECT {
+			bansTotal.Inc(event.Category)
+		} else {
+			releasesTotal.Inc()
+		}
+	}
+}
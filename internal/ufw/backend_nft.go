@@ -0,0 +1,183 @@
+package ufw
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/nylssoft/goaccesslog/internal/executer"
+	"github.com/nylssoft/goaccesslog/internal/ipaddr"
+)
+
+// Uses an nftables table named after the comment with one set for IPv4 and one set for IPv6.
+// The input chain of the table rejects all packets with a source address in one of the sets.
+// Operations are applied atomically as a script using nft -f.
+type nftBackend struct {
+	table    string
+	action   string
+	ports    []int
+	executer executer.Executer
+}
+
+type nftSet struct {
+	Nftables []struct {
+		Set *struct {
+			Elem []any `json:"elem"`
+		} `json:"set"`
+	} `json:"nftables"`
+}
+
+func newNftBackend(executer executer.Executer, options Options) backend {
+	var backend nftBackend
+	backend.executer = executer
+	backend.table = nftIdentifier(options.Comment)
+	backend.action = "reject"
+	if options.Action == ACTION_DENY {
+		backend.action = "drop"
+	}
+	backend.ports = options.Ports
+	return &backend
+}
+
+func (backend *nftBackend) status() ([]string, error) {
+	err := backend.setup()
+	if err != nil {
+		return nil, err
+	}
+	var ips []string
+	for _, set := range []string{"ipv4", "ipv6"} {
+		args := []string{"-j", "list", "set", "inet", backend.table, set}
+		res, err := backend.executer.Exec("nft", args...)
+		if err != nil {
+			return nil, commandError("nft", args, err, res)
+		}
+		elements, err := parseNftSet(res)
+		if err != nil {
+			return nil, err
+		}
+		ips = append(ips, elements...)
+	}
+	return ips, nil
+}
+
+// Deletes are applied before adds, because the interval sets reject a network
+// that overlaps with an element, e.g. if single IP addresses are replaced by a network ban.
+func (backend *nftBackend) apply(ops []operation) []error {
+	var sorted []operation
+	var indices []int
+	for _, reject := range []bool{false, true} {
+		for idx, op := range ops {
+			if op.reject == reject {
+				sorted = append(sorted, op)
+				indices = append(indices, idx)
+			}
+		}
+	}
+	sortedErrs := applyBatch(sorted, func(batch []operation) error {
+		return backend.run(backend.script(batch))
+	})
+	errs := make([]error, len(ops))
+	for idx, err := range sortedErrs {
+		errs[indices[idx]] = err
+	}
+	return errs
+}
+
+// Creates the table, the sets and the chain if they do not exist and replaces the rules of the chain.
+func (backend *nftBackend) setup() error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "add table inet %s\n", backend.table)
+	fmt.Fprintf(&sb, "add set inet %s ipv4 { type ipv4_addr; flags interval; }\n", backend.table)
+	fmt.Fprintf(&sb, "add set inet %s ipv6 { type ipv6_addr; flags interval; }\n", backend.table)
+	fmt.Fprintf(&sb, "add chain inet %s input { type filter hook input priority -10; policy accept; }\n", backend.table)
+	fmt.Fprintf(&sb, "flush chain inet %s input\n", backend.table)
+	match := ""
+	if len(backend.ports) > 0 {
+		ports := make([]string, 0, len(backend.ports))
+		for _, port := range backend.ports {
+			ports = append(ports, strconv.Itoa(port))
+		}
+		match = fmt.Sprintf("tcp dport { %s } ", strings.Join(ports, ", "))
+	}
+	fmt.Fprintf(&sb, "add rule inet %s input %sip saddr @ipv4 %s\n", backend.table, match, backend.action)
+	fmt.Fprintf(&sb, "add rule inet %s input %sip6 saddr @ipv6 %s\n", backend.table, match, backend.action)
+	return backend.run(sb.String())
+}
+
+func (backend *nftBackend) script(ops []operation) string {
+	var sb strings.Builder
+	for _, op := range ops {
+		cmd := "delete"
+		if op.reject {
+			cmd = "add"
+		}
+		set := "ipv6"
+		if isIPv4(op.ip) {
+			set = "ipv4"
+		}
+		fmt.Fprintf(&sb, "%s element inet %s %s { %s }\n", cmd, backend.table, set, op.ip)
+	}
+	return sb.String()
+}
+
+func (backend *nftBackend) run(script string) error {
+	args := []string{"-f", "-"}
+	res, err := backend.executer.ExecInput([]byte(script), "nft", args...)
+	return commandError("nft", args, err, res)
+}
+
+// Returns the canonical IP addresses and networks of the JSON output of nft -j list set.
+func parseNftSet(data []byte) ([]string, error) {
+	var set nftSet
+	err := json.Unmarshal(data, &set)
+	if err != nil {
+		return nil, fmt.Errorf("cannot parse nft set: %s", err.Error())
+	}
+	var ips []string
+	for _, item := range set.Nftables {
+		if item.Set == nil {
+			continue
+		}
+		for _, elem := range item.Set.Elem {
+			ip, ok := parseNftElement(elem)
+			if ok {
+				ips = append(ips, ip)
+			}
+		}
+	}
+	return ips, nil
+}
+
+// Parses a set element, either an address, a prefix object or an element object with a value.
+func parseNftElement(elem any) (string, bool) {
+	switch v := elem.(type) {
+	case string:
+		ip, err := ipaddr.Parse(v)
+		return ip, err == nil
+	case map[string]any:
+		if prefix, ok := v["prefix"].(map[string]any); ok {
+			addr, _ := prefix["addr"].(string)
+			bits, _ := prefix["len"].(float64)
+			ip, err := ipaddr.Parse(fmt.Sprintf("%s/%d", addr, int(bits)))
+			return ip, err == nil
+		}
+		if inner, ok := v["elem"].(map[string]any); ok {
+			return parseNftElement(inner["val"])
+		}
+	}
+	return "", false
+}
+
+// Returns a valid nftables identifier for the comment.
+func nftIdentifier(comment string) string {
+	var sb strings.Builder
+	for idx, r := range comment {
+		if r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (idx > 0 && r >= '0' && r <= '9') {
+			sb.WriteRune(r)
+		} else {
+			sb.WriteRune('_')
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,54 @@
+package ufw
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Expiration date of the ban of an IP address or network.
+type expiration struct {
+	ip string
+	to time.Time
+}
+
+// Min-heap of expiration dates ordered by the earliest expiration.
+// Entries are not removed if a ban is extended or released, outdated entries are skipped when they expire.
+type expirations []expiration
+
+func (e expirations) Len() int { return len(e) }
+
+func (e expirations) Less(i, j int) bool { return e[i].to.Before(e[j].to) }
+
+func (e expirations) Swap(i, j int) { e[i], e[j] = e[j], e[i] }
+
+func (e *expirations) Push(x any) { *e = append(*e, x.(expiration)) }
+
+func (e *expirations) Pop() any {
+	old := *e
+	n := len(old)
+	item := old[n-1]
+	*e = old[:n-1]
+	return item
+}
+
+// Adds the expiration date of the IP address or network.
+func (e *expirations) add(ip string, to time.Time) {
+	heap.Push(e, expiration{ip: ip, to: to})
+}
+
+// Returns the earliest expiration date, the second return value is false if the heap is empty.
+func (e expirations) next() (time.Time, bool) {
+	if len(e) == 0 {
+		return time.Time{}, false
+	}
+	return e[0].to, true
+}
+
+// Removes and returns all entries that expire before or at the specified time.
+func (e *expirations) expired(now time.Time) []expiration {
+	var ret []expiration
+	for len(*e) > 0 && !(*e)[0].to.After(now) {
+		ret = append(ret, heap.Pop(e).(expiration))
+	}
+	return ret
+}
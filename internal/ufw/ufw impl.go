@@ -1,106 +1,734 @@
 package ufw
 
 import (
-	"fmt"
 	"log"
-	"strings"
+	"net/netip"
+	"sort"
+	"sync"
 	"time"
 
-	"github.com/nylssoft/goaccesslog/internal/executer"
+	"github.com/nylssoft/goaccesslog/internal/ipaddr"
 )
 
+// maximum number of attempts to apply a firewall operation
+const maxAttempts = 5
+
+// delay before the first retry of a failed firewall operation, doubled for each further retry
+const retryDelay = time.Second
+
+const maxRetryDelay = time.Minute
+
 type info struct {
-	locked   bool
+	// whether the IP address should be rejected
+	locked bool
+	// whether the firewall rule exists
+	applied  bool
 	from     time.Time
 	to       time.Time
 	occurred int
+	// category of the ban, see CATEGORY constants
+	category string
+	// first and last time the IP address has been rejected
+	firstSeen time.Time
+	lastSeen  time.Time
+	// rule that requested the last ban
+	rule string
+	// number of times the IP address has been rejected
+	hits int
+	// node that detected the last ban, empty for bans detected by this process
+	source   string
+	attempts int
+	retryAt  time.Time
 }
 
 type ufw_impl struct {
-	comment     string
-	delay       time.Duration
-	maxFailures int
-	executer    executer.Executer
-	ips         map[string]info
+	mutex   sync.Mutex
+	options Options
+	backend backend
+	store   Store
+	ips     map[string]info
+	// IP addresses with pending firewall operations
+	pending map[string]bool
+	// pending firewall operations are applied by the caller, e.g. to apply the operations of an aggregation together
+	deferred bool
+	// expiration dates of the bans
+	expirations expirations
+	running     bool
+	wake        chan bool
+	stop        chan bool
+	done        chan bool
 }
 
 func (ufw *ufw_impl) Init() {
+	ufw.mutex.Lock()
+	defer ufw.mutex.Unlock()
 	ufw.ips = make(map[string]info)
-	match := fmt.Sprintf("# %s", ufw.comment)
-	res, err := ufw.executer.Exec("ufw", "status")
-	if err == nil {
-		lines := strings.SplitSeq(string(res), "\n")
-		for line := range lines {
-			idx := strings.LastIndex(line, match)
-			if idx > 0 {
-				line = line[0:idx]
-				idx = strings.LastIndex(line, "REJECT")
-				if idx > 0 {
-					ip := strings.TrimSpace(line[idx+len("REJECT"):])
-					from := time.Now()
-					until := from.Add(ufw.delay)
-					ufw.ips[ip] = info{locked: true, from: from, to: until, occurred: 1}
-				}
+	ufw.pending = make(map[string]bool)
+	ufw.expirations = nil
+	ips, err := ufw.backend.status()
+	if err != nil {
+		// the stored bans are applied again, failed firewall operations are retried by the worker
+		checkError(err)
+		log.Println("ERROR: Cannot read firewall rules. Apply stored bans again.")
+		ufw.deferred = true
+		defer func() { ufw.deferred = false }()
+	}
+	stored := map[string]Ban{}
+	if ufw.store != nil {
+		bans, err := ufw.store.LoadBans()
+		checkError(err)
+		for _, ban := range bans {
+			stored[ban.IP] = ban
+		}
+	}
+	now := time.Now()
+	rules := map[string]bool{}
+	for _, ip := range ips {
+		rules[ip] = true
+		ban, found := stored[ip]
+		info := newInfo(ban)
+		info.locked = true
+		info.applied = true
+		if found && ban.Category == CATEGORY_BLOCKLIST {
+			info.category = ban.Category
+			ufw.ips[ip] = info
+		} else if found && ban.To.After(now) {
+			ufw.ips[ip] = info
+			ufw.expirations.add(ip, ban.To)
+			log.Println("Adopt locked IP", ip, "until", ban.To, ".")
+		} else if found {
+			ufw.ips[ip] = info
+			ufw.release(ip, "expired")
+		} else {
+			ufw.handleUnknownRule(ip, now)
+		}
+	}
+	ufw.releaseAllowlisted()
+	for ip, ban := range stored {
+		if rules[ip] {
+			continue
+		}
+		info := newInfo(ban)
+		ufw.ips[ip] = info
+		if ufw.isAllowlisted(ip) {
+			// no firewall rule is added, the stored ban is released
+			if ban.Category == CATEGORY_BLOCKLIST || ban.To.After(now) {
+				log.Println("Release allowlisted IP", ip, ".")
+				ufw.release(ip, "allowlisted")
 			}
+		} else if ban.Category == CATEGORY_BLOCKLIST {
+			info.locked = true
+			info.category = ban.Category
+			ufw.ips[ip] = info
+			ufw.schedule(ip)
+		} else if ban.To.After(now) {
+			log.Println("Add missing firewall rule for locked IP", ip, "until", ban.To, ".")
+			info.locked = true
+			ufw.ips[ip] = info
+			ufw.expirations.add(ip, ban.To)
+			ufw.schedule(ip)
 		}
 	}
-	checkError("ufw status", err, res)
+}
+
+func (ufw *ufw_impl) Start() {
+	ufw.mutex.Lock()
+	defer ufw.mutex.Unlock()
+	if ufw.running {
+		return
+	}
+	ufw.running = true
+	ufw.wake = make(chan bool, 1)
+	ufw.stop = make(chan bool)
+	ufw.done = make(chan bool)
+	if len(ufw.pending) > 0 {
+		// operations deferred by Init
+		ufw.wake <- true
+	}
+	go ufw.worker()
+}
+
+func (ufw *ufw_impl) Stop() {
+	ufw.mutex.Lock()
+	if !ufw.running {
+		ufw.mutex.Unlock()
+		return
+	}
+	close(ufw.stop)
+	ufw.mutex.Unlock()
+	<-ufw.done
+	ufw.mutex.Lock()
+	defer ufw.mutex.Unlock()
+	ufw.running = false
+	ops := ufw.collect(true)
+	if len(ops) > 0 {
+		ufw.complete(ops, ufw.backend.apply(ops), false)
+	}
 }
 
 func (ufw *ufw_impl) ReleaseAll() {
+	ufw.mutex.Lock()
+	defer ufw.mutex.Unlock()
 	for ip, info := range ufw.ips {
 		if info.locked {
-			ufw.Release(ip)
+			ufw.release(ip, "release all")
 		}
 	}
 }
 
 func (ufw *ufw_impl) ReleaseIfExpired() {
+	ufw.mutex.Lock()
+	defer ufw.mutex.Unlock()
+	ufw.releaseExpired(time.Now())
+}
+
+func (ufw *ufw_impl) IsRejected(ip string) bool {
+	ufw.mutex.Lock()
+	defer ufw.mutex.Unlock()
+	ip = ipaddr.Canonical(ip)
+	info := ufw.ips[ip]
+	return info.locked || len(ufw.coveringPrefix(ip)) > 0
+}
+
+func (ufw *ufw_impl) Reject(ip string, reason string) bool {
+	return ufw.RejectFor(ip, 0, reason)
+}
+
+func (ufw *ufw_impl) RejectFor(ip string, duration time.Duration, reason string) bool {
+	return ufw.RejectFrom(ip, duration, reason, "")
+}
+
+func (ufw *ufw_impl) RejectFrom(ip string, duration time.Duration, reason string, source string) bool {
+	ufw.mutex.Lock()
+	defer ufw.mutex.Unlock()
+	ip, err := ipaddr.Parse(ip)
+	if err != nil {
+		log.Println("ERROR: Cannot reject IP.", err)
+		return false
+	}
+	if ufw.isAllowlisted(ip) {
+		log.Printf("WARNING: Ignore ban of allowlisted IP %s requested by %s.\n", ip, reason)
+		return false
+	}
+	if prefix := ufw.coveringPrefix(ip); len(prefix) > 0 {
+		// the firewall rule of the network rejects the IP address, nft does not accept overlapping set elements
+		ufw.extendCovering(prefix, ip, duration, reason, source)
+		return true
+	}
+	if !ufw.reject(ip, duration, reason, source) {
+		return false
+	}
+	ufw.aggregate(ip)
+	return true
+}
+
+func (ufw *ufw_impl) ReleaseAllowlisted() {
+	ufw.mutex.Lock()
+	defer ufw.mutex.Unlock()
+	ufw.releaseAllowlisted()
+}
+
+func (ufw *ufw_impl) Release(ip string) bool {
+	ufw.mutex.Lock()
+	defer ufw.mutex.Unlock()
+	ip = ipaddr.Canonical(ip)
+	if !ufw.ips[ip].locked {
+		return false
+	}
+	return ufw.release(ip, "manual release")
+}
+
+func (ufw *ufw_impl) Bans() []Ban {
+	ufw.mutex.Lock()
+	defer ufw.mutex.Unlock()
+	bans := []Ban{}
+	for ip, info := range ufw.ips {
+		if info.locked {
+			bans = append(bans, ufw.ban(ip))
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool {
+		// blocklist bans without expiration date are ordered last
+		if bans[i].To.IsZero() != bans[j].To.IsZero() {
+			return bans[j].To.IsZero()
+		}
+		return bans[i].To.Before(bans[j].To)
+	})
+	return bans
+}
+
+func (ufw *ufw_impl) SetBlocklist(ips []string) {
+	ufw.mutex.Lock()
+	defer ufw.mutex.Unlock()
 	now := time.Now()
+	blocked := map[string]bool{}
+	var changed []string
+	var events []BanEvent
+	for _, entry := range ips {
+		ip, err := ipaddr.Parse(entry)
+		if err != nil {
+			log.Println("ERROR: Cannot reject blocklist IP.", err)
+			continue
+		}
+		if blocked[ip] {
+			continue
+		}
+		if ufw.isAllowlisted(ip) {
+			log.Printf("WARNING: Ignore ban of allowlisted IP %s requested by blocklist.\n", ip)
+			continue
+		}
+		blocked[ip] = true
+		info := ufw.ips[ip]
+		if info.locked && info.category == CATEGORY_BLOCKLIST {
+			continue
+		}
+		if !info.locked {
+			info.from = now
+			info.to = time.Time{}
+		}
+		info.locked = true
+		info.category = CATEGORY_BLOCKLIST
+		ufw.ips[ip] = info
+		ufw.pending[ip] = true
+		changed = append(changed, ip)
+		events = append(events, ufw.event(ip, EVENT_REJECT, "blocklist"))
+	}
+	added := len(changed)
 	for ip, info := range ufw.ips {
-		if info.locked && now.After(info.to) {
-			ufw.Release(ip)
+		if info.category != CATEGORY_BLOCKLIST || blocked[ip] {
+			continue
+		}
+		if info.locked && !info.to.After(now) {
+			events = append(events, ufw.event(ip, EVENT_RELEASE, "removed from blocklist"))
+		}
+		info.category = ""
+		if info.locked && info.to.After(now) {
+			// keep the ban detected by a rule or added manually
+			ufw.expirations.add(ip, info.to)
+		} else if info.locked {
+			info.locked = false
+			info.to = now
+			ufw.pending[ip] = true
 		}
+		ufw.ips[ip] = info
+		changed = append(changed, ip)
 	}
+	ufw.saveAll(changed)
+	ufw.recordAll(events)
+	log.Printf("Blocklist contains %d IPs and networks. Added %d and removed %d blocklist bans.\n", len(blocked), added, len(changed)-added)
+	ufw.flush()
 }
 
-func (ufw *ufw_impl) IsRejected(ip string) bool {
-	info := ufw.ips[ip]
-	return info.locked
+// Handles a firewall rule marked with the used comment for which no ban is stored.
+func (ufw *ufw_impl) handleUnknownRule(ip string, now time.Time) {
+	switch ufw.options.UnknownRulePolicy {
+	case POLICY_RELEASE:
+		log.Println("Release IP", ip, "without stored ban.")
+		ufw.ips[ip] = info{locked: true, applied: true, from: now, to: now, occurred: 1}
+		ufw.release(ip, "firewall rule without stored ban")
+	case POLICY_ALERT:
+		log.Println("WARNING: Firewall rule for IP", ip, "has no stored ban. The firewall rule is not managed.")
+	default:
+		until := now.Add(ufw.options.Delay)
+		ufw.ips[ip] = info{locked: true, applied: true, from: now, to: until, occurred: 1, firstSeen: now, lastSeen: now, rule: "adopted firewall rule", hits: 1}
+		ufw.expirations.add(ip, until)
+		ufw.save(ip)
+		ufw.record(ip, EVENT_REJECT, "adopted firewall rule")
+		log.Println("Adopt IP", ip, "without stored ban until", until, ".")
+	}
 }
 
-func (ufw *ufw_impl) Reject(ip string) bool {
+// Locks the IP address and schedules the firewall operation.
+// Bans of other nodes only extend an active ban and do not escalate the ban duration of this node.
+// Returns false if the firewall operation has been applied synchronously and failed.
+func (ufw *ufw_impl) reject(ip string, duration time.Duration, reason string, source string) bool {
 	info := ufw.ips[ip]
-	res, err := ufw.executer.Exec("ufw", "insert", "1", "reject", "from", ip, "to", "any", "comment", "goaccesslog")
-	if err == nil {
+	now := time.Now()
+	if len(source) > 0 && info.locked {
+		if to := now.Add(ufw.banDuration(duration, info.occurred)); info.category != CATEGORY_BLOCKLIST && to.After(info.to) {
+			info.to = to
+			info.rule = reason
+			info.source = source
+		}
+	} else {
+		duration = ufw.banDuration(duration, info.occurred)
 		info.locked = true
-		info.from = time.Now()
-		info.to = info.from.Add(ufw.delay * (1 << info.occurred))
-		info.occurred += 1
-		if info.occurred > ufw.maxFailures {
-			info.occurred = ufw.maxFailures
+		info.from = now
+		info.to = now.Add(duration)
+		if len(source) == 0 {
+			info.occurred = min(info.occurred+1, ufw.options.MaxFailures)
 		}
-		ufw.ips[ip] = info
-		log.Println("Lock IP", ip, "until", info.to, ". Detected", info.occurred, "times.")
-		return true
+		info.rule = reason
+		info.source = source
 	}
-	checkError("ufw insert 1 reject from "+ip+" to any comment goaccesslog", err, res)
-	return false
+	if info.firstSeen.IsZero() {
+		info.firstSeen = now
+	}
+	info.lastSeen = now
+	info.hits++
+	ufw.ips[ip] = info
+	ufw.expirations.add(ip, info.to)
+	ufw.save(ip)
+	ufw.record(ip, EVENT_REJECT, reason)
+	if len(source) > 0 {
+		log.Println("Lock IP", ip, "until", info.to, "requested by", reason, "on node", source, ". Detected", info.occurred, "times.")
+	} else {
+		log.Println("Lock IP", ip, "until", info.to, "requested by", reason, ". Detected", info.occurred, "times.")
+	}
+	ufw.schedule(ip)
+	if !ufw.ips[ip].locked {
+		return false
+	}
+	// bans received from other nodes are not shared again
+	if len(source) == 0 && ufw.options.Notifier != nil {
+		ufw.options.Notifier.Banned(ufw.ban(ip))
+	}
+	return true
 }
 
-func (ufw *ufw_impl) Release(ip string) {
-	res, err := ufw.executer.Exec("ufw", "delete", "reject", "from", ip, "to", "any")
-	if err == nil {
+// Returns the ban duration, the escalated ban duration for the number of failures if the duration is not positive.
+// The ban duration is limited to the maximum ban duration, also for requested durations, e.g. of other nodes.
+func (ufw *ufw_impl) banDuration(duration time.Duration, occurred int) time.Duration {
+	if duration <= 0 {
+		duration = ufw.options.Delay * (1 << occurred)
+	}
+	if ufw.options.MaxDelay > 0 && duration > ufw.options.MaxDelay {
+		duration = ufw.options.MaxDelay
+	}
+	return duration
+}
+
+// Extends the ban of the network that covers the IP address instead of adding a firewall rule for the IP address.
+// The ban of the network is not shortened.
+func (ufw *ufw_impl) extendCovering(prefix string, ip string, duration time.Duration, reason string, source string) {
+	info := ufw.ips[prefix]
+	now := time.Now()
+	to := now.Add(ufw.banDuration(duration, ufw.ips[ip].occurred))
+	if info.category != CATEGORY_BLOCKLIST && to.After(info.to) {
+		info.to = to
+		info.lastSeen = now
+		info.hits++
+		ufw.ips[prefix] = info
+		ufw.expirations.add(prefix, to)
+		ufw.save(prefix)
+		ufw.record(prefix, EVENT_REJECT, reason)
+	}
+	log.Println("IP", ip, "is rejected by locked network", prefix, "until", info.to, ". Requested by", reason, ".")
+	if len(source) == 0 && ufw.options.Notifier != nil {
+		ufw.options.Notifier.Banned(Ban{IP: ip, From: now, To: to, Rule: reason})
+	}
+}
+
+// Unlocks the IP address and schedules the firewall operation.
+// The reason is stored in the audit trail.
+// Returns false if the firewall operation has been applied synchronously and failed.
+func (ufw *ufw_impl) release(ip string, reason string) bool {
+	ufw.record(ip, EVENT_RELEASE, reason)
+	info := ufw.ips[ip]
+	info.locked = false
+	info.to = time.Now()
+	info.category = ""
+	ufw.ips[ip] = info
+	ufw.save(ip)
+	log.Println("Unlocked IP", ip)
+	ufw.schedule(ip)
+	return !ufw.ips[ip].locked
+}
+
+// Schedules the firewall operation for the IP address.
+func (ufw *ufw_impl) schedule(ip string) {
+	ufw.pending[ip] = true
+	if !ufw.deferred {
+		ufw.flush()
+	}
+}
+
+// Applies the pending firewall operations.
+// If the worker is running the operations are applied in the background,
+// otherwise the operations are applied immediately.
+func (ufw *ufw_impl) flush() {
+	if ufw.running {
+		select {
+		case ufw.wake <- true:
+		default:
+		}
+		return
+	}
+	ops := ufw.collect(true)
+	if len(ops) > 0 {
+		ufw.complete(ops, ufw.backend.apply(ops), false)
+	}
+}
+
+// Releases expired bans at their expiration date and applies pending firewall operations in batches
+// until the worker is stopped.
+func (ufw *ufw_impl) worker() {
+	defer close(ufw.done)
+	for {
+		var expire, retry <-chan time.Time
+		ufw.mutex.Lock()
+		next, ok := ufw.expirations.next()
+		retryAt, retrying := ufw.nextRetry()
+		ufw.mutex.Unlock()
+		if ok {
+			// rejecting an IP address wakes the worker, so an earlier expiration date is always considered
+			expire = time.After(time.Until(next))
+		}
+		if retrying {
+			// a later failure does not postpone the retry of an earlier failure
+			retry = time.After(time.Until(retryAt))
+		}
+		select {
+		case <-ufw.stop:
+			return
+		case <-ufw.wake:
+		case <-retry:
+		case <-expire:
+		}
+		ufw.mutex.Lock()
+		ufw.releaseExpired(time.Now())
+		ops := ufw.collect(false)
+		ufw.mutex.Unlock()
+		if len(ops) == 0 {
+			continue
+		}
+		// the lock is not held while the firewall commands run, so IP addresses can be locked in the meantime
+		errs := ufw.backend.apply(ops)
+		ufw.mutex.Lock()
+		ufw.complete(ops, errs, true)
+		ufw.mutex.Unlock()
+	}
+}
+
+// Returns the earliest retry time of the pending failed operations, false if no operation waits for a retry.
+func (ufw *ufw_impl) nextRetry() (time.Time, bool) {
+	var next time.Time
+	for ip := range ufw.pending {
+		retryAt := ufw.ips[ip].retryAt
+		if !retryAt.IsZero() && (next.IsZero() || retryAt.Before(next)) {
+			next = retryAt
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// Returns the operations for all pending IP addresses whose firewall rule does not match the locked state.
+// Failed operations are skipped until their retry time is reached unless force is true.
+// Rejects are ordered before releases, so a network is rejected before its single IP addresses are released.
+func (ufw *ufw_impl) collect(force bool) []operation {
+	var ops []operation
+	now := time.Now()
+	for ip := range ufw.pending {
 		info := ufw.ips[ip]
-		info.locked = false
-		ufw.ips[ip] = info
-		log.Println("Unlocked IP", ip)
+		if !force && info.retryAt.After(now) {
+			continue
+		}
+		if info.locked != info.applied {
+			ops = append(ops, operation{ip: ip, reject: info.locked})
+		}
+		delete(ufw.pending, ip)
+	}
+	sort.Slice(ops, func(i, j int) bool {
+		if ops[i].reject != ops[j].reject {
+			return ops[i].reject
+		}
+		return ops[i].ip < ops[j].ip
+	})
+	return ops
+}
+
+// Updates the firewall state for the applied operations.
+// Failed operations are scheduled again if retry is true and the maximum number of attempts is not reached.
+// Otherwise the locked state is reverted.
+func (ufw *ufw_impl) complete(ops []operation, errs []error, retry bool) {
+	for idx, op := range ops {
+		info := ufw.ips[op.ip]
+		err := errs[idx]
+		if err == nil {
+			info.applied = op.reject
+			info.attempts = 0
+			info.retryAt = time.Time{}
+			if info.locked != info.applied {
+				// locked state changed while the operation has been applied
+				ufw.schedule(op.ip)
+			}
+			ufw.ips[op.ip] = info
+			continue
+		}
+		checkError(err)
+		info.attempts++
+		if retry && info.attempts < maxAttempts {
+			ufw.pending[op.ip] = true
+			next := min(retryDelay<<(info.attempts-1), maxRetryDelay)
+			info.retryAt = time.Now().Add(next)
+			log.Println("Retry firewall operation for IP", op.ip, "in", next, ".")
+		} else {
+			info.attempts = 0
+			info.retryAt = time.Time{}
+			info.locked = info.applied
+			info.to = time.Now()
+			if op.reject {
+				// the blocklist ban is added again if the blocklist is modified
+				info.category = ""
+				log.Println("ERROR: Failed to lock IP", op.ip, ".")
+			} else {
+				// the IP address is released again after the maximum retry delay
+				info.to = info.to.Add(maxRetryDelay)
+				ufw.expirations.add(op.ip, info.to)
+				log.Println("ERROR: Failed to unlock IP", op.ip, ".")
+			}
+		}
+		ufw.ips[op.ip] = info
+		ufw.save(op.ip)
+	}
+}
+
+// Releases all bans that expire before or at the specified time.
+// Outdated expiration dates of extended or released bans are skipped.
+func (ufw *ufw_impl) releaseExpired(now time.Time) {
+	for _, expiration := range ufw.expirations.expired(now) {
+		info := ufw.ips[expiration.ip]
+		if info.locked && info.category != CATEGORY_BLOCKLIST && !info.to.After(now) {
+			ufw.release(expiration.ip, "expired")
+		}
+	}
+}
+
+// Returns whether the IP address or network overlaps with the allowlist.
+func (ufw *ufw_impl) isAllowlisted(ip string) bool {
+	return ufw.options.Allowlist != nil && ufw.options.Allowlist.Contains(ip)
+}
+
+// Releases all locked IP addresses and networks that overlap with the allowlist.
+func (ufw *ufw_impl) releaseAllowlisted() {
+	for ip, info := range ufw.ips {
+		if info.locked && ufw.isAllowlisted(ip) {
+			log.Println("Release allowlisted IP", ip, ".")
+			ufw.release(ip, "allowlisted")
+		}
+	}
+}
+
+// Persists the ban of the specified IP address or network.
+func (ufw *ufw_impl) save(ip string) {
+	if ufw.store != nil {
+		checkError(ufw.store.SaveBan(ufw.ban(ip)))
+	}
+}
+
+// Persists the bans of the specified IP addresses and networks in a single transaction.
+func (ufw *ufw_impl) saveAll(ips []string) {
+	if ufw.store != nil && len(ips) > 0 {
+		bans := make([]Ban, 0, len(ips))
+		for _, ip := range ips {
+			bans = append(bans, ufw.ban(ip))
+		}
+		checkError(ufw.store.SaveBans(bans))
+	}
+}
+
+// Appends an event for the IP address or network to the audit trail.
+func (ufw *ufw_impl) record(ip string, action string, reason string) {
+	ufw.recordAll([]BanEvent{ufw.event(ip, action, reason)})
+}
+
+// Appends the events to the audit trail in a single transaction.
+func (ufw *ufw_impl) recordAll(events []BanEvent) {
+	countEvents(events)
+	if ufw.store != nil && len(events) > 0 {
+		checkError(ufw.store.SaveBanEvents(events))
+	}
+}
+
+// Returns the event for the current state of the IP address or network.
+func (ufw *ufw_impl) event(ip string, action string, reason string) BanEvent {
+	info := ufw.ips[ip]
+	event := BanEvent{Time: time.Now(), IP: ip, Action: action, Reason: reason, Category: info.category}
+	if action == EVENT_REJECT {
+		event.To = info.to
+		event.Source = info.source
+	}
+	return event
+}
+
+func (ufw *ufw_impl) ban(ip string) Ban {
+	info := ufw.ips[ip]
+	return Ban{IP: ip, From: info.from, To: info.to, Occurred: info.occurred, Category: info.category,
+		FirstSeen: info.firstSeen, LastSeen: info.lastSeen, Rule: info.rule, Hits: info.hits, Source: info.source}
+}
+
+// Returns the firewall state of a stored ban, the IP address is not locked.
+func newInfo(ban Ban) info {
+	return info{from: ban.From, to: ban.To, occurred: ban.Occurred,
+		firstSeen: ban.FirstSeen, lastSeen: ban.LastSeen, rule: ban.Rule, hits: ban.Hits, source: ban.Source}
+}
+
+// Replaces the bans of all IP addresses in the network of the specified IP address
+// with a single ban for the network if enough IP addresses have been rejected within the window.
+func (ufw *ufw_impl) aggregate(ip string) {
+	aggregation := ufw.options.Aggregation
+	if aggregation.Threshold <= 0 {
+		return
+	}
+	prefix, ok := ufw.aggregationPrefix(ip)
+	if !ok || ufw.ips[prefix.String()].locked {
+		return
+	}
+	if ufw.isAllowlisted(prefix.String()) {
+		return
+	}
+	since := time.Now().Add(-aggregation.Window)
+	var neighbors []string
+	for other, info := range ufw.ips {
+		if info.locked && info.category == "" && info.from.After(since) && !ipaddr.IsPrefix(other) && ipaddr.Contains(prefix, other) {
+			neighbors = append(neighbors, other)
+		}
+	}
+	if len(neighbors) < aggregation.Threshold {
+		return
+	}
+	sort.Strings(neighbors)
+	log.Println("Detected", len(neighbors), "rejected IPs in network", prefix, ". Lock network instead of single IPs.")
+	// the network ban and the releases are applied together
+	ufw.deferred = true
+	if ufw.reject(prefix.String(), 0, "network aggregation", "") {
+		for _, neighbor := range neighbors {
+			ufw.release(neighbor, "replaced by network ban "+prefix.String())
+		}
+	}
+	ufw.deferred = false
+	ufw.flush()
+}
+
+// Returns the network of the specified IP address using the configured prefix length.
+func (ufw *ufw_impl) aggregationPrefix(ip string) (netip.Prefix, bool) {
+	addr, err := ipaddr.ParseAddr(ip)
+	if err != nil {
+		return netip.Prefix{}, false
+	}
+	bits := ufw.options.Aggregation.IPv6PrefixLength
+	if addr.Is4() {
+		bits = ufw.options.Aggregation.IPv4PrefixLength
+	}
+	prefix, err := addr.Prefix(bits)
+	return prefix, err == nil
+}
+
+// Returns the rejected network that contains the specified IP address or an empty string.
+func (ufw *ufw_impl) coveringPrefix(ip string) string {
+	for target, info := range ufw.ips {
+		if info.locked && target != ip {
+			prefix, err := ipaddr.ParsePrefix(target)
+			if err == nil && ipaddr.Contains(prefix, ip) {
+				return target
+			}
+		}
 	}
-	checkError("ufw delete reject from "+ip+" to any", err, res)
+	return ""
 }
 
-func checkError(cmd string, err error, res []byte) {
+func checkError(err error) {
 	if err != nil {
-		log.Println("ERROR:", cmd, err, string(res))
+		log.Println("ERROR:", err)
 	}
 }
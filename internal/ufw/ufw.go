@@ -10,39 +10,193 @@ import (
 // for IP addresses.
 //
 // Each added firewall rule has an expiration date.
-// The rule will expire after 1 hour if the IP address is added for the first time.
-// The expiration date will increase by a factor 1 << (reject count) to a maximum of 1024 hours.
+// The rule will expire after the configured delay (e.g. 1 hour) if the IP address is added for the first time.
+// The expiration date will increase by a factor 1 << (reject count) up to the configured maximum
+// number of failures and the maximum delay (e.g. 1024 hours).
 //
-// Requires sudo permissions.
+// Firewall rules are marked with the configured comment, therefore several processes
+// with different comments can manage their own rules on the same host.
+//
+// Requires sudo permissions. The firewall object can be used concurrently.
 //
 // Use NewUfw to create a new firewall object.
 type Ufw interface {
 	// Initializes the firewall object.
-	// Reads all rejected IP addresses for REJECT firewall rules marked with the used comment.
+	// Reads all rejected IP addresses for REJECT firewall rules marked with the used comment
+	// and reconciles them with the stored bans:
+	// rules with an active ban are adopted with the stored expiration date,
+	// rules with an expired ban are deleted, rules without a ban are handled by the unknown rule policy,
+	// and missing rules for active bans are added again.
+	// If the firewall rules cannot be read, the rules of all active bans are added again by the worker.
 	Init()
+	// Starts the worker that applies firewall operations in the background.
+	// Reject and Release return immediately, the firewall operations are deduplicated and applied in batches.
+	// Failed operations are retried with increasing delay.
+	// Expired bans are released at their expiration date, independent of calls to ReleaseIfExpired.
+	// If the worker is not started, firewall operations are applied synchronously.
+	Start()
+	// Stops the worker and applies all pending firewall operations.
+	Stop()
 	// Returns whether the specified IP addresses is rejected by a firewall rule.
 	IsRejected(ip string) bool
 	// Rejects the specified IP address.
 	// Adds a REJECT firewall rule with the used comment for the specified IP address.
-	Reject(ip string) bool
+	// The reason describes the rule that requested the ban and is logged.
+	// Returns false if the IP address is in the allowlist.
+	// If the IP address is in a locked network, the ban of the network is extended instead.
+	Reject(ip string, reason string) bool
+	// Rejects the specified IP address for the specified duration.
+	// If the duration is not positive the expiration date is calculated as for Reject.
+	// The duration is limited to the maximum expiration delay.
+	RejectFor(ip string, duration time.Duration, reason string) bool
+	// Rejects the specified IP address for the specified duration on behalf of another node.
+	// The source is the name of the node that detected the IP address.
+	// Bans with a source are not passed to the notifier, so they are not shared again.
+	RejectFrom(ip string, duration time.Duration, reason string, source string) bool
 	// Releases all rejected IP addresses.
 	// All REJECT firewall rules that are marked with the used comment are deleted.
 	ReleaseAll()
+	// Releases the firewall rules for all IP addresses and networks in the allowlist,
+	// e.g. if the allowlist has been modified.
+	ReleaseAllowlisted()
+	// Replaces the bans of the blocklist category with the specified IP addresses and networks.
+	// Blocklist bans do not expire, they are released if they are removed from the blocklist.
+	// Bans detected by rules or added manually are not affected,
+	// an active ban of another category is kept if the IP address is removed from the blocklist.
+	SetBlocklist(ips []string)
 	// Releases firewall rules that are expired.
 	// All REJECT firewall rules that are expired and marked with the used comment are deleted.
 	ReleaseIfExpired()
 	// Releases the firewall rule for the specified IP address.
 	// The REJECT firewall rule with the used comment and the specified IP address as source is deleted.
-	Release(ip string)
+	// Returns false if the IP address is not rejected or the firewall rule could not be deleted.
+	Release(ip string) bool
+	// Returns all rejected IP addresses and networks ordered by expiration date.
+	Bans() []Ban
+}
+
+// Describes the firewall parameters.
+type Options struct {
+	// Name of the firewall backend: ufw, nft or ipset.
+	Backend string
+	// Comment used to mark the firewall rules.
+	Comment string
+	// Action of the firewall rules, either reject or deny.
+	Action string
+	// Destination TCP ports of the firewall rules, all ports are blocked if empty.
+	Ports []int
+	// Expiration delay for the first ban of an IP address.
+	Delay time.Duration
+	// Maximum number of escalations of the expiration delay.
+	MaxFailures int
+	// Maximum expiration delay, unlimited if not positive.
+	// Also limits the durations of RejectFor and RejectFrom, e.g. of manual bans and bans of other nodes.
+	MaxDelay time.Duration
+	// Parameters to replace the bans of neighbor IP addresses with a single network ban.
+	Aggregation Aggregation
+	// Whether all firewall rules are deleted if the process terminates.
+	ReleaseOnShutdown bool
+	// Policy for firewall rules marked with the used comment but without a stored ban, see POLICY constants.
+	UnknownRulePolicy string
+	// IP addresses and networks that are never rejected, optional.
+	Allowlist Allowlist
+	// Is notified about new bans of this process, optional.
+	Notifier Notifier
+}
+
+// Is notified about new bans, e.g. to share them with other nodes.
+type Notifier interface {
+	// Called for each new ban detected by rules, added manually or by network aggregation.
+	// The firewall object is locked during the call, therefore the call must not block.
+	Banned(ban Ban)
+}
+
+// Describes IP addresses and networks that must not be rejected.
+type Allowlist interface {
+	// Returns whether the specified IP address or network overlaps with the allowlist.
+	Contains(ip string) bool
+}
+
+// Persists bans so that they survive a restart of the process.
+//
+// Released bans are kept with the release time as expiration date
+// to remember how often an IP address has been rejected.
+type Store interface {
+	// Returns all stored bans.
+	LoadBans() ([]Ban, error)
+	// Inserts or updates the ban for the IP address or network.
+	SaveBan(ban Ban) error
+	// Inserts or updates the bans in a single transaction.
+	SaveBans(bans []Ban) error
+	// Appends the events to the audit trail of the firewall actions in a single transaction.
+	SaveBanEvents(events []BanEvent) error
 }
 
-// Creates a new firewall object with the specified comment for REJECT firewall rules.
-func NewUfw(executer executer.Executer, comment string, delay time.Duration, maxFailures int) Ufw {
+// Describes when rejected IP addresses of the same network are replaced by a single network ban.
+//
+// If at least Threshold distinct IP addresses of the same IPv4 or IPv6 network have been rejected
+// within Window, the network is rejected and the firewall rules for the single IP addresses are deleted.
+// The network ban is tracked and released as a unit. Aggregation is disabled if Threshold is not positive.
+type Aggregation struct {
+	Threshold        int
+	Window           time.Duration
+	IPv4PrefixLength int
+	IPv6PrefixLength int
+}
+
+// Describes a rejected IP address or network.
+type Ban struct {
+	IP       string    `json:"ip"`
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Occurred int       `json:"occurred"`
+	// Category of the ban, see CATEGORY constants. Empty for bans detected by rules or added manually.
+	Category string `json:"category,omitempty"`
+	// First and last time the IP address has been rejected.
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	// Rule that requested the last ban.
+	Rule string `json:"rule,omitempty"`
+	// Number of times the IP address has been rejected.
+	Hits int `json:"hits"`
+	// Node that detected the last ban, empty if the ban has been detected by this process.
+	Source string `json:"source,omitempty"`
+}
+
+// Describes a reject or release action of the firewall object.
+type BanEvent struct {
+	Time time.Time `json:"time"`
+	IP   string    `json:"ip"`
+	// Action, see EVENT constants.
+	Action string `json:"action"`
+	// Rule or reason that requested the action, e.g. expired or manual release.
+	Reason string `json:"reason,omitempty"`
+	// Expiration date of a rejected IP address, zero for releases and blocklist bans.
+	To       time.Time `json:"to"`
+	Category string    `json:"category,omitempty"`
+	Source   string    `json:"source,omitempty"`
+}
+
+// Creates a new firewall object with the specified options.
+// Bans are persisted in the specified store, if the store is nil bans are only kept in memory.
+func NewUfw(executer executer.Executer, store Store, options Options) Ufw {
 	var ufw ufw_impl
-	ufw.executer = executer
-	ufw.comment = comment
-	ufw.delay = delay
-	ufw.maxFailures = maxFailures
+	ufw.options = options
+	ufw.store = store
+	ufw.backend = newMetricsBackend(newBackend(executer, options), options.Backend)
 	ufw.ips = make(map[string]info)
+	ufw.pending = make(map[string]bool)
 	return &ufw
 }
+
+// Returns the default options, firewall rules reject all requests and are marked with the comment goaccesslog.
+func DefaultOptions() Options {
+	return Options{
+		Backend:           BACKEND_UFW,
+		Comment:           "goaccesslog",
+		Action:            ACTION_REJECT,
+		Delay:             time.Hour,
+		MaxFailures:       10,
+		UnknownRulePolicy: POLICY_ADOPT,
+	}
+}
@@ -2,10 +2,19 @@ package ufw
 
 import (
 	"errors"
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/nylssoft/goaccesslog/internal/metrics"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestUfw(t *testing.T) {
@@ -22,7 +31,7 @@ OpenSSH                    DENY        Anywhere`,
 		err: nil,
 	}
 
-	ufw := NewUfw(&e, "unittest", time.Hour, 10)
+	ufw := NewUfw(&e, nil, newOptions(time.Hour, 10, Aggregation{}))
 	assert.NotNil(t, ufw)
 
 	ufw.Init()
@@ -36,11 +45,14 @@ OpenSSH                    DENY        Anywhere`,
 	assert.True(t, rejected)
 	rejected = ufw.IsRejected("204.76.203.219")
 	assert.False(t, rejected)
+	assert.Len(t, ufw.Bans(), 3)
 
 	// release a single IP
-	ufw.Release("178.128.20.144")
+	assert.True(t, ufw.Release("178.128.20.144"))
 	rejected = ufw.IsRejected("178.128.20.144")
 	assert.False(t, rejected)
+	assert.False(t, ufw.Release("178.128.20.144"))
+	assert.Len(t, ufw.Bans(), 2)
 
 	// release all IPs
 	ufw.ReleaseAll()
@@ -51,7 +63,7 @@ OpenSSH                    DENY        Anywhere`,
 	rejected = ufw.IsRejected("176.65.148.236")
 	assert.False(t, rejected)
 
-	ufw = NewUfw(&e, "unittest", time.Second, 3)
+	ufw = NewUfw(&e, nil, newOptions(time.Second, 3, Aggregation{}))
 	ufw.Init()
 	time.Sleep(time.Second * 2)
 	// all IPs expired, therefore released
@@ -64,10 +76,10 @@ OpenSSH                    DENY        Anywhere`,
 	assert.False(t, rejected)
 
 	// reject IP four times, totally delayed for 1 << 3 seconds == 8 seconds
-	ufw.Reject("1.1.1.1")
-	ufw.Reject("1.1.1.1")
-	ufw.Reject("1.1.1.1")
-	ufw.Reject("1.1.1.1")
+	ufw.Reject("1.1.1.1", "test")
+	ufw.Reject("1.1.1.1", "test")
+	ufw.Reject("1.1.1.1", "test")
+	ufw.Reject("1.1.1.1", "test")
 	assert.True(t, ufw.IsRejected("1.1.1.1"))
 	time.Sleep(time.Second * 3)
 	ufw.ReleaseIfExpired()
@@ -76,17 +88,766 @@ OpenSSH                    DENY        Anywhere`,
 	ufw.ReleaseIfExpired()
 	assert.False(t, ufw.IsRejected("1.1.1.1"))
 
+	// reject IP for a fixed duration
+	assert.True(t, ufw.RejectFor("2.2.2.2", 24*time.Hour, "test"))
+	bans := ufw.Bans()
+	require.Len(t, bans, 1)
+	assert.Equal(t, "2.2.2.2", bans[0].IP)
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), bans[0].To, time.Minute)
+
 	// error handling
 	e.err = errors.New("simulate error")
 	ufw.Init()
-	assert.False(t, ufw.Reject("1.1.1.1"))
+	assert.False(t, ufw.Reject("1.1.1.1", "test"))
+}
+
+func TestInitIPv6(t *testing.T) {
+	e := mockExecutor{
+		ret: `Status: active
+
+To                         Action      From
+--                         ------      ----
+22/tcp                     ALLOW       Anywhere
+Anywhere                   REJECT      203.0.113.7                # unittest
+Anywhere                   REJECT      198.51.100.0/24            # unittest
+Anywhere                   REJECT      192.0.2.1                  # unittest-other
+Anywhere on eth0           REJECT IN   192.0.2.2                  # unittest
+22/tcp (v6)                ALLOW       Anywhere (v6)
+Anywhere (v6)              REJECT      2001:db8::1                # unittest
+Anywhere (v6)              REJECT      2001:0DB8:0:0::2           # unittest
+Anywhere (v6)              REJECT      2001:db8:1::/64            # unittest
+Anywhere (v6)              REJECT      2001:db8::3                # other
+Anywhere (v6)              REJECT      Anywhere (v6)              # unittest
+`,
+	}
+	ufw := NewUfw(&e, nil, newOptions(time.Hour, 10, Aggregation{}))
+	ufw.Init()
+
+	bans := ufw.Bans()
+	var ips []string
+	for _, ban := range bans {
+		ips = append(ips, ban.IP)
+	}
+	assert.ElementsMatch(t, []string{"203.0.113.7", "198.51.100.0/24", "192.0.2.2", "2001:db8::1", "2001:db8::2", "2001:db8:1::/64"}, ips)
+
+	// addresses are compared in canonical form
+	assert.True(t, ufw.IsRejected("2001:0db8::1"))
+	assert.True(t, ufw.IsRejected("2001:db8:0:0:0:0:0:2"))
+	assert.True(t, ufw.IsRejected("::ffff:203.0.113.7"))
+	assert.True(t, ufw.IsRejected("2001:db8:1::abcd"))
+	assert.True(t, ufw.IsRejected("198.51.100.99"))
+	assert.False(t, ufw.IsRejected("2001:db8::3"))
+	assert.False(t, ufw.IsRejected("192.0.2.1"))
+
+	assert.True(t, ufw.Release("2001:0DB8::1"))
+	assert.False(t, ufw.IsRejected("2001:db8::1"))
+	assert.True(t, ufw.Reject("2001:0db8::0003", "test"))
+	assert.True(t, ufw.IsRejected("2001:db8::3"))
+	assert.False(t, ufw.Reject("invalid", "test"))
+}
+
+func TestAggregation(t *testing.T) {
+	e := mockExecutor{}
+	ufw := NewUfw(&e, nil, newOptions(time.Hour, 10, Aggregation{Threshold: 3, Window: time.Hour, IPv4PrefixLength: 24, IPv6PrefixLength: 64}))
+
+	// two IPs of the same network are rejected separately
+	assert.True(t, ufw.Reject("1.2.3.1", "test"))
+	assert.True(t, ufw.Reject("1.2.3.2", "test"))
+	assert.True(t, ufw.Reject("1.2.4.1", "test"))
+	assert.Len(t, ufw.Bans(), 3)
+	assert.False(t, ufw.IsRejected("1.2.3.3"))
+
+	// third IP of the same network replaces the single bans with a network ban
+	assert.True(t, ufw.Reject("1.2.3.3", "test"))
+	bans := ufw.Bans()
+	require.Len(t, bans, 2)
+	assert.ElementsMatch(t, []string{"1.2.3.0/24", "1.2.4.1"}, []string{bans[0].IP, bans[1].IP})
+	assert.True(t, ufw.IsRejected("1.2.3.1"))
+	assert.True(t, ufw.IsRejected("1.2.3.200"))
+	assert.False(t, ufw.IsRejected("1.2.5.1"))
+
+	// network is released as a unit
+	assert.False(t, ufw.Release("1.2.3.1"))
+	assert.True(t, ufw.Release("1.2.3.0/24"))
+	assert.False(t, ufw.IsRejected("1.2.3.1"))
+
+	// IPv6 networks
+	assert.True(t, ufw.Reject("2001:db8::1", "test"))
+	assert.True(t, ufw.Reject("2001:db8::2", "test"))
+	assert.True(t, ufw.Reject("2001:db8::3", "test"))
+	assert.True(t, ufw.IsRejected("2001:db8::ffff"))
+	assert.False(t, ufw.IsRejected("2001:db8:1::1"))
+	assert.Len(t, ufw.Bans(), 2)
+
+	// rejects outside the window are not counted
+	ufw = NewUfw(&e, nil, newOptions(time.Hour, 10, Aggregation{Threshold: 2, Window: time.Second, IPv4PrefixLength: 24, IPv6PrefixLength: 64}))
+	assert.True(t, ufw.Reject("5.6.7.1", "test"))
+	time.Sleep(time.Second * 2)
+	assert.True(t, ufw.Reject("5.6.7.2", "test"))
+	assert.Len(t, ufw.Bans(), 2)
+}
+
+func TestOptions(t *testing.T) {
+	e := mockExecutor{}
+	options := newOptions(time.Hour, 3, Aggregation{})
+	options.Action = ACTION_DENY
+	options.Comment = "instance-2"
+	options.Ports = []int{80, 443}
+	options.MaxDelay = 3 * time.Hour
+	ufw := NewUfw(&e, nil, options)
+
+	assert.True(t, ufw.Reject("1.1.1.1", "test"))
+	assert.Equal(t, "ufw insert 1 deny from 1.1.1.1 to any port 80,443 proto tcp comment instance-2", e.cmd)
+	assert.True(t, ufw.Reject("2001:db8::1", "test"))
+	assert.Equal(t, "ufw prepend deny from 2001:db8::1 to any port 80,443 proto tcp comment instance-2", e.cmd)
+	assert.True(t, ufw.Release("1.1.1.1"))
+	assert.Equal(t, "ufw delete deny from 1.1.1.1 to any port 80,443 proto tcp", e.cmd)
+
+	// expiration delay is limited by the maximum delay: 2h, 3h, 3h
+	assert.True(t, ufw.Reject("1.1.1.1", "test"))
+	assert.True(t, ufw.Reject("1.1.1.1", "test"))
+	bans := ufw.Bans()
+	require.Len(t, bans, 2)
+	assert.Equal(t, "1.1.1.1", bans[1].IP)
+	assert.Equal(t, 3*time.Hour, bans[1].To.Sub(bans[1].From))
+
+	// only DENY rules with the used comment are read
+	e.ret = `Anywhere                   DENY        3.3.3.3                    # instance-2
+Anywhere                   REJECT      4.4.4.4                    # instance-2
+Anywhere                   DENY        5.5.5.5                    # goaccesslog`
+	ufw.Init()
+	bans = ufw.Bans()
+	require.Len(t, bans, 1)
+	assert.Equal(t, "3.3.3.3", bans[0].IP)
+}
+
+func TestReconcile(t *testing.T) {
+	now := time.Now()
+	e := mockExecutor{
+		ret: `Anywhere                   REJECT      1.1.1.1                    # unittest
+Anywhere                   REJECT      2.2.2.2                    # unittest
+Anywhere                   REJECT      3.3.3.3                    # unittest`,
+	}
+	newStore := func() *mockStore {
+		return &mockStore{bans: map[string]Ban{
+			"1.1.1.1": {IP: "1.1.1.1", From: now.Add(-time.Hour), To: now.Add(time.Hour), Occurred: 2},
+			"2.2.2.2": {IP: "2.2.2.2", From: now.Add(-2 * time.Hour), To: now.Add(-time.Hour), Occurred: 1},
+			"4.4.4.4": {IP: "4.4.4.4", From: now.Add(-time.Hour), To: now.Add(3 * time.Hour), Occurred: 3},
+			"5.5.5.5": {IP: "5.5.5.5", From: now.Add(-5 * time.Hour), To: now.Add(-4 * time.Hour), Occurred: 2},
+		}}
+	}
+
+	// adopt unknown firewall rules
+	store := newStore()
+	ufw := NewUfw(&e, store, newOptions(time.Hour, 10, Aggregation{}))
+	ufw.Init()
+	bans := map[string]Ban{}
+	for _, ban := range ufw.Bans() {
+		bans[ban.IP] = ban
+	}
+	assert.Len(t, bans, 3)
+	// active ban is adopted with stored expiration date
+	assert.True(t, now.Add(time.Hour).Equal(bans["1.1.1.1"].To))
+	assert.Equal(t, 2, bans["1.1.1.1"].Occurred)
+	// expired ban is released
+	assert.False(t, ufw.IsRejected("2.2.2.2"))
+	assert.WithinDuration(t, now, store.bans["2.2.2.2"].To, time.Second)
+	// unknown rule is adopted and stored
+	assert.True(t, ufw.IsRejected("3.3.3.3"))
+	assert.Contains(t, store.bans, "3.3.3.3")
+	// missing rule is added again
+	assert.True(t, now.Add(3*time.Hour).Equal(bans["4.4.4.4"].To))
+	// escalation continues for released IP addresses
+	assert.False(t, ufw.IsRejected("5.5.5.5"))
+	assert.True(t, ufw.Reject("5.5.5.5", "test"))
+	assert.Equal(t, 3, store.bans["5.5.5.5"].Occurred)
+	assert.Equal(t, 4*time.Hour, store.bans["5.5.5.5"].To.Sub(store.bans["5.5.5.5"].From))
+
+	// release unknown firewall rules
+	store = newStore()
+	options := newOptions(time.Hour, 10, Aggregation{})
+	options.UnknownRulePolicy = POLICY_RELEASE
+	ufw = NewUfw(&e, store, options)
+	ufw.Init()
+	assert.False(t, ufw.IsRejected("3.3.3.3"))
+	assert.True(t, ufw.IsRejected("1.1.1.1"))
+
+	// alert for unknown firewall rules
+	store = newStore()
+	options.UnknownRulePolicy = POLICY_ALERT
+	ufw = NewUfw(&e, store, options)
+	ufw.Init()
+	assert.False(t, ufw.IsRejected("3.3.3.3"))
+	assert.NotContains(t, store.bans, "3.3.3.3")
+	assert.Len(t, ufw.Bans(), 2)
+
+	// stored bans are applied again by the worker if the firewall rules cannot be read
+	store = newStore()
+	failing := mockExecutor{err: errors.New("ufw not available")}
+	ufw = NewUfw(&failing, store, newOptions(time.Hour, 10, Aggregation{}))
+	ufw.Init()
+	assert.True(t, ufw.IsRejected("1.1.1.1"))
+	assert.True(t, ufw.IsRejected("4.4.4.4"))
+	assert.False(t, ufw.IsRejected("2.2.2.2"))
+	assert.True(t, now.Add(3*time.Hour).Equal(store.bans["4.4.4.4"].To))
+	failing.err = nil
+	ufw.Start()
+	defer ufw.Stop()
+	impl := ufw.(*ufw_impl)
+	assert.Eventually(t, func() bool {
+		impl.mutex.Lock()
+		defer impl.mutex.Unlock()
+		return impl.ips["1.1.1.1"].applied && impl.ips["4.4.4.4"].applied
+	}, time.Second, 10*time.Millisecond)
+	assert.Len(t, ufw.Bans(), 2)
+}
+
+func TestWorker(t *testing.T) {
+	e := &blockingExecutor{entered: make(chan bool, 10), gate: make(chan bool, 10)}
+	options := newOptions(time.Hour, 10, Aggregation{})
+	options.Backend = BACKEND_NFT
+	ufw := NewUfw(e, nil, options)
+	ufw.Start()
+
+	// first operation blocks the worker
+	assert.True(t, ufw.Reject("1.1.1.1", "test"))
+	<-e.entered
+	// operations are queued while the worker is blocked, rejected and released IP addresses are skipped
+	assert.True(t, ufw.Reject("2.2.2.2", "test"))
+	assert.True(t, ufw.Reject("3.3.3.3", "test"))
+	assert.True(t, ufw.Reject("2001:db8::1", "test"))
+	assert.True(t, ufw.Release("2.2.2.2"))
+	assert.True(t, ufw.IsRejected("3.3.3.3"))
+	assert.False(t, ufw.IsRejected("2.2.2.2"))
+	e.gate <- true
+	e.gate <- true
+	ufw.Stop()
+
+	inputs := e.getInputs()
+	require.Len(t, inputs, 2)
+	assert.Equal(t, "add element inet unittest ipv4 { 1.1.1.1 }\n", inputs[0])
+	assert.Equal(t, "add element inet unittest ipv6 { 2001:db8::1 }\nadd element inet unittest ipv4 { 3.3.3.3 }\n", inputs[1])
+
+	// failed operations are retried
+	e = &blockingExecutor{entered: make(chan bool, 10), gate: make(chan bool, 10), failures: 1}
+	ufw = NewUfw(e, nil, options)
+	ufw.Start()
+	e.gate <- true
+	e.gate <- true
+	assert.True(t, ufw.Reject("4.4.4.4", "test"))
+	time.Sleep(retryDelay + time.Second/2)
+	ufw.Stop()
+	assert.Len(t, e.getInputs(), 2)
+	assert.True(t, ufw.IsRejected("4.4.4.4"))
+
+	// a later retry does not postpone an earlier retry
+	ufw = NewUfw(&mockExecutor{}, nil, options)
+	impl := ufw.(*ufw_impl)
+	impl.ips["6.6.6.6"] = info{locked: true, attempts: 2, retryAt: time.Now().Add(time.Hour)}
+	impl.ips["7.7.7.7"] = info{locked: true, attempts: 1, retryAt: time.Now().Add(100 * time.Millisecond)}
+	impl.pending["6.6.6.6"] = true
+	impl.pending["7.7.7.7"] = true
+	ufw.Start()
+	assert.Eventually(t, func() bool {
+		impl.mutex.Lock()
+		defer impl.mutex.Unlock()
+		return impl.ips["7.7.7.7"].applied
+	}, time.Second, 10*time.Millisecond)
+	impl.mutex.Lock()
+	assert.False(t, impl.ips["6.6.6.6"].applied)
+	impl.mutex.Unlock()
+	ufw.Stop()
+
+	// lock is reverted if all attempts failed
+	e = &blockingExecutor{entered: make(chan bool, 10), gate: make(chan bool, 10), failures: 1}
+	ufw = NewUfw(e, nil, options)
+	e.gate <- true
+	assert.False(t, ufw.Reject("5.5.5.5", "test"))
+	assert.False(t, ufw.IsRejected("5.5.5.5"))
+}
+
+func TestExpiration(t *testing.T) {
+	e := mockExecutor{}
+	ufw := NewUfw(&e, nil, newOptions(time.Hour, 10, Aggregation{}))
+	ufw.Start()
+	defer ufw.Stop()
+	assert.True(t, ufw.RejectFor("1.1.1.1", 300*time.Millisecond, "test"))
+	assert.True(t, ufw.RejectFor("2.2.2.2", 100*time.Millisecond, "test"))
+	assert.True(t, ufw.RejectFor("3.3.3.3", time.Hour, "test"))
+	// extended ban is not released at the outdated expiration date
+	assert.True(t, ufw.RejectFor("4.4.4.4", 100*time.Millisecond, "test"))
+	assert.True(t, ufw.RejectFor("4.4.4.4", time.Hour, "test"))
+	time.Sleep(200 * time.Millisecond)
+	assert.True(t, ufw.IsRejected("1.1.1.1"))
+	assert.False(t, ufw.IsRejected("2.2.2.2"))
+	assert.True(t, ufw.IsRejected("4.4.4.4"))
+	time.Sleep(200 * time.Millisecond)
+	assert.False(t, ufw.IsRejected("1.1.1.1"))
+	assert.True(t, ufw.IsRejected("3.3.3.3"))
+	assert.True(t, ufw.IsRejected("4.4.4.4"))
+	assert.Len(t, ufw.Bans(), 2)
+
+	var exp expirations
+	now := time.Now()
+	exp.add("b", now.Add(2*time.Second))
+	exp.add("a", now.Add(time.Second))
+	exp.add("c", now.Add(3*time.Second))
+	next, ok := exp.next()
+	assert.True(t, ok)
+	assert.Equal(t, now.Add(time.Second), next)
+	expired := exp.expired(now.Add(2 * time.Second))
+	require.Len(t, expired, 2)
+	assert.Equal(t, "a", expired[0].ip)
+	assert.Equal(t, "b", expired[1].ip)
+	assert.Len(t, exp, 1)
+}
+
+func TestAllowlist(t *testing.T) {
+	e := mockExecutor{ret: `
+Anywhere                   REJECT      10.1.2.3                   # unittest
+`}
+	options := newOptions(time.Hour, 10, Aggregation{Threshold: 2, Window: time.Hour, IPv4PrefixLength: 24, IPv6PrefixLength: 64})
+	allowlist := &mockAllowlist{prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8"), netip.MustParsePrefix("5.6.7.8/32")}}
+	options.Allowlist = allowlist
+	ufw := NewUfw(&e, nil, options)
+	// existing firewall rules of allowlisted IPs are released
+	ufw.Init()
+	assert.False(t, ufw.IsRejected("10.1.2.3"))
+	assert.Len(t, ufw.Bans(), 0)
+
+	assert.False(t, ufw.Reject("10.2.3.4", "test"))
+	assert.False(t, ufw.RejectFor("10.0.0.0/16", time.Hour, "test"))
+	assert.False(t, ufw.IsRejected("10.2.3.4"))
+	// network is not rejected if it contains an allowlisted IP
+	assert.True(t, ufw.Reject("5.6.7.1", "test"))
+	assert.True(t, ufw.Reject("5.6.7.2", "test"))
+	assert.True(t, ufw.IsRejected("5.6.7.1"))
+	assert.False(t, ufw.IsRejected("5.6.7.8"))
+
+	// modified allowlist
+	allowlist.prefixes = append(allowlist.prefixes, netip.MustParsePrefix("5.6.7.1/32"))
+	ufw.ReleaseAllowlisted()
+	assert.False(t, ufw.IsRejected("5.6.7.1"))
+	assert.True(t, ufw.IsRejected("5.6.7.2"))
+
+	// no firewall rule is added for stored bans of allowlisted IPs, e.g. after a reboot with nft
+	now := time.Now()
+	store := &mockStore{bans: map[string]Ban{
+		"10.3.3.3": {IP: "10.3.3.3", From: now.Add(-time.Hour), To: now.Add(time.Hour), Occurred: 1},
+		"10.4.4.4": {IP: "10.4.4.4", From: now.Add(-time.Hour), Category: CATEGORY_BLOCKLIST},
+		"1.1.1.1":  {IP: "1.1.1.1", From: now.Add(-time.Hour), To: now.Add(time.Hour), Occurred: 1},
+	}}
+	e = mockExecutor{}
+	ufw = NewUfw(&e, store, options)
+	ufw.Init()
+	assert.False(t, ufw.IsRejected("10.3.3.3"))
+	assert.False(t, ufw.IsRejected("10.4.4.4"))
+	assert.True(t, ufw.IsRejected("1.1.1.1"))
+	assert.WithinDuration(t, now, store.bans["10.3.3.3"].To, time.Second)
+	assert.Empty(t, store.bans["10.4.4.4"].Category)
+	assert.Contains(t, e.cmd, "1.1.1.1")
+}
+
+func TestBlocklist(t *testing.T) {
+	e := mockExecutor{}
+	store := &mockStore{bans: map[string]Ban{}}
+	ufw := NewUfw(&e, store, newOptions(time.Hour, 10, Aggregation{}))
+	ufw.Init()
+	assert.True(t, ufw.Reject("1.1.1.1", "test"))
+	ufw.SetBlocklist([]string{"1.1.1.1", "5.6.0.0/16", "invalid", "7.7.7.7", "7.7.7.7"})
+	assert.True(t, ufw.IsRejected("5.6.7.8"))
+	assert.True(t, ufw.IsRejected("7.7.7.7"))
+	bans := ufw.Bans()
+	require.Len(t, bans, 3)
+	for _, ban := range bans {
+		assert.Equal(t, CATEGORY_BLOCKLIST, ban.Category)
+	}
+	// blocklist bans do not expire
+	assert.True(t, store.bans["7.7.7.7"].To.IsZero())
+	ufw.ReleaseIfExpired()
+	assert.True(t, ufw.IsRejected("7.7.7.7"))
+	assert.Equal(t, CATEGORY_BLOCKLIST, store.bans["5.6.0.0/16"].Category)
+
+	// blocklist bans are adopted on startup
+	e.ret = `
+Anywhere                   REJECT      1.1.1.1                    # unittest
+Anywhere                   REJECT      7.7.7.7                    # unittest
+`
+	ufw = NewUfw(&e, store, newOptions(time.Hour, 10, Aggregation{}))
+	ufw.Init()
+	assert.Len(t, ufw.Bans(), 3)
+	assert.True(t, ufw.IsRejected("5.6.7.8"))
+	assert.Equal(t, "ufw insert 1 reject from 5.6.0.0/16 to any comment unittest", e.cmd)
+
+	// clearing the blocklist keeps the detected ban
+	ufw.SetBlocklist(nil)
+	assert.False(t, ufw.IsRejected("5.6.7.8"))
+	assert.False(t, ufw.IsRejected("7.7.7.7"))
+	bans = ufw.Bans()
+	require.Len(t, bans, 1)
+	assert.Equal(t, "1.1.1.1", bans[0].IP)
+	assert.Equal(t, "", bans[0].Category)
+	assert.Equal(t, "", store.bans["7.7.7.7"].Category)
+}
+
+func TestBanEvents(t *testing.T) {
+	e := mockExecutor{}
+	store := &mockStore{bans: map[string]Ban{}}
+	ufw := NewUfw(&e, store, newOptions(time.Hour, 10, Aggregation{Threshold: 2, Window: time.Hour, IPv4PrefixLength: 24, IPv6PrefixLength: 64}))
+	ufw.Init()
+	assert.True(t, ufw.Reject("1.2.3.1", "bad rule 'status-444'"))
+	assert.True(t, ufw.RejectFrom("1.2.3.2", time.Minute, "bad rule 'hex'", "web2"))
+	assert.True(t, ufw.Release("1.2.3.0/24"))
+	ufw.SetBlocklist([]string{"7.7.7.7"})
+	ufw.SetBlocklist(nil)
+	assert.True(t, ufw.RejectFor("8.8.8.8", time.Millisecond, "manual"))
+	time.Sleep(10 * time.Millisecond)
+	ufw.ReleaseIfExpired()
+
+	type event struct {
+		ip, action, reason, category, source string
+	}
+	var events []event
+	for _, ev := range store.events {
+		events = append(events, event{ev.IP, ev.Action, ev.Reason, ev.Category, ev.Source})
+		assert.WithinDuration(t, time.Now(), ev.Time, time.Second)
+		if ev.Action == EVENT_RELEASE || ev.Category == CATEGORY_BLOCKLIST {
+			assert.True(t, ev.To.IsZero())
+		} else {
+			assert.True(t, ev.To.After(ev.Time))
+		}
+	}
+	assert.Equal(t, []event{
+		{"1.2.3.1", EVENT_REJECT, "bad rule 'status-444'", "", ""},
+		{"1.2.3.2", EVENT_REJECT, "bad rule 'hex'", "", "web2"},
+		{"1.2.3.0/24", EVENT_REJECT, "network aggregation", "", ""},
+		{"1.2.3.1", EVENT_RELEASE, "replaced by network ban 1.2.3.0/24", "", ""},
+		{"1.2.3.2", EVENT_RELEASE, "replaced by network ban 1.2.3.0/24", "", ""},
+		{"1.2.3.0/24", EVENT_RELEASE, "manual release", "", ""},
+		{"7.7.7.7", EVENT_REJECT, "blocklist", CATEGORY_BLOCKLIST, ""},
+		{"7.7.7.7", EVENT_RELEASE, "removed from blocklist", CATEGORY_BLOCKLIST, ""},
+		{"8.8.8.8", EVENT_REJECT, "manual", "", ""},
+		{"8.8.8.8", EVENT_RELEASE, "expired", "", ""},
+	}, events)
+}
+
+func TestRemoteBans(t *testing.T) {
+	e := mockExecutor{}
+	store := &mockStore{bans: map[string]Ban{}}
+	ufw := NewUfw(&e, store, newOptions(time.Hour, 10, Aggregation{}))
+	ufw.Init()
+	ban := func(ip string) Ban {
+		idx := slices.IndexFunc(ufw.Bans(), func(ban Ban) bool { return ban.IP == ip })
+		require.GreaterOrEqual(t, idx, 0)
+		return ufw.Bans()[idx]
+	}
+	// a remote ban of an unknown IP address does not count as failure of this node
+	assert.True(t, ufw.RejectFrom("1.1.1.1", time.Hour, "bad rule 'hex'", "web2"))
+	assert.Equal(t, 0, ban("1.1.1.1").Occurred)
+	// a shorter remote ban does not shorten the local ban
+	assert.True(t, ufw.Reject("2.2.2.2", "bad rule 'status-444'"))
+	local := ban("2.2.2.2")
+	assert.Equal(t, 1, local.Occurred)
+	ufw.RejectFrom("2.2.2.2", time.Minute, "bad rule 'hex'", "web2")
+	remote := ban("2.2.2.2")
+	assert.Equal(t, local.To, remote.To)
+	assert.Equal(t, 1, remote.Occurred)
+	assert.Equal(t, "", remote.Source)
+	// a longer remote ban extends the local ban
+	ufw.RejectFrom("2.2.2.2", 2*time.Hour, "bad rule 'hex'", "web2")
+	remote = ban("2.2.2.2")
+	assert.True(t, remote.To.After(local.To))
+	assert.Equal(t, local.From, remote.From)
+	assert.Equal(t, 1, remote.Occurred)
+	assert.Equal(t, "web2", remote.Source)
+	assert.Equal(t, "bad rule 'hex'", remote.Rule)
+
+	// requested durations are limited to the maximum ban duration
+	options := newOptions(time.Hour, 10, Aggregation{})
+	options.MaxDelay = 24 * time.Hour
+	ufw = NewUfw(&e, store, options)
+	ufw.Init()
+	assert.True(t, ufw.RejectFrom("3.3.3.3", 10*365*24*time.Hour, "bad rule 'hex'", "web2"))
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), ban("3.3.3.3").To, time.Second)
+	ufw.RejectFrom("3.3.3.3", 10*365*24*time.Hour, "bad rule 'hex'", "web2")
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), ban("3.3.3.3").To, time.Second)
+	assert.True(t, ufw.RejectFor("4.4.4.4", 10*365*24*time.Hour, "manual"))
+	assert.WithinDuration(t, time.Now().Add(24*time.Hour), ban("4.4.4.4").To, time.Second)
+}
+
+func TestBackends(t *testing.T) {
+	// nft
+	e := mockExecutor{ret: `{"nftables": [{"metainfo": {"version": "1.0.9"}}, {"set": {"family": "inet", "name": "ipv4", "table": "unittest",
+		"type": "ipv4_addr", "flags": ["interval"], "elem": ["1.2.3.4", {"prefix": {"addr": "5.6.7.0", "len": 24}}, {"elem": {"val": "2001:0db8::1", "timeout": 60}}]}}]}`}
+	options := newOptions(time.Hour, 10, Aggregation{})
+	options.Backend = BACKEND_NFT
+	options.Ports = []int{443}
+	options.Action = ACTION_DENY
+	ufw := NewUfw(&e, nil, options)
+	ufw.Init()
+	assert.True(t, ufw.IsRejected("1.2.3.4"))
+	assert.True(t, ufw.IsRejected("5.6.7.8"))
+	assert.True(t, ufw.IsRejected("2001:db8::1"))
+	assert.Contains(t, e.input, "add rule inet unittest input tcp dport { 443 } ip saddr @ipv4 drop")
+	assert.True(t, ufw.Release("1.2.3.4"))
+	assert.Equal(t, "delete element inet unittest ipv4 { 1.2.3.4 }\n", e.input)
+	assert.Equal(t, "nft -f -", e.cmd)
+
+	// ipset
+	e = mockExecutor{ret: `create unittest-v4 hash:net family inet hashsize 1024 maxelem 65536
+add unittest-v4 1.2.3.4
+add unittest-v4 5.6.7.0/24
+add other-v4 8.8.8.8`}
+	options.Backend = BACKEND_IPSET
+	ufw = NewUfw(&e, nil, options)
+	ufw.Init()
+	assert.Len(t, ufw.Bans(), 2)
+	assert.True(t, ufw.IsRejected("5.6.7.8"))
+	assert.False(t, ufw.IsRejected("8.8.8.8"))
+	assert.True(t, ufw.Reject("2001:db8::1", "test"))
+	assert.Equal(t, "add unittest-v6 2001:db8::1\n", e.input)
+	assert.Equal(t, "ipset restore -exist", e.cmd)
+}
+
+func TestNftAggregation(t *testing.T) {
+	e := &nftExecutor{elements: map[string]bool{}}
+	options := newOptions(time.Hour, 10, Aggregation{Threshold: 2, Window: time.Hour, IPv4PrefixLength: 24, IPv6PrefixLength: 64})
+	options.Backend = BACKEND_NFT
+	ufw := NewUfw(e, nil, options)
+	ufw.Init()
+	assert.True(t, ufw.Reject("1.2.3.1", "test"))
+	assert.True(t, ufw.Reject("1.2.3.2", "test"))
+	assert.Equal(t, "delete element inet unittest ipv4 { 1.2.3.1 }\n"+
+		"delete element inet unittest ipv4 { 1.2.3.2 }\n"+
+		"add element inet unittest ipv4 { 1.2.3.0/24 }\n", e.scripts[len(e.scripts)-1])
+	assert.Equal(t, []string{"1.2.3.0/24"}, e.list())
+	assert.True(t, ufw.IsRejected("1.2.3.3"))
+	assert.Len(t, ufw.Bans(), 1)
+
+	// an IP address of a locked network extends the network ban without a firewall operation
+	scripts := len(e.scripts)
+	network := ufw.Bans()[0]
+	assert.True(t, ufw.RejectFor("1.2.3.4", 3*time.Hour, "manual"))
+	assert.True(t, ufw.RejectFrom("1.2.3.5", time.Minute, "bad rule 'hex'", "web2"))
+	assert.Len(t, e.scripts, scripts)
+	bans := ufw.Bans()
+	require.Len(t, bans, 1)
+	assert.Equal(t, "1.2.3.0/24", bans[0].IP)
+	assert.WithinDuration(t, time.Now().Add(3*time.Hour), bans[0].To, time.Second)
+	assert.True(t, bans[0].To.After(network.To))
+
+	// the operations applied one by one after a failed script also delete first
+	e.failBatches = true
+	ufw.Start()
+	defer ufw.Stop()
+	assert.True(t, ufw.Reject("5.6.7.1", "test"))
+	assert.True(t, ufw.Reject("5.6.7.2", "test"))
+	assert.Eventually(t, func() bool {
+		return slices.Equal([]string{"1.2.3.0/24", "5.6.7.0/24"}, e.list())
+	}, time.Second, 10*time.Millisecond)
+	assert.True(t, ufw.IsRejected("5.6.7.3"))
+	assert.Len(t, ufw.Bans(), 2)
+}
+
+func TestMetrics(t *testing.T) {
+	value := func(sample string) float64 {
+		var sb strings.Builder
+		require.NoError(t, metrics.Write(&sb))
+		for _, line := range strings.Split(sb.String(), "\n") {
+			if str, found := strings.CutPrefix(line, sample+" "); found {
+				ret, err := strconv.ParseFloat(str, 64)
+				require.NoError(t, err)
+				return ret
+			}
+		}
+		return 0
+	}
+	bans := value(`goaccesslog_bans_total{category=""}`)
+	releases := value("goaccesslog_releases_total")
+	commands := value(`goaccesslog_firewall_command_duration_seconds_count{backend="ufw",operation="apply"}`)
+	failures := value(`goaccesslog_firewall_command_failures_total{backend="ufw",operation="apply"}`)
+
+	e := mockExecutor{}
+	ufw := NewUfw(&e, nil, newOptions(time.Hour, 1, Aggregation{}))
+	ufw.Init()
+	require.True(t, ufw.Reject("1.1.1.1", "test"))
+	require.True(t, ufw.Release("1.1.1.1"))
+	assert.Equal(t, bans+1, value(`goaccesslog_bans_total{category=""}`))
+	assert.Equal(t, releases+1, value("goaccesslog_releases_total"))
+	assert.Equal(t, commands+2, value(`goaccesslog_firewall_command_duration_seconds_count{backend="ufw",operation="apply"}`))
+	assert.Equal(t, failures, value(`goaccesslog_firewall_command_failures_total{backend="ufw",operation="apply"}`))
+
+	e.err = errors.New("failed")
+	ufw.Reject("2.2.2.2", "test")
+	assert.Equal(t, failures+1, value(`goaccesslog_firewall_command_failures_total{backend="ufw",operation="apply"}`))
+}
+
+func newOptions(delay time.Duration, maxFailures int, aggregation Aggregation) Options {
+	options := DefaultOptions()
+	options.Comment = "unittest"
+	options.Delay = delay
+	options.MaxFailures = maxFailures
+	options.Aggregation = aggregation
+	return options
+}
+
+type mockStore struct {
+	bans   map[string]Ban
+	events []BanEvent
+}
+
+func (s *mockStore) LoadBans() ([]Ban, error) {
+	var bans []Ban
+	for _, ban := range s.bans {
+		bans = append(bans, ban)
+	}
+	return bans, nil
+}
+
+func (s *mockStore) SaveBan(ban Ban) error {
+	s.bans[ban.IP] = ban
+	return nil
+}
+
+func (s *mockStore) SaveBans(bans []Ban) error {
+	for _, ban := range bans {
+		s.bans[ban.IP] = ban
+	}
+	return nil
+}
+
+func (s *mockStore) SaveBanEvents(events []BanEvent) error {
+	s.events = append(s.events, events...)
+	return nil
+}
+
+// Blocks each command until the gate is opened and fails the first commands.
+type blockingExecutor struct {
+	mutex    sync.Mutex
+	entered  chan bool
+	gate     chan bool
+	failures int
+	inputs   []string
+}
+
+func (e *blockingExecutor) Exec(cmdName string, args ...string) ([]byte, error) {
+	return e.ExecInput(nil, cmdName, args...)
+}
+
+func (e *blockingExecutor) ExecInput(input []byte, cmdName string, args ...string) ([]byte, error) {
+	e.entered <- true
+	<-e.gate
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.inputs = append(e.inputs, string(input))
+	if e.failures > 0 {
+		e.failures--
+		return nil, errors.New("simulate error")
+	}
+	return []byte("{}"), nil
+}
+
+func (e *blockingExecutor) getInputs() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	return e.inputs
+}
+
+type mockAllowlist struct {
+	prefixes []netip.Prefix
+}
+
+func (a *mockAllowlist) Contains(ip string) bool {
+	for _, prefix := range a.prefixes {
+		other, err := netip.ParsePrefix(ip)
+		if err != nil {
+			other = netip.PrefixFrom(netip.MustParseAddr(ip), 32)
+		}
+		if prefix.Overlaps(other) {
+			return true
+		}
+	}
+	return false
 }
 
 type mockExecutor struct {
-	ret string
-	err error
+	ret   string
+	err   error
+	cmd   string
+	input string
 }
 
 func (e *mockExecutor) Exec(cmdName string, args ...string) ([]byte, error) {
+	e.cmd = strings.Join(append([]string{cmdName}, args...), " ")
 	return []byte(e.ret), e.err
 }
+
+func (e *mockExecutor) ExecInput(input []byte, cmdName string, args ...string) ([]byte, error) {
+	e.input = string(input)
+	return e.Exec(cmdName, args...)
+}
+
+// Simulates the interval sets of nft, an element must not overlap with another element.
+type nftExecutor struct {
+	mutex       sync.Mutex
+	elements    map[string]bool
+	scripts     []string
+	failBatches bool
+}
+
+func (e *nftExecutor) Exec(cmdName string, args ...string) ([]byte, error) {
+	return []byte(`{"nftables": []}`), nil
+}
+
+func (e *nftExecutor) ExecInput(input []byte, cmdName string, args ...string) ([]byte, error) {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	script := string(input)
+	e.scripts = append(e.scripts, script)
+	if e.failBatches && strings.Count(script, "element") > 1 {
+		return []byte("Error: batch failed"), errors.New("exit status 1")
+	}
+	elements := maps.Clone(e.elements)
+	for _, line := range strings.Split(strings.TrimSpace(script), "\n") {
+		var cmd, set, ip string
+		if _, err := fmt.Sscanf(line, "%s element inet unittest %s { %s }", &cmd, &set, &ip); err != nil {
+			continue
+		}
+		if !strings.Contains(ip, "/") {
+			ip = fmt.Sprintf("%s/%d", ip, netip.MustParseAddr(ip).BitLen())
+		}
+		prefix := netip.MustParsePrefix(ip)
+		if cmd == "delete" {
+			if !elements[prefix.String()] {
+				return []byte("Error: element does not exist"), errors.New("exit status 1")
+			}
+			delete(elements, prefix.String())
+			continue
+		}
+		for element := range elements {
+			if netip.MustParsePrefix(element).Overlaps(prefix) {
+				return []byte("Error: conflicting intervals specified"), errors.New("exit status 1")
+			}
+		}
+		elements[prefix.String()] = true
+	}
+	e.elements = elements
+	return nil, nil
+}
+
+// Returns the elements of the sets, single IP addresses without prefix length.
+func (e *nftExecutor) list() []string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	var ips []string
+	for element := range e.elements {
+		prefix := netip.MustParsePrefix(element)
+		if prefix.IsSingleIP() {
+			ips = append(ips, prefix.Addr().String())
+		} else {
+			ips = append(ips, element)
+		}
+	}
+	slices.Sort(ips)
+	return ips
+}
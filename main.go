@@ -2,27 +2,39 @@ package main
 
 import (
 	"flag"
-	"fmt"
 	"log"
 	"os"
 	"os/signal"
 	"path/filepath"
+	"slices"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/nylssoft/goaccesslog/internal/analyzer"
+	"github.com/nylssoft/goaccesslog/internal/api"
+	"github.com/nylssoft/goaccesslog/internal/banexport"
 	"github.com/nylssoft/goaccesslog/internal/config"
+	"github.com/nylssoft/goaccesslog/internal/control"
 	"github.com/nylssoft/goaccesslog/internal/executer"
+	"github.com/nylssoft/goaccesslog/internal/fleet"
+	"github.com/nylssoft/goaccesslog/internal/iplist"
+	"github.com/nylssoft/goaccesslog/internal/metrics"
+	"github.com/nylssoft/goaccesslog/internal/retention"
+	"github.com/nylssoft/goaccesslog/internal/storage"
 	"github.com/nylssoft/goaccesslog/internal/ufw"
 )
 
 var flagConfig = flag.String("config", "", "config file")
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		os.Exit(runCommand(os.Args[1], os.Args[2:]))
+	}
 	flag.Parse()
 	if len(*flagConfig) == 0 {
-		fmt.Println("Usage: goaccesslog -config <config-file>")
+		printUsage()
 		os.Exit(1)
 	}
 	cfg := config.NewConfig()
@@ -39,15 +51,69 @@ func main() {
 	logDir := filepath.Dir(cfg.AccessLogFilename())
 	shutdown := make(chan bool, 1)
 	executer := executer.NewExecuter()
-	ufw := ufw.NewUfw(executer, "goaccesslog", time.Hour, 10)
+	storage := storage.NewStorage(cfg.DatabaseDriver(), cfg.DatabaseDataSource())
+	defer storage.Close()
+	retention := retention.NewRetention(cfg.DatabaseFilename(), cfg.RetentionOptions())
+	defer retention.Close()
+	if cfg.IsRetentionEnabled() {
+		// the database is converted before it is used by the analyzer, the firewall and the HTTP API
+		err = retention.Init()
+		if err != nil {
+			log.Fatal("Failed to initialize retention.", err)
+		}
+	}
+	firewallOptions := cfg.FirewallOptions()
+	var banSharing fleet.Fleet
+	if cfg.IsFleetEnabled() {
+		banSharing = fleet.NewFleet(cfg.FleetOptions())
+		firewallOptions.Notifier = banSharing
+	}
+	ufw := ufw.NewUfw(executer, storage, firewallOptions)
 	ufw.Init()
-	ufw.ReleaseAll() // remove all previously locked IP addresses if the process did not terminate appropriately
-	analyzer := analyzer.NewAnalyzer(cfg, ufw)
+	ufw.Start()
+	if banSharing != nil {
+		banSharing.Start(ufw)
+		defer banSharing.Stop()
+	}
+	ufw.SetBlocklist(blocklistEntries(cfg))
+	metrics.NewGaugeFunc("goaccesslog_active_bans", "IP addresses and networks rejected by firewall rules.", func() float64 { return float64(len(ufw.Bans())) })
+	analyzer := analyzer.NewAnalyzer(cfg, storage, ufw)
+	control := control.NewServer(cfg.ControlSocketFilename(), ufw)
+	err = control.Start()
+	if err != nil {
+		log.Fatal("Failed to start control socket.", err)
+	}
+	if len(cfg.ApiAddress()) > 0 {
+		api := api.NewServer(cfg.ApiOptions(), ufw, storage, banSharing)
+		err = api.Start()
+		if err != nil {
+			log.Fatal("Failed to start HTTP API.", err)
+		}
+		defer api.Stop()
+	}
+	var exportTicker <-chan time.Time
+	exporter := banexport.NewExporter(cfg.ExportDirectory())
+	if len(cfg.ExportDirectory()) > 0 {
+		ticker := time.NewTicker(cfg.ExportInterval())
+		defer ticker.Stop()
+		exportTicker = ticker.C
+	}
+	var retentionTicker <-chan time.Time
+	if cfg.IsRetentionEnabled() {
+		ticker := time.NewTicker(cfg.RetentionInterval())
+		defer ticker.Stop()
+		retentionTicker = ticker.C
+	}
 	go func() {
 		stop := make(chan os.Signal, 1)
 		signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
 		update := false
-		var lastTimeLocal time.Time
+		updateBlocklists := false
+		// log lines before the last stored log line have already been processed
+		lastTimeLocal, err := storage.LastTimeLocal()
+		if err != nil {
+			log.Println("ERROR: Failed to read last processed log line.", err)
+		}
 	loop:
 		for {
 			select {
@@ -56,6 +122,22 @@ func main() {
 				shutdown <- true
 				break loop
 			case event := <-watcher.Events:
+				allowlist := cfg.AllowedIPs()
+				if event.Name == allowlist.Filename() && (event.Has(fsnotify.Write) || event.Has(fsnotify.Create)) {
+					err := allowlist.Reload()
+					if err != nil {
+						log.Println("ERROR: Failed to reload allowlist.", err)
+					} else {
+						log.Printf("Reloaded allowlist with %d IPs and networks.\n", allowlist.Len())
+						ufw.ReleaseAllowlisted()
+					}
+				}
+				if !updateBlocklists && (event.Has(fsnotify.Write) || event.Has(fsnotify.Create)) &&
+					slices.ContainsFunc(cfg.Blocklists(), func(list iplist.IPList) bool { return list.Filename() == event.Name }) {
+					// large files are written in several steps, therefore blocklists are reloaded on next schedule
+					updateBlocklists = true
+					log.Println("Detected modified blocklist file. Reload blocklists on next schedule.")
+				}
 				if !update && event.Has(fsnotify.Write) && event.Name == cfg.AccessLogFilename() {
 					update = true
 					if cfg.IsVerbose() {
@@ -63,6 +145,16 @@ func main() {
 					}
 				}
 			case <-ticker.C:
+				if updateBlocklists {
+					updateBlocklists = false
+					for _, list := range cfg.Blocklists() {
+						err := list.Reload()
+						if err != nil {
+							log.Println("ERROR: Failed to reload blocklist.", err)
+						}
+					}
+					ufw.SetBlocklist(blocklistEntries(cfg))
+				}
 				if update {
 					update = false
 					lastTimeLocal, err = analyzer.Analyze(lastTimeLocal)
@@ -70,6 +162,18 @@ func main() {
 						log.Println("ERROR: Failed to analyze access log file.", err)
 					}
 				}
+			case <-exportTicker:
+				err := exporter.Export(ufw.Bans())
+				if err != nil {
+					log.Println("ERROR: Failed to export bans.", err)
+				}
+			case <-retentionTicker:
+				cnt, err := retention.Prune(time.Now())
+				if err != nil {
+					log.Println("ERROR: Failed to delete expired log lines.", err)
+				} else if cnt > 0 {
+					log.Printf("Deleted %d expired log lines.\n", cnt)
+				}
 			case err := <-watcher.Errors:
 				log.Println("ERROR: Failed to watch directory.", err)
 			}
@@ -79,6 +183,31 @@ func main() {
 	if err != nil {
 		log.Fatal("Failed to add directory to file watcher.", err)
 	}
+	// directories are watched as editors and downloads replace files
+	watchedDirs := map[string]bool{logDir: true}
+	for _, list := range append([]iplist.IPList{cfg.AllowedIPs()}, cfg.Blocklists()...) {
+		if len(list.Filename()) == 0 || watchedDirs[filepath.Dir(list.Filename())] {
+			continue
+		}
+		watchedDirs[filepath.Dir(list.Filename())] = true
+		err = watcher.Add(filepath.Dir(list.Filename()))
+		if err != nil {
+			log.Fatal("Failed to add directory to file watcher.", err)
+		}
+	}
 	<-shutdown
-	ufw.ReleaseAll()
+	control.Stop()
+	if cfg.FirewallOptions().ReleaseOnShutdown {
+		ufw.ReleaseAll()
+	}
+	ufw.Stop()
+}
+
+// Returns the IP addresses and networks of all blocklists.
+func blocklistEntries(cfg config.Config) []string {
+	var entries []string
+	for _, list := range cfg.Blocklists() {
+		entries = append(entries, list.Entries()...)
+	}
+	return entries
 }